@@ -0,0 +1,120 @@
+// Package auth emite e valida os access tokens (JWT) usados pela API http
+package auth
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Duração por omissão dos tokens, alteráveis pelas variáveis de ambiente
+// ACCESS_TOKEN_TTL_MINUTES e REFRESH_TOKEN_TTL_HOURS
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	// Tamanho mínimo do segredo HMAC, em bytes
+	minSecretLength = 32
+	issuer          = "dropmedical"
+)
+
+var (
+	ErrMissingSecret = errors.New("variável de ambiente JWT_SECRET não definida ou com menos de 32 caracteres")
+	ErrInvalidToken  = errors.New("access token inválido ou expirado")
+)
+
+// Claims são os dados transportados no access token
+type Claims struct {
+	jwt.RegisteredClaims
+	UserID uint `json:"uid"`
+	// Conta/agregado a que o utilizador pertence, todos os dados são isolados por tenant
+	TenantID uint `json:"tid"`
+	// Papel do utilizador no seu tenant
+	Role string `json:"role"`
+}
+
+func signingKey() ([]byte, error) {
+	secret, _ := os.LookupEnv("JWT_SECRET")
+	if len(secret) < minSecretLength {
+		return nil, ErrMissingSecret
+	}
+	return []byte(secret), nil
+}
+
+// CheckConfig confirma que o segredo para assinar tokens está configurado
+func CheckConfig() error {
+	_, err := signingKey()
+	return err
+}
+
+func ttlFromEnv(name string, unit time.Duration, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 1 {
+		return fallback
+	}
+	return time.Duration(parsed) * unit
+}
+
+// AccessTokenTTL é a validade dos access tokens
+func AccessTokenTTL() time.Duration {
+	return ttlFromEnv("ACCESS_TOKEN_TTL_MINUTES", time.Minute, DefaultAccessTokenTTL)
+}
+
+// RefreshTokenTTL é a validade dos refresh tokens
+func RefreshTokenTTL() time.Duration {
+	return ttlFromEnv("REFRESH_TOKEN_TTL_HOURS", time.Hour, DefaultRefreshTokenTTL)
+}
+
+// NewAccessToken emite um access token de curta duração para o utilizador, com o seu tenant e papel
+func NewAccessToken(userID uint, tenantID uint, role string) (token string, expires time.Time, err error) {
+	key, err := signingKey()
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	expires = now.Add(AccessTokenTTL())
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		UserID:   userID,
+		TenantID: tenantID,
+		Role:     role,
+	}
+
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	return
+}
+
+// ParseAccessToken valida a assinatura e a validade do token e devolve as suas claims
+func ParseAccessToken(token string) (*Claims, error) {
+	key, err := signingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	_, err = jwt.ParseWithClaims(
+		token,
+		&claims,
+		func(t *jwt.Token) (any, error) { return key, nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.UserID == 0 || claims.TenantID == 0 || claims.Role == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
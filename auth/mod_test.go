@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestAccessTokenRoundTrip(t *testing.T) {
+	t.Setenv("JWT_SECRET", "a-test-secret-that-is-long-enough-for-hs256")
+
+	token, expires, err := NewAccessToken(42, 3, "caregiver")
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if time.Until(expires) > DefaultAccessTokenTTL {
+		t.Fatalf("Token lives longer than the default TTL: %s", expires)
+	}
+
+	claims, err := ParseAccessToken(token)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if claims.UserID != 42 || claims.TenantID != 3 || claims.Role != "caregiver" {
+		t.Fatalf("Expected caregiver 42 of tenant 3, got %s %d of %d", claims.Role, claims.UserID, claims.TenantID)
+	}
+}
+
+func TestRejectsTamperedAndForeignTokens(t *testing.T) {
+	t.Setenv("JWT_SECRET", "a-test-secret-that-is-long-enough-for-hs256")
+
+	token, _, _ := NewAccessToken(1, 1, "admin")
+	if _, err := ParseAccessToken(token + "x"); err == nil {
+		t.Fatal("Tampered token should be rejected")
+	}
+
+	// Token assinado com outro segredo
+	foreign, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		UserID: 1,
+	}).SignedString([]byte("another-secret-that-is-also-long-enough"))
+	if _, err := ParseAccessToken(foreign); err == nil {
+		t.Fatal("Token signed with another secret should be rejected")
+	}
+
+	// Token sem tenant nem papel, emitido antes do isolamento por tenant
+	key, _ := signingKey()
+	untenanted, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		UserID: 1,
+	}).SignedString(key)
+	if _, err := ParseAccessToken(untenanted); err == nil {
+		t.Fatal("Token without a tenant should be rejected")
+	}
+
+	// Token sem algoritmo
+	none, _ := jwt.NewWithClaims(jwt.SigningMethodNone, Claims{UserID: 1}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := ParseAccessToken(none); err == nil {
+		t.Fatal("Unsigned token should be rejected")
+	}
+}
+
+func TestMissingSecret(t *testing.T) {
+	t.Setenv("JWT_SECRET", "short")
+
+	if err := CheckConfig(); err == nil {
+		t.Fatal("A short secret should not be accepted")
+	}
+}
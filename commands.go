@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	database "github.com/TomascpMarques/dropmedical/database"
+	migrations "github.com/TomascpMarques/dropmedical/migrations"
+	models "github.com/TomascpMarques/dropmedical/models"
+	setup "github.com/TomascpMarques/dropmedical/setup"
+)
+
+// command é um subcomando da linha de comandos, devolve o código de saída
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+// commands são os subcomandos aceites, ex: `dropmedical import -tenant 1 droppers.csv`.
+// Sem subcomando a aplicação arranca os servidores.
+var commands = map[string]command{
+	"import":  {importUsage, importCommand},
+	"audit":   {auditUsage, auditCommand},
+	"migrate": {migrateUsage, migrateCommand},
+}
+
+const (
+	importUsage  = "import -tenant <id> [-dry-run] <ficheiro.csv|ficheiro.json>"
+	auditUsage   = "audit verify"
+	migrateUsage = "migrate up [-to <versão>] | down [-steps <n>] | status | baseline | create <nome>"
+)
+
+// migrationsDir é o diretório das migrações no código fonte, onde `migrate create` as escreve
+const migrationsDir = "migrations"
+
+// runCommand corre o subcomando indicado em args
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usages := make([]string, 0, len(commands))
+		for _, cmd := range commands {
+			usages = append(usages, cmd.usage)
+		}
+		sort.Strings(usages)
+		fmt.Fprintf(os.Stderr, "Subcomando desconhecido: %s\nUso:\n  dropmedical %s\n", args[0], strings.Join(usages, "\n  dropmedical "))
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+// importCommand importa um ficheiro de droppers, secções, carregamentos e horários no tenant
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	tenant := flags.Uint("tenant", 0, "id do tenant onde os dados são importados")
+	dryRun := flags.Bool("dry-run", false, "só valida o ficheiro, nada é guardado")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *tenant == 0 || flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Uso: dropmedical %s\n", importUsage)
+		return 2
+	}
+
+	path := flags.Arg(0)
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if format != models.ImportCSV && format != models.ImportJSON {
+		fmt.Fprintf(os.Stderr, "Formato desconhecido: %s, esperado .csv ou .json\n", path)
+		return 2
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	setup.LoadEnvironment()
+	db, err := database.NewPostgresConnection()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DB Error: %s\n", err)
+		return 1
+	}
+
+	if err := migrations.Check(db); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := models.RegisterAudit(db); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	db = models.AuditAs(db, models.AuditActor{Source: models.AuditSourceCLI, TenantID: tenant})
+
+	result, err := models.Import(db, *tenant, file, format, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, row_err := range result.Errors {
+		fmt.Fprintln(os.Stderr, row_err.Error())
+	}
+
+	kinds := make([]string, 0, len(result.Created))
+	for kind, count := range result.Created {
+		kinds = append(kinds, fmt.Sprintf("%s: %d", kind, count))
+	}
+	sort.Strings(kinds)
+	fmt.Printf("%d linhas, %d com erros (%s)\n", result.Rows, len(result.Errors), strings.Join(kinds, ", "))
+
+	switch {
+	case len(result.Errors) > 0:
+		fmt.Println("Nada foi importado")
+		return 1
+	case result.DryRun:
+		fmt.Println("Ficheiro válido, nada foi importado (dry-run)")
+	default:
+		fmt.Println("Importação aplicada")
+	}
+	return 0
+}
+
+// auditCommand verifica a cadeia de hashes do histórico de auditoria. Termina com 1 se alguma
+// entrada selada tiver sido alterada ou apagada.
+func auditCommand(args []string) int {
+	if len(args) != 1 || args[0] != "verify" {
+		fmt.Fprintf(os.Stderr, "Uso: dropmedical %s\n", auditUsage)
+		return 2
+	}
+
+	setup.LoadEnvironment()
+	db, err := database.NewPostgresConnection()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DB Error: %s\n", err)
+		return 1
+	}
+
+	if err := migrations.Check(db); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	verification, err := models.VerifyAudit(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if verification.Problem != "" {
+		fmt.Printf("Histórico adulterado na entrada %d: %s\n", verification.BrokenSeq, verification.Problem)
+		fmt.Printf("%d entradas válidas antes dela\n", verification.Entries)
+		return 1
+	}
+	fmt.Printf("%d entradas válidas, %d por selar\n", verification.Entries, verification.Unsealed)
+	fmt.Printf("Última entrada: %s\n", verification.Head)
+	return 0
+}
+
+// migrateCommand aplica, reverte e lista as migrações do esquema da base de dados
+func migrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Uso: dropmedical %s\n", migrateUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	to := flags.Uint("to", 0, "versão até à qual aplicar as migrações, por omissão a última")
+	steps := flags.Int("steps", 1, "número de migrações a reverter")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	// As migrações novas são escritas no código fonte e não precisam da base de dados
+	if args[0] == "create" {
+		if flags.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Uso: dropmedical %s\n", migrateUsage)
+			return 2
+		}
+		up, down, err := migrations.Create(migrationsDir, flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Criadas %s e %s\n", up, down)
+		return 0
+	}
+
+	setup.LoadEnvironment()
+	db, err := database.NewPostgresConnection()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DB Error: %s\n", err)
+		return 1
+	}
+
+	var changed []migrations.Migration
+	switch args[0] {
+	case "up":
+		changed, err = migrations.Up(db, *to)
+		for _, migration := range changed {
+			fmt.Printf("Aplicada %04d_%s\n", migration.Version, migration.Name)
+		}
+	case "down":
+		changed, err = migrations.Down(db, *steps)
+		for _, migration := range changed {
+			fmt.Printf("Revertida %04d_%s\n", migration.Version, migration.Name)
+		}
+	case "baseline":
+		if err = migrations.Baseline(db); err == nil {
+			fmt.Printf("Migrações até à versão %d marcadas como aplicadas, aplique as restantes com migrate up\n", migrations.BaselineVersion)
+		}
+	case "status":
+		var applied []migrations.Applied
+		applied, err = migrations.Status(db)
+		done := make(map[uint]migrations.Applied, len(applied))
+		for _, migration := range applied {
+			done[migration.Version] = migration
+		}
+		for _, migration := range migrations.All() {
+			if at, ok := done[migration.Version]; ok {
+				fmt.Printf("%04d_%s\taplicada em %s\n", migration.Version, migration.Name, at.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%04d_%s\tpor aplicar\n", migration.Version, migration.Name)
+			}
+		}
+		for _, migration := range applied {
+			if migration.Version > migrations.Latest() {
+				fmt.Printf("%04d_%s\tdesconhecida, de uma versão mais recente\n", migration.Version, migration.Name)
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Uso: dropmedical %s\n", migrateUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+// Package events distribui os eventos em tempo real da API (dispensas, respostas dos dispositivos,
+// inventário, ligação dos dispositivos e alertas) pelas ligações WebSocket e SSE. Os últimos eventos
+// ficam num buffer circular, para que um cliente que perca a ligação a retome a partir do cursor
+// do último evento que recebeu. Os tipos de evento e os seus dados estão no pacote models.
+package events
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubscriptionBuffer é o número de eventos por entregar a uma subscrição. Uma subscrição que
+// o ultrapasse é fechada e o cliente retoma a partir do último evento recebido.
+const SubscriptionBuffer = 64
+
+// Event é um evento de um tenant e, opcionalmente, de um dos seus droppers
+type Event struct {
+	// Crescente desde o arranque do servidor
+	ID uint64 `json:"id"`
+	// Ponto de retoma, `<arranque>-<id>`, enviado como id do SSE. Distingue os ids de cada
+	// arranque, que recomeçam em 1.
+	Cursor string    `json:"cursor"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+
+	TenantID  uint `json:"-"`
+	DropperID uint `json:"-"`
+	// Serial do dropper
+	Dropper string `json:"dropper,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// Broker guarda os últimos eventos e entrega os novos às subscrições
+type Broker struct {
+	mu          sync.Mutex
+	history     []Event
+	last        uint64
+	subscribers map[*Subscription]struct{}
+	// Instante da criação do broker em milissegundos, o prefixo dos cursores
+	epoch string
+}
+
+// NewBroker cria um broker que guarda os últimos history eventos
+func NewBroker(history int) *Broker {
+	return &Broker{
+		history:     make([]Event, max(history, 1)),
+		subscribers: make(map[*Subscription]struct{}),
+		epoch:       strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+}
+
+// Cursor devolve o cursor do evento com o id indicado
+func (b *Broker) Cursor(id uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(id, 10)
+}
+
+// Subscription recebe os eventos publicados depois da sua criação
+type Subscription struct {
+	broker *Broker
+	events chan Event
+}
+
+// Events devolve o canal dos eventos, fechado quando a subscrição termina
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close termina a subscrição, pode ser chamado mais de uma vez
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.remove(s)
+}
+
+func (b *Broker) remove(s *Subscription) {
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+// Publish atribui o id ao evento, guarda-o e entrega-o às subscrições. Nunca bloqueia, as
+// subscrições que não acompanham os eventos são fechadas.
+func (b *Broker) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.last++
+	event.ID, event.Cursor = b.last, b.Cursor(b.last)
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	b.history[(event.ID-1)%uint64(len(b.history))] = event
+
+	for s := range b.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			b.remove(s)
+		}
+	}
+	return event
+}
+
+// Subscribe cria uma subscrição e devolve os eventos guardados posteriores a lastID, um id deste
+// broker, para retomar uma ligação. Devolve falso se algum evento posterior a lastID já não
+// estiver guardado, ou se lastID ainda não existir, e o cliente tem de voltar a carregar o estado;
+// nesse caso são devolvidos todos os eventos guardados.
+func (b *Broker) Subscribe(lastID uint64) (*Subscription, []Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(lastID)
+}
+
+// Resume é igual a Subscribe, a partir do cursor do último evento recebido pelo cliente. Um
+// cursor de outro arranque do servidor, ou inválido, nunca retoma a ligação, mesmo que o seu id
+// exista neste arranque.
+func (b *Broker) Resume(cursor string) (*Subscription, []Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if cursor == "" {
+		return b.subscribe(0)
+	}
+	epoch, id, _ := strings.Cut(cursor, "-")
+	lastID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || epoch != b.epoch {
+		// Um id posterior ao último evento nunca retoma a ligação
+		return b.subscribe(b.last + 1)
+	}
+	return b.subscribe(lastID)
+}
+
+func (b *Broker) subscribe(lastID uint64) (*Subscription, []Event, bool) {
+	s := &Subscription{broker: b, events: make(chan Event, SubscriptionBuffer)}
+	b.subscribers[s] = struct{}{}
+
+	if lastID == 0 {
+		return s, nil, true
+	}
+
+	oldest := uint64(1)
+	if b.last > uint64(len(b.history)) {
+		oldest = b.last - uint64(len(b.history)) + 1
+	}
+	if lastID > b.last {
+		lastID = 0
+	}
+
+	first := max(lastID+1, oldest)
+	missed := make([]Event, 0, b.last+1-first)
+	for id := first; id <= b.last; id++ {
+		missed = append(missed, b.history[(id-1)%uint64(len(b.history))])
+	}
+	return s, missed, lastID != 0 && lastID+1 >= oldest
+}
@@ -0,0 +1,78 @@
+package events
+
+import "testing"
+
+func TestPublishAndResume(t *testing.T) {
+	broker := NewBroker(3)
+	sub, missed, complete := broker.Subscribe(0)
+	if len(missed) != 0 || !complete {
+		t.Fatal("A new subscription has nothing to replay")
+	}
+
+	for _, kind := range []string{"a", "b", "c", "d"} {
+		broker.Publish(Event{Type: kind, TenantID: 1})
+	}
+	for id := uint64(1); id <= 4; id++ {
+		if event := <-sub.Events(); event.ID != id || event.Time.IsZero() {
+			t.Fatalf("Expected event %d, got %+v", id, event)
+		}
+	}
+	sub.Close()
+	sub.Close()
+	if _, open := <-sub.Events(); open {
+		t.Fatal("Closed subscriptions should close the channel")
+	}
+
+	// Só os 3 últimos eventos estão guardados
+	_, missed, complete = broker.Subscribe(2)
+	if !complete || len(missed) != 2 || missed[0].Type != "c" || missed[1].Type != "d" {
+		t.Fatalf("Unexpected replay %+v", missed)
+	}
+	broker.Publish(Event{Type: "e"})
+	if _, missed, complete = broker.Subscribe(1); complete || len(missed) != 3 || missed[0].ID != 3 {
+		t.Fatalf("Event 2 was lost, got %+v", missed)
+	}
+	if _, missed, complete = broker.Subscribe(10); complete || len(missed) != 3 {
+		t.Fatalf("Unknown ids should not resume, got %+v", missed)
+	}
+}
+
+func TestResumeCursor(t *testing.T) {
+	broker := NewBroker(10)
+	first := broker.Publish(Event{Type: "a"})
+	second := broker.Publish(Event{Type: "b"})
+	if first.Cursor != broker.Cursor(1) || second.Cursor == first.Cursor {
+		t.Fatalf("Unexpected cursors %s %s", first.Cursor, second.Cursor)
+	}
+
+	if _, missed, complete := broker.Resume(first.Cursor); !complete || len(missed) != 1 || missed[0].ID != second.ID {
+		t.Fatalf("Expected to resume after the first event, got %+v", missed)
+	}
+	if _, missed, complete := broker.Resume(""); !complete || len(missed) != 0 {
+		t.Fatalf("A new connection has nothing to replay, got %+v", missed)
+	}
+
+	// Os ids de um arranque anterior, com o mesmo número, não retomam a ligação
+	for _, cursor := range []string{"1-1", "1", "invalid", broker.epoch + "-x"} {
+		if _, missed, complete := broker.Resume(cursor); complete || len(missed) != 2 {
+			t.Errorf("%s: expected a reset with every stored event, got %+v", cursor, missed)
+		}
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	broker := NewBroker(10)
+	slow, _, _ := broker.Subscribe(0)
+
+	for range SubscriptionBuffer + 1 {
+		broker.Publish(Event{Type: "dispense"})
+	}
+
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	if received != SubscriptionBuffer {
+		t.Fatalf("Expected %d buffered events, got %d", SubscriptionBuffer, received)
+	}
+}
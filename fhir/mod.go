@@ -0,0 +1,283 @@
+// Package fhir define os recursos HL7 FHIR R4 trocados com hospitais e farmácias: MedicationRequest,
+// MedicationDispense, MedicationAdministration e Bundle. Só inclui os elementos que a API usa,
+// o mapeamento dos models está no pacote models.
+package fhir
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// ContentType é o content-type dos recursos FHIR em JSON
+const ContentType = "application/fhir+json; charset=utf-8"
+
+// Tipos de recurso
+const (
+	TypeMedicationRequest        = "MedicationRequest"
+	TypeMedicationDispense       = "MedicationDispense"
+	TypeMedicationAdministration = "MedicationAdministration"
+	TypeBundle                   = "Bundle"
+)
+
+// Tipos de Bundle
+const (
+	BundleSearchset           = "searchset"
+	BundleTransaction         = "transaction"
+	BundleTransactionResponse = "transaction-response"
+)
+
+// UnitsOfMeasure é o sistema UCUM das quantidades
+const UnitsOfMeasure = "http://unitsofmeasure.org"
+
+type Meta struct {
+	VersionID   string     `json:"versionId,omitempty"`
+	LastUpdated *time.Time `json:"lastUpdated,omitempty"`
+}
+
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+// Name devolve o texto do conceito ou, sem texto, o display da primeira codificação
+func (c *CodeableConcept) Name() string {
+	if c == nil {
+		return ""
+	}
+	if c.Text != "" {
+		return c.Text
+	}
+	for _, coding := range c.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+	}
+	return ""
+}
+
+type Quantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+// Tablets devolve uma quantidade de comprimidos
+func Tablets(count int) *Quantity {
+	return &Quantity{Value: float64(count), Unit: "comprimido", System: UnitsOfMeasure, Code: "{tbl}"}
+}
+
+type Period struct {
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+type Annotation struct {
+	Text string `json:"text"`
+}
+
+type TimingRepeat struct {
+	BoundsPeriod   *Period   `json:"boundsPeriod,omitempty"`
+	BoundsDuration *Quantity `json:"boundsDuration,omitempty"`
+	Frequency      int       `json:"frequency,omitempty"`
+	Period         float64   `json:"period,omitempty"`
+	// s, min, h, d, wk, mo ou a
+	PeriodUnit string `json:"periodUnit,omitempty"`
+}
+
+type Timing struct {
+	Repeat *TimingRepeat `json:"repeat,omitempty"`
+}
+
+type DoseAndRate struct {
+	DoseQuantity *Quantity `json:"doseQuantity,omitempty"`
+}
+
+type Dosage struct {
+	Sequence           int           `json:"sequence,omitempty"`
+	Text               string        `json:"text,omitempty"`
+	PatientInstruction string        `json:"patientInstruction,omitempty"`
+	Timing             *Timing       `json:"timing,omitempty"`
+	AsNeededBoolean    *bool         `json:"asNeededBoolean,omitempty"`
+	DoseAndRate        []DoseAndRate `json:"doseAndRate,omitempty"`
+}
+
+type DispenseRequest struct {
+	ValidityPeriod         *Period `json:"validityPeriod,omitempty"`
+	NumberOfRepeatsAllowed *uint   `json:"numberOfRepeatsAllowed,omitempty"`
+}
+
+// MedicationRequest é uma receita, ou um horário criado sem receita
+type MedicationRequest struct {
+	ResourceType              string           `json:"resourceType"`
+	ID                        string           `json:"id,omitempty"`
+	Meta                      *Meta            `json:"meta,omitempty"`
+	Identifier                []Identifier     `json:"identifier,omitempty"`
+	Status                    string           `json:"status"`
+	Intent                    string           `json:"intent"`
+	MedicationCodeableConcept *CodeableConcept `json:"medicationCodeableConcept,omitempty"`
+	Subject                   Reference        `json:"subject"`
+	AuthoredOn                *time.Time       `json:"authoredOn,omitempty"`
+	Requester                 *Reference       `json:"requester,omitempty"`
+	Note                      []Annotation     `json:"note,omitempty"`
+	DosageInstruction         []Dosage         `json:"dosageInstruction,omitempty"`
+	DispenseRequest           *DispenseRequest `json:"dispenseRequest,omitempty"`
+}
+
+// MedicationDispense é uma toma dispensada, ou que falhou ou foi saltada, de um medicamento
+type MedicationDispense struct {
+	ResourceType                string           `json:"resourceType"`
+	ID                          string           `json:"id,omitempty"`
+	Meta                        *Meta            `json:"meta,omitempty"`
+	Status                      string           `json:"status"`
+	StatusReasonCodeableConcept *CodeableConcept `json:"statusReasonCodeableConcept,omitempty"`
+	MedicationCodeableConcept   *CodeableConcept `json:"medicationCodeableConcept,omitempty"`
+	Subject                     *Reference       `json:"subject,omitempty"`
+	AuthorizingPrescription     []Reference      `json:"authorizingPrescription,omitempty"`
+	Quantity                    *Quantity        `json:"quantity,omitempty"`
+	WhenPrepared                *time.Time       `json:"whenPrepared,omitempty"`
+	WhenHandedOver              *time.Time       `json:"whenHandedOver,omitempty"`
+}
+
+type AdministrationDosage struct {
+	Dose *Quantity `json:"dose,omitempty"`
+}
+
+// MedicationAdministration é a confirmação de que o medicamento dispensado foi tomado
+type MedicationAdministration struct {
+	ResourceType              string                `json:"resourceType"`
+	ID                        string                `json:"id,omitempty"`
+	Meta                      *Meta                 `json:"meta,omitempty"`
+	Status                    string                `json:"status"`
+	MedicationCodeableConcept *CodeableConcept      `json:"medicationCodeableConcept,omitempty"`
+	Subject                   Reference             `json:"subject"`
+	SupportingInformation     []Reference           `json:"supportingInformation,omitempty"`
+	EffectiveDateTime         *time.Time            `json:"effectiveDateTime,omitempty"`
+	Request                   *Reference            `json:"request,omitempty"`
+	Note                      []Annotation          `json:"note,omitempty"`
+	Dosage                    *AdministrationDosage `json:"dosage,omitempty"`
+}
+
+type BundleRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type BundleResponse struct {
+	Status   string `json:"status"`
+	Location string `json:"location,omitempty"`
+}
+
+type BundleEntry struct {
+	FullURL  string          `json:"fullUrl,omitempty"`
+	Resource json.RawMessage `json:"resource,omitempty"`
+	Request  *BundleRequest  `json:"request,omitempty"`
+	Response *BundleResponse `json:"response,omitempty"`
+}
+
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	ID           string        `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	Timestamp    *time.Time    `json:"timestamp,omitempty"`
+	Total        *int          `json:"total,omitempty"`
+	Entry        []BundleEntry `json:"entry"`
+}
+
+// NewBundle cria um Bundle vazio do tipo indicado
+func NewBundle(kind string, now time.Time) *Bundle {
+	return &Bundle{ResourceType: TypeBundle, Type: kind, Timestamp: &now, Entry: make([]BundleEntry, 0)}
+}
+
+// Add acrescenta o recurso ao Bundle, nos searchset atualiza o total
+func (b *Bundle) Add(resource any, response *BundleResponse) error {
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	b.Entry = append(b.Entry, BundleEntry{Resource: raw, Response: response})
+	if b.Type == BundleSearchset {
+		total := len(b.Entry)
+		b.Total = &total
+	}
+	return nil
+}
+
+// ResourceType devolve o tipo do recurso da entrada
+func (e *BundleEntry) ResourceType() string {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+	}
+	json.Unmarshal(e.Resource, &resource)
+	return resource.ResourceType
+}
+
+// units são as unidades de tempo UCUM aceites nos Timing e nas durações
+var units = map[string]time.Duration{
+	"s":   time.Second,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+	"wk":  7 * 24 * time.Hour,
+	"mo":  30 * 24 * time.Hour,
+	"a":   365 * 24 * time.Hour,
+}
+
+// Interval devolve o tempo entre tomas do Timing, `frequency` vezes em cada `period`.
+// Devolve falso se a unidade for desconhecida ou o período não for positivo.
+func (r *TimingRepeat) Interval() (time.Duration, bool) {
+	unit, ok := units[r.PeriodUnit]
+	if !ok || r.Period <= 0 {
+		return 0, false
+	}
+	frequency := max(r.Frequency, 1)
+	return time.Duration(r.Period*float64(unit)) / time.Duration(frequency), true
+}
+
+// RepeatEvery devolve o Timing de uma toma a cada interval, na maior unidade que o divide
+func RepeatEvery(interval time.Duration) *TimingRepeat {
+	for _, unit := range []string{"d", "h", "min"} {
+		if interval%units[unit] == 0 {
+			return &TimingRepeat{Frequency: 1, Period: float64(interval / units[unit]), PeriodUnit: unit}
+		}
+	}
+	return &TimingRepeat{Frequency: 1, Period: interval.Seconds(), PeriodUnit: "s"}
+}
+
+// Duration devolve a duração de uma quantidade de tempo, ex: boundsDuration
+func (q *Quantity) Duration() (time.Duration, bool) {
+	unit := q.Code
+	if unit == "" {
+		unit = q.Unit
+	}
+	multiplier, ok := units[unit]
+	if !ok || q.Value <= 0 {
+		return 0, false
+	}
+	return time.Duration(q.Value * float64(multiplier)), true
+}
+
+// Count devolve a quantidade como número inteiro positivo, ex: comprimidos por toma
+func (q *Quantity) Count() (uint, bool) {
+	if q == nil || q.Value < 1 || q.Value != math.Trunc(q.Value) {
+		return 0, false
+	}
+	return uint(q.Value), true
+}
@@ -0,0 +1,73 @@
+package fhir
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimingInterval(t *testing.T) {
+	cases := []struct {
+		repeat   TimingRepeat
+		expected time.Duration
+	}{
+		{TimingRepeat{Frequency: 3, Period: 1, PeriodUnit: "d"}, 8 * time.Hour},
+		{TimingRepeat{Period: 12, PeriodUnit: "h"}, 12 * time.Hour},
+		{TimingRepeat{Frequency: 2, Period: 1, PeriodUnit: "wk"}, 84 * time.Hour},
+		{TimingRepeat{Frequency: 1, Period: 0.5, PeriodUnit: "h"}, 30 * time.Minute},
+	}
+	for _, c := range cases {
+		interval, ok := c.repeat.Interval()
+		if !ok || interval != c.expected {
+			t.Errorf("%+v: expected %s, got %s", c.repeat, c.expected, interval)
+		}
+	}
+
+	for _, repeat := range []TimingRepeat{{Period: 1, PeriodUnit: "fortnight"}, {Frequency: 2, PeriodUnit: "d"}} {
+		if _, ok := repeat.Interval(); ok {
+			t.Errorf("%+v should be rejected", repeat)
+		}
+	}
+}
+
+func TestRepeatEvery(t *testing.T) {
+	for _, interval := range []time.Duration{48 * time.Hour, 8 * time.Hour, 90 * time.Minute, 45 * time.Second} {
+		repeat := RepeatEvery(interval)
+		if back, ok := repeat.Interval(); !ok || back != interval {
+			t.Errorf("%s: got %+v", interval, repeat)
+		}
+	}
+	if repeat := RepeatEvery(8 * time.Hour); repeat.PeriodUnit != "h" || repeat.Period != 8 {
+		t.Fatalf("Expected every 8 hours, got %+v", repeat)
+	}
+}
+
+func TestQuantity(t *testing.T) {
+	if count, ok := (&Quantity{Value: 2}).Count(); !ok || count != 2 {
+		t.Fatal("Expected 2 tablets")
+	}
+	if _, ok := (&Quantity{Value: 1.5}).Count(); ok {
+		t.Fatal("Half tablets should be rejected")
+	}
+	if d, ok := (&Quantity{Value: 10, Unit: "days", Code: "d"}).Duration(); !ok || d != 240*time.Hour {
+		t.Fatalf("Expected 10 days, got %s", d)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	bundle := NewBundle(BundleSearchset, time.Now())
+	bundle.Add(MedicationRequest{ResourceType: TypeMedicationRequest, ID: "prescription-1", Status: "active", Intent: "order"}, nil)
+	bundle.Add(MedicationDispense{ResourceType: TypeMedicationDispense, ID: "dose-1-1", Status: "completed"}, nil)
+
+	raw, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Bundle
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Total == nil || *decoded.Total != 2 || decoded.Entry[1].ResourceType() != TypeMedicationDispense {
+		t.Fatalf("Unexpected bundle: %s", raw)
+	}
+}
@@ -0,0 +1,92 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type caregiverResponse struct {
+	UserID    uint      `json:"user_id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	GrantedBy uint      `json:"granted_by"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+func newCaregiverResponse(g *models.DropperGrant) caregiverResponse {
+	return caregiverResponse{
+		UserID:    g.UserID,
+		Email:     g.User.Email,
+		Name:      g.User.Name,
+		GrantedBy: g.GrantedBy,
+		GrantedAt: g.CreatedAt,
+	}
+}
+
+func listCaregiversV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	grants, err := dropper.ListGrants(db, models.RoleCaregiver)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response := make([]caregiverResponse, len(grants))
+	for i := range grants {
+		response[i] = newCaregiverResponse(&grants[i])
+	}
+	c.JSON(200, response)
+}
+
+type inviteCaregiverBody struct {
+	// Email de um utilizador já registado, de qualquer tenant
+	Email string `json:"email" binding:"required"`
+}
+
+func inviteCaregiverV1(c *gin.Context, db *gorm.DB) {
+	var body inviteCaregiverBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	grant, err := dropper.Grant(db, body.Email, models.RoleCaregiver, currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newCaregiverResponse(grant))
+}
+
+func revokeCaregiverV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+	userID, ok := idFromPath(c, "user", models.ErrGrantNotFound)
+	if !ok {
+		return
+	}
+
+	if err := dropper.Revoke(db, userID, models.RoleCaregiver); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
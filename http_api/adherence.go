@@ -0,0 +1,189 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// confirmDoseBody confirma manualmente uma toma, sem taken_at a toma foi feita agora
+type confirmDoseBody struct {
+	TakenAt *time.Time `json:"taken_at"`
+}
+
+type doseConfirmationResponse struct {
+	ID     uint  `json:"id"`
+	UserID *uint `json:"user_id"`
+	// cup_removed, pill_taken ou manual
+	Event     string    `json:"event"`
+	TakenAt   time.Time `json:"taken_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newDoseConfirmationResponse(c *models.DoseConfirmation) *doseConfirmationResponse {
+	if c == nil {
+		return nil
+	}
+	return &doseConfirmationResponse{
+		ID:        c.ID,
+		UserID:    c.UserID,
+		Event:     c.Event,
+		TakenAt:   c.TakenAt,
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+// confirmDoseV1 confirma na app que uma toma dispensada foi feita
+func confirmDoseV1(c *gin.Context, db *gorm.DB) {
+	var body confirmDoseBody
+
+	// A hora é opcional, o corpo pode ser omitido
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+	id, ok := idFromPath(c, "dose", models.ErrDoseNotFound)
+	if !ok {
+		return
+	}
+
+	record, err := dropper.FindDose(db, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	takenAt := time.Now().UTC()
+	if body.TakenAt != nil {
+		takenAt = *body.TakenAt
+	}
+	userID := currentUserID(c)
+	if err := record.Confirm(db, models.ConfirmManual, &userID, takenAt); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newDoseResponse(record))
+}
+
+// adherenceQuery filtra o relatório de adesão. Sem datas são os últimos 30 dias.
+type adherenceQuery struct {
+	From       time.Time `form:"from"`
+	To         time.Time `form:"to"`
+	Medication string    `form:"medication"`
+	Period     string    `form:"period" binding:"omitempty,oneof=day week month"`
+}
+
+// adherenceCounts são as percentagens calculadas sobre as tomas já decididas, sem as pendentes
+type adherenceCounts struct {
+	Doses      uint    `json:"doses"`
+	OnTime     uint    `json:"on_time"`
+	Late       uint    `json:"late"`
+	Missed     uint    `json:"missed"`
+	Pending    uint    `json:"pending"`
+	OnTimeRate float64 `json:"on_time_rate"`
+	LateRate   float64 `json:"late_rate"`
+	MissedRate float64 `json:"missed_rate"`
+}
+
+func newAdherenceCounts(c models.AdherenceCounts) adherenceCounts {
+	return adherenceCounts{
+		Doses:      c.Doses,
+		OnTime:     c.OnTime,
+		Late:       c.Late,
+		Missed:     c.Missed,
+		Pending:    c.Pending,
+		OnTimeRate: c.Rate(models.AdherenceOnTime),
+		LateRate:   c.Rate(models.AdherenceLate),
+		MissedRate: c.Rate(models.AdherenceMissed),
+	}
+}
+
+type adherencePeriodResponse struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	adherenceCounts
+}
+
+func newAdherencePeriods(periods []models.AdherencePeriod) []adherencePeriodResponse {
+	response := make([]adherencePeriodResponse, len(periods))
+	for i, period := range periods {
+		response[i] = adherencePeriodResponse{Start: period.Start, End: period.End, adherenceCounts: newAdherenceCounts(period.AdherenceCounts)}
+	}
+	return response
+}
+
+type medicationAdherenceResponse struct {
+	Medication string `json:"medication"`
+	adherenceCounts
+	Periods []adherencePeriodResponse `json:"periods"`
+}
+
+type adherenceResponse struct {
+	PatientID  uint      `json:"patient_id"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Period     string    `json:"period"`
+	Medication string    `json:"medication,omitempty"`
+	adherenceCounts
+	Periods     []adherencePeriodResponse     `json:"periods"`
+	Medications []medicationAdherenceResponse `json:"medications"`
+}
+
+func newAdherenceResponse(r *models.AdherenceReport) adherenceResponse {
+	response := adherenceResponse{
+		PatientID:       r.PatientID,
+		From:            r.Query.From,
+		To:              r.Query.To,
+		Period:          r.Query.Period,
+		Medication:      r.Query.Medication,
+		adherenceCounts: newAdherenceCounts(r.AdherenceCounts),
+		Periods:         newAdherencePeriods(r.Periods),
+		Medications:     make([]medicationAdherenceResponse, len(r.Medications)),
+	}
+	for i, medication := range r.Medications {
+		response.Medications[i] = medicationAdherenceResponse{
+			Medication:      medication.Medication,
+			adherenceCounts: newAdherenceCounts(medication.AdherenceCounts),
+			Periods:         newAdherencePeriods(medication.Periods),
+		}
+	}
+	return response
+}
+
+func patientAdherenceV1(c *gin.Context, db *gorm.DB) {
+	var query adherenceQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	report, err := patient.Adherence(db, models.AdherenceQuery{
+		From:       query.From,
+		To:         query.To,
+		Medication: query.Medication,
+		Period:     query.Period,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newAdherenceResponse(report))
+}
@@ -0,0 +1,99 @@
+package http_api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type auditQuery struct {
+	listQuery
+	// Tabela do registo, ex: dropper_sections
+	Entity   string `form:"entity"`
+	EntityID string `form:"entity_id"`
+	Action   string `form:"action" binding:"omitempty,oneof=create update delete"`
+	Source   string `form:"source" binding:"omitempty,oneof=api scheduler device cli system"`
+	User     *uint  `form:"user"`
+}
+
+type auditEntryResponse struct {
+	ID        uint64          `json:"id"`
+	Seq       *uint64         `json:"seq"`
+	CreatedAt time.Time       `json:"created_at"`
+	Source    string          `json:"source"`
+	UserID    *uint           `json:"user_id"`
+	Device    string          `json:"device,omitempty"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityID  string          `json:"entity_id"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+func newAuditEntryResponse(e *models.AuditEntry) auditEntryResponse {
+	state := func(value []byte) json.RawMessage {
+		if len(value) == 0 {
+			return json.RawMessage("null")
+		}
+		return value
+	}
+	return auditEntryResponse{
+		ID:        e.ID,
+		Seq:       e.Seq,
+		CreatedAt: e.CreatedAt,
+		Source:    e.Source,
+		UserID:    e.UserID,
+		Device:    e.Device,
+		Action:    e.Action,
+		Entity:    e.Entity,
+		EntityID:  e.EntityID,
+		Before:    state(e.Before),
+		After:     state(e.After),
+		PrevHash:  e.PrevHash,
+		Hash:      e.Hash,
+	}
+}
+
+// listAuditEntriesV1 lista o histórico de alterações do tenant, com o estado antes e depois
+func listAuditEntriesV1(c *gin.Context, db *gorm.DB) {
+	var query auditQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	filter := models.AuditFilter{
+		Entity:   query.Entity,
+		EntityID: query.EntityID,
+		Action:   query.Action,
+		Source:   query.Source,
+		UserID:   query.User,
+	}
+	list, total, err := models.ListAuditEntries(db, currentTenantID(c), filter, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[auditEntryResponse]{
+		Data:    make([]auditEntryResponse, len(list)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range list {
+		page.Data[i] = newAuditEntryResponse(&list[i])
+	}
+	c.JSON(200, page)
+}
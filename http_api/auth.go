@@ -0,0 +1,228 @@
+package http_api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/auth"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// Chaves do contexto gin onde o middleware guarda o utilizador autenticado, o seu tenant e a
+// validade do access token
+const (
+	userIDKey       = "user_id"
+	tenantIDKey     = "tenant_id"
+	tokenExpiresKey = "token_expires"
+)
+
+// setupAuthRoutes regista as rotas públicas de registo e sessão
+func setupAuthRoutes(public *gin.RouterGroup, db *gorm.DB) {
+	public.POST("/auth/register", func(ctx *gin.Context) { registerUserPOST(ctx, requestDB(ctx, db)) })
+	public.POST("/auth/login", func(ctx *gin.Context) { loginPOST(ctx, requestDB(ctx, db)) })
+	public.POST("/auth/refresh", func(ctx *gin.Context) { refreshTokenPOST(ctx, requestDB(ctx, db)) })
+	public.POST("/auth/logout", func(ctx *gin.Context) { logoutPOST(ctx, requestDB(ctx, db)) })
+	public.POST("/auth/invites/accept", func(ctx *gin.Context) { acceptInvitePOST(ctx, requestDB(ctx, db)) })
+}
+
+// queryTokenRoutes aceitam o access token no parâmetro access_token, porque o EventSource e o
+// WebSocket dos browsers não enviam o cabeçalho Authorization
+var queryTokenRoutes = map[string]bool{
+	"/api/v1/events":    true,
+	"/api/v1/events/ws": true,
+}
+
+// requireAuth só deixa passar pedidos com um access token válido no cabeçalho Authorization
+func requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" && queryTokenRoutes[c.FullPath()] && c.Query("access_token") != "" {
+			header = "Bearer " + c.Query("access_token")
+		}
+
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			respondError(c, newAPIError(401, CodeUnauthorized))
+			return
+		}
+
+		claims, err := auth.ParseAccessToken(token)
+		if err != nil {
+			respondError(c, newAPIError(401, CodeUnauthorized))
+			return
+		}
+
+		c.Set(userIDKey, claims.UserID)
+		c.Set(tenantIDKey, claims.TenantID)
+		if claims.ExpiresAt != nil {
+			c.Set(tokenExpiresKey, claims.ExpiresAt.Time)
+		}
+		c.Set(actorKey, models.Actor{
+			UserID:   claims.UserID,
+			TenantID: claims.TenantID,
+			Role:     models.Role(claims.Role),
+		})
+		c.Next()
+	}
+}
+
+// currentUserID devolve o utilizador autenticado, só é válido em rotas protegidas por requireAuth
+func currentUserID(c *gin.Context) uint {
+	return c.GetUint(userIDKey)
+}
+
+// tokenExpired é fechado quando o access token do pedido expira, nunca se o token não tiver validade
+func tokenExpired(c *gin.Context) <-chan time.Time {
+	expires, ok := c.Get(tokenExpiresKey)
+	if !ok {
+		return nil
+	}
+	return time.After(time.Until(expires.(time.Time)))
+}
+
+// currentTenantID devolve o tenant do utilizador autenticado, a que todas as consultas são limitadas
+func currentTenantID(c *gin.Context) uint {
+	return c.GetUint(tenantIDKey)
+}
+
+type userResponse struct {
+	ID       uint        `json:"id"`
+	TenantID uint        `json:"tenant_id"`
+	Role     models.Role `json:"role"`
+	Email    string      `json:"email"`
+	Name     string      `json:"name"`
+}
+
+func newUserResponse(u *models.User) userResponse {
+	return userResponse{ID: u.ID, TenantID: u.TenantID, Role: u.Role, Email: u.Email, Name: u.Name}
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newTokenResponse emite um access token para o utilizador e junta-o ao refresh token
+func newTokenResponse(user *models.User, refresh string) (tokenResponse, error) {
+	access, _, err := auth.NewAccessToken(user.ID, user.TenantID, string(user.Role))
+
+	return tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(auth.AccessTokenTTL().Seconds()),
+		RefreshToken: refresh,
+	}, err
+}
+
+type registerUserBody struct {
+	Name     string `json:"name" binding:"required"`
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func registerUserPOST(c *gin.Context, db *gorm.DB) {
+	var body registerUserBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	user, err := models.RegisterUser(db, body.Name, body.Email, body.Password)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newUserResponse(user))
+}
+
+type loginBody struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func loginPOST(c *gin.Context, db *gorm.DB) {
+	var body loginBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	user, err := models.AuthenticateUser(db, body.Email, body.Password)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	refresh, err := models.IssueRefreshToken(db, user.ID, auth.RefreshTokenTTL())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response, err := newTokenResponse(user, refresh)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+type refreshTokenBody struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func refreshTokenPOST(c *gin.Context, db *gorm.DB) {
+	var body refreshTokenBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	user, refresh, err := models.RotateRefreshToken(db, body.RefreshToken, auth.RefreshTokenTTL())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response, err := newTokenResponse(user, refresh)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+func logoutPOST(c *gin.Context, db *gorm.DB) {
+	var body refreshTokenBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	if err := models.RevokeRefreshToken(db, body.RefreshToken); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+func currentUserGET(c *gin.Context, db *gorm.DB) {
+	user, err := models.FindUser(db, currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newUserResponse(user))
+}
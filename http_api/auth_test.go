@@ -0,0 +1,88 @@
+package http_api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomascpMarques/dropmedical/auth"
+)
+
+func TestRequireAuth(t *testing.T) {
+	t.Setenv("JWT_SECRET", "a-test-secret-that-is-long-enough-for-hs256")
+
+	r := gin.New()
+	r.GET("/health_check/up", func(ctx *gin.Context) { ctx.Status(200) })
+	r.GET("/api/me", requireAuth(), func(ctx *gin.Context) { ctx.JSON(200, currentUserID(ctx)) })
+
+	token, _, err := auth.NewAccessToken(7, 2, "patient")
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+
+	cases := []struct {
+		path          string
+		authorization string
+		status        int
+	}{
+		{"/health_check/up", "", 200},
+		{"/api/me", "", 401},
+		{"/api/me", "Bearer", 401},
+		{"/api/me", "Basic " + token, 401},
+		{"/api/me", "Bearer not-a-token", 401},
+		{"/api/me", "Bearer " + token, 200},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		if resp.Code != c.status {
+			t.Fatalf("%s <%s>: expected %d, got %d", c.path, c.authorization, c.status, resp.Code)
+		}
+		if c.status == 200 && c.path == "/api/me" && resp.Body.String() != "7" {
+			t.Fatalf("Expected the user id 7, got %s", resp.Body.String())
+		}
+	}
+}
+
+func TestQueryToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "a-test-secret-that-is-long-enough-for-hs256")
+
+	r := gin.New()
+	r.GET("/api/me", requireAuth(), func(ctx *gin.Context) { ctx.JSON(200, currentUserID(ctx)) })
+	r.GET("/api/v1/events", requireAuth(), func(ctx *gin.Context) { ctx.JSON(200, currentUserID(ctx)) })
+
+	token, _, err := auth.NewAccessToken(7, 2, "patient")
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+
+	// Só as rotas de eventos aceitam o token na query
+	for path, status := range map[string]int{"/api/v1/events": 200, "/api/me": 401} {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest("GET", path+"?access_token="+token, nil))
+		if resp.Code != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, resp.Code)
+		}
+	}
+}
+
+func TestAPILoggerRedactsTokens(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/api/v1/events?types=alert&access_token=secret": "/api/v1/events?types=alert&access_token=***",
+		"/api/calendar/secret.ics":                       "/api/calendar/***",
+		"/api/calendar/secret.ics?x=1":                   "/api/calendar/***?x=1",
+	} {
+		line := apiLogger(gin.LogFormatterParams{Path: path, Method: "GET", StatusCode: 200})
+		if strings.Contains(line, "secret") || !strings.Contains(line, expected) {
+			t.Errorf("Expected %s to be logged as %s, got %s", path, expected, line)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package http_api
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type calendarFeedResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	PatientID  *uint      `json:"patient_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func newCalendarFeedResponse(f *models.CalendarFeed) calendarFeedResponse {
+	return calendarFeedResponse{
+		ID:         f.ID,
+		Name:       f.Name,
+		PatientID:  f.PatientID,
+		CreatedAt:  f.CreatedAt,
+		LastUsedAt: f.LastUsedAt,
+		RevokedAt:  f.RevokedAt,
+	}
+}
+
+// createdCalendarFeedResponse inclui o token, devolvido apenas na criação do calendário
+type createdCalendarFeedResponse struct {
+	calendarFeedResponse
+	Token string `json:"token"`
+	// Caminho público do calendário, a subscrever na aplicação de calendário
+	Path string `json:"path"`
+}
+
+func respondCalendarFeedCreated(c *gin.Context, feed *models.CalendarFeed, token string) {
+	c.JSON(201, createdCalendarFeedResponse{
+		calendarFeedResponse: newCalendarFeedResponse(feed),
+		Token:                token,
+		Path:                 "/api/calendar/" + token + ".ics",
+	})
+}
+
+func createPatientCalendarFeedV1(c *gin.Context, db *gorm.DB) {
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	feed, token, err := patient.CreateCalendarFeed(db, currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	respondCalendarFeedCreated(c, feed, token)
+}
+
+func createDropperCalendarFeedV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	feed, token, err := dropper.CreateCalendarFeed(db, currentTenantID(c), currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	respondCalendarFeedCreated(c, feed, token)
+}
+
+func listCalendarFeedsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	list, total, err := models.ListCalendarFeeds(db, currentUserID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[calendarFeedResponse]{
+		Data:    make([]calendarFeedResponse, len(list)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range list {
+		page.Data[i] = newCalendarFeedResponse(&list[i])
+	}
+	c.JSON(200, page)
+}
+
+func revokeCalendarFeedV1(c *gin.Context, db *gorm.DB) {
+	id, ok := idFromPath(c, "feed", models.ErrCalendarFeedNotFound)
+	if !ok {
+		return
+	}
+
+	if err := models.RevokeCalendarFeed(db, currentUserID(c), id); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// calendarGET envia o calendário do token, rota pública para as aplicações de calendário que
+// não enviam access tokens. O sufixo `.ics` é opcional.
+func calendarGET(c *gin.Context, db *gorm.DB) {
+	feed, err := models.FindCalendarFeed(db, strings.TrimSuffix(c.Param("token"), ".ics"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := feed.Render(db, &out); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(200, "text/calendar; charset=utf-8", out.Bytes())
+}
@@ -0,0 +1,220 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// pauseBody pausa um horário, ou todos os do paciente, até resume_at ou até ser retomado
+type pauseBody struct {
+	Reason   string     `json:"reason" binding:"required"`
+	ResumeAt *time.Time `json:"resume_at"`
+}
+
+type resumeBody struct {
+	Reason string `json:"reason"`
+}
+
+type skipBody struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+type scheduleControlResponse struct {
+	ID          uint       `json:"id"`
+	ScheduleID  uint       `json:"schedule_id"`
+	PatientID   *uint      `json:"patient_id"`
+	UserID      uint       `json:"user_id"`
+	Action      string     `json:"action"`
+	Reason      string     `json:"reason"`
+	ResumeAt    *time.Time `json:"resume_at"`
+	DueAt       *time.Time `json:"due_at"`
+	PatientWide bool       `json:"patient_wide"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func newScheduleControlResponse(control *models.ScheduleControl) scheduleControlResponse {
+	return scheduleControlResponse{
+		ID:          control.ID,
+		ScheduleID:  control.ScheduleID,
+		PatientID:   control.PatientID,
+		UserID:      control.UserID,
+		Action:      control.Action,
+		Reason:      control.Reason,
+		ResumeAt:    control.ResumeAt,
+		DueAt:       control.DueAt,
+		PatientWide: control.PatientWide,
+		CreatedAt:   control.CreatedAt,
+	}
+}
+
+// respondSchedules responde com a lista de horários
+func respondSchedules(c *gin.Context, db *gorm.DB, schedules []models.DispenseSchedule) {
+	var err error
+
+	response := make([]scheduleResponse, len(schedules))
+	for i := range schedules {
+		if response[i], err = newScheduleResponse(db, &schedules[i]); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	c.JSON(200, response)
+}
+
+func pauseScheduleV1(c *gin.Context, db *gorm.DB) {
+	var body pauseBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	_, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := schedule.Pause(db, models.ScheduleControlFields{UserID: currentUserID(c), Reason: body.Reason, ResumeAt: body.ResumeAt}); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response, err := newScheduleResponse(db, schedule)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+func resumeScheduleV1(c *gin.Context, db *gorm.DB) {
+	var body resumeBody
+
+	// O motivo é opcional, o corpo pode ser omitido
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	_, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := schedule.Resume(db, models.ScheduleControlFields{UserID: currentUserID(c), Reason: body.Reason}); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response, err := newScheduleResponse(db, schedule)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+// skipDoseV1 salta a próxima toma do horário, que fica no histórico de tomas como saltada
+func skipDoseV1(c *gin.Context, db *gorm.DB) {
+	var body skipBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	_, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	record, err := schedule.SkipNext(db, models.ScheduleControlFields{UserID: currentUserID(c), Reason: body.Reason})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newDoseResponse(record))
+}
+
+func listScheduleControlsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	_, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	controls, total, err := schedule.ListControls(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[scheduleControlResponse]{
+		Data:    make([]scheduleControlResponse, len(controls)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range controls {
+		page.Data[i] = newScheduleControlResponse(&controls[i])
+	}
+	c.JSON(200, page)
+}
+
+// pausePatientV1 pausa todos os horários ativos do paciente, ex: durante um internamento
+func pausePatientV1(c *gin.Context, db *gorm.DB) {
+	var body pauseBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	schedules, err := patient.PauseSchedules(db, models.ScheduleControlFields{UserID: currentUserID(c), Reason: body.Reason, ResumeAt: body.ResumeAt})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	respondSchedules(c, db, schedules)
+}
+
+func resumePatientV1(c *gin.Context, db *gorm.DB) {
+	var body resumeBody
+
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	schedules, err := patient.ResumeSchedules(db, models.ScheduleControlFields{UserID: currentUserID(c), Reason: body.Reason})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	respondSchedules(c, db, schedules)
+}
@@ -0,0 +1,460 @@
+package http_api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/text/language"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// Códigos de erro estáveis devolvidos pela API, os clientes devem depender destes e não das mensagens
+const (
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeNotFound             = "NOT_FOUND"
+	CodeInternalError        = "INTERNAL_ERROR"
+	CodeDropperNotFound      = "DROPPER_NOT_FOUND"
+	CodeDropperExists        = "DROPPER_EXISTS"
+	CodeSectionNotFound      = "SECTION_NOT_FOUND"
+	CodeSectionExists        = "SECTION_EXISTS"
+	CodeSectionFull          = "SECTION_FULL"
+	CodeScheduleNotFound     = "SCHEDULE_NOT_FOUND"
+	CodeScheduleExists       = "SCHEDULE_EXISTS"
+	CodeTooManyPills         = "TOO_MANY_PILLS"
+	CodeTooFewPills          = "TOO_FEW_PILLS"
+	CodeNotEnoughPills       = "NOT_ENOUGH_PILLS"
+	CodeInvalidPosition      = "INVALID_POSITION"
+	CodeInvalidSort          = "INVALID_SORT"
+	CodeDiscrepancyNotFound  = "DISCREPANCY_NOT_FOUND"
+	CodeDiscrepancyResolved  = "DISCREPANCY_RESOLVED"
+	CodeInvalidResolution    = "INVALID_RESOLUTION"
+	CodeInvalidOccupancyData = "INVALID_OCCUPANCY_DATA"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeUserExists           = "USER_EXISTS"
+	CodeUserNotFound         = "USER_NOT_FOUND"
+	CodeInvalidEmail         = "INVALID_EMAIL"
+	CodeWeakPassword         = "WEAK_PASSWORD"
+	CodeInvalidCredentials   = "INVALID_CREDENTIALS"
+	CodeInvalidRefreshToken  = "INVALID_REFRESH_TOKEN"
+	CodeForbidden            = "FORBIDDEN"
+	CodeInvalidRole          = "INVALID_ROLE"
+	CodeGrantExists          = "GRANT_EXISTS"
+	CodeGrantNotFound        = "GRANT_NOT_FOUND"
+	CodeInviteNotFound       = "INVITE_NOT_FOUND"
+	CodeMemberNotFound       = "MEMBER_NOT_FOUND"
+	CodeLastAdmin            = "LAST_ADMIN"
+	CodePatientNotFound      = "PATIENT_NOT_FOUND"
+	CodePatientNotLinked     = "PATIENT_NOT_LINKED"
+	CodeInvalidTimeZone      = "INVALID_TIME_ZONE"
+	CodeSameDropper          = "SAME_DROPPER"
+	CodeInvalidPatientData   = "INVALID_PATIENT_DATA"
+	CodePrescriptionNotFound = "PRESCRIPTION_NOT_FOUND"
+	CodeInvalidPrescription  = "INVALID_PRESCRIPTION"
+	CodePrescriptionInactive = "PRESCRIPTION_INACTIVE"
+	CodeSevereInteraction    = "SEVERE_INTERACTION"
+	CodeDoseLimitExceeded    = "DOSE_LIMIT_EXCEEDED"
+	CodeInvalidDoseLimit     = "INVALID_DOSE_LIMIT"
+	CodeDoseLimitNotFound    = "DOSE_LIMIT_NOT_FOUND"
+	CodeIntervalTooShort     = "INTERVAL_TOO_SHORT"
+	CodeAlertNotFound        = "ALERT_NOT_FOUND"
+	CodeNotPrnSchedule       = "NOT_PRN_SCHEDULE"
+	CodeInvalidScheduleKind  = "INVALID_SCHEDULE_KIND"
+	CodeInvalidDailyCap      = "INVALID_DAILY_CAP"
+	CodeInvalidPhases        = "INVALID_PHASES"
+	CodePhasesWithoutPills   = "PHASES_WITHOUT_PILLS"
+	CodeScheduleNotPaused    = "SCHEDULE_NOT_PAUSED"
+	CodeNoUpcomingDose       = "NO_UPCOMING_DOSE"
+	CodeInvalidResumeTime    = "INVALID_RESUME_TIME"
+	CodeInvalidReminder      = "INVALID_REMINDER"
+	CodeReminderNotFound     = "REMINDER_NOT_FOUND"
+	CodeSnoozeLimit          = "SNOOZE_LIMIT"
+	CodeDoseAlreadyDispensed = "DOSE_ALREADY_DISPENSED"
+	CodeDoseNotFound         = "DOSE_NOT_FOUND"
+	CodeDoseNotDispensed     = "DOSE_NOT_DISPENSED"
+	CodeDoseAlreadyConfirmed = "DOSE_ALREADY_CONFIRMED"
+	CodeInvalidConfirmation  = "INVALID_CONFIRMATION"
+	CodeInvalidPeriod        = "INVALID_PERIOD"
+	CodeReportNotFound       = "REPORT_NOT_FOUND"
+	CodeReportNotReady       = "REPORT_NOT_READY"
+	CodeInvalidReport        = "INVALID_REPORT"
+	CodeCalendarFeedNotFound = "CALENDAR_FEED_NOT_FOUND"
+	CodeInvalidFHIR          = "INVALID_FHIR"
+	CodeMedicationNotStocked = "MEDICATION_NOT_STOCKED"
+	CodeInvalidImport        = "INVALID_IMPORT"
+	CodeWebhookNotFound      = "WEBHOOK_NOT_FOUND"
+	CodeInvalidWebhook       = "INVALID_WEBHOOK"
+	CodeDeliveryNotFound     = "DELIVERY_NOT_FOUND"
+	CodeDeliveryNotFailed    = "DELIVERY_NOT_FAILED"
+	CodeInvalidNotification  = "INVALID_NOTIFICATION_PREFERENCE"
+)
+
+// apiError é o único formato de erro da API, enviado dentro de errorEnvelope
+type apiError struct {
+	Status  int          `json:"-"`
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []fieldError `json:"details,omitempty"`
+}
+
+// fieldError descreve um campo inválido do pedido
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code
+}
+
+func newAPIError(status int, code string) *apiError {
+	return &apiError{Status: status, Code: code}
+}
+
+// invalidFields cria um erro de validação para os campos indicados
+func invalidFields(details ...fieldError) *apiError {
+	return &apiError{Status: 400, Code: CodeValidationFailed, Details: details}
+}
+
+// modelErrors mapeia os erros dos models para o estado http e código correspondentes.
+// Todos os erros exportados por models devem constar aqui.
+var modelErrors = map[error]*apiError{
+	models.ErrDropperNotFound:               newAPIError(404, CodeDropperNotFound),
+	models.ErrDropperExists:                 newAPIError(409, CodeDropperExists),
+	models.ErrSectionNotFound:               newAPIError(404, CodeSectionNotFound),
+	models.ErrSectionExists:                 newAPIError(409, CodeSectionExists),
+	models.ErrSectionFull:                   newAPIError(409, CodeSectionFull),
+	models.ErrSectionIsFull:                 newAPIError(409, CodeSectionFull),
+	models.ErrScheduleNotFound:              newAPIError(404, CodeScheduleNotFound),
+	models.ErrScheduleExists:                newAPIError(409, CodeScheduleExists),
+	models.ErrTooManyPills:                  newAPIError(400, CodeTooManyPills),
+	models.ErrTooFewPills:                   newAPIError(400, CodeTooFewPills),
+	models.ErrNotEnoughPills:                newAPIError(409, CodeNotEnoughPills),
+	models.ErrInvalidPosition:               newAPIError(400, CodeInvalidPosition),
+	models.ErrInvalidSort:                   newAPIError(400, CodeInvalidSort),
+	models.ErrDiscrepancyNotFound:           newAPIError(404, CodeDiscrepancyNotFound),
+	models.ErrDiscrepancyResolved:           newAPIError(409, CodeDiscrepancyResolved),
+	models.ErrInvalidResolution:             newAPIError(400, CodeInvalidResolution),
+	models.ErrInvalidOccupancyData:          newAPIError(400, CodeInvalidOccupancyData),
+	models.ErrUnexpectedError:               newAPIError(500, CodeInternalError),
+	models.ErrUserExists:                    newAPIError(409, CodeUserExists),
+	models.ErrUserNotFound:                  newAPIError(404, CodeUserNotFound),
+	models.ErrInvalidEmail:                  newAPIError(400, CodeInvalidEmail),
+	models.ErrWeakPassword:                  newAPIError(400, CodeWeakPassword),
+	models.ErrInvalidCredentials:            newAPIError(401, CodeInvalidCredentials),
+	models.ErrInvalidRefreshToken:           newAPIError(401, CodeInvalidRefreshToken),
+	models.ErrInvalidRole:                   newAPIError(400, CodeInvalidRole),
+	models.ErrGrantExists:                   newAPIError(409, CodeGrantExists),
+	models.ErrGrantNotFound:                 newAPIError(404, CodeGrantNotFound),
+	models.ErrInviteNotFound:                newAPIError(404, CodeInviteNotFound),
+	models.ErrMemberNotFound:                newAPIError(404, CodeMemberNotFound),
+	models.ErrLastAdmin:                     newAPIError(409, CodeLastAdmin),
+	models.ErrPatientNotFound:               newAPIError(404, CodePatientNotFound),
+	models.ErrPatientNotLinked:              newAPIError(409, CodePatientNotLinked),
+	models.ErrInvalidTimeZone:               newAPIError(400, CodeInvalidTimeZone),
+	models.ErrSameDropper:                   newAPIError(400, CodeSameDropper),
+	models.ErrInvalidPatientData:            newAPIError(400, CodeInvalidPatientData),
+	models.ErrPrescriptionNotFound:          newAPIError(404, CodePrescriptionNotFound),
+	models.ErrInvalidPrescription:           newAPIError(400, CodeInvalidPrescription),
+	models.ErrPrescriptionInactive:          newAPIError(409, CodePrescriptionInactive),
+	models.ErrSevereInteraction:             newAPIError(409, CodeSevereInteraction),
+	models.ErrDoseLimitExceeded:             newAPIError(409, CodeDoseLimitExceeded),
+	models.ErrInvalidDoseLimit:              newAPIError(400, CodeInvalidDoseLimit),
+	models.ErrDoseLimitNotFound:             newAPIError(404, CodeDoseLimitNotFound),
+	models.ErrIntervalTooShort:              newAPIError(400, CodeIntervalTooShort),
+	models.ErrAlertNotFound:                 newAPIError(404, CodeAlertNotFound),
+	models.ErrNotPrnSchedule:                newAPIError(409, CodeNotPrnSchedule),
+	models.ErrInvalidScheduleKind:           newAPIError(400, CodeInvalidScheduleKind),
+	models.ErrInvalidDailyCap:               newAPIError(400, CodeInvalidDailyCap),
+	models.ErrInvalidPhases:                 newAPIError(400, CodeInvalidPhases),
+	models.ErrPhasesWithoutPills:            newAPIError(400, CodePhasesWithoutPills),
+	models.ErrScheduleNotPaused:             newAPIError(409, CodeScheduleNotPaused),
+	models.ErrNoUpcomingDose:                newAPIError(409, CodeNoUpcomingDose),
+	models.ErrInvalidResumeTime:             newAPIError(400, CodeInvalidResumeTime),
+	models.ErrInvalidReminder:               newAPIError(400, CodeInvalidReminder),
+	models.ErrReminderNotFound:              newAPIError(404, CodeReminderNotFound),
+	models.ErrSnoozeLimit:                   newAPIError(409, CodeSnoozeLimit),
+	models.ErrDoseAlreadyDispensed:          newAPIError(409, CodeDoseAlreadyDispensed),
+	models.ErrDoseNotFound:                  newAPIError(404, CodeDoseNotFound),
+	models.ErrDoseNotDispensed:              newAPIError(409, CodeDoseNotDispensed),
+	models.ErrDoseAlreadyConfirmed:          newAPIError(409, CodeDoseAlreadyConfirmed),
+	models.ErrInvalidConfirmation:           newAPIError(400, CodeInvalidConfirmation),
+	models.ErrInvalidPeriod:                 newAPIError(400, CodeInvalidPeriod),
+	models.ErrReportNotFound:                newAPIError(404, CodeReportNotFound),
+	models.ErrReportNotReady:                newAPIError(409, CodeReportNotReady),
+	models.ErrInvalidReport:                 newAPIError(400, CodeInvalidReport),
+	models.ErrCalendarFeedNotFound:          newAPIError(404, CodeCalendarFeedNotFound),
+	models.ErrInvalidFHIR:                   newAPIError(400, CodeInvalidFHIR),
+	models.ErrMedicationNotStocked:          newAPIError(409, CodeMedicationNotStocked),
+	models.ErrInvalidImport:                 newAPIError(400, CodeInvalidImport),
+	models.ErrWebhookNotFound:               newAPIError(404, CodeWebhookNotFound),
+	models.ErrInvalidWebhook:                newAPIError(400, CodeInvalidWebhook),
+	models.ErrDeliveryNotFound:              newAPIError(404, CodeDeliveryNotFound),
+	models.ErrDeliveryNotFailed:             newAPIError(409, CodeDeliveryNotFailed),
+	models.ErrInvalidNotificationPreference: newAPIError(400, CodeInvalidNotification),
+}
+
+// Idiomas suportados, o primeiro é o idioma por omissão
+const (
+	langPT = "pt"
+	langEN = "en"
+)
+
+var languageMatcher = language.NewMatcher([]language.Tag{language.Portuguese, language.English})
+
+// errorMessages contêm as mensagens de cada código em cada idioma suportado
+var errorMessages = map[string]map[string]string{
+	CodeInvalidRequest:       {langPT: "dados fornecidos são invalidos ou mal-formados", langEN: "the request data is invalid or malformed"},
+	CodeValidationFailed:     {langPT: "alguns campos do pedido são inválidos", langEN: "some request fields are invalid"},
+	CodeNotFound:             {langPT: "recurso não encontrado", langEN: "resource not found"},
+	CodeInternalError:        {langPT: "erro interno, tente novamente mais tarde", langEN: "internal error, try again later"},
+	CodeDropperNotFound:      {langPT: "o dropper não foi encontrado", langEN: "the dropper was not found"},
+	CodeDropperExists:        {langPT: "este dropper já existe", langEN: "this dropper already exists"},
+	CodeSectionNotFound:      {langPT: "secção não encontrada", langEN: "section not found"},
+	CodeSectionExists:        {langPT: "esta secção e/ou os seus comprimidos já foram definidos", langEN: "this section or its pills are already defined"},
+	CodeSectionFull:          {langPT: "secção cheia", langEN: "the section is full"},
+	CodeScheduleNotFound:     {langPT: "horário não encontrado", langEN: "schedule not found"},
+	CodeScheduleExists:       {langPT: "já existe um horário com este nome", langEN: "a schedule with this name already exists"},
+	CodeTooManyPills:         {langPT: "demasiados comprimidos fornecidos", langEN: "too many pills provided"},
+	CodeTooFewPills:          {langPT: "poucos comprimidos fornecidos", langEN: "too few pills provided"},
+	CodeNotEnoughPills:       {langPT: "comprimidos insuficientes no dropper", langEN: "the dropper does not hold enough pills"},
+	CodeInvalidPosition:      {langPT: "posição de secção fora do intervalo permitido", langEN: "section position out of the allowed range"},
+	CodeInvalidSort:          {langPT: "campo de ordenação inválido", langEN: "invalid sort field"},
+	CodeDiscrepancyNotFound:  {langPT: "discrepância não encontrada", langEN: "discrepancy not found"},
+	CodeDiscrepancyResolved:  {langPT: "discrepância já resolvida", langEN: "discrepancy already resolved"},
+	CodeInvalidResolution:    {langPT: "resolução inválida, esperado 'device' ou 'database'", langEN: "invalid resolution, expected 'device' or 'database'"},
+	CodeInvalidOccupancyData: {langPT: "relatório de ocupação inválido", langEN: "invalid occupancy report"},
+	CodeUnauthorized:         {langPT: "autenticação necessária", langEN: "authentication required"},
+	CodeUserExists:           {langPT: "já existe um utilizador com este email", langEN: "a user with this email already exists"},
+	CodeUserNotFound:         {langPT: "utilizador não encontrado", langEN: "user not found"},
+	CodeInvalidEmail:         {langPT: "email inválido", langEN: "invalid email"},
+	CodeWeakPassword:         {langPT: "a password tem de ter entre 8 e 72 caracteres", langEN: "the password must have between 8 and 72 characters"},
+	CodeInvalidCredentials:   {langPT: "email ou password incorretos", langEN: "wrong email or password"},
+	CodeInvalidRefreshToken:  {langPT: "refresh token inválido ou expirado", langEN: "invalid or expired refresh token"},
+	CodeForbidden:            {langPT: "não tem permissão para esta ação", langEN: "you are not allowed to perform this action"},
+	CodeInvalidRole:          {langPT: "papel inválido", langEN: "invalid role"},
+	CodeGrantExists:          {langPT: "o utilizador já tem acesso a este dropper", langEN: "the user already has access to this dropper"},
+	CodeGrantNotFound:        {langPT: "o utilizador não tem acesso a este dropper", langEN: "the user has no access to this dropper"},
+	CodeInviteNotFound:       {langPT: "convite inválido ou expirado", langEN: "invalid or expired invite"},
+	CodeMemberNotFound:       {langPT: "o utilizador não pertence a este tenant", langEN: "the user does not belong to this tenant"},
+	CodeLastAdmin:            {langPT: "o tenant tem de ter pelo menos um administrador", langEN: "the tenant must keep at least one administrator"},
+	CodePatientNotFound:      {langPT: "paciente não encontrado", langEN: "patient not found"},
+	CodePatientNotLinked:     {langPT: "o paciente não está associado a este dropper", langEN: "the patient is not linked to this dropper"},
+	CodeInvalidTimeZone:      {langPT: "fuso horário inválido, esperado um nome IANA como Europe/Lisbon", langEN: "invalid time zone, expected an IANA name such as Europe/Lisbon"},
+	CodeSameDropper:          {langPT: "o dropper de substituição tem de ser diferente do atual", langEN: "the replacement dropper must differ from the current one"},
+	CodeInvalidPatientData:   {langPT: "dados do paciente inválidos", langEN: "invalid patient data"},
+	CodePrescriptionNotFound: {langPT: "receita não encontrada", langEN: "prescription not found"},
+	CodeInvalidPrescription:  {langPT: "dados da receita inválidos", langEN: "invalid prescription data"},
+	CodePrescriptionInactive: {langPT: "a receita foi cancelada ou já terminou", langEN: "the prescription was cancelled or has ended"},
+	CodeSevereInteraction:    {langPT: "o horário tem interações graves, é necessário um motivo para o criar", langEN: "the schedule has severe interactions, a reason is required to create it"},
+	CodeDoseLimitExceeded:    {langPT: "a dose máxima do medicamento seria ultrapassada", langEN: "the medication's maximum dose would be exceeded"},
+	CodeInvalidDoseLimit:     {langPT: "limite de dose inválido", langEN: "invalid dose limit"},
+	CodeDoseLimitNotFound:    {langPT: "limite de dose não encontrado", langEN: "dose limit not found"},
+	CodeIntervalTooShort:     {langPT: "o intervalo entre tomas é inferior ao mínimo permitido", langEN: "the interval between doses is below the allowed minimum"},
+	CodeAlertNotFound:        {langPT: "alerta não encontrado", langEN: "alert not found"},
+	CodeNotPrnSchedule:       {langPT: "o horário não é de toma em SOS", langEN: "the schedule is not an as-needed schedule"},
+	CodeInvalidScheduleKind:  {langPT: "tipo de horário inválido", langEN: "invalid schedule kind"},
+	CodeInvalidDailyCap:      {langPT: "o limite diário de tomas só se aplica a horários em SOS", langEN: "the daily dose cap only applies to as-needed schedules"},
+	CodeInvalidPhases:        {langPT: "as fases do horário têm de ser contíguas e cobrir todo o horário", langEN: "the schedule phases must be contiguous and cover the whole schedule"},
+	CodePhasesWithoutPills:   {langPT: "um horário sem fases precisa de comprimidos", langEN: "a schedule without phases needs pills"},
+	CodeScheduleNotPaused:    {langPT: "o horário não está em pausa", langEN: "the schedule is not paused"},
+	CodeNoUpcomingDose:       {langPT: "o horário não tem mais tomas previstas", langEN: "the schedule has no upcoming doses"},
+	CodeInvalidResumeTime:    {langPT: "a hora de retoma tem de ser futura", langEN: "the resume time must be in the future"},
+	CodeInvalidReminder:      {langPT: "configuração de lembretes inválida", langEN: "invalid reminder settings"},
+	CodeReminderNotFound:     {langPT: "lembrete não encontrado", langEN: "reminder not found"},
+	CodeSnoozeLimit:          {langPT: "a toma já foi adiada o número máximo de vezes", langEN: "the dose was already snoozed the maximum number of times"},
+	CodeDoseAlreadyDispensed: {langPT: "a toma já foi dispensada", langEN: "the dose was already dispensed"},
+	CodeDoseNotFound:         {langPT: "toma não encontrada", langEN: "dose not found"},
+	CodeDoseNotDispensed:     {langPT: "a toma não foi dispensada", langEN: "the dose was not dispensed"},
+	CodeDoseAlreadyConfirmed: {langPT: "a toma já foi confirmada", langEN: "the dose was already confirmed"},
+	CodeInvalidConfirmation:  {langPT: "a hora da toma tem de ser entre a dispensa e agora", langEN: "the time taken must be between the dispense and now"},
+	CodeInvalidPeriod:        {langPT: "período de adesão inválido, o intervalo máximo é de um ano", langEN: "invalid adherence period, the maximum range is one year"},
+	CodeReportNotFound:       {langPT: "relatório não encontrado", langEN: "report not found"},
+	CodeReportNotReady:       {langPT: "o relatório ainda não está pronto", langEN: "the report is not ready yet"},
+	CodeInvalidReport:        {langPT: "o relatório tem de ser de um paciente ou de um dropper", langEN: "the report must be for either a patient or a dropper"},
+	CodeCalendarFeedNotFound: {langPT: "calendário não encontrado ou revogado", langEN: "calendar not found or revoked"},
+	CodeInvalidFHIR:          {langPT: "recurso FHIR inválido ou não suportado", langEN: "invalid or unsupported FHIR resource"},
+	CodeMedicationNotStocked: {langPT: "o medicamento não está carregado no dropper", langEN: "the medication is not loaded in the dropper"},
+	CodeInvalidImport:        {langPT: "ficheiro de importação inválido, nada foi importado", langEN: "invalid import file, nothing was imported"},
+	CodeWebhookNotFound:      {langPT: "webhook não encontrado", langEN: "webhook not found"},
+	CodeInvalidWebhook:       {langPT: "o endereço tem de ser http(s) e público e os eventos conhecidos", langEN: "the url must be public http(s) and the events known"},
+	CodeDeliveryNotFound:     {langPT: "entrega não encontrada", langEN: "delivery not found"},
+	CodeDeliveryNotFailed:    {langPT: "só as entregas falhadas podem ser repetidas", langEN: "only failed deliveries can be replayed"},
+	CodeInvalidNotification:  {langPT: "preferências de notificação inválidas: os canais sms e push precisam do telefone e do token, as horas de silêncio são HH:MM", langEN: "invalid notification preferences: the sms and push channels need the phone and token, quiet hours are HH:MM"},
+}
+
+// fieldMessages contêm as mensagens das validações de campos, pela tag do validator
+var fieldMessages = map[string]map[string]string{
+	"required":     {langPT: "campo obrigatório", langEN: "field is required"},
+	"invalid_type": {langPT: "tipo de valor inválido", langEN: "invalid value type"},
+	"invalid":      {langPT: "valor inválido", langEN: "invalid value"},
+	"positive":     {langPT: "o valor tem de ser positivo", langEN: "value must be positive"},
+	"after_start":  {langPT: "tem de ser posterior à data de início", langEN: "must be later than the start date"},
+	"min":          {langPT: "valor abaixo do mínimo permitido", langEN: "value below the allowed minimum"},
+	"interaction":  {langPT: "interage gravemente com outro medicamento do paciente", langEN: "severely interacts with another of the patient's medications"},
+	"limit_single": {langPT: "ultrapassa o máximo por toma", langEN: "exceeds the maximum per dose"},
+	"limit_daily":  {langPT: "ultrapassa o máximo diário", langEN: "exceeds the daily maximum"},
+	"limit_weekly": {langPT: "ultrapassa o máximo semanal", langEN: "exceeds the weekly maximum"},
+	"allergy":      {langPT: "o paciente é alérgico a este medicamento", langEN: "the patient is allergic to this medication"},
+	"contiguous":   {langPT: "tem de coincidir com o fim da fase anterior ou o início do horário", langEN: "must match the end of the previous phase or the schedule start"},
+	"span":         {langPT: "a última fase tem de terminar no fim do horário", langEN: "the last phase must end at the schedule end"},
+	"unsupported":  {langPT: "valor não suportado", langEN: "unsupported value"},
+	"not_found":    {langPT: "não encontrado", langEN: "not found"},
+	"not_stocked":  {langPT: "não está carregado no dropper para uma toma", langEN: "not loaded in the dropper for a single dose"},
+	"duplicate":    {langPT: "valor repetido", langEN: "duplicated value"},
+}
+
+// requestLanguage escolhe o idioma da resposta a partir do cabeçalho Accept-Language
+func requestLanguage(c *gin.Context) string {
+	tags, _, err := language.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	if err != nil || len(tags) == 0 {
+		return langPT
+	}
+
+	_, index, _ := languageMatcher.Match(tags...)
+	if index == 1 {
+		return langEN
+	}
+	return langPT
+}
+
+func localize(table map[string]map[string]string, key, lang string) string {
+	messages, ok := table[key]
+	if !ok {
+		return key
+	}
+	return messages[lang]
+}
+
+// localizeDetail devolve a mensagem do código de um campo. Os detalhes que indicam um erro da API,
+// ex: nas linhas de uma importação, usam a mensagem desse erro.
+func localizeDetail(code, lang string) string {
+	if _, ok := fieldMessages[code]; !ok {
+		if _, ok := errorMessages[code]; ok {
+			return localize(errorMessages, code, lang)
+		}
+	}
+	return localize(fieldMessages, code, lang)
+}
+
+// apiErrorFor traduz um erro dos models no apiError correspondente, nil se o erro não for conhecido
+func apiErrorFor(err error) *apiError {
+	var api_err *apiError
+	var interaction_err *models.InteractionError
+	var limit_err *models.DoseLimitError
+	var phase_err *models.PhaseError
+	var entry_err *models.FHIREntryError
+
+	if errors.As(err, &entry_err) {
+		// Os detalhes do erro da entrada passam a indicar a entrada do Bundle
+		if mapped := apiErrorFor(entry_err.Err); mapped != nil {
+			copied := *mapped
+			api_err = &copied
+			api_err.Details = make([]fieldError, 0, len(mapped.Details)+1)
+			if entry_err.Field != "" {
+				api_err.Details = append(api_err.Details, fieldError{Field: fmt.Sprintf("entry.%d.%s", entry_err.Index, entry_err.Field), Code: entry_err.Code})
+			}
+			for _, detail := range mapped.Details {
+				detail.Field = fmt.Sprintf("entry.%d.%s", entry_err.Index, detail.Field)
+				api_err.Details = append(api_err.Details, detail)
+			}
+			if len(api_err.Details) == 0 {
+				api_err.Details = []fieldError{{Field: fmt.Sprintf("entry.%d", entry_err.Index), Code: "invalid"}}
+			}
+		}
+	} else if errors.As(err, &interaction_err) {
+		api_err = interactionAPIError(interaction_err)
+	} else if errors.As(err, &limit_err) {
+		api_err = newAPIError(409, CodeDoseLimitExceeded)
+		api_err.Details = []fieldError{{Field: "pills." + limit_err.Medication, Code: "limit_" + limit_err.Period}}
+	} else if errors.As(err, &phase_err) {
+		api_err = newAPIError(400, CodeInvalidPhases)
+		api_err.Details = []fieldError{{Field: fmt.Sprintf("phases.%d.%s", phase_err.Index, phase_err.Field), Code: phase_err.Code}}
+	} else if !errors.As(err, &api_err) {
+		for model_err, mapped := range modelErrors {
+			if errors.Is(err, model_err) {
+				api_err = mapped
+				break
+			}
+		}
+	}
+	return api_err
+}
+
+// respondError envia o erro no formato padrão, traduzindo erros dos models e localizando as mensagens
+func respondError(c *gin.Context, err error) {
+	api_err := apiErrorFor(err)
+	if api_err == nil {
+		log.Printf("Erro interno: %s\n", err.Error())
+		api_err = newAPIError(500, CodeInternalError)
+	}
+
+	lang := requestLanguage(c)
+	response := *api_err
+	response.Message = localize(errorMessages, api_err.Code, lang)
+	response.Details = make([]fieldError, len(api_err.Details))
+	for i, detail := range api_err.Details {
+		detail.Message = localizeDetail(detail.Code, lang)
+		response.Details[i] = detail
+	}
+
+	c.AbortWithStatusJSON(response.Status, errorEnvelope{Error: response})
+}
+
+// respondBindError responde a um pedido que falhou o bind, com o detalhe dos campos inválidos
+func respondBindError(c *gin.Context, err error) {
+	log.Printf("Pedido inválido em %s: %s \n", c.FullPath(), err.Error())
+
+	var validation validator.ValidationErrors
+	var type_err *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &validation):
+		api_err := newAPIError(400, CodeValidationFailed)
+		for _, field := range validation {
+			code := field.Tag()
+			if _, known := fieldMessages[code]; !known {
+				code = "invalid"
+			}
+			api_err.Details = append(api_err.Details, fieldError{Field: field.Field(), Code: code})
+		}
+		respondError(c, api_err)
+	case errors.As(err, &type_err):
+		api_err := newAPIError(400, CodeValidationFailed)
+		api_err.Details = []fieldError{{Field: type_err.Field, Code: "invalid_type"}}
+		respondError(c, api_err)
+	default:
+		respondError(c, newAPIError(400, CodeInvalidRequest))
+	}
+}
+
+// useFieldTagNames faz o validator reportar os campos pelo nome json/form em vez do nome Go
+func useFieldTagNames() {
+	validate, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{"json", "form"} {
+			name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+			if name != "" && name != "-" {
+				return name
+			}
+		}
+		return field.Name
+	})
+}
@@ -0,0 +1,119 @@
+package http_api
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+func TestAllModelErrorsAreMapped(t *testing.T) {
+	packages, err := parser.ParseDir(token.NewFileSet(), "../models", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+
+	mapped := make(map[string]bool, len(modelErrors))
+	for model_err := range modelErrors {
+		mapped[model_err.Error()] = true
+	}
+
+	for _, file := range packages["models"].Files {
+		for name, object := range file.Scope.Objects {
+			if object.Kind != ast.Var || !strings.HasPrefix(name, "Err") {
+				continue
+			}
+			value := object.Decl.(*ast.ValueSpec).Values[0].(*ast.CallExpr).Args[0].(*ast.BasicLit).Value
+			if !mapped[strings.Trim(value, `"`)] {
+				t.Errorf("models.%s is not mapped in modelErrors", name)
+			}
+		}
+	}
+}
+
+func TestErrorEnvelopeIsLocalized(t *testing.T) {
+	r := gin.New()
+	r.GET("/", func(ctx *gin.Context) { respondError(ctx, models.ErrSectionFull) })
+
+	for lang, message := range map[string]string{
+		"en-GB,en;q=0.9": "the section is full",
+		"pt-PT":          "secção cheia",
+		"":               "secção cheia",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", lang)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		var envelope errorEnvelope
+		if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("Error: %s", err.Error())
+		}
+		if resp.Code != 409 || envelope.Error.Code != CodeSectionFull || envelope.Error.Message != message {
+			t.Fatalf("Unexpected error for <%s>: %d %+v", lang, resp.Code, envelope.Error)
+		}
+	}
+}
+
+func TestValidationErrorDetails(t *testing.T) {
+	useFieldTagNames()
+
+	r := gin.New()
+	r.POST("/", func(ctx *gin.Context) {
+		var body reloadSectionBody
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			respondBindError(ctx, err)
+		}
+	})
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"pill_quantity": 2}`))
+	req.Header.Set("Accept-Language", "en")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	var envelope errorEnvelope
+	if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if envelope.Error.Code != CodeValidationFailed || len(envelope.Error.Details) != 1 {
+		t.Fatalf("Unexpected error: %+v", envelope.Error)
+	}
+	if detail := envelope.Error.Details[0]; detail.Field != "pill_name" || detail.Code != "required" {
+		t.Fatalf("Unexpected detail: %+v", detail)
+	}
+}
+
+func TestFHIREntryErrorDetails(t *testing.T) {
+	r := gin.New()
+	r.GET("/", func(ctx *gin.Context) {
+		respondError(ctx, &models.FHIREntryError{Index: 2, Field: "medicationCodeableConcept", Code: "not_stocked", Err: models.ErrMedicationNotStocked})
+	})
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+	var envelope errorEnvelope
+	if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if resp.Code != 409 || envelope.Error.Code != CodeMedicationNotStocked || len(envelope.Error.Details) != 1 {
+		t.Fatalf("Unexpected error: %d %+v", resp.Code, envelope.Error)
+	}
+	if detail := envelope.Error.Details[0]; detail.Field != "entry.2.medicationCodeableConcept" || detail.Code != "not_stocked" {
+		t.Fatalf("Unexpected detail: %+v", detail)
+	}
+	// O erro mapeado não é alterado
+	if len(modelErrors[models.ErrMedicationNotStocked].Details) != 0 {
+		t.Fatal("The shared model error should keep no details")
+	}
+}
@@ -0,0 +1,281 @@
+package http_api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/events"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// eventsKeepAlive é o intervalo das mensagens que mantêm a ligação aberta através de proxies
+const eventsKeepAlive = 25 * time.Second
+
+// eventsRecheck é o intervalo a que o utilizador e o seu acesso aos droppers são verificados de
+// novo, para que um acesso retirado deixe de receber eventos sem esperar pelo fim da ligação
+const eventsRecheck = time.Minute
+
+// eventReset é enviado quando a ligação não pode ser retomada, o cliente tem de voltar a carregar o estado
+const eventReset = "reset"
+
+// eventsQuery filtra os eventos enviados. Sem filtros são enviados todos os eventos dos droppers
+// acessíveis ao utilizador.
+type eventsQuery struct {
+	Dropper uuid.UUID `form:"dropper"`
+	// Tipos separados por vírgulas, ex: dispense,alert
+	Types string `form:"types"`
+	// Cursor do último evento recebido, alternativa ao cabeçalho Last-Event-ID para as ligações WebSocket
+	LastEventID string `form:"last_event_id"`
+}
+
+// eventFilter decide que eventos são enviados ao utilizador. O acesso a cada dropper é verificado
+// no primeiro evento do dropper e guardado até à verificação seguinte, ver recheck.
+type eventFilter struct {
+	db      *gorm.DB
+	actor   models.Actor
+	dropper string
+	types   map[string]bool
+	access  map[uint]bool
+}
+
+func (f *eventFilter) allows(event events.Event) bool {
+	if len(f.types) > 0 && !f.types[event.Type] {
+		return false
+	}
+	if f.dropper != "" && event.Dropper != f.dropper {
+		return false
+	}
+	if event.DropperID == 0 {
+		return event.TenantID == f.actor.TenantID
+	}
+
+	allowed, known := f.access[event.DropperID]
+	if !known {
+		if dropper, err := models.FindDropper(f.db, f.actor, event.DropperID); err == nil {
+			allowed, _ = f.actor.Can(f.db, dropper, models.PermViewDropper)
+		}
+		f.access[event.DropperID] = allowed
+	}
+	return allowed
+}
+
+// recheck esquece os acessos guardados e volta a ler o tenant e o papel do utilizador. Devolve
+// false se o utilizador já não existir e a ligação tiver de ser fechada.
+func (f *eventFilter) recheck() bool {
+	user, err := models.FindUser(f.db, f.actor.UserID)
+	if errors.Is(err, models.ErrUserNotFound) {
+		return false
+	} else if err == nil {
+		f.actor = models.Actor{UserID: user.ID, TenantID: user.TenantID, Role: user.Role}
+	}
+	clear(f.access)
+	return true
+}
+
+// eventsResume é o ponto de retoma da ligação, o evento reset e os eventos perdidos
+type eventsResume struct {
+	reset  *events.Event
+	missed []events.Event
+}
+
+// subscribeEvents valida o pedido e subscreve os eventos a partir do último recebido pelo cliente
+func subscribeEvents(c *gin.Context, db *gorm.DB) (*events.Subscription, *eventFilter, *eventsResume, bool) {
+	var query eventsQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return nil, nil, nil, false
+	}
+	if header := c.GetHeader("Last-Event-ID"); header != "" {
+		query.LastEventID = header
+	}
+
+	filter := &eventFilter{db: db, actor: currentActor(c), types: make(map[string]bool), access: make(map[uint]bool)}
+	if query.Dropper != uuid.Nil {
+		dropper, err := authorizedDropper(c, db, query.Dropper)
+		if err != nil {
+			respondError(c, err)
+			return nil, nil, nil, false
+		}
+		filter.dropper = dropper.SerialID.String()
+		filter.access[dropper.ID] = true
+	}
+	for _, kind := range strings.Split(query.Types, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			filter.types[kind] = true
+		}
+	}
+
+	sub, missed, complete := models.Events.Resume(query.LastEventID)
+	resume := &eventsResume{missed: missed}
+	if !complete {
+		// Os eventos guardados são enviados depois do reset, a partir do id indicado
+		reset := events.Event{Type: eventReset, Time: time.Now().UTC()}
+		if len(missed) > 0 {
+			reset.ID = missed[0].ID - 1
+		}
+		reset.Cursor = models.Events.Cursor(reset.ID)
+		resume.reset = &reset
+	}
+	return sub, filter, resume, true
+}
+
+// writeSSE escreve o evento no formato Server-Sent Events
+func writeSSE(w io.Writer, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Cursor, event.Type, data)
+	return err
+}
+
+// eventsSSE envia os eventos em tempo real como Server-Sent Events. O EventSource dos browsers
+// retoma a ligação com o cabeçalho Last-Event-ID. A ligação é fechada quando o access token
+// expira, o cliente volta a ligar-se com um token novo.
+func eventsSSE(c *gin.Context, db *gorm.DB) {
+	sub, filter, resume, ok := subscribeEvents(c, db)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	if resume.reset != nil {
+		if writeSSE(c.Writer, *resume.reset) != nil {
+			return
+		}
+	}
+	for _, event := range resume.missed {
+		if filter.allows(event) && writeSSE(c.Writer, event) != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	recheck := time.NewTicker(eventsRecheck)
+	defer recheck.Stop()
+	expired := tokenExpired(c)
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-expired:
+			return
+		case <-recheck.C:
+			if !filter.recheck() {
+				return
+			}
+			continue
+		case event, open := <-sub.Events():
+			if !open {
+				return
+			}
+			if !filter.allows(event) {
+				continue
+			}
+			if writeSSE(c.Writer, event) != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// eventsUpgrader aceita todas as origens, a autenticação usa o access token e não cookies
+var eventsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// eventsWebSocket envia os eventos em tempo real numa ligação WebSocket, uma mensagem JSON por
+// evento. Para retomar a ligação o cliente indica last_event_id. A ligação é fechada quando o
+// access token expira.
+func eventsWebSocket(c *gin.Context, db *gorm.DB) {
+	sub, filter, resume, ok := subscribeEvents(c, db)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	conn, err := eventsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// O upgrader já respondeu ao pedido
+		return
+	}
+	defer conn.Close()
+
+	// As mensagens do cliente são ignoradas, a leitura só deteta o fecho da ligação
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if resume.reset != nil {
+		if conn.WriteJSON(resume.reset) != nil {
+			return
+		}
+	}
+	for _, event := range resume.missed {
+		if filter.allows(event) && conn.WriteJSON(event) != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	recheck := time.NewTicker(eventsRecheck)
+	defer recheck.Stop()
+	expired := tokenExpired(c)
+	for {
+		select {
+		case <-closed:
+			return
+		case <-expired:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired"))
+			return
+		case <-recheck.C:
+			if !filter.recheck() {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"))
+				return
+			}
+		case event, open := <-sub.Events():
+			if !open {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if filter.allows(event) && conn.WriteJSON(event) != nil {
+				return
+			}
+		case <-ticker.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsKeepAlive)) != nil {
+				return
+			}
+		}
+	}
+}
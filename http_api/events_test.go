@@ -0,0 +1,123 @@
+package http_api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomascpMarques/dropmedical/events"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// readSSE lê o próximo evento do stream, ignorando os comentários
+func readSSE(t *testing.T, reader *bufio.Reader) (kind string, event events.Event) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading the stream: %s", err.Error())
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			kind = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatal(err)
+			}
+		case line == "" && kind != "":
+			return kind, event
+		}
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	r := gin.New()
+	r.GET("/api/v1/events", func(ctx *gin.Context) {
+		ctx.Set(actorKey, models.Actor{UserID: 1, TenantID: 1, Role: models.RoleCaregiver})
+		eventsSSE(ctx, nil)
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	connect := func(lastEventID string) (*bufio.Reader, context.CancelFunc) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/events?types=alert", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Unexpected content type %s", resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body), cancel
+	}
+
+	reader, cancel := connect("")
+	// Os eventos de outros tenants e de outros tipos não são enviados
+	models.Events.Publish(events.Event{Type: models.EventAlert, TenantID: 2, Data: "other tenant"})
+	models.Events.Publish(events.Event{Type: models.EventInventory, TenantID: 1})
+	first := models.Events.Publish(events.Event{Type: models.EventAlert, TenantID: 1, Data: "first"})
+	second := models.Events.Publish(events.Event{Type: models.EventAlert, TenantID: 1, Data: "second"})
+
+	if kind, event := readSSE(t, reader); kind != models.EventAlert || event.ID != first.ID || event.Data != "first" {
+		t.Fatalf("Unexpected event %s %+v", kind, event)
+	}
+	cancel()
+
+	// A ligação é retomada a partir do último evento recebido
+	reader, cancel = connect(first.Cursor)
+	defer cancel()
+	if kind, event := readSSE(t, reader); kind != models.EventAlert || event.ID != second.ID {
+		t.Fatalf("Expected to resume at %d, got %s %+v", second.ID, kind, event)
+	}
+
+	reader, cancel = connect(models.Events.Cursor(second.ID + 100))
+	defer cancel()
+	if kind, _ := readSSE(t, reader); kind != eventReset {
+		t.Fatalf("Unknown ids should reset the client, got %s", kind)
+	}
+
+	// O mesmo id de um arranque anterior do servidor também
+	reader, cancel = connect(fmt.Sprintf("1-%d", first.ID))
+	defer cancel()
+	if kind, _ := readSSE(t, reader); kind != eventReset {
+		t.Fatalf("Ids of another boot should reset the client, got %s", kind)
+	}
+}
+
+func TestEventsSSEClosesWhenTokenExpires(t *testing.T) {
+	r := gin.New()
+	r.GET("/api/v1/events", func(ctx *gin.Context) {
+		ctx.Set(actorKey, models.Actor{UserID: 1, TenantID: 1, Role: models.RoleCaregiver})
+		ctx.Set(tokenExpiresKey, time.Now().Add(200*time.Millisecond))
+		eventsSSE(ctx, nil)
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// O servidor fecha o stream quando o token expira, antes do timeout do cliente
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("Expected the stream to end when the token expires: %s", err.Error())
+	}
+}
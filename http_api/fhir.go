@@ -0,0 +1,110 @@
+package http_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/fhir"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// fhirSearchQuery limita as tomas às previstas entre from e to, por omissão os últimos 30 dias
+type fhirSearchQuery struct {
+	From time.Time `form:"from"`
+	To   time.Time `form:"to"`
+}
+
+// fhirImportQuery indica o dropper onde são criados os horários das receitas importadas
+type fhirImportQuery struct {
+	Dropper uuid.UUID `form:"dropper" binding:"required"`
+}
+
+// respondFHIR envia o recurso com o content-type FHIR
+func respondFHIR(c *gin.Context, status int, resource any) {
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Data(status, fhir.ContentType, raw)
+}
+
+// patientMedicationRequestsFHIR devolve as receitas e os horários sem receita do paciente
+func patientMedicationRequestsFHIR(c *gin.Context, db *gorm.DB) {
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	bundle, err := patient.FHIRMedicationRequests(db)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondFHIR(c, 200, bundle)
+}
+
+// patientDosesFHIR devolve as tomas, ou as confirmações, do paciente no período pedido
+func patientDosesFHIR(c *gin.Context, db *gorm.DB, search func(*models.Patient, *gorm.DB, models.AdherenceQuery) (*fhir.Bundle, error)) {
+	var query fhirSearchQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	bundle, err := search(patient, db, models.AdherenceQuery{From: query.From, To: query.To})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondFHIR(c, 200, bundle)
+}
+
+// importFHIRBundleV1 cria as receitas de um Bundle transaction de MedicationRequest. A resposta
+// é um Bundle transaction-response com a localização de cada receita criada.
+func importFHIRBundleV1(c *gin.Context, db *gorm.DB) {
+	var query fhirImportQuery
+	var bundle fhir.Bundle
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if err := c.ShouldBindJSON(&bundle); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, err := authorizedDropper(c, db, query.Dropper)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	prescriptions, err := models.ImportMedicationRequests(db, currentTenantID(c), dropper, &bundle)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	response := fhir.NewBundle(fhir.BundleTransactionResponse, now)
+	for i := range prescriptions {
+		patient := models.Patient{ID: prescriptions[i].PatientID}
+		request := prescriptions[i].MedicationRequest(&patient, now)
+		location := fmt.Sprintf("%s/%s/_history/%s", fhir.TypeMedicationRequest, request.ID, request.Meta.VersionID)
+		response.Add(request, &fhir.BundleResponse{Status: "201 Created", Location: location})
+	}
+	respondFHIR(c, 200, response)
+}
@@ -0,0 +1,116 @@
+package http_api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// maxImportSize é o tamanho máximo do ficheiro de importação
+const maxImportSize = 4 << 20
+
+// importQuery escolhe o modo e o formato da importação. Sem format o formato vem do Content-Type.
+type importQuery struct {
+	DryRun bool   `form:"dry_run"`
+	Format string `form:"format" binding:"omitempty,oneof=csv json"`
+}
+
+type importResponse struct {
+	DryRun  bool `json:"dry_run"`
+	Applied bool `json:"applied"`
+	Rows    int  `json:"rows"`
+	// Registos criados, ou validados em dry_run, por tipo de linha
+	Created map[string]int `json:"created"`
+	// Erros de cada linha, só nas respostas de dry_run
+	Errors []fieldError `json:"errors"`
+}
+
+// importFormat devolve o formato do corpo pelo Content-Type
+func importFormat(c *gin.Context) string {
+	media, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch media {
+	case "text/csv":
+		return models.ImportCSV
+	case "application/json":
+		return models.ImportJSON
+	}
+	return ""
+}
+
+// importErrorDetails converte os erros das linhas em detalhes `rows.<linha>.<campo>`. Os erros
+// dos models sem código de campo usam o código de erro da API, ex: SECTION_FULL.
+func importErrorDetails(errs []models.ImportError) []fieldError {
+	details := make([]fieldError, 0, len(errs))
+	for _, row_err := range errs {
+		field := fmt.Sprintf("rows.%d", row_err.Row)
+		if row_err.Field != "" {
+			field += "." + row_err.Field
+		}
+
+		code := row_err.Code
+		if code == "" {
+			code = CodeInternalError
+			if mapped := apiErrorFor(row_err.Err); mapped != nil {
+				code = mapped.Code
+			}
+		}
+		details = append(details, fieldError{Field: field, Code: code})
+	}
+	return details
+}
+
+// importV1 importa droppers, secções, carregamentos e horários de um ficheiro CSV ou JSON.
+// Em dry_run as linhas são só validadas e os erros devolvidos na resposta; sem dry_run nada é
+// guardado se alguma linha falhar.
+func importV1(c *gin.Context, db *gorm.DB) {
+	var query importQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if query.Format == "" {
+		query.Format = importFormat(c)
+	}
+	if query.Format == "" {
+		respondError(c, invalidFields(fieldError{Field: "format", Code: "required"}))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	result, err := models.Import(db, currentTenantID(c), body, query.Format, query.DryRun)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	details := importErrorDetails(result.Errors)
+	if !query.DryRun && len(details) > 0 {
+		api_err := newAPIError(400, CodeInvalidImport)
+		api_err.Details = details
+		respondError(c, api_err)
+		return
+	}
+
+	lang := requestLanguage(c)
+	for i := range details {
+		details[i].Message = localizeDetail(details[i].Code, lang)
+	}
+
+	status := 201
+	if query.DryRun {
+		status = 200
+	}
+	c.JSON(status, importResponse{
+		DryRun:  result.DryRun,
+		Applied: result.Applied,
+		Rows:    result.Rows,
+		Created: result.Created,
+		Errors:  details,
+	})
+}
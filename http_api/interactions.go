@@ -0,0 +1,25 @@
+package http_api
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// overrideFrom autoriza, em nome do utilizador autenticado, um horário com interações graves.
+// Sem motivo não há autorização.
+func overrideFrom(c *gin.Context, reason string) *models.Override {
+	if reason == "" {
+		return nil
+	}
+	return &models.Override{Reason: reason, UserID: currentUserID(c)}
+}
+
+// interactionAPIError descreve cada interação grave nos detalhes do erro, pelo medicamento afetado
+func interactionAPIError(err *models.InteractionError) *apiError {
+	api_err := newAPIError(409, CodeSevereInteraction)
+	for _, warning := range err.Warnings {
+		api_err.Details = append(api_err.Details, fieldError{Field: "pills." + warning.Medication, Code: warning.Kind})
+	}
+	return api_err
+}
@@ -0,0 +1,178 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type doseLimitResponse struct {
+	ID uint `json:"id"`
+	// Sem paciente o limite é do catálogo do tenant
+	PatientID  *uint     `json:"patient_id"`
+	Medication string    `json:"medication"`
+	MaxSingle  uint      `json:"max_single"`
+	MaxDaily   uint      `json:"max_daily"`
+	MaxWeekly  uint      `json:"max_weekly"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newDoseLimitResponse(l *models.DoseLimit) doseLimitResponse {
+	return doseLimitResponse{
+		ID:         l.ID,
+		PatientID:  l.PatientID,
+		Medication: l.Medication,
+		MaxSingle:  l.MaxSingle,
+		MaxDaily:   l.MaxDaily,
+		MaxWeekly:  l.MaxWeekly,
+		UpdatedAt:  l.UpdatedAt,
+	}
+}
+
+// doseLimitBody substitui o limite do medicamento, no catálogo ou do paciente indicado
+type doseLimitBody struct {
+	PatientID  *uint  `json:"patient_id"`
+	Medication string `json:"medication" binding:"required"`
+	// Máximos em comprimidos, 0 não limita
+	MaxSingle uint `json:"max_single"`
+	MaxDaily  uint `json:"max_daily"`
+	MaxWeekly uint `json:"max_weekly"`
+}
+
+func listDoseLimitsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	limits, total, err := models.ListDoseLimits(db, currentTenantID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[doseLimitResponse]{
+		Data:    make([]doseLimitResponse, len(limits)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range limits {
+		page.Data[i] = newDoseLimitResponse(&limits[i])
+	}
+	c.JSON(200, page)
+}
+
+func setDoseLimitV1(c *gin.Context, db *gorm.DB) {
+	var body doseLimitBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	limit, created, err := models.SetDoseLimit(db, currentTenantID(c), models.DoseLimitFields{
+		PatientID:  body.PatientID,
+		Medication: body.Medication,
+		MaxSingle:  body.MaxSingle,
+		MaxDaily:   body.MaxDaily,
+		MaxWeekly:  body.MaxWeekly,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	status := 200
+	if created {
+		status = 201
+	}
+	c.JSON(status, newDoseLimitResponse(limit))
+}
+
+func deleteDoseLimitV1(c *gin.Context, db *gorm.DB) {
+	id, ok := idFromPath(c, "limit", models.ErrDoseLimitNotFound)
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteDoseLimit(db, currentTenantID(c), id); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+type alertResponse struct {
+	ID             uint           `json:"id"`
+	Kind           string         `json:"kind"`
+	Message        string         `json:"message"`
+	DropperID      *uint          `json:"dropper_id"`
+	PatientID      *uint          `json:"patient_id"`
+	ScheduleID     *uint          `json:"schedule_id"`
+	DoseID         *uint          `json:"dose_id"`
+	Details        map[string]any `json:"details,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	AcknowledgedAt *time.Time     `json:"acknowledged_at"`
+	AcknowledgedBy *uint          `json:"acknowledged_by"`
+}
+
+func newAlertResponse(a *models.Alert) alertResponse {
+	return alertResponse{
+		ID:             a.ID,
+		Kind:           a.Kind,
+		Message:        a.Message,
+		DropperID:      a.DropperID,
+		PatientID:      a.PatientID,
+		ScheduleID:     a.ScheduleID,
+		DoseID:         a.DoseID,
+		Details:        a.Details,
+		CreatedAt:      a.CreatedAt,
+		AcknowledgedAt: a.AcknowledgedAt,
+		AcknowledgedBy: a.AcknowledgedBy,
+	}
+}
+
+// listAlertsV1 lista os alertas do tenant, `?active=true` devolve só os que estão por confirmar
+func listAlertsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	alerts, total, err := models.ListAlerts(db, currentTenantID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[alertResponse]{
+		Data:    make([]alertResponse, len(alerts)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range alerts {
+		page.Data[i] = newAlertResponse(&alerts[i])
+	}
+	c.JSON(200, page)
+}
+
+func acknowledgeAlertV1(c *gin.Context, db *gorm.DB) {
+	id, ok := idFromPath(c, "alert", models.ErrAlertNotFound)
+	if !ok {
+		return
+	}
+
+	alert, err := models.AcknowledgeAlert(db, currentTenantID(c), id, currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newAlertResponse(alert))
+}
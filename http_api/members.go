@@ -0,0 +1,126 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+func listMembersV1(c *gin.Context, db *gorm.DB) {
+	members, err := models.ListMembers(db, currentTenantID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response := make([]userResponse, len(members))
+	for i := range members {
+		response[i] = newUserResponse(&members[i])
+	}
+	c.JSON(200, response)
+}
+
+type inviteMemberBody struct {
+	// Email da pessoa convidada, que ainda não pode ter conta
+	Email string      `json:"email" binding:"required"`
+	Role  models.Role `json:"role" binding:"required"`
+}
+
+type inviteResponse struct {
+	ID        uint        `json:"id"`
+	Email     string      `json:"email"`
+	Role      models.Role `json:"role"`
+	InvitedBy uint        `json:"invited_by"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	// Token do convite, só é devolvido nesta resposta
+	Token string `json:"token"`
+}
+
+func inviteMemberV1(c *gin.Context, db *gorm.DB) {
+	var body inviteMemberBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	invite, token, err := models.InviteMember(db, currentActor(c), body.Email, body.Role)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, inviteResponse{
+		ID:        invite.ID,
+		Email:     invite.Email,
+		Role:      invite.Role,
+		InvitedBy: invite.InvitedBy,
+		ExpiresAt: invite.ExpiresAt,
+		Token:     token,
+	})
+}
+
+type updateMemberBody struct {
+	Role models.Role `json:"role" binding:"required"`
+}
+
+func updateMemberV1(c *gin.Context, db *gorm.DB) {
+	var body updateMemberBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	userID, ok := idFromPath(c, "user", models.ErrMemberNotFound)
+	if !ok {
+		return
+	}
+
+	member, err := models.SetMemberRole(db, currentTenantID(c), userID, body.Role)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newUserResponse(member))
+}
+
+func removeMemberV1(c *gin.Context, db *gorm.DB) {
+	userID, ok := idFromPath(c, "user", models.ErrMemberNotFound)
+	if !ok {
+		return
+	}
+
+	if err := models.RemoveMember(db, currentTenantID(c), userID); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+type acceptInviteBody struct {
+	Token    string `json:"token" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func acceptInvitePOST(c *gin.Context, db *gorm.DB) {
+	var body acceptInviteBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	user, err := models.AcceptInvite(db, body.Token, body.Name, body.Password)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newUserResponse(user))
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,7 +15,8 @@ import (
 	"github.com/TomascpMarques/dropmedical/models"
 )
 
-// SetupRoutesGroup groups the API routes into a Engine route group with the path prefix of `/api`
+// SetupRoutesGroup groups the API routes into a Engine route group with the path prefix of `/api`.
+// Every `/api` route requires a valid access token, except for the auth, docs and calendar routes.
 func SetupRoutesGroup(router *gin.Engine, db *gorm.DB, ch *chan models.MqttActionRequest) {
 	// Logger
 	router.Use(gin.LoggerWithFormatter(apiLogger))
@@ -22,17 +24,35 @@ func SetupRoutesGroup(router *gin.Engine, db *gorm.DB, ch *chan models.MqttActio
 	// Recovery from panics inside middlewares and handlers
 	router.Use(gin.Recovery())
 
+	// Validation errors report the json/form field names
+	useFieldTagNames()
+
+	// Public routes
+	public := router.Group("/api")
+	// ------------------------
+	setupAuthRoutes(public, db)
+	setupDocsRoutes(public)
+	public.GET("/calendar/:token", func(ctx *gin.Context) { calendarGET(ctx, requestDB(ctx, db)) })
+	// ------------------------
+
 	// Routes
-	api := router.Group("/api")
+	api := router.Group("/api", requireAuth(), authorizeRoute(db))
 	// ------------------------
-	api.POST("/dropper", func(ctx *gin.Context) { registerDropperPOST(ctx, db) })
-	api.POST("/dropper/section", func(ctx *gin.Context) { registerDropperSectionPOST(ctx, db) })
-	api.POST("/dropper/section/reload", func(ctx *gin.Context) { reloadDropperSectionPOST(ctx, db, ch) })
-	api.POST("/dropper/schedule", func(ctx *gin.Context) { createDropperDispenseSchedulePOST(ctx, db) })
-
-	api.GET("/dropper/section/pills", func(ctx *gin.Context) { dropperSectionPillsGET(ctx, db) })
-	api.GET("/dropper/activate", func(ctx *gin.Context) { activateDropperGET(ctx, db) })
-	api.GET("/dropper/dispense", func(ctx *gin.Context) { dropperDispensePillsGET(ctx, db) })
+	api.GET("/auth/me", func(ctx *gin.Context) { currentUserGET(ctx, requestDB(ctx, db)) })
+
+	api.POST("/dropper", func(ctx *gin.Context) { registerDropperPOST(ctx, requestDB(ctx, db)) })
+	api.POST("/dropper/section", func(ctx *gin.Context) { registerDropperSectionPOST(ctx, requestDB(ctx, db)) })
+	api.POST("/dropper/section/reload", func(ctx *gin.Context) { reloadDropperSectionPOST(ctx, requestDB(ctx, db), ch) })
+	api.POST("/dropper/schedule", func(ctx *gin.Context) { createDropperDispenseSchedulePOST(ctx, requestDB(ctx, db)) })
+
+	api.GET("/dropper/section/pills", func(ctx *gin.Context) { dropperSectionPillsGET(ctx, requestDB(ctx, db)) })
+	api.GET("/dropper/activate", func(ctx *gin.Context) { activateDropperGET(ctx, requestDB(ctx, db)) })
+	api.GET("/dropper/dispense", func(ctx *gin.Context) { dropperDispensePillsGET(ctx, requestDB(ctx, db), ch) })
+
+	api.GET("/dropper/discrepancies", func(ctx *gin.Context) { dropperDiscrepanciesGET(ctx, requestDB(ctx, db)) })
+	api.POST("/dropper/discrepancies/resolve", func(ctx *gin.Context) { resolveDropperDiscrepancyPOST(ctx, requestDB(ctx, db)) })
+
+	setupV1Routes(api, db, ch)
 	// ------------------------
 
 	health_check := router.Group("/health_check")
@@ -50,37 +70,23 @@ func dropperSectionPillsGET(ctx *gin.Context, db *gorm.DB) {
 	var query getSectionPillsQuery
 
 	if err := ctx.ShouldBindQuery(&query); err != nil {
-		log.Printf("Tentativa de ativar o dropper falhada! <query> : %s \n", err.Error())
-		ctx.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"query string fornecida invalida ou mal-formada",
-			),
-		)
+		respondBindError(ctx, err)
+		return
+	}
+
+	dropper, err := authorizedDropperByID(ctx, db, query.Dropper)
+	if err != nil {
+		respondError(ctx, err)
 		return
 	}
 
 	var section models.DropperSection
-	err := db.Model(models.DropperSection{DropperID: query.Dropper}).Preload("Positions").First(&section).Error
+	err = db.Preload("Positions").Where("dropper_id = ?", dropper.ID).Order("id").First(&section).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		ctx.JSON(
-			404,
-			returnMessage(
-				"not found",
-				"o dropper não foi encontrado",
-			),
-		)
+		respondError(ctx, models.ErrSectionNotFound)
 		return
 	} else if err != nil {
-		log.Printf("Erro inesperado: %s", err.Error())
-		ctx.JSON(
-			500,
-			returnMessage(
-				"erro",
-				"tente novamente mais tarde",
-			),
-		)
+		respondError(ctx, err)
 		return
 	}
 
@@ -91,54 +97,29 @@ func dropperSectionPillsGET(ctx *gin.Context, db *gorm.DB) {
 }
 
 type dropperActivationQuery struct {
-	DropperID string `form:"id" query:"id"`
+	DropperID uuid.UUID `form:"id" query:"id" binding:"required"`
 }
 
 func activateDropperGET(ctx *gin.Context, db *gorm.DB) {
 	var queryParams dropperActivationQuery
 
 	if err := ctx.ShouldBindQuery(&queryParams); err != nil {
-		log.Printf("Tentativa de ativar o dropper falhada! <query> : %s \n", err.Error())
-		ctx.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"query string fornecida invalida ou mal-formada",
-			),
-		)
+		respondBindError(ctx, err)
 		return
 	}
 
-	dropper := models.Dropper{
-		SerialID: uuid.MustParse(queryParams.DropperID),
-		Active:   false,
+	dropper, err := authorizedDropper(ctx, db, queryParams.DropperID)
+	if err != nil {
+		respondError(ctx, err)
+		return
 	}
 
-	err := db.Limit(1).Find(&dropper).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		ctx.JSON(
-			404,
-			returnMessage(
-				"not found",
-				"o dropper não foi encontrado",
-			),
-		)
-		return
-	} else if err != nil {
-		log.Printf("Erro inesperado: %s", err.Error())
-		ctx.JSON(
-			500,
-			returnMessage(
-				"erro",
-				"tente novamente mais tarde",
-			),
-		)
+	active := true
+	if err := dropper.Update(db, models.DropperChanges{Active: &active}); err != nil {
+		respondError(ctx, err)
 		return
 	}
 
-	dropper.Active = true
-	db.Save(&dropper)
-
 	ctx.JSON(
 		200,
 		returnMessage(
@@ -149,7 +130,7 @@ func activateDropperGET(ctx *gin.Context, db *gorm.DB) {
 }
 
 type createDispenseScheduleQuery struct {
-	DropperID string `form:"dropper" query:"dropper"`
+	DropperID uuid.UUID `form:"dropper" query:"dropper" binding:"required"`
 }
 
 type createDispenseScheduleBody struct {
@@ -160,6 +141,38 @@ type createDispenseScheduleBody struct {
 	EndDate     time.Time      `json:"end_date"    form:"end_date"`
 	Interval    time.Duration  `json:"interval"    form:"interval"`
 	Pills       map[string]int `json:"pills"       form:"pills"`
+	PatientID   *uint          `json:"patient_id"  form:"patient_id"`
+	// scheduled, por omissão, ou prn para tomas em SOS pedidas pelo paciente
+	Kind          string `json:"kind"            form:"kind"`
+	MaxDailyDoses uint   `json:"max_daily_doses" form:"max_daily_doses"`
+	// Fases contíguas com doses diferentes, do início ao fim do horário, em vez de pills
+	Phases []models.SchedulePhase `json:"phases" form:"-"`
+	// Antecedência do lembrete e adiamentos permitidos, em nanossegundos
+	ReminderLead   time.Duration `json:"reminder_lead"   form:"reminder_lead"`
+	MaxSnoozes     uint          `json:"max_snoozes"     form:"max_snoozes"`
+	SnoozeDuration time.Duration `json:"snooze_duration" form:"snooze_duration"`
+	// Motivo para criar o horário apesar de interações graves, fica registado
+	OverrideReason string `json:"override_reason" form:"override_reason"`
+}
+
+func (b createDispenseScheduleBody) spec(c *gin.Context) models.ScheduleSpec {
+	return models.ScheduleSpec{
+		Name:           b.Name,
+		Active:         b.Active,
+		Description:    b.Description,
+		Start:          b.StartDate,
+		End:            b.EndDate,
+		Interval:       b.Interval,
+		Pills:          b.Pills,
+		PatientID:      b.PatientID,
+		Kind:           b.Kind,
+		MaxDailyDoses:  b.MaxDailyDoses,
+		Phases:         b.Phases,
+		ReminderLead:   b.ReminderLead,
+		MaxSnoozes:     b.MaxSnoozes,
+		SnoozeDuration: b.SnoozeDuration,
+		Override:       overrideFrom(c, b.OverrideReason),
+	}
 }
 
 func createDropperDispenseSchedulePOST(c *gin.Context, db *gorm.DB) {
@@ -167,98 +180,93 @@ func createDropperDispenseSchedulePOST(c *gin.Context, db *gorm.DB) {
 	var new_schedule createDispenseScheduleBody
 
 	if err := c.ShouldBindQuery(&query); err != nil {
-		log.Printf("Tentativa de criar horario falhada! <query> : %s \n", err.Error())
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados fornecidos são invalidos ou mal-formados",
-			),
-		)
+		respondBindError(c, err)
 		return
 	}
 
 	if err := c.ShouldBindJSON(&new_schedule); err != nil {
-		log.Printf("Tentativa de criar horario falhada! <body> : %s \n", err.Error())
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados fornecidos são invalidos ou mal-formados",
-			),
-		)
+		respondBindError(c, err)
 		return
 	}
 
-	var dropper models.Dropper
-	err := db.Find(&dropper, "serial_id = ?", query.DropperID).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		log.Printf("O dropper pedido <%s> não existe\n", query.DropperID)
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados fornecidos são invalidos ou mal-formados",
-			),
-		)
-		return
-	} else if errors.Is(err, gorm.ErrForeignKeyViolated) {
-		log.Printf("Erro de chave estrangeira: %s\n", err.Error())
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"Ay Caramba!",
-			),
-		)
-		return
-	} else if err != nil {
-		log.Printf("Erro interno, base de dados: %s\n", err.Error())
-		c.JSON(
-			500,
-			returnMessage(
-				"erro",
-				"Erro interno tente mais tarde",
-			),
-		)
+	dropper, err := authorizedDropper(c, db, query.DropperID)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	if err := dropper.CreateDispenseSchedule(
-		db,
-		new_schedule.Active,
-		new_schedule.Name,
-		new_schedule.Description,
-		new_schedule.StartDate,
-		new_schedule.EndDate,
-		new_schedule.Interval,
-		new_schedule.Pills,
-	); err != nil {
+	if _, err := dropper.CreateDispenseSchedule(db, new_schedule.spec(c)); err != nil {
 		log.Println("O horário não foi criado")
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados fornecidos são invalidos ou mal-formados",
-			),
-		)
+		respondError(c, err)
 		return
 	}
+
+	c.JSON(
+		200,
+		returnMessage(
+			"sucesso",
+			"horário criado",
+		),
+	)
 }
 
-/* type dispensePills struct {} */
+type dispensePillsQuery struct {
+	DropperID uuid.UUID `form:"dropper" binding:"required"`
+	PillName  string    `form:"pill" binding:"required"`
+	Count     int       `form:"count"`
+}
+
+func dropperDispensePillsGET(ctx *gin.Context, db *gorm.DB, ch *chan models.MqttActionRequest) {
+	var query dispensePillsQuery
+
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		respondBindError(ctx, err)
+		return
+	}
+	if query.Count < 1 {
+		query.Count = 1
+	}
+
+	dropper, err := authorizedDropper(ctx, db, query.DropperID)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
 
-func dropperDispensePillsGET(ctx *gin.Context, db *gorm.DB) {
-	panic("unimplemented")
+	commands, err := dropper.DispensePills(db, models.PillList{query.PillName: query.Count})
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	for _, command := range commands {
+		*ch <- command
+	}
+
+	ctx.JSON(
+		200,
+		returnMessage(
+			"sucesso",
+			"comprimidos enviados para dispensa",
+		),
+	)
 }
 
+// accessTokenParamRegex encontra os access tokens enviados na query, que não devem ficar nos logs
+var accessTokenParamRegex = regexp.MustCompile(`access_token=[^&]*`)
+
+// calendarTokenRegex encontra o token secreto no caminho dos calendários públicos
+var calendarTokenRegex = regexp.MustCompile(`^/api/calendar/[^/?]+`)
+
 func apiLogger(param gin.LogFormatterParams) string {
+	path := accessTokenParamRegex.ReplaceAllString(param.Path, "access_token=***")
+	path = calendarTokenRegex.ReplaceAllString(path, "/api/calendar/***")
+
 	return fmt.Sprintf(
 		`[%s] (%s) %s %s %d`,
 		param.TimeStamp.UTC(),
 		param.ClientIP,
 		param.Method,
-		param.Path,
+		path,
 		param.StatusCode,
 	)
 }
@@ -271,48 +279,23 @@ func returnMessage(status, message string) gin.H {
 }
 
 type reloadDropperSection struct {
-	Dropper  uuid.UUID `form:"dropper_id" json:"dropper_id"`
-	Section  uint      `form:"section_pos" json:"section_pos"`
-	PillName string    `form:"pill_name" json:"pill_name"`
-	Quantity uint      `form:"pill_quantity" json:"pill_quantity"`
+	Dropper  uuid.UUID `form:"dropper_id" json:"dropper_id" binding:"required"`
+	Section  uint      `form:"section_pos" json:"section_pos" binding:"required"`
+	PillName string    `form:"pill_name" json:"pill_name" binding:"required"`
+	Quantity uint      `form:"pill_quantity" json:"pill_quantity" binding:"required"`
 }
 
 func reloadDropperSectionPOST(c *gin.Context, db *gorm.DB, ch *chan models.MqttActionRequest) {
 	var reloadSectionAction reloadDropperSection
 
 	if err := c.ShouldBind(&reloadSectionAction); err != nil {
-		log.Printf("Tentativa de recarregar uma secção falhada!: %s \n", err.Error())
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados fornecidos são invalidos ou mal-formados",
-			),
-		)
+		respondBindError(c, err)
 		return
 	}
 
-	var dropper models.Dropper
-	err := db.Find(&dropper, "serial_id = ?", reloadSectionAction.Dropper).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		log.Printf("O dropper pedido <%d> não existe\n", reloadSectionAction.Dropper)
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados fornecidos são invalidos ou mal-formados",
-			),
-		)
-		return
-	} else if err != nil {
-		log.Printf("Erro interno, base de dados: %s\n", err.Error())
-		c.JSON(
-			500,
-			returnMessage(
-				"erro",
-				"Erro interno tente mais tarde",
-			),
-		)
+	dropper, err := authorizedDropper(c, db, reloadSectionAction.Dropper)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -323,77 +306,63 @@ func reloadDropperSectionPOST(c *gin.Context, db *gorm.DB, ch *chan models.MqttA
 		reloadSectionAction.Quantity,
 	)
 	if err != nil {
-		log.Printf("Erro ao recarregar secção, erro: %+e\n", err)
-		c.JSON(
-			500,
-			returnMessage(
-				"erro",
-				"Erro interno tente mais tarde",
-			),
-		)
+		log.Printf("Erro ao recarregar secção, erro: %s\n", err)
+		respondError(c, err)
 		return
 	}
+	dropper.PublishEvent(models.EventInventory, models.InventoryEvent{Reason: models.InventoryReload})
 
 	*ch <- models.MqttActionRequest{
 		Topic: fmt.Sprintf("angle%d", reloadSectionAction.Section),
 		Value: []byte(fmt.Sprintf("0,%d", reloadSectionAction.Section)),
 	}
 
-	c.JSON(200, gin.H{
-		"status": "sucesso",
-		"razao":  "Secção carregada",
-	})
+	c.JSON(
+		200,
+		returnMessage(
+			"sucesso",
+			"Secção carregada",
+		),
+	)
 }
 
 type newDropperSection struct {
-	Dropper uuid.UUID       `form:"dropper_id" json:"dropper_id"`
-	Name    string          `form:"name" json:"name"`
+	Dropper uuid.UUID       `form:"dropper_id" json:"dropper_id" binding:"required"`
+	Name    string          `form:"name" json:"name" binding:"required"`
 	Pills   models.PillList `form:"pills" json:"pills"`
 }
 
+type newDropperSectionResponse struct {
+	Status    string `json:"status"`
+	SectionID uint   `json:"id_seccao"`
+}
+
 func registerDropperSectionPOST(c *gin.Context, db *gorm.DB) {
 	var newSection newDropperSection
 
 	if err := c.ShouldBindJSON(&newSection); err != nil {
-		log.Printf("Tentativa de criar dropper com request-body malformed\n")
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				"dados inválidos enviados para criar dropper",
-			),
-		)
+		respondBindError(c, err)
 		return
 	}
 
-	var dropper models.Dropper
-	err := db.Find(&dropper, "serial_id = ?", newSection.Dropper).Error
+	dropper, err := authorizedDropper(c, db, newSection.Dropper)
 	if err != nil {
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				err.Error(),
-			),
-		)
+		respondError(c, err)
+		return
 	}
 
 	section_id, err := dropper.CreateDropperSection(db, newSection.Name, newSection.Pills)
 	if err != nil {
-		c.JSON(
-			400,
-			returnMessage(
-				"erro",
-				err.Error(),
-			),
-		)
+		respondError(c, err)
+		return
 	}
+	dropper.PublishEvent(models.EventInventory, models.InventoryEvent{Reason: models.InventorySectionCreated, Section: newSection.Name})
 
 	c.JSON(
 		201,
-		gin.H{
-			"status":    "sucesso",
-			"id_seccao": section_id,
+		newDropperSectionResponse{
+			Status:    "sucesso",
+			SectionID: section_id,
 		},
 	)
 }
@@ -407,31 +376,15 @@ type newDropper struct {
 func registerDropperPOST(c *gin.Context, db *gorm.DB) {
 	var newDropper newDropper
 
-	if c.ShouldBind(&newDropper) != nil {
-		c.JSON(400, gin.H{
-			"status": "error",
-			"reason": "Bad query parameters",
-		})
+	if err := c.ShouldBind(&newDropper); err != nil {
+		respondBindError(c, err)
 		return
 	}
 
-	dropper := models.NewDropper(newDropper.Name, newDropper.MachineUrl)
-
-	err := db.Create(&dropper).Error
+	dropper := models.NewDropper(currentTenantID(c), newDropper.Name, newDropper.MachineUrl)
 
-	if errors.Is(err, gorm.ErrDuplicatedKey) {
-		log.Println("Tentativa de criar um dropper que já existe")
-		c.JSON(409, gin.H{
-			"status": "erro",
-			"razao":  "Este dropper já existe",
-		})
-		return
-	} else if err != nil {
-		log.Printf("Erro inesperado: %+v", err)
-		c.JSON(500, gin.H{
-			"status": "erro",
-			"razao":  "Ocorreu um erro inesperado",
-		})
+	if _, err := dropper.Create(db); err != nil {
+		respondError(c, err)
 		return
 	}
 
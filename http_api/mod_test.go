@@ -7,14 +7,21 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/TomascpMarques/dropmedical/database"
+	"github.com/TomascpMarques/dropmedical/fhir"
+	"github.com/TomascpMarques/dropmedical/interactions"
+	"github.com/TomascpMarques/dropmedical/migrations"
 	"github.com/TomascpMarques/dropmedical/models"
+	"github.com/TomascpMarques/dropmedical/webhooks"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -31,9 +38,21 @@ func TestCreateServer(t *testing.T) {
 
 	db, _ := database.NewPostgresConnection()
 
-	models.MigrateAll(db)
+	if _, err := migrations.Up(db, 0); err != nil {
+		log.Fatalf("X Failed to migrate the database: %s\n", err)
+	}
+	if err := models.RegisterAudit(db); err != nil {
+		log.Fatalf("X Failed to register the audit log: %s\n", err)
+	}
+
+	checker, err := interactions.LoadFromEnv()
+	if err != nil {
+		log.Fatalf("X Failed to load the interactions dataset: %s\n", err)
+	}
+	models.SetInteractionChecker(checker)
 
-	SetupRoutesGroup(r, db)
+	ch := make(chan models.MqttActionRequest, 20)
+	SetupRoutesGroup(r, db, &ch)
 
 	go func() {
 		err := r.Run()
@@ -54,11 +73,65 @@ func TestShouldCreateDropper(t *testing.T) {
 	wg.Done()
 }
 
+var testTokenOnce sync.Once
+var testToken string
+
+// registerTestUser regista um novo utilizador, com o seu próprio tenant, e devolve o seu access token
+func registerTestUser(t *testing.T) string {
+	return registerTestUserAs(t, fmt.Sprintf("test-%d@dropmedical.pt", time.Now().UnixNano()))
+}
+
+func registerTestUserAs(t *testing.T, email string) string {
+	credentials := registerUserBody{
+		Name:     "Test",
+		Email:    email,
+		Password: "test-password",
+	}
+	json_payload, _ := json.Marshal(credentials)
+	resp, err := http.Post("http://localhost:8080/api/auth/register", "application/json", bytes.NewBuffer(json_payload))
+	if err != nil || resp.StatusCode != 201 {
+		t.Fatalf("Failed to register the test user")
+	}
+
+	json_payload, _ = json.Marshal(loginBody{Email: credentials.Email, Password: credentials.Password})
+	resp, err = http.Post("http://localhost:8080/api/auth/login", "application/json", bytes.NewBuffer(json_payload))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Failed to login the test user")
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	read, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(read, &tokens); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	return tokens.AccessToken
+}
+
+// authorize adiciona o access token de um utilizador de teste ao pedido, registando-o na primeira chamada
+func authorize(t *testing.T, req *http.Request) {
+	testTokenOnce.Do(func() { testToken = registerTestUser(t) })
+
+	req.Header.Set("Authorization", "Bearer "+testToken)
+}
+
+// post envia um pedido POST autenticado
+func post(t *testing.T, url, content_type string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	authorize(t, req)
+
+	return http.DefaultClient.Do(req)
+}
+
 func createDropper(t *testing.T, name, machine_url string) (dropper models.Dropper) {
-	resp, err := http.PostForm("http://localhost:8080/api/dropper", url.Values{
+	resp, err := post(t, "http://localhost:8080/api/dropper", "application/x-www-form-urlencoded", strings.NewReader(url.Values{
 		"name":        {name},
 		"machine_url": {machine_url},
-	})
+	}.Encode()))
 	if err != nil {
 		wg.Done()
 		t.Fatalf("Error: %s", err.Error())
@@ -113,7 +186,8 @@ func TestCreateDropperSchedule(t *testing.T) {
 	}
 	json_payload, _ := json.Marshal(newSection)
 
-	resp, err := http.Post(
+	resp, err := post(
+		t,
 		"http://localhost:8080/api/dropper/section",
 		"application/json",
 		bytes.NewBuffer(json_payload),
@@ -137,7 +211,8 @@ func TestCreateDropperSchedule(t *testing.T) {
 
 	url := "http://localhost:8080/api/dropper/schedule?dropper=" + dropper.SerialID.String()
 	log.Printf("URL IS: %s", url)
-	resp, err = http.Post(
+	resp, err = post(
+		t,
 		url,
 		"application/json",
 		bytes.NewBuffer(json_payload),
@@ -163,7 +238,8 @@ func TestShouldCreateAndReloadDropperSection(t *testing.T) {
 	}
 	json_payload, _ := json.Marshal(newSection)
 
-	resp, err := http.Post(
+	resp, err := post(
+		t,
 		"http://localhost:8080/api/dropper/section",
 		"application/json",
 		bytes.NewBuffer(json_payload),
@@ -185,7 +261,8 @@ func TestShouldCreateAndReloadDropperSection(t *testing.T) {
 	json_payload, _ = json.Marshal(sectionReload)
 	t.Logf("Payload: %s", json_payload)
 
-	resp, err = http.Post(
+	resp, err = post(
+		t,
 		"http://localhost:8080/api/dropper/section/reload",
 		"application/json",
 		bytes.NewBuffer(json_payload),
@@ -197,3 +274,1319 @@ func TestShouldCreateAndReloadDropperSection(t *testing.T) {
 		t.Fatalf("Erro!!! > %d", resp.StatusCode)
 	}
 }
+
+func doJSON(t *testing.T, method, url string, payload any) *http.Response {
+	return doJSONAs(t, "", method, url, payload)
+}
+
+// doJSONAs envia o pedido com o token indicado, ou com o do utilizador de teste se token for vazio
+func doJSONAs(t *testing.T, token, method, url string, payload any) *http.Response {
+	var body io.Reader
+	if payload != nil {
+		json_payload, _ := json.Marshal(payload)
+		body = bytes.NewBuffer(json_payload)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token == "" {
+		authorize(t, req)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	return resp
+}
+
+func TestV1DropperLifecycle(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	resp := doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "V1_ONE", MachineUrl: "V1_ONE_URL"})
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var created dropperResponse
+	read, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &created); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + created.SerialID.String()
+
+	name := "V1_ONE_RENAMED"
+	resp = doJSON(t, "PATCH", dropper_url, updateDropperBody{Name: &name})
+	if resp.StatusCode != 200 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+
+	resp = doJSON(t, "GET", "http://localhost:8080/api/v1/droppers?name=V1_ONE_RENAMED&sort=-created_at", nil)
+	var page pageResponse[dropperResponse]
+	read, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &page); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	if page.Total < 1 || page.Data[0].Name != name {
+		t.Fatalf("Renamed dropper not listed: %+v", page)
+	}
+
+	resp = doJSON(t, "GET", "http://localhost:8080/api/v1/droppers?sort=machine_url;drop", nil)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for an invalid sort, got %d", resp.StatusCode)
+	}
+
+	resp = doJSON(t, "DELETE", dropper_url, nil)
+	if resp.StatusCode != 204 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+
+	resp = doJSON(t, "GET", dropper_url, nil)
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for a deleted dropper, got %d", resp.StatusCode)
+	}
+
+	// O endereço de um dropper removido pode voltar a ser registado
+	var again dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "V1_ONE", MachineUrl: "V1_ONE_URL"}), &again)
+	again_url := "http://localhost:8080/api/v1/droppers/" + again.SerialID.String()
+
+	// Tal como o nome de um horário removido
+	schedule := createDispenseScheduleBody{
+		Name:      "REUSED",
+		Active:    true,
+		StartDate: time.Now().Add(time.Hour).UTC(),
+		EndDate:   time.Now().Add(48 * time.Hour).UTC(),
+		Interval:  24 * time.Hour,
+		Pills:     map[string]int{"Aspirin": 1},
+	}
+	var first scheduleResponse
+	decode(t, doJSON(t, "POST", again_url+"/schedules", schedule), &first)
+	resp = doJSON(t, "DELETE", fmt.Sprintf("%s/schedules/%d", again_url, first.ID), nil)
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	resp = doJSON(t, "POST", again_url+"/schedules", schedule)
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Expected the deleted schedule's name to be reusable, got %d", resp.StatusCode)
+	}
+
+	resp = doJSON(t, "DELETE", again_url, nil)
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+}
+
+func TestAPIRequiresAuthentication(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	resp, err := http.Get("http://localhost:8080/api/v1/droppers")
+	if err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	if resp.StatusCode != 401 {
+		t.Fatalf("Expected 401 without a token, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://localhost:8080/health_check/up")
+	if err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Health check should stay public, got %d", resp.StatusCode)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	resp := doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "TENANT_A", MachineUrl: uuid.NewString()})
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var created dropperResponse
+	read, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &created); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + created.SerialID.String()
+	resp = doJSON(t, "POST", dropper_url+"/sections", createSectionBody{Name: "SECTION 1", Pills: models.PillList{"Aspirin": 2}})
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var section sectionResponse
+	read, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &section); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+
+	// Um utilizador de outro tenant, que conhece o serial do dropper
+	intruder := registerTestUser(t)
+	serial := created.SerialID.String()
+	section_url := fmt.Sprintf("%s/sections/%d", dropper_url, section.ID)
+
+	cases := []struct {
+		method  string
+		url     string
+		payload any
+	}{
+		{"GET", dropper_url, nil},
+		{"PATCH", dropper_url, updateDropperBody{Active: new(bool)}},
+		{"DELETE", dropper_url, nil},
+		{"GET", section_url + "/positions", nil},
+		{"POST", section_url + "/reload", reloadSectionBody{PillName: "Aspirin", Quantity: 1}},
+		{"POST", dropper_url + "/dispense", dispenseBody{Pills: models.PillList{"Aspirin": 1}}},
+		{"GET", "http://localhost:8080/api/dropper/activate?id=" + serial, nil},
+		{"GET", "http://localhost:8080/api/dropper/dispense?dropper=" + serial + "&pill=Aspirin&count=1", nil},
+		{"POST", "http://localhost:8080/api/dropper/section/reload", reloadDropperSection{
+			Dropper: created.SerialID, Section: 1, PillName: "Aspirin", Quantity: 1,
+		}},
+		// Um serial adivinhado tem a mesma resposta que um serial de outro tenant
+		{"GET", "http://localhost:8080/api/v1/droppers/" + uuid.NewString(), nil},
+	}
+	for _, c := range cases {
+		resp := doJSONAs(t, intruder, c.method, c.url, c.payload)
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Fatalf("%s %s: expected 404 for another tenant, got %d", c.method, c.url, resp.StatusCode)
+		}
+	}
+
+	resp = doJSONAs(t, intruder, "GET", "http://localhost:8080/api/v1/droppers", nil)
+	var page pageResponse[dropperResponse]
+	read, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &page); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	if page.Total != 0 {
+		t.Fatalf("Another tenant should not list any dropper, got %+v", page)
+	}
+
+	// O dono continua a ter acesso e nada foi alterado pelo outro tenant
+	resp = doJSON(t, "GET", section_url+"/positions", nil)
+	var positions []positionResponse
+	read, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Owner lost access to its dropper: %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(read, &positions); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	for _, position := range positions {
+		if position.Position <= 2 && position.Empty {
+			t.Fatalf("Position %d was changed by another tenant", position.Position)
+		}
+	}
+}
+
+func TestCaregiverAccess(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	resp := doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "CARED", MachineUrl: uuid.NewString()})
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var created dropperResponse
+	read, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &created); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + created.SerialID.String()
+	resp = doJSON(t, "POST", dropper_url+"/sections", createSectionBody{Name: "SECTION 1", Pills: models.PillList{"Aspirin": 2}})
+	var section sectionResponse
+	read, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &section); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	reload_url := fmt.Sprintf("%s/sections/%d/reload", dropper_url, section.ID)
+
+	// O cuidador é de outro tenant e só vê o dropper depois de convidado
+	email := fmt.Sprintf("caregiver-%d@dropmedical.pt", time.Now().UnixNano())
+	caregiver := registerTestUserAs(t, email)
+
+	expect := func(token, method, url string, payload any, status int) *http.Response {
+		t.Helper()
+		resp := doJSONAs(t, token, method, url, payload)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected %d, got %d", method, url, status, resp.StatusCode)
+		}
+		return resp
+	}
+
+	expect(caregiver, "GET", dropper_url, nil, 404).Body.Close()
+	expect("", "POST", dropper_url+"/caregivers", inviteCaregiverBody{Email: email}, 201).Body.Close()
+	expect("", "POST", dropper_url+"/caregivers", inviteCaregiverBody{Email: email}, 409).Body.Close()
+
+	expect(caregiver, "GET", dropper_url, nil, 200).Body.Close()
+	expect(caregiver, "POST", reload_url, reloadSectionBody{PillName: "Brufen", Quantity: 1}, 200).Body.Close()
+	expect(caregiver, "POST", dropper_url+"/dispense", dispenseBody{Pills: models.PillList{"Aspirin": 1}}, 202).Body.Close()
+
+	// Mas não gere o dispositivo, os horários nem os acessos
+	name := "RENAMED"
+	expect(caregiver, "PATCH", dropper_url, updateDropperBody{Name: &name}, 403).Body.Close()
+	expect(caregiver, "POST", dropper_url+"/schedules", updateScheduleBody{Name: &name}, 403).Body.Close()
+	expect(caregiver, "POST", dropper_url+"/caregivers", inviteCaregiverBody{Email: email}, 403).Body.Close()
+	expect(caregiver, "POST", "http://localhost:8080/api/dropper/discrepancies/resolve", resolveDiscrepancyBody{
+		Dropper: created.SerialID, Discrepancy: 1, Accept: models.ResolutionDevice,
+	}, 403).Body.Close()
+
+	resp = expect("", "GET", dropper_url+"/caregivers", nil, 200)
+	var caregivers []caregiverResponse
+	read, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, &caregivers); err != nil {
+		t.Fatalf("Erro: %s", err.Error())
+	}
+	if len(caregivers) != 1 || caregivers[0].Email != email {
+		t.Fatalf("Expected the invited caregiver, got %+v", caregivers)
+	}
+
+	// O calendário partilhado pelo cuidador deixa de funcionar quando o acesso é retirado
+	var feed createdCalendarFeedResponse
+	decode(t, expect(caregiver, "POST", dropper_url+"/calendar-feeds", nil, 201), &feed)
+	expect("", "GET", "http://localhost:8080"+feed.Path, nil, 200).Body.Close()
+
+	revoke_url := fmt.Sprintf("%s/caregivers/%d", dropper_url, caregivers[0].UserID)
+	expect("", "DELETE", revoke_url, nil, 204).Body.Close()
+	expect(caregiver, "GET", dropper_url, nil, 404).Body.Close()
+	expect("", "GET", "http://localhost:8080"+feed.Path, nil, 404).Body.Close()
+}
+
+func TestConcurrentRefreshTokenReuse(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	email := fmt.Sprintf("refresh-%d@dropmedical.pt", time.Now().UnixNano())
+	registerTestUserAs(t, email)
+	var tokens tokenResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/auth/login", loginBody{Email: email, Password: "test-password"}), &tokens)
+
+	// Só um dos pedidos simultâneos com o mesmo refresh token pode receber novos tokens
+	var refreshing sync.WaitGroup
+	statuses := make(chan int, 5)
+	for range 5 {
+		refreshing.Add(1)
+		go func() {
+			defer refreshing.Done()
+			resp := doJSON(t, "POST", "http://localhost:8080/api/auth/refresh", refreshTokenBody{RefreshToken: tokens.RefreshToken})
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	refreshing.Wait()
+	close(statuses)
+
+	granted := 0
+	for status := range statuses {
+		if status == 200 {
+			granted++
+		}
+	}
+	if granted > 1 {
+		t.Fatalf("Expected at most one refresh to succeed, got %d", granted)
+	}
+}
+
+func TestTenantMembers(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	expect := func(token, method, url string, payload any, status int) *http.Response {
+		t.Helper()
+		resp := doJSONAs(t, token, method, url, payload)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected %d, got %d", method, url, status, resp.StatusCode)
+		}
+		return resp
+	}
+
+	var me userResponse
+	decode(t, expect("", "GET", "http://localhost:8080/api/auth/me", nil, 200), &me)
+
+	// O convidado cria a conta já no tenant de quem o convidou, com o papel do convite
+	email := fmt.Sprintf("member-%d@dropmedical.pt", time.Now().UnixNano())
+	expect("", "POST", "http://localhost:8080/api/v1/members/invites", inviteMemberBody{Email: email, Role: "intruder"}, 400).Body.Close()
+	var invite inviteResponse
+	decode(t, expect("", "POST", "http://localhost:8080/api/v1/members/invites", inviteMemberBody{Email: email, Role: models.RoleAdmin}, 201), &invite)
+
+	accept := acceptInviteBody{Token: invite.Token, Name: "Member", Password: "test-password"}
+	var member userResponse
+	decode(t, expect("", "POST", "http://localhost:8080/api/auth/invites/accept", accept, 201), &member)
+	if member.TenantID != me.TenantID || member.Role != models.RoleAdmin {
+		t.Fatalf("Expected an admin of the inviter's tenant: %+v", member)
+	}
+	expect("", "POST", "http://localhost:8080/api/auth/invites/accept", accept, 404).Body.Close()
+
+	var tokens tokenResponse
+	decode(t, expect("", "POST", "http://localhost:8080/api/auth/login", loginBody{Email: email, Password: accept.Password}, 200), &tokens)
+	expect(tokens.AccessToken, "GET", "http://localhost:8080/api/v1/members", nil, 200).Body.Close()
+
+	var dropper dropperResponse
+	decode(t, expect("", "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "MEMBERS", MachineUrl: uuid.NewString()}, 201), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+	expect(tokens.AccessToken, "GET", dropper_url, nil, 200).Body.Close()
+
+	// A mudança de papel vale logo nas rotas sensíveis, mesmo com o access token antigo
+	member_url := fmt.Sprintf("http://localhost:8080/api/v1/members/%d", member.ID)
+	var updated userResponse
+	decode(t, expect("", "PATCH", member_url, updateMemberBody{Role: models.RolePatient}, 200), &updated)
+	if updated.Role != models.RolePatient {
+		t.Fatalf("Expected the member to be a patient: %+v", updated)
+	}
+	expect(tokens.AccessToken, "GET", "http://localhost:8080/api/v1/members", nil, 403).Body.Close()
+
+	var refreshed tokenResponse
+	decode(t, expect("", "POST", "http://localhost:8080/api/auth/refresh", refreshTokenBody{RefreshToken: tokens.RefreshToken}, 200), &refreshed)
+	// O refresh emite o papel guardado, que já não gere os dispositivos
+	expect(refreshed.AccessToken, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "MEMBER", MachineUrl: uuid.NewString()}, 403).Body.Close()
+
+	// Ao sair do tenant as sessões do utilizador são revogadas
+	expect("", "DELETE", member_url, nil, 204).Body.Close()
+	expect("", "DELETE", member_url, nil, 404).Body.Close()
+	// As rotas do dropper deixam logo de aceitar o access token que ainda não expirou
+	expect(tokens.AccessToken, "GET", dropper_url, nil, 404).Body.Close()
+	expect(tokens.AccessToken, "POST", dropper_url+"/dispense", dispenseBody{Pills: models.PillList{"Aspirin": 1}}, 404).Body.Close()
+	expect("", "POST", "http://localhost:8080/api/auth/refresh", refreshTokenBody{RefreshToken: refreshed.RefreshToken}, 401).Body.Close()
+
+	// O tenant nunca fica sem administradores
+	me_url := fmt.Sprintf("http://localhost:8080/api/v1/members/%d", me.ID)
+	expect("", "PATCH", me_url, updateMemberBody{Role: models.RolePatient}, 409).Body.Close()
+}
+
+// decode lê o corpo da resposta para value
+func decode(t *testing.T, resp *http.Response, value any) {
+	t.Helper()
+	read, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(read, value); err != nil {
+		t.Fatalf("Erro: %s (%s)", err.Error(), read)
+	}
+}
+
+func TestPatientMovesToReplacementDropper(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var old_dropper, replacement dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "OLD", MachineUrl: uuid.NewString()}), &old_dropper)
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "NEW", MachineUrl: uuid.NewString()}), &replacement)
+
+	name, zone := "Maria", "Europe/Lisbon"
+	resp := doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{
+		Name:      &name,
+		TimeZone:  &zone,
+		Allergies: []string{"penicilina"},
+		Contacts:  []patientContact{{Name: "João", Relationship: "filho", Phone: "+351900000000", Primary: true}},
+	})
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var patient patientResponse
+	decode(t, resp, &patient)
+	if patient.TimeZone != zone || len(patient.Contacts) != 1 {
+		t.Fatalf("Patient was not created with its data: %+v", patient)
+	}
+	patient_url := fmt.Sprintf("http://localhost:8080/api/v1/patients/%d", patient.ID)
+
+	schedule := createDispenseScheduleBody{
+		Name:      "MORNING",
+		Active:    true,
+		StartDate: time.Now().UTC(),
+		EndDate:   time.Now().Add(48 * time.Hour).UTC(),
+		Interval:  24 * time.Hour,
+		PatientID: &patient.ID,
+	}
+
+	// O paciente tem de estar associado ao dropper do horário
+	resp = doJSON(t, "POST", "http://localhost:8080/api/v1/droppers/"+old_dropper.SerialID.String()+"/schedules", schedule)
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 for a patient not linked to the dropper, got %d", resp.StatusCode)
+	}
+
+	resp = doJSON(t, "POST", patient_url+"/droppers", linkDropperBody{Dropper: old_dropper.SerialID})
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	resp = doJSON(t, "POST", "http://localhost:8080/api/v1/droppers/"+old_dropper.SerialID.String()+"/schedules", schedule)
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+
+	resp = doJSON(t, "POST", patient_url+"/move", movePatientBody{From: old_dropper.SerialID, To: replacement.SerialID})
+	if resp.StatusCode != 200 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var moved movePatientResponse
+	decode(t, resp, &moved)
+	if moved.MovedSchedules != 1 {
+		t.Fatalf("Expected 1 moved schedule, got %d", moved.MovedSchedules)
+	}
+
+	var schedules pageResponse[scheduleResponse]
+	decode(t, doJSON(t, "GET", "http://localhost:8080/api/v1/droppers/"+replacement.SerialID.String()+"/schedules", nil), &schedules)
+	if schedules.Total != 1 || schedules.Data[0].Name != "MORNING" || *schedules.Data[0].PatientID != patient.ID {
+		t.Fatalf("The schedule should be on the replacement dropper: %+v", schedules)
+	}
+
+	var droppers []dropperResponse
+	decode(t, doJSON(t, "GET", patient_url+"/droppers", nil), &droppers)
+	if len(droppers) != 1 || droppers[0].SerialID != replacement.SerialID {
+		t.Fatalf("The patient should only be linked to the replacement dropper: %+v", droppers)
+	}
+
+	// Outro tenant não vê o paciente
+	resp = doJSONAs(t, registerTestUser(t), "GET", patient_url, nil)
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for another tenant's patient, got %d", resp.StatusCode)
+	}
+}
+
+func TestPrescriptionGeneratesSchedules(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "RX", MachineUrl: uuid.NewString()}), &dropper)
+
+	name := "Ana"
+	var patient patientResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{Name: &name}), &patient)
+	patient_url := fmt.Sprintf("http://localhost:8080/api/v1/patients/%d", patient.ID)
+
+	resp := doJSON(t, "POST", patient_url+"/droppers", linkDropperBody{Dropper: dropper.SerialID})
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+
+	medication, dose, frequency, duration := "Aspirin", uint(1), 12*time.Hour, 5*24*time.Hour
+	start := time.Now().UTC()
+	resp = doJSON(t, "POST", patient_url+"/prescriptions", createPrescriptionBody{
+		prescriptionBody: prescriptionBody{
+			Medication: &medication, Dose: &dose, Frequency: &frequency, StartDate: &start, Duration: &duration,
+		},
+		Dropper: dropper.SerialID,
+	})
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var prescription prescriptionResponse
+	decode(t, resp, &prescription)
+	if len(prescription.Schedules) != 1 || *prescription.Schedules[0].PrescriptionID != prescription.ID {
+		t.Fatalf("Expected one schedule linked to the prescription: %+v", prescription.Schedules)
+	}
+	if prescription.Schedules[0].Pills[medication] != 1 {
+		t.Fatalf("The schedule should dispense the prescribed dose: %+v", prescription.Schedules[0])
+	}
+
+	// Alterar a toma termina o horário anterior e gera um novo
+	dose = 2
+	resp = doJSON(t, "PATCH", fmt.Sprintf("http://localhost:8080/api/v1/prescriptions/%d", prescription.ID), prescriptionBody{Dose: &dose})
+	if resp.StatusCode != 200 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	decode(t, resp, &prescription)
+	if prescription.Revision != 2 || len(prescription.Schedules) != 2 {
+		t.Fatalf("Expected a second revision with two schedules: %+v", prescription)
+	}
+	if !prescription.Schedules[0].Active || prescription.Schedules[1].Active || prescription.Schedules[0].Pills[medication] != 2 {
+		t.Fatalf("Only the new schedule should be active: %+v", prescription.Schedules)
+	}
+
+	resp = doJSON(t, "DELETE", fmt.Sprintf("http://localhost:8080/api/v1/prescriptions/%d", prescription.ID), nil)
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	resp = doJSON(t, "PATCH", fmt.Sprintf("http://localhost:8080/api/v1/prescriptions/%d", prescription.ID), prescriptionBody{Dose: &dose})
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 when amending a cancelled prescription, got %d", resp.StatusCode)
+	}
+}
+
+func TestSevereInteractionRequiresOverride(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "ALLERGY", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	name := "Rui"
+	var patient patientResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{Name: &name, Allergies: []string{"penicilina"}}), &patient)
+	resp := doJSON(t, "POST", fmt.Sprintf("http://localhost:8080/api/v1/patients/%d/droppers", patient.ID), linkDropperBody{Dropper: dropper.SerialID})
+	resp.Body.Close()
+
+	schedule := createDispenseScheduleBody{
+		Name:      "ANTIBIOTIC",
+		Active:    true,
+		StartDate: time.Now().UTC(),
+		EndDate:   time.Now().Add(72 * time.Hour).UTC(),
+		Interval:  8 * time.Hour,
+		Pills:     map[string]int{"Amoxicilina": 1},
+		PatientID: &patient.ID,
+	}
+
+	resp = doJSON(t, "POST", dropper_url+"/schedules", schedule)
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 for a medication the patient is allergic to, got %d", resp.StatusCode)
+	}
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if envelope.Error.Code != CodeSevereInteraction || len(envelope.Error.Details) != 1 || envelope.Error.Details[0].Code != interactions.KindAllergy {
+		t.Fatalf("Unexpected error: %+v", envelope.Error)
+	}
+
+	schedule.OverrideReason = "Teste de tolerância em ambiente hospitalar"
+	resp = doJSON(t, "POST", dropper_url+"/schedules", schedule)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var created scheduleResponse
+	decode(t, resp, &created)
+	if len(created.Warnings) != 1 || created.Warnings[0].Severity != interactions.Severe {
+		t.Fatalf("The created schedule should carry the overridden warning: %+v", created.Warnings)
+	}
+
+	// Só os horários que se sobrepõem interagem
+	day := 24 * time.Hour
+	later := func(name string, from, to time.Duration) createDispenseScheduleBody {
+		start := time.Now().Add(from).Truncate(time.Second).UTC()
+		return createDispenseScheduleBody{
+			Name: name, Active: true, StartDate: start, EndDate: start.Add(to - from),
+			Interval: 8 * time.Hour, Pills: map[string]int{name: 1}, PatientID: &patient.ID,
+		}
+	}
+	resp = doJSON(t, "POST", dropper_url+"/schedules", later("Varfarina", 10*day, 20*day))
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Expected the warfarin schedule, got %d", resp.StatusCode)
+	}
+	var ibuprofen scheduleResponse
+	resp = doJSON(t, "POST", dropper_url+"/schedules", later("Ibuprofeno", 30*day, 40*day))
+	decode(t, resp, &ibuprofen)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Schedules that do not overlap should not interact, got %d", resp.StatusCode)
+	}
+
+	// Mudar as datas volta a verificar as interações
+	start := time.Now().Add(15 * day).UTC()
+	resp = doJSON(t, "PATCH", fmt.Sprintf("%s/schedules/%d", dropper_url, ibuprofen.ID), updateScheduleBody{StartDate: &start})
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 when moving the schedule over the warfarin, got %d", resp.StatusCode)
+	}
+}
+
+func TestDoseLimitBlocksSchedule(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	token := registerTestUser(t)
+	var dropper dropperResponse
+	decode(t, doJSONAs(t, token, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "LIMITS", MachineUrl: uuid.NewString()}), &dropper)
+
+	resp := doJSONAs(t, token, "POST", "http://localhost:8080/api/v1/dose-limits", doseLimitBody{Medication: "aspirin", MaxDaily: 2})
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+
+	// 4 tomas por dia ultrapassam o máximo diário de 2
+	schedule := createDispenseScheduleBody{
+		Name:      "TOO MUCH",
+		Active:    true,
+		StartDate: time.Now().UTC(),
+		EndDate:   time.Now().Add(72 * time.Hour).UTC(),
+		Interval:  6 * time.Hour,
+		Pills:     map[string]int{"Aspirin": 1},
+	}
+	resp = doJSONAs(t, token, "POST", "http://localhost:8080/api/v1/droppers/"+dropper.SerialID.String()+"/schedules", schedule)
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 for a schedule above the daily limit, got %d", resp.StatusCode)
+	}
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if envelope.Error.Code != CodeDoseLimitExceeded || envelope.Error.Details[0].Code != "limit_daily" {
+		t.Fatalf("Unexpected error: %+v", envelope.Error)
+	}
+
+	var alerts pageResponse[alertResponse]
+	decode(t, doJSONAs(t, token, "GET", "http://localhost:8080/api/v1/alerts?active=true", nil), &alerts)
+	if alerts.Total != 1 || alerts.Data[0].Kind != models.AlertDoseLimit {
+		t.Fatalf("Expected one dose limit alert: %+v", alerts)
+	}
+
+	schedule.Interval = 12 * time.Hour
+	resp = doJSONAs(t, token, "POST", "http://localhost:8080/api/v1/droppers/"+dropper.SerialID.String()+"/schedules", schedule)
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+}
+
+func TestPrnRequestLockout(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "PRN", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	resp := doJSON(t, "POST", dropper_url+"/sections", createSectionBody{Name: "SECTION 1", Pills: models.PillList{"Paracetamol": 4}})
+	resp.Body.Close()
+
+	var schedule scheduleResponse
+	decode(t, doJSON(t, "POST", dropper_url+"/schedules", createDispenseScheduleBody{
+		Name:          "AS NEEDED",
+		Active:        true,
+		StartDate:     time.Now().Add(-time.Hour).UTC(),
+		EndDate:       time.Now().Add(72 * time.Hour).UTC(),
+		Interval:      6 * time.Hour,
+		Pills:         map[string]int{"Paracetamol": 1},
+		Kind:          models.ScheduleKindPRN,
+		MaxDailyDoses: 4,
+	}), &schedule)
+	if schedule.Kind != models.ScheduleKindPRN {
+		t.Fatalf("Expected a PRN schedule: %+v", schedule)
+	}
+
+	request_url := fmt.Sprintf("%s/schedules/%d/prn-requests", dropper_url, schedule.ID)
+	var first, second prnRequestResponse
+	decode(t, doJSON(t, "POST", request_url, nil), &first)
+	if !first.Granted || first.DoseID == nil {
+		t.Fatalf("The first request should be granted: %+v", first)
+	}
+
+	// O segundo pedido cai dentro do intervalo mínimo de 6 horas
+	decode(t, doJSON(t, "POST", request_url, nil), &second)
+	if second.Granted || second.Reason != models.PrnDeniedLockout || second.NextAllowedAt == nil {
+		t.Fatalf("The second request should be locked out: %+v", second)
+	}
+
+	var requests pageResponse[prnRequestResponse]
+	decode(t, doJSON(t, "GET", dropper_url+"/prn-requests", nil), &requests)
+	if requests.Total != 2 || requests.Data[0].ID != second.ID {
+		t.Fatalf("Expected both requests in the log: %+v", requests)
+	}
+}
+
+func TestTaperingScheduleValidatesPhases(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "TAPER", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	start := time.Now().Truncate(time.Hour).UTC()
+	day := 24 * time.Hour
+	schedule := createDispenseScheduleBody{
+		Name:      "TAPER",
+		Active:    true,
+		StartDate: start,
+		EndDate:   start.Add(6 * day),
+		Interval:  day,
+		Phases: []models.SchedulePhase{
+			{StartDate: start, EndDate: start.Add(3 * day), Pills: models.PillList{"Prednisolona": 4}},
+			{StartDate: start.Add(3*day + time.Hour), EndDate: start.Add(6 * day), Pills: models.PillList{"Prednisolona": 2}},
+		},
+	}
+
+	resp := doJSON(t, "POST", dropper_url+"/schedules", schedule)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for phases with a gap, got %d", resp.StatusCode)
+	}
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if envelope.Error.Code != CodeInvalidPhases || envelope.Error.Details[0].Field != "phases.1.start_date" {
+		t.Fatalf("Unexpected error: %+v", envelope.Error)
+	}
+
+	schedule.Phases[1].StartDate = start.Add(3 * day)
+	var created scheduleResponse
+	decode(t, doJSON(t, "POST", dropper_url+"/schedules", schedule), &created)
+	if len(created.Phases) != 2 || created.Phases[1].Pills["Prednisolona"] != 2 {
+		t.Fatalf("Expected the schedule with both phases: %+v", created)
+	}
+
+	schedule_url := fmt.Sprintf("%s/schedules/%d", dropper_url, created.ID)
+	resp = doJSON(t, "PATCH", schedule_url, map[string]any{"phases": []models.SchedulePhase{}})
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 400 || envelope.Error.Code != CodePhasesWithoutPills {
+		t.Fatalf("Expected 400 clearing the phases without pills, got %d %+v", resp.StatusCode, envelope.Error)
+	}
+
+	var cleared scheduleResponse
+	decode(t, doJSON(t, "PATCH", schedule_url, map[string]any{"phases": []models.SchedulePhase{}, "pills": models.PillList{"Prednisolona": 1}}), &cleared)
+	if len(cleared.Phases) != 0 || cleared.Pills["Prednisolona"] != 1 {
+		t.Fatalf("Expected the schedule back on its own pills: %+v", cleared)
+	}
+}
+
+func TestPauseAndSkipSchedule(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "PAUSE", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	var schedule scheduleResponse
+	decode(t, doJSON(t, "POST", dropper_url+"/schedules", createDispenseScheduleBody{
+		Name:      "DAILY",
+		Active:    true,
+		StartDate: time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		EndDate:   time.Now().Add(72 * time.Hour).UTC(),
+		Interval:  24 * time.Hour,
+		Pills:     map[string]int{"Aspirin": 1},
+	}), &schedule)
+	schedule_url := fmt.Sprintf("%s/schedules/%d", dropper_url, schedule.ID)
+
+	var skipped doseResponse
+	decode(t, doJSON(t, "POST", schedule_url+"/skip", skipBody{Reason: "consulta em jejum"}), &skipped)
+	if skipped.Status != models.DoseSkipped || !skipped.DueAt.Equal(schedule.StartDate) {
+		t.Fatalf("Expected the first dose to be skipped: %+v", skipped)
+	}
+
+	resume := time.Now().Add(48 * time.Hour).UTC()
+	var paused scheduleResponse
+	decode(t, doJSON(t, "POST", schedule_url+"/pause", pauseBody{Reason: "internamento", ResumeAt: &resume}), &paused)
+	if !paused.Paused || paused.ResumeAt == nil {
+		t.Fatalf("Expected the schedule to be paused: %+v", paused)
+	}
+
+	resp := doJSON(t, "POST", schedule_url+"/resume", nil)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	resp = doJSON(t, "POST", schedule_url+"/resume", nil)
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 resuming a schedule that is not paused, got %d", resp.StatusCode)
+	}
+
+	var controls pageResponse[scheduleControlResponse]
+	decode(t, doJSON(t, "GET", schedule_url+"/controls", nil), &controls)
+	if controls.Total != 3 || controls.Data[0].Action != models.ControlResume {
+		t.Fatalf("Expected the skip, pause and resume in the log: %+v", controls)
+	}
+}
+
+func TestScheduleReminders(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "REMIND", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	schedule := createDispenseScheduleBody{
+		Name:           "REMINDED",
+		Active:         true,
+		StartDate:      time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		EndDate:        time.Now().Add(72 * time.Hour).UTC(),
+		Interval:       8 * time.Hour,
+		Pills:          map[string]int{"Aspirin": 1},
+		ReminderLead:   15 * time.Minute,
+		MaxSnoozes:     3,
+		SnoozeDuration: 3 * time.Hour,
+	}
+
+	// Três adiamentos de 3 horas chegam à toma seguinte
+	resp := doJSON(t, "POST", dropper_url+"/schedules", schedule)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for snoozes longer than the interval, got %d", resp.StatusCode)
+	}
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if envelope.Error.Code != CodeInvalidReminder {
+		t.Fatalf("Unexpected error: %+v", envelope.Error)
+	}
+
+	schedule.SnoozeDuration = 10 * time.Minute
+	var created scheduleResponse
+	decode(t, doJSON(t, "POST", dropper_url+"/schedules", schedule), &created)
+	if created.MaxSnoozes != 3 || created.ReminderLead != 15*time.Minute {
+		t.Fatalf("Expected the schedule with reminders: %+v", created)
+	}
+
+	resp = doJSON(t, "POST", dropper_url+"/reminders/999999/snooze", nil)
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 snoozing an unknown reminder, got %d", resp.StatusCode)
+	}
+}
+
+func TestDoseConfirmationAndAdherence(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "ADHERENCE", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	name := "Ana"
+	var patient patientResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{Name: &name}), &patient)
+	patient_url := fmt.Sprintf("http://localhost:8080/api/v1/patients/%d", patient.ID)
+	doJSON(t, "POST", patient_url+"/droppers", linkDropperBody{Dropper: dropper.SerialID}).Body.Close()
+	doJSON(t, "POST", dropper_url+"/sections", createSectionBody{Name: "SECTION 1", Pills: models.PillList{"Paracetamol": 2}}).Body.Close()
+
+	resp := doJSON(t, "POST", dropper_url+"/dispense", dispenseBody{Pills: models.PillList{"Paracetamol": 1}})
+	resp.Body.Close()
+	if resp.StatusCode != 202 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+
+	var doses pageResponse[doseResponse]
+	decode(t, doJSON(t, "GET", dropper_url+"/doses", nil), &doses)
+	if doses.Total != 1 || doses.Data[0].Outcome != models.AdherencePending || doses.Data[0].ConfirmBy == nil {
+		t.Fatalf("Expected one dose waiting for confirmation: %+v", doses)
+	}
+	confirm_url := fmt.Sprintf("%s/doses/%d/confirm", dropper_url, doses.Data[0].ID)
+
+	var confirmed doseResponse
+	decode(t, doJSON(t, "POST", confirm_url, nil), &confirmed)
+	if confirmed.Outcome != models.AdherenceOnTime || confirmed.Confirmation == nil || confirmed.Confirmation.Event != models.ConfirmManual {
+		t.Fatalf("Expected the dose to be taken on time: %+v", confirmed)
+	}
+	resp = doJSON(t, "POST", confirm_url, nil)
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 confirming a dose twice, got %d", resp.StatusCode)
+	}
+
+	var adherence adherenceResponse
+	decode(t, doJSON(t, "GET", patient_url+"/adherence?period=day&medication=paracetamol", nil), &adherence)
+	if adherence.OnTime != 1 || adherence.OnTimeRate != 100 || len(adherence.Medications) != 1 {
+		t.Fatalf("Expected full adherence: %+v", adherence)
+	}
+
+	resp = doJSON(t, "GET", patient_url+"/adherence?period=year", nil)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for an unknown period, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestReport(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "REPORT", MachineUrl: uuid.NewString()}), &dropper)
+
+	name := "Rui"
+	var patient patientResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{Name: &name}), &patient)
+
+	to := time.Now().UTC()
+	body := createReportBody{
+		Kind:      models.ReportDispensing,
+		Format:    "pdf",
+		PatientID: &patient.ID,
+		Dropper:   &dropper.SerialID,
+		From:      to.AddDate(0, -1, 0),
+		To:        to,
+	}
+
+	// Um relatório é de um paciente ou de um dropper, não de ambos
+	resp := doJSON(t, "POST", "http://localhost:8080/api/v1/reports", body)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for a report of both a patient and a dropper, got %d", resp.StatusCode)
+	}
+
+	body.PatientID = nil
+	resp = doJSON(t, "POST", "http://localhost:8080/api/v1/reports", body)
+	if resp.StatusCode != 202 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var report reportResponse
+	decode(t, resp, &report)
+	if report.Status != models.ReportPending {
+		t.Fatalf("Expected a pending report: %+v", report)
+	}
+
+	// O relatório é gerado pelo ReportBGJob, que não corre nos testes
+	resp = doJSON(t, "GET", fmt.Sprintf("http://localhost:8080/api/v1/reports/%d/download", report.ID), nil)
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatalf("Expected 409 downloading a pending report, got %d", resp.StatusCode)
+	}
+}
+
+func TestCalendarFeed(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "CALENDAR", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	schedule := createDispenseScheduleBody{
+		Name:         "CALENDAR",
+		Active:       true,
+		StartDate:    time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		EndDate:      time.Now().Add(72 * time.Hour).UTC(),
+		Interval:     8 * time.Hour,
+		Pills:        map[string]int{"Aspirin": 1},
+		ReminderLead: 15 * time.Minute,
+	}
+	resp := doJSON(t, "POST", dropper_url+"/schedules", schedule)
+	resp.Body.Close()
+
+	resp = doJSON(t, "POST", dropper_url+"/calendar-feeds", nil)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var feed createdCalendarFeedResponse
+	decode(t, resp, &feed)
+
+	// O calendário é público, o token é a credencial
+	resp, err := http.Get("http://localhost:8080" + feed.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/calendar") {
+		t.Fatalf("Expected the calendar, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if strings.Count(string(ics), "BEGIN:VEVENT") != 9 || !strings.Contains(string(ics), "TRIGGER:-PT15M") {
+		t.Fatalf("Expected 9 doses with reminders:\n%s", ics)
+	}
+
+	resp = doJSON(t, "DELETE", fmt.Sprintf("http://localhost:8080/api/v1/calendar-feeds/%d", feed.ID), nil)
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("Expected 204 revoking the calendar, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://localhost:8080" + feed.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for a revoked calendar, got %d", resp.StatusCode)
+	}
+}
+
+func TestFHIRImport(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var dropper dropperResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/droppers", newDropper{Name: "FHIR", MachineUrl: uuid.NewString()}), &dropper)
+	dropper_url := "http://localhost:8080/api/v1/droppers/" + dropper.SerialID.String()
+
+	name := "Marta"
+	var patient patientResponse
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{Name: &name}), &patient)
+	patient_url := fmt.Sprintf("http://localhost:8080/api/v1/patients/%d", patient.ID)
+	doJSON(t, "POST", patient_url+"/droppers", linkDropperBody{Dropper: dropper.SerialID}).Body.Close()
+	doJSON(t, "POST", dropper_url+"/sections", createSectionBody{Name: "SECTION 1", Pills: models.PillList{"Metformina": 4}}).Body.Close()
+
+	request := func(medication string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{
+			"resourceType": "MedicationRequest", "status": "active", "intent": "order",
+			"subject": {"reference": "Patient/%d"},
+			"medicationCodeableConcept": {"text": "%s"},
+			"dosageInstruction": [{
+				"timing": {"repeat": {"frequency": 2, "period": 1, "periodUnit": "d", "boundsDuration": {"value": 7, "code": "d"}}},
+				"doseAndRate": [{"doseQuantity": {"value": 1}}]
+			}]
+		}`, patient.ID, medication))
+	}
+	bundle := fhir.Bundle{
+		ResourceType: fhir.TypeBundle,
+		Type:         fhir.BundleTransaction,
+		Entry:        []fhir.BundleEntry{{Resource: request("Metformina")}, {Resource: request("Varfarina")}},
+	}
+	import_url := "http://localhost:8080/api/v1/fhir?dropper=" + dropper.SerialID.String()
+
+	// A Varfarina não está carregada no dropper, nenhuma receita é criada
+	resp := doJSON(t, "POST", import_url, bundle)
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 409 || envelope.Error.Code != CodeMedicationNotStocked || envelope.Error.Details[0].Field != "entry.1.medicationCodeableConcept" {
+		t.Fatalf("Expected the second entry to be rejected: %d %+v", resp.StatusCode, envelope.Error)
+	}
+
+	bundle.Entry = bundle.Entry[:1]
+	resp = doJSON(t, "POST", import_url, bundle)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Erro!!! > %d", resp.StatusCode)
+	}
+	var response fhir.Bundle
+	decode(t, resp, &response)
+	if response.Type != fhir.BundleTransactionResponse || len(response.Entry) != 1 || response.Entry[0].Response.Status != "201 Created" {
+		t.Fatalf("Unexpected transaction response: %+v", response)
+	}
+
+	var requests fhir.Bundle
+	decode(t, doJSON(t, "GET", "http://localhost:8080/api/v1/fhir/Patient/"+fmt.Sprint(patient.ID)+"/MedicationRequest", nil), &requests)
+	if requests.Total == nil || *requests.Total != 1 || requests.Entry[0].ResourceType() != fhir.TypeMedicationRequest {
+		t.Fatalf("Expected the imported prescription: %+v", requests)
+	}
+}
+
+func TestBulkImport(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	name, machine_url := uuid.NewString(), uuid.NewString()
+	csv := strings.Join([]string{
+		"kind,dropper,name,machine_url,section,pill,count,pills,start_date,end_date,interval",
+		fmt.Sprintf("dropper,,%s,%s,,,,,,,", name, machine_url),
+		fmt.Sprintf("section,%s,,,SECTION 1,,,Aspirina:1,,,", name),
+		fmt.Sprintf("load,%s,,,SECTION 1,Aspirina,3,,,,", name),
+		fmt.Sprintf("schedule,%s,Manhã,,,,,Aspirina:1,2030-01-01T08:00:00Z,2030-02-01T08:00:00Z,24h", name),
+		fmt.Sprintf("load,%s,,,SECTION 9,Aspirina,1,,,,", name),
+	}, "\n")
+
+	// A última linha refere uma secção inexistente, nada é importado
+	resp, err := post(t, "http://localhost:8080/api/v1/imports?dry_run=true", "text/csv", strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report importResponse
+	decode(t, resp, &report)
+	if resp.StatusCode != 200 || report.Applied || report.Rows != 5 || len(report.Errors) != 1 || report.Errors[0].Field != "rows.5.section" {
+		t.Fatalf("Unexpected dry run report: %d %+v", resp.StatusCode, report)
+	}
+
+	resp, err = post(t, "http://localhost:8080/api/v1/imports", "text/csv", strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 400 || envelope.Error.Code != CodeInvalidImport || envelope.Error.Details[0].Code != "not_found" {
+		t.Fatalf("Expected the import to be rejected: %d %+v", resp.StatusCode, envelope.Error)
+	}
+
+	var droppers pageResponse[dropperResponse]
+	decode(t, doJSON(t, "GET", "http://localhost:8080/api/v1/droppers?name="+name, nil), &droppers)
+	if droppers.Total != 0 {
+		t.Fatal("Nothing should be saved when a row fails")
+	}
+
+	csv = csv[:strings.LastIndex(csv, "\n")]
+	resp, err = post(t, "http://localhost:8080/api/v1/imports", "text/csv", strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, resp, &report)
+	if resp.StatusCode != 201 || !report.Applied || report.Created[models.ImportLoad] != 1 || report.Created[models.ImportSchedule] != 1 {
+		t.Fatalf("Unexpected import: %d %+v", resp.StatusCode, report)
+	}
+
+	// Em JSON, um dropper com o endereço de um já importado
+	rows := []models.ImportRow{{Kind: models.ImportDropper, Name: name, MachineURL: machine_url}}
+	resp = doJSON(t, "POST", "http://localhost:8080/api/v1/imports?dry_run=true", rows)
+	decode(t, resp, &report)
+	if resp.StatusCode != 200 || len(report.Errors) != 1 || report.Errors[0].Code != CodeDropperExists {
+		t.Fatalf("Expected the duplicated dropper: %d %+v", resp.StatusCode, report)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	db, _ := database.NewPostgresConnection()
+
+	// O parceiro é um servidor local, fora dos testes recusado
+	resp := doJSON(t, "POST", "http://localhost:8080/api/v1/webhooks", gin.H{"url": "http://169.254.169.254/latest", "events": []string{"alert"}})
+	var envelope errorEnvelope
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 400 || envelope.Error.Code != CodeInvalidWebhook {
+		t.Fatalf("Internal addresses should be rejected: %d %+v", resp.StatusCode, envelope.Error)
+	}
+	webhooks.AllowPrivate = true
+	defer func() { webhooks.AllowPrivate = false }()
+
+	// O parceiro está em baixo na primeira entrega
+	var secret string
+	received := make([]string, 0)
+	partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := webhooks.Verify(secret, r.Header.Get(webhooks.SignatureHeader), body, time.Now()); err != nil {
+			t.Errorf("Invalid signature: %s", err.Error())
+		}
+		received = append(received, r.Header.Get(webhooks.EventHeader))
+		if len(received) == 1 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer partner.Close()
+
+	resp = doJSON(t, "POST", "http://localhost:8080/api/v1/webhooks", gin.H{"url": partner.URL, "events": []string{"alert", "unknown"}})
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 400 || envelope.Error.Code != CodeInvalidWebhook {
+		t.Fatalf("Unknown events should be rejected: %d %+v", resp.StatusCode, envelope.Error)
+	}
+
+	resp = doJSON(t, "POST", "http://localhost:8080/api/v1/webhooks", gin.H{"url": partner.URL, "events": []string{"alert"}})
+	var webhook createdWebhookResponse
+	decode(t, resp, &webhook)
+	if resp.StatusCode != 201 || webhook.Secret == "" || !webhook.Active {
+		t.Fatalf("Unexpected webhook: %d %+v", resp.StatusCode, webhook)
+	}
+	secret = webhook.Secret
+	base := fmt.Sprintf("http://localhost:8080/api/v1/webhooks/%d", webhook.ID)
+
+	var delivery webhookDeliveryResponse
+	resp = doJSON(t, "POST", base+"/ping", nil)
+	decode(t, resp, &delivery)
+	if resp.StatusCode != 202 || delivery.Status != models.DeliveryPending {
+		t.Fatalf("Unexpected ping: %d %+v", resp.StatusCode, delivery)
+	}
+
+	now := time.Now().UTC()
+	if err := models.DeliverWebhooks(db, http.DefaultClient, now); err != nil {
+		t.Fatal(err)
+	}
+	var deliveries pageResponse[webhookDeliveryResponse]
+	decode(t, doJSON(t, "GET", base+"/deliveries?status=pending", nil), &deliveries)
+	if deliveries.Total != 1 || deliveries.Data[0].Attempts != 1 || deliveries.Data[0].ResponseStatus != 503 {
+		t.Fatalf("Expected a retry to be scheduled: %+v", deliveries)
+	}
+
+	// A nova tentativa só é feita depois da espera
+	if err := models.DeliverWebhooks(db, http.DefaultClient, now.Add(webhooks.Backoff(1))); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 || received[1] != models.EventWebhookPing {
+		t.Fatalf("Expected the ping to be delivered, got %v", received)
+	}
+
+	resp = doJSON(t, "POST", fmt.Sprintf("%s/deliveries/%d/replay", base, delivery.ID), nil)
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 409 || envelope.Error.Code != CodeDeliveryNotFailed {
+		t.Fatalf("Delivered events should not be replayed: %d %+v", resp.StatusCode, envelope.Error)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	var preference notificationPreferenceResponse
+	resp := doJSON(t, "GET", "http://localhost:8080/api/v1/notification-preferences", nil)
+	decode(t, resp, &preference)
+	if resp.StatusCode != 200 || preference.Language != "pt" || len(preference.Channels) != 1 || preference.Channels[0] != "email" {
+		t.Fatalf("Unexpected default preferences: %d %+v", resp.StatusCode, preference)
+	}
+
+	// O canal de SMS precisa do número de telefone
+	var envelope errorEnvelope
+	resp = doJSON(t, "PATCH", "http://localhost:8080/api/v1/notification-preferences", gin.H{"channels": []string{"sms"}})
+	decode(t, resp, &envelope)
+	if resp.StatusCode != 400 || envelope.Error.Code != CodeInvalidNotification {
+		t.Fatalf("Expected INVALID_NOTIFICATION_PREFERENCE, got %d %+v", resp.StatusCode, envelope.Error)
+	}
+
+	resp = doJSON(t, "PATCH", "http://localhost:8080/api/v1/notification-preferences", gin.H{
+		"channels":    []string{"email", "sms"},
+		"phone":       "+351910000000",
+		"language":    "en",
+		"time_zone":   "Europe/Lisbon",
+		"quiet_start": "22:00",
+		"quiet_end":   "07:30",
+		"muted":       []string{"low_stock"},
+	})
+	decode(t, resp, &preference)
+	if resp.StatusCode != 200 || preference.QuietStart != "22:00" || len(preference.Muted) != 1 {
+		t.Fatalf("Unexpected preferences: %d %+v", resp.StatusCode, preference)
+	}
+
+	decode(t, doJSON(t, "GET", "http://localhost:8080/api/v1/notification-preferences", nil), &preference)
+	if preference.Language != "en" || preference.Phone != "+351910000000" || preference.TimeZone != "Europe/Lisbon" {
+		t.Fatalf("Preferences were not saved: %+v", preference)
+	}
+
+	var notifications pageResponse[notificationResponse]
+	resp = doJSON(t, "GET", "http://localhost:8080/api/v1/notifications?sort=-send_at", nil)
+	decode(t, resp, &notifications)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	wg.Add(1)
+	defer wg.Done()
+
+	db, _ := database.NewPostgresConnection()
+
+	var patient patientResponse
+	name, renamed := "Auditado", "Auditado Silva"
+	decode(t, doJSON(t, "POST", "http://localhost:8080/api/v1/patients", patientBody{Name: &name}), &patient)
+	resp := doJSON(t, "PATCH", fmt.Sprintf("http://localhost:8080/api/v1/patients/%d", patient.ID), patientBody{Name: &renamed})
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	if _, err := models.SealAuditEntries(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries pageResponse[auditEntryResponse]
+	url := fmt.Sprintf("http://localhost:8080/api/v1/audit?entity=patients&entity_id=%d", patient.ID)
+	resp = doJSON(t, "GET", url, nil)
+	decode(t, resp, &entries)
+	if resp.StatusCode != 200 || entries.Total != 2 {
+		t.Fatalf("Expected the creation and the update, got %d %+v", resp.StatusCode, entries)
+	}
+
+	update := entries.Data[0]
+	if update.Action != models.AuditUpdate || update.Source != models.AuditSourceAPI || update.UserID == nil || update.Seq == nil {
+		t.Fatalf("Unexpected audit entry %+v", update)
+	}
+	var before, after struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(update.Before, &before)
+	json.Unmarshal(update.After, &after)
+	if before.Name != name || after.Name != renamed {
+		t.Fatalf("Expected the name change, got %s -> %s", before.Name, after.Name)
+	}
+
+	verification, err := models.VerifyAudit(db)
+	if err != nil || verification.Problem != "" {
+		t.Fatalf("Expected an intact audit log: %+v %v", verification, err)
+	}
+}
@@ -0,0 +1,153 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type notificationPreferenceBody struct {
+	// Canais por onde os alertas são enviados: email, sms e push
+	Channels  []string `json:"channels"`
+	Phone     *string  `json:"phone"`
+	PushToken *string  `json:"push_token"`
+	// pt ou en
+	Language *string `json:"language"`
+	// Nome IANA, ex: Europe/Lisbon
+	TimeZone *string `json:"time_zone"`
+	// Horas de silêncio, HH:MM na hora local; vazias para desativar
+	QuietStart *string `json:"quiet_start"`
+	QuietEnd   *string `json:"quiet_end"`
+	// Tipos de alerta que não são notificados
+	Muted []string `json:"muted"`
+}
+
+func (b notificationPreferenceBody) fields() models.NotificationPreferenceFields {
+	return models.NotificationPreferenceFields{
+		Channels:   b.Channels,
+		Phone:      b.Phone,
+		PushToken:  b.PushToken,
+		Language:   b.Language,
+		TimeZone:   b.TimeZone,
+		QuietStart: b.QuietStart,
+		QuietEnd:   b.QuietEnd,
+		Muted:      b.Muted,
+	}
+}
+
+type notificationPreferenceResponse struct {
+	Channels   []string `json:"channels"`
+	Phone      string   `json:"phone"`
+	PushToken  string   `json:"push_token"`
+	Language   string   `json:"language"`
+	TimeZone   string   `json:"time_zone"`
+	QuietStart string   `json:"quiet_start"`
+	QuietEnd   string   `json:"quiet_end"`
+	Muted      []string `json:"muted"`
+}
+
+func newNotificationPreferenceResponse(p *models.NotificationPreference) notificationPreferenceResponse {
+	return notificationPreferenceResponse{
+		Channels:   p.Channels,
+		Phone:      p.Phone,
+		PushToken:  p.PushToken,
+		Language:   p.Language,
+		TimeZone:   p.TimeZone,
+		QuietStart: p.QuietStart,
+		QuietEnd:   p.QuietEnd,
+		Muted:      p.Muted,
+	}
+}
+
+type notificationResponse struct {
+	ID        uint       `json:"id"`
+	AlertID   *uint      `json:"alert_id"`
+	Kind      string     `json:"kind"`
+	Channel   string     `json:"channel"`
+	Address   string     `json:"address"`
+	Subject   string     `json:"subject"`
+	Body      string     `json:"body"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	SendAt    time.Time  `json:"send_at"`
+	SentAt    *time.Time `json:"sent_at"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func newNotificationResponse(n *models.Notification) notificationResponse {
+	return notificationResponse{
+		ID:        n.ID,
+		AlertID:   n.AlertID,
+		Kind:      n.Kind,
+		Channel:   n.Channel,
+		Address:   n.Address,
+		Subject:   n.Subject,
+		Body:      n.Body,
+		Status:    n.Status,
+		Attempts:  n.Attempts,
+		SendAt:    n.SendAt,
+		SentAt:    n.SentAt,
+		Error:     n.Error,
+		CreatedAt: n.CreatedAt,
+	}
+}
+
+func getNotificationPreferenceV1(c *gin.Context, db *gorm.DB) {
+	preference, err := models.FindNotificationPreference(db, currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newNotificationPreferenceResponse(preference))
+}
+
+func updateNotificationPreferenceV1(c *gin.Context, db *gorm.DB) {
+	var body notificationPreferenceBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	preference, err := models.FindNotificationPreference(db, currentUserID(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := preference.Update(db, body.fields()); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newNotificationPreferenceResponse(preference))
+}
+
+// listNotificationsV1 lista as notificações de alertas enviadas ao utilizador
+func listNotificationsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	list, total, err := models.ListNotifications(db, currentUserID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[notificationResponse]{
+		Data:    make([]notificationResponse, len(list)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range list {
+		page.Data[i] = newNotificationResponse(&list[i])
+	}
+	c.JSON(200, page)
+}
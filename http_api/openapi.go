@@ -0,0 +1,961 @@
+package http_api
+
+import (
+	_ "embed"
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/TomascpMarques/dropmedical/events"
+	"github.com/TomascpMarques/dropmedical/fhir"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+// apiOperation descreve uma rota da API para a especificação OpenAPI.
+// Query, Body e os valores de Responses são valores zero dos tipos Go usados pelos handlers,
+// a partir dos quais os schemas são gerados.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Summary string
+	Tag     string
+	Query   any
+	Body    any
+	// Content-types aceites no corpo, por omissão apenas json
+	Consumes  []string
+	Responses map[int]any
+	// Rotas públicas não exigem access token
+	Public bool
+}
+
+// messageResponse é a forma das respostas de sucesso geradas por returnMessage
+type messageResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// apiOperations lista todas as rotas registadas em SetupRoutesGroup
+var apiOperations = []apiOperation{
+	{
+		Method: "GET", Path: "/health_check/up", Tag: "health",
+		Summary:   "Verifica se a API está disponível",
+		Public:    true,
+		Responses: map[int]any{200: nil},
+	},
+	{
+		Method: "GET", Path: "/api/openapi.json", Tag: "docs",
+		Summary:   "Especificação OpenAPI desta API",
+		Public:    true,
+		Responses: map[int]any{200: map[string]any{}},
+	},
+	{
+		Method: "GET", Path: "/api/docs", Tag: "docs",
+		Summary:   "Documentação interativa da API",
+		Public:    true,
+		Responses: map[int]any{200: nil},
+	},
+	// ------------------------ Autenticação
+	{
+		Method: "POST", Path: "/api/auth/register", Tag: "auth", Public: true,
+		Summary:   "Cria uma conta de utilizador",
+		Body:      registerUserBody{},
+		Responses: map[int]any{201: userResponse{}, 400: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/auth/login", Tag: "auth", Public: true,
+		Summary:   "Inicia sessão e emite access e refresh tokens",
+		Body:      loginBody{},
+		Responses: map[int]any{200: tokenResponse{}, 400: errorEnvelope{}, 401: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/auth/refresh", Tag: "auth", Public: true,
+		Summary:   "Troca um refresh token por novos tokens",
+		Body:      refreshTokenBody{},
+		Responses: map[int]any{200: tokenResponse{}, 400: errorEnvelope{}, 401: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/auth/logout", Tag: "auth", Public: true,
+		Summary:   "Termina a sessão do refresh token",
+		Body:      refreshTokenBody{},
+		Responses: map[int]any{204: nil, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/auth/invites/accept", Tag: "auth", Public: true,
+		Summary:   "Aceita um convite e cria a conta no tenant do convite",
+		Body:      acceptInviteBody{},
+		Responses: map[int]any{201: userResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/auth/me", Tag: "auth",
+		Summary:   "Utilizador autenticado",
+		Responses: map[int]any{200: userResponse{}},
+	},
+	// ------------------------ Rotas originais
+	{
+		Method: "POST", Path: "/api/dropper", Tag: "legacy",
+		Summary:  "Regista um dropper",
+		Body:     newDropper{},
+		Consumes: []string{"application/json", "application/x-www-form-urlencoded"},
+		Responses: map[int]any{
+			200: models.Dropper{},
+			400: errorEnvelope{},
+			409: errorEnvelope{},
+			500: errorEnvelope{},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/dropper/section", Tag: "legacy",
+		Summary: "Cria uma secção num dropper",
+		Body:    newDropperSection{},
+		Responses: map[int]any{
+			201: newDropperSectionResponse{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/dropper/section/reload", Tag: "legacy",
+		Summary:  "Recarrega uma secção de um dropper",
+		Body:     reloadDropperSection{},
+		Consumes: []string{"application/json", "application/x-www-form-urlencoded"},
+		Responses: map[int]any{
+			200: messageResponse{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+			500: errorEnvelope{},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/dropper/schedule", Tag: "legacy",
+		Summary: "Cria um horário de dispensa",
+		Query:   createDispenseScheduleQuery{},
+		Body:    createDispenseScheduleBody{},
+		Responses: map[int]any{
+			200: messageResponse{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+			500: errorEnvelope{},
+		},
+	},
+	{
+		Method: "GET", Path: "/api/dropper/section/pills", Tag: "legacy",
+		Summary: "Posições da primeira secção de um dropper",
+		Query:   getSectionPillsQuery{},
+		Responses: map[int]any{
+			200: []models.Position{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+			500: errorEnvelope{},
+		},
+	},
+	{
+		Method: "GET", Path: "/api/dropper/activate", Tag: "legacy",
+		Summary: "Ativa um dropper",
+		Query:   dropperActivationQuery{},
+		Responses: map[int]any{
+			200: messageResponse{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+			500: errorEnvelope{},
+		},
+	},
+	{
+		Method: "GET", Path: "/api/dropper/dispense", Tag: "legacy",
+		Summary: "Dispensa comprimidos de um dropper",
+		Query:   dispensePillsQuery{},
+		Responses: map[int]any{
+			200: messageResponse{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+		},
+	},
+	{
+		Method: "GET", Path: "/api/dropper/discrepancies", Tag: "reconciliation",
+		Summary: "Discrepâncias entre os sensores do dropper e a base de dados",
+		Query:   dropperDiscrepanciesQuery{},
+		Responses: map[int]any{
+			200: []models.SlotDiscrepancy{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/dropper/discrepancies/resolve", Tag: "reconciliation",
+		Summary:  "Aceita a visão do dispositivo ou da base de dados para uma discrepância",
+		Body:     resolveDiscrepancyBody{},
+		Consumes: []string{"application/json", "application/x-www-form-urlencoded"},
+		Responses: map[int]any{
+			200: models.SlotDiscrepancy{},
+			400: errorEnvelope{},
+			404: errorEnvelope{},
+			409: errorEnvelope{},
+		},
+	},
+	// ------------------------ v1
+	{
+		Method: "GET", Path: "/api/v1/droppers", Tag: "droppers",
+		Summary:   "Lista droppers",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[dropperResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers", Tag: "droppers",
+		Summary:   "Regista um dropper",
+		Body:      newDropper{},
+		Responses: map[int]any{201: dropperResponse{}, 400: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial", Tag: "droppers",
+		Summary:   "Obtém um dropper pelo serial",
+		Responses: map[int]any{200: dropperResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/droppers/:serial", Tag: "droppers",
+		Summary:   "Renomeia, ativa ou desativa um dropper",
+		Body:      updateDropperBody{},
+		Responses: map[int]any{200: dropperResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/droppers/:serial", Tag: "droppers",
+		Summary:   "Remove um dropper",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/dispense", Tag: "droppers",
+		Summary:   "Dispensa comprimidos manualmente",
+		Body:      dispenseBody{},
+		Responses: map[int]any{202: messageResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/caregivers", Tag: "access",
+		Summary:   "Lista os cuidadores com acesso ao dropper",
+		Responses: map[int]any{200: []caregiverResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/caregivers", Tag: "access",
+		Summary:   "Convida um utilizador registado como cuidador do dropper",
+		Body:      inviteCaregiverBody{},
+		Responses: map[int]any{201: caregiverResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/droppers/:serial/caregivers/:user", Tag: "access",
+		Summary:   "Revoga o acesso de um cuidador ao dropper",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/members", Tag: "access",
+		Summary:   "Lista os utilizadores do tenant e os seus papéis",
+		Responses: map[int]any{200: []userResponse{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/members/invites", Tag: "access",
+		Summary:   "Convida uma pessoa sem conta para o tenant com um papel",
+		Body:      inviteMemberBody{},
+		Responses: map[int]any{201: inviteResponse{}, 400: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/members/:user", Tag: "access",
+		Summary:   "Muda o papel de um utilizador no tenant",
+		Body:      updateMemberBody{},
+		Responses: map[int]any{200: userResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/members/:user", Tag: "access",
+		Summary:   "Retira um utilizador do tenant",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/sections", Tag: "sections",
+		Summary:   "Lista as secções de um dropper",
+		Responses: map[int]any{200: []sectionResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/sections", Tag: "sections",
+		Summary:   "Cria uma secção",
+		Body:      createSectionBody{},
+		Responses: map[int]any{201: sectionResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/sections/:section", Tag: "sections",
+		Summary:   "Obtém uma secção",
+		Responses: map[int]any{200: sectionResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/droppers/:serial/sections/:section", Tag: "sections",
+		Summary:   "Remove uma secção",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/sections/:section/positions", Tag: "sections",
+		Summary:   "Lista as posições de uma secção",
+		Responses: map[int]any{200: []positionResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/sections/:section/reload", Tag: "sections",
+		Summary:   "Recarrega uma secção",
+		Body:      reloadSectionBody{},
+		Responses: map[int]any{200: sectionResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/schedules", Tag: "schedules",
+		Summary:   "Lista os horários de um dropper",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[scheduleResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/schedules", Tag: "schedules",
+		Summary:   "Cria um horário",
+		Body:      createDispenseScheduleBody{},
+		Responses: map[int]any{201: scheduleResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/schedules/:schedule", Tag: "schedules",
+		Summary:   "Obtém um horário",
+		Responses: map[int]any{200: scheduleResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/droppers/:serial/schedules/:schedule", Tag: "schedules",
+		Summary:   "Altera um horário",
+		Body:      updateScheduleBody{},
+		Responses: map[int]any{200: scheduleResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/droppers/:serial/schedules/:schedule", Tag: "schedules",
+		Summary:   "Remove um horário",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/schedules/:schedule/prn-requests", Tag: "schedules",
+		Summary:   "Pede uma toma de um horário em SOS, a resposta indica se foi aceite ou o motivo da recusa",
+		Responses: map[int]any{201: prnRequestResponse{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/schedules/:schedule/pause", Tag: "schedules",
+		Summary:   "Pausa o horário, até resume_at ou até ser retomado; as tomas da pausa ficam como saltadas",
+		Body:      pauseBody{},
+		Responses: map[int]any{200: scheduleResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/schedules/:schedule/resume", Tag: "schedules",
+		Summary:   "Retoma o horário em pausa",
+		Body:      resumeBody{},
+		Responses: map[int]any{200: scheduleResponse{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/schedules/:schedule/skip", Tag: "schedules",
+		Summary:   "Salta a próxima toma do horário, que fica no histórico como saltada",
+		Body:      skipBody{},
+		Responses: map[int]any{201: doseResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/schedules/:schedule/controls", Tag: "schedules",
+		Summary:   "Lista as pausas, retomas e tomas saltadas do horário, com quem as fez e porquê",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[scheduleControlResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/reminders", Tag: "schedules",
+		Summary:   "Lista os lembretes das próximas tomas do dropper",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[reminderResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/reminders/:reminder/snooze", Tag: "schedules",
+		Summary:   "Adia a toma do lembrete pelo tempo de adiamento do horário",
+		Responses: map[int]any{200: reminderResponse{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/patients/:patient/pause", Tag: "patients",
+		Summary:   "Pausa todos os horários ativos do paciente, ex: durante um internamento",
+		Body:      pauseBody{},
+		Responses: map[int]any{200: []scheduleResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/patients/:patient/resume", Tag: "patients",
+		Summary:   "Retoma todos os horários do paciente em pausa",
+		Body:      resumeBody{},
+		Responses: map[int]any{200: []scheduleResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/prn-requests", Tag: "schedules",
+		Summary:   "Lista os pedidos de tomas em SOS feitos no dropper, aceites e recusados",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[prnRequestResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/patients", Tag: "patients",
+		Summary:   "Lista os pacientes, com paginação e ordenação",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[patientResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/patients", Tag: "patients",
+		Summary:   "Cria um paciente",
+		Body:      patientBody{},
+		Responses: map[int]any{201: patientResponse{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/patients/:patient", Tag: "patients",
+		Summary:   "Obtém um paciente",
+		Responses: map[int]any{200: patientResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/patients/:patient", Tag: "patients",
+		Summary:   "Altera os dados de um paciente",
+		Body:      patientBody{},
+		Responses: map[int]any{200: patientResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/patients/:patient", Tag: "patients",
+		Summary:   "Remove um paciente, os seus horários ficam sem paciente",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/patients/:patient/schedules", Tag: "patients",
+		Summary:   "Lista os horários do paciente em todos os seus droppers",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[scheduleResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/patients/:patient/droppers", Tag: "patients",
+		Summary:   "Lista os droppers associados ao paciente",
+		Responses: map[int]any{200: []dropperResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/patients/:patient/droppers", Tag: "patients",
+		Summary:   "Associa um dropper ao paciente",
+		Body:      linkDropperBody{},
+		Responses: map[int]any{201: dropperResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/patients/:patient/droppers/:serial", Tag: "patients",
+		Summary:   "Desassocia um dropper do paciente e desativa os seus horários nesse dropper",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/patients/:patient/move", Tag: "patients",
+		Summary:   "Passa o paciente e os seus horários para um dropper de substituição",
+		Body:      movePatientBody{},
+		Responses: map[int]any{200: movePatientResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/patients/:patient/prescriptions", Tag: "prescriptions",
+		Summary:   "Lista as receitas do paciente, o filtro de nome aplica-se ao medicamento",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[prescriptionResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/patients/:patient/prescriptions", Tag: "prescriptions",
+		Summary:   "Cria uma receita e gera o seu horário no dropper indicado",
+		Body:      createPrescriptionBody{},
+		Responses: map[int]any{201: prescriptionResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/prescriptions/:prescription", Tag: "prescriptions",
+		Summary:   "Obtém uma receita e os horários que gerou",
+		Responses: map[int]any{200: prescriptionResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/prescriptions/:prescription", Tag: "prescriptions",
+		Summary:   "Altera uma receita, regenerando o horário se a posologia mudar",
+		Body:      prescriptionBody{},
+		Responses: map[int]any{200: prescriptionResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/prescriptions/:prescription", Tag: "prescriptions",
+		Summary:   "Cancela uma receita e termina os seus horários",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/prescriptions/:prescription/doses", Tag: "prescriptions",
+		Summary:   "Lista as tomas registadas a partir da receita",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[doseResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/droppers/:serial/doses", Tag: "droppers",
+		Summary:   "Lista as tomas dispensadas, ou falhadas, no dropper",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[doseResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/doses/:dose/confirm", Tag: "droppers",
+		Summary:   "Confirma na app que a toma dispensada foi feita",
+		Body:      confirmDoseBody{},
+		Responses: map[int]any{200: doseResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/patients/:patient/adherence", Tag: "patients",
+		Summary:   "Calcula a adesão do paciente às tomas, no total, por medicamento e por período",
+		Query:     adherenceQuery{},
+		Responses: map[int]any{200: adherenceResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/dose-limits", Tag: "safety",
+		Summary:   "Lista os limites de dose do catálogo e dos pacientes, o filtro de nome aplica-se ao medicamento",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[doseLimitResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/dose-limits", Tag: "safety",
+		Summary:   "Cria ou substitui o limite de dose de um medicamento, no catálogo ou de um paciente",
+		Body:      doseLimitBody{},
+		Responses: map[int]any{200: doseLimitResponse{}, 201: doseLimitResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/dose-limits/:limit", Tag: "safety",
+		Summary:   "Remove um limite de dose",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/alerts", Tag: "safety",
+		Summary:   "Lista os alertas do tenant, `active=true` devolve os que estão por confirmar",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[alertResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/alerts/:alert/acknowledge", Tag: "safety",
+		Summary:   "Confirma que o alerta foi visto",
+		Responses: map[int]any{200: alertResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/reports", Tag: "reports",
+		Summary:   "Lista os relatórios pedidos no tenant",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[reportResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/reports", Tag: "reports",
+		Summary:   "Pede um relatório de dispensa ou de adesão, gerado em segundo plano",
+		Body:      createReportBody{},
+		Responses: map[int]any{202: reportResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/reports/:report", Tag: "reports",
+		Summary:   "Obtém o estado de um relatório",
+		Responses: map[int]any{200: reportResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/reports/:report/download", Tag: "reports",
+		Summary:   "Descarrega o ficheiro CSV, JSON ou PDF do relatório",
+		Responses: map[int]any{200: nil, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	// ------------------------ Calendários
+	{
+		Method: "POST", Path: "/api/v1/patients/:patient/calendar-feeds", Tag: "calendar",
+		Summary:   "Cria um calendário das próximas tomas do paciente, o token só é devolvido nesta resposta",
+		Responses: map[int]any{201: createdCalendarFeedResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/droppers/:serial/calendar-feeds", Tag: "calendar",
+		Summary:   "Cria um calendário das próximas tomas do dropper, o token só é devolvido nesta resposta",
+		Responses: map[int]any{201: createdCalendarFeedResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/calendar-feeds", Tag: "calendar",
+		Summary:   "Lista os calendários criados pelo utilizador",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[calendarFeedResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/calendar-feeds/:feed", Tag: "calendar",
+		Summary:   "Revoga um calendário, o seu endereço deixa de funcionar",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/calendar/:token", Tag: "calendar", Public: true,
+		Summary:   "Calendário iCalendar das próximas tomas, o token funciona como credencial",
+		Responses: map[int]any{200: nil, 404: errorEnvelope{}},
+	},
+	// ------------------------ FHIR R4
+	{
+		Method: "GET", Path: "/api/v1/fhir/Patient/:patient/MedicationRequest", Tag: "fhir",
+		Summary:   "Bundle searchset com as receitas do paciente e os horários criados sem receita",
+		Responses: map[int]any{200: fhir.Bundle{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/fhir/Patient/:patient/MedicationDispense", Tag: "fhir",
+		Summary:   "Bundle searchset com as tomas do paciente previstas no período, um recurso por medicamento",
+		Query:     fhirSearchQuery{},
+		Responses: map[int]any{200: fhir.Bundle{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/fhir/Patient/:patient/MedicationAdministration", Tag: "fhir",
+		Summary:   "Bundle searchset com as tomas confirmadas do paciente no período",
+		Query:     fhirSearchQuery{},
+		Responses: map[int]any{200: fhir.Bundle{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/fhir", Tag: "fhir",
+		Summary:   "Importa um Bundle transaction de MedicationRequest, criando as receitas e os horários no dropper",
+		Query:     fhirImportQuery{},
+		Body:      fhir.Bundle{},
+		Consumes:  []string{"application/fhir+json", "application/json"},
+		Responses: map[int]any{200: fhir.Bundle{}, 400: errorEnvelope{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+	// ------------------------ Importação
+	{
+		Method: "POST", Path: "/api/v1/imports", Tag: "imports",
+		Summary:   "Importa droppers, secções, carregamentos e horários de um ficheiro CSV ou JSON, tudo ou nada",
+		Query:     importQuery{},
+		Body:      []models.ImportRow{},
+		Consumes:  []string{"text/csv", "application/json"},
+		Responses: map[int]any{200: importResponse{}, 201: importResponse{}, 400: errorEnvelope{}},
+	},
+	// ------------------------ Eventos em tempo real
+	{
+		Method: "GET", Path: "/api/v1/events", Tag: "events",
+		Summary:   "Eventos dos droppers acessíveis em Server-Sent Events (text/event-stream), retomados com Last-Event-ID",
+		Query:     eventsQuery{},
+		Responses: map[int]any{200: events.Event{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/events/ws", Tag: "events",
+		Summary:   "Eventos dos droppers acessíveis numa ligação WebSocket, uma mensagem JSON por evento",
+		Query:     eventsQuery{},
+		Responses: map[int]any{101: events.Event{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	// ------------------------ Notificações
+	{
+		Method: "GET", Path: "/api/v1/notification-preferences", Tag: "notifications",
+		Summary:   "Canais, idioma e horas de silêncio das notificações de alertas do utilizador",
+		Responses: map[int]any{200: notificationPreferenceResponse{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/notification-preferences", Tag: "notifications",
+		Summary:   "Altera as preferências de notificação do utilizador",
+		Body:      notificationPreferenceBody{},
+		Responses: map[int]any{200: notificationPreferenceResponse{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/notifications", Tag: "notifications",
+		Summary:   "Lista as notificações de alertas enviadas ao utilizador",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[notificationResponse]{}, 400: errorEnvelope{}},
+	},
+	// ------------------------ Auditoria
+	{
+		Method: "GET", Path: "/api/v1/audit", Tag: "audit",
+		Summary:   "Lista o histórico de alterações do tenant, com o autor, a origem e o estado antes e depois",
+		Query:     auditQuery{},
+		Responses: map[int]any{200: pageResponse[auditEntryResponse]{}, 400: errorEnvelope{}},
+	},
+	// ------------------------ Webhooks
+	{
+		Method: "GET", Path: "/api/v1/webhooks", Tag: "webhooks",
+		Summary:   "Lista os webhooks do tenant",
+		Query:     listQuery{},
+		Responses: map[int]any{200: pageResponse[webhookResponse]{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/webhooks", Tag: "webhooks",
+		Summary:   "Subscreve os eventos do tenant num endereço, o segredo das assinaturas só é devolvido nesta resposta",
+		Body:      webhookBody{},
+		Responses: map[int]any{201: createdWebhookResponse{}, 400: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/webhooks/:webhook", Tag: "webhooks",
+		Summary:   "Devolve um webhook",
+		Responses: map[int]any{200: webhookResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/webhooks/:webhook", Tag: "webhooks",
+		Summary:   "Altera o endereço, os eventos ou o estado do webhook",
+		Body:      webhookBody{},
+		Responses: map[int]any{200: webhookResponse{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/webhooks/:webhook", Tag: "webhooks",
+		Summary:   "Remove o webhook e o registo das suas entregas",
+		Responses: map[int]any{204: nil, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/webhooks/:webhook/ping", Tag: "webhooks",
+		Summary:   "Envia um evento ping de teste para o endereço do webhook",
+		Responses: map[int]any{202: webhookDeliveryResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/webhooks/:webhook/deliveries", Tag: "webhooks",
+		Summary:   "Registo das entregas do webhook, com o resultado da última tentativa",
+		Query:     webhookDeliveriesQuery{},
+		Responses: map[int]any{200: pageResponse[webhookDeliveryResponse]{}, 400: errorEnvelope{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/webhooks/:webhook/deliveries/replay", Tag: "webhooks",
+		Summary:   "Volta a enviar todas as entregas falhadas do webhook",
+		Responses: map[int]any{202: replayResponse{}, 404: errorEnvelope{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/webhooks/:webhook/deliveries/:delivery/replay", Tag: "webhooks",
+		Summary:   "Volta a enviar uma entrega falhada",
+		Responses: map[int]any{202: webhookDeliveryResponse{}, 404: errorEnvelope{}, 409: errorEnvelope{}},
+	},
+}
+
+// setupDocsRoutes expõe a especificação OpenAPI e a interface de documentação
+func setupDocsRoutes(api *gin.RouterGroup) {
+	spec := buildOpenAPISpec(apiOperations)
+
+	api.GET("/openapi.json", func(ctx *gin.Context) { ctx.JSON(200, spec) })
+	api.GET("/docs", func(ctx *gin.Context) { ctx.Data(200, "text/html; charset=utf-8", docsPage) })
+}
+
+var pathParamRegex = regexp.MustCompile(`:(\w+)`)
+
+// openAPIPath converte um caminho gin (`/a/:b`) para a notação OpenAPI (`/a/{b}`)
+func openAPIPath(path string) string {
+	return pathParamRegex.ReplaceAllString(path, "{$1}")
+}
+
+// buildOpenAPISpec gera o documento OpenAPI 3 a partir das operações e dos tipos Go associados
+func buildOpenAPISpec(operations []apiOperation) gin.H {
+	schemas := newSchemaRegistry()
+	paths := gin.H{}
+
+	for _, op := range operations {
+		path := openAPIPath(op.Path)
+		item, ok := paths[path].(gin.H)
+		if !ok {
+			item = gin.H{}
+			paths[path] = item
+		}
+
+		parameters := make([]gin.H, 0)
+		for _, match := range pathParamRegex.FindAllStringSubmatch(op.Path, -1) {
+			parameters = append(parameters, gin.H{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   gin.H{"type": "string"},
+			})
+		}
+		if op.Query != nil {
+			parameters = append(parameters, schemas.queryParameters(reflect.TypeOf(op.Query))...)
+		}
+
+		operation := gin.H{
+			"summary":     op.Summary,
+			"operationId": strings.ToLower(op.Method) + strings.ReplaceAll(openAPIPath(op.Path), "/", "_"),
+			"tags":        []string{op.Tag},
+			"parameters":  parameters,
+		}
+
+		if op.Body != nil {
+			consumes := op.Consumes
+			if len(consumes) == 0 {
+				consumes = []string{"application/json"}
+			}
+			content := gin.H{}
+			for _, media := range consumes {
+				content[media] = gin.H{"schema": schemas.schemaFor(reflect.TypeOf(op.Body))}
+			}
+			operation["requestBody"] = gin.H{"required": true, "content": content}
+		}
+
+		responses := gin.H{}
+		if !op.Public {
+			operation["security"] = []gin.H{{"bearerAuth": []string{}}}
+			if policy, ok := routePolicies[op.Method+" "+op.Path]; ok {
+				operation["description"] = "Permissão: `" + string(policy.permission) + "`"
+			}
+			for _, status := range []int{401, 403} {
+				responses[strconv.Itoa(status)] = gin.H{
+					"description": http.StatusText(status),
+					"content": gin.H{
+						"application/json": gin.H{"schema": schemas.schemaFor(reflect.TypeOf(errorEnvelope{}))},
+					},
+				}
+			}
+		}
+		for status, body := range op.Responses {
+			response := gin.H{"description": http.StatusText(status)}
+			if body != nil {
+				response["content"] = gin.H{
+					"application/json": gin.H{"schema": schemas.schemaFor(reflect.TypeOf(body))},
+				}
+			}
+			responses[strconv.Itoa(status)] = response
+		}
+		operation["responses"] = responses
+
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":   "Dropmedical API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": schemas.definitions,
+			"securitySchemes": gin.H{
+				"bearerAuth": gin.H{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// schemaRegistry gera schemas JSON a partir de tipos Go, guardando os structs nomeados em components
+type schemaRegistry struct {
+	definitions gin.H
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{definitions: gin.H{}}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	uuidType     = reflect.TypeOf(uuid.UUID{})
+	// JSON embutido sem schema fixo, ex: os recursos das entradas de um Bundle FHIR
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+	// Tipos simples serializados como texto, ex: interactions.Severity
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	// Nomes de tipos genéricos incluem o caminho do pacote dos parâmetros
+	packagePathRegex = regexp.MustCompile(`[\w./-]+\.`)
+)
+
+func schemaName(t reflect.Type) string {
+	name := packagePathRegex.ReplaceAllString(t.Name(), "")
+	name = strings.NewReplacer("[", "_", "]", "", ",", "_").Replace(name)
+	if t.PkgPath() != "" && !strings.HasSuffix(t.PkgPath(), "http_api") {
+		name = t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:] + "." + name
+	}
+	return name
+}
+
+func (r *schemaRegistry) schemaFor(t reflect.Type) gin.H {
+	switch t {
+	case timeType:
+		return gin.H{"type": "string", "format": "date-time"}
+	case durationType:
+		return gin.H{"type": "integer", "format": "int64", "description": "duração em nanosegundos"}
+	case uuidType:
+		return gin.H{"type": "string", "format": "uuid"}
+	case rawJSONType:
+		return gin.H{"type": "object"}
+	}
+	if t.Kind() != reflect.Struct && t.Kind() != reflect.Pointer && t.Implements(textMarshalerType) {
+		return gin.H{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := r.schemaFor(t.Elem())
+		if _, ref := schema["$ref"]; ref {
+			return gin.H{"allOf": []gin.H{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return gin.H{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": r.schemaFor(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": r.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return r.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, exists := r.definitions[name]; !exists {
+			// Reserva o nome antes de descer nos campos, para suportar tipos recursivos
+			r.definitions[name] = gin.H{}
+			r.definitions[name] = r.structSchema(t)
+		}
+		return gin.H{"$ref": "#/components/schemas/" + name}
+	}
+
+	return gin.H{}
+}
+
+// structSchema gera o schema de um struct a partir das tags json, incluindo campos embutidos
+func (r *schemaRegistry) structSchema(t reflect.Type) gin.H {
+	properties := gin.H{}
+	required := make([]string, 0)
+
+	var visit func(t reflect.Type)
+	visit = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+				continue
+			}
+
+			name, _, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				visit(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			properties[name] = r.schemaFor(field.Type)
+			if strings.Contains(field.Tag.Get("binding"), "required") {
+				required = append(required, name)
+			}
+		}
+	}
+	visit(t)
+
+	schema := gin.H{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// queryParameters gera os parâmetros de query a partir das tags form de um struct, incluindo
+// campos embutidos
+func (r *schemaRegistry) queryParameters(t reflect.Type) []gin.H {
+	parameters := make([]gin.H, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			parameters = append(parameters, r.queryParameters(field.Type)...)
+			continue
+		}
+		name := field.Tag.Get("form")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		parameters = append(parameters, gin.H{
+			"name":     name,
+			"in":       "query",
+			"required": strings.Contains(field.Tag.Get("binding"), "required"),
+			"schema":   r.schemaFor(field.Type),
+		})
+	}
+	return parameters
+}
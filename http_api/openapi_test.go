@@ -0,0 +1,42 @@
+package http_api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	r := gin.New()
+	ch := make(chan models.MqttActionRequest, 1)
+	SetupRoutesGroup(r, nil, &ch)
+
+	spec := buildOpenAPISpec(apiOperations)
+	paths := spec["paths"].(gin.H)
+
+	for _, route := range r.Routes() {
+		item, ok := paths[openAPIPath(route.Path)].(gin.H)
+		if !ok {
+			t.Errorf("Route %s %s is missing from the OpenAPI spec", route.Method, route.Path)
+			continue
+		}
+		if _, ok := item[strings.ToLower(route.Method)]; !ok {
+			t.Errorf("Route %s %s is missing from the OpenAPI spec", route.Method, route.Path)
+		}
+	}
+}
+
+func TestOpenAPISchemaFromTypes(t *testing.T) {
+	schemas := newSchemaRegistry()
+	schemas.schemaFor(reflect.TypeOf(reloadDropperSection{}))
+
+	schema := schemas.definitions["reloadDropperSection"].(gin.H)
+	dropper_id := schema["properties"].(gin.H)["dropper_id"].(gin.H)
+	if dropper_id["type"] != "string" || dropper_id["format"] != "uuid" {
+		t.Fatalf("dropper_id should be documented as an uuid, got %+v", dropper_id)
+	}
+}
@@ -0,0 +1,343 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type patientContact struct {
+	Name         string `json:"name" binding:"required"`
+	Relationship string `json:"relationship"`
+	Phone        string `json:"phone"`
+	Email        string `json:"email"`
+	Primary      bool   `json:"primary"`
+}
+
+type patientResponse struct {
+	ID        uint             `json:"id"`
+	Name      string           `json:"name"`
+	BirthDate *time.Time       `json:"birth_date"`
+	Sex       string           `json:"sex"`
+	TimeZone  string           `json:"time_zone"`
+	Allergies []string         `json:"allergies"`
+	Notes     string           `json:"notes"`
+	Contacts  []patientContact `json:"contacts"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+func newPatientResponse(p *models.Patient) patientResponse {
+	response := patientResponse{
+		ID:        p.ID,
+		Name:      p.Name,
+		BirthDate: p.BirthDate,
+		Sex:       p.Sex,
+		TimeZone:  p.TimeZone,
+		Allergies: p.Allergies,
+		Notes:     p.Notes,
+		Contacts:  make([]patientContact, len(p.Contacts)),
+		CreatedAt: p.CreatedAt,
+		UpdatedAt: p.UpdatedAt,
+	}
+	if response.Allergies == nil {
+		response.Allergies = []string{}
+	}
+	for i, contact := range p.Contacts {
+		response.Contacts[i] = patientContact{
+			Name:         contact.Name,
+			Relationship: contact.Relationship,
+			Phone:        contact.Phone,
+			Email:        contact.Email,
+			Primary:      contact.Primary,
+		}
+	}
+	return response
+}
+
+// patientBody é usado na criação e na alteração, campos omitidos não são alterados
+type patientBody struct {
+	Name      *string    `json:"name"`
+	BirthDate *time.Time `json:"birth_date"`
+	Sex       *string    `json:"sex"`
+	// Nome IANA, ex: Europe/Lisbon
+	TimeZone  *string  `json:"time_zone"`
+	Allergies []string `json:"allergies"`
+	Notes     *string  `json:"notes"`
+	// Substitui todos os contactos do paciente
+	Contacts []patientContact `json:"contacts" binding:"omitempty,dive"`
+}
+
+func (b patientBody) fields() models.PatientFields {
+	fields := models.PatientFields{
+		Name:      b.Name,
+		BirthDate: b.BirthDate,
+		Sex:       b.Sex,
+		TimeZone:  b.TimeZone,
+		Allergies: b.Allergies,
+		Notes:     b.Notes,
+	}
+	if b.Contacts != nil {
+		fields.Contacts = make([]models.PatientContact, len(b.Contacts))
+		for i, contact := range b.Contacts {
+			fields.Contacts[i] = models.PatientContact{
+				Name:         contact.Name,
+				Relationship: contact.Relationship,
+				Phone:        contact.Phone,
+				Email:        contact.Email,
+				Primary:      contact.Primary,
+			}
+		}
+	}
+	return fields
+}
+
+// patientFromPath procura o paciente do tenant identificado pelo parâmetro `:patient`
+func patientFromPath(c *gin.Context, db *gorm.DB) (*models.Patient, bool) {
+	id, ok := idFromPath(c, "patient", models.ErrPatientNotFound)
+	if !ok {
+		return nil, false
+	}
+
+	patient, err := models.FindPatient(db, currentTenantID(c), id)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return patient, true
+}
+
+func listPatientsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	patients, total, err := models.ListPatients(db, currentTenantID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[patientResponse]{
+		Data:    make([]patientResponse, len(patients)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range patients {
+		page.Data[i] = newPatientResponse(&patients[i])
+	}
+	c.JSON(200, page)
+}
+
+func createPatientV1(c *gin.Context, db *gorm.DB) {
+	var body patientBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if body.Name == nil || *body.Name == "" {
+		respondError(c, invalidFields(fieldError{Field: "name", Code: "required"}))
+		return
+	}
+
+	patient, err := models.CreatePatient(db, currentTenantID(c), body.fields())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newPatientResponse(patient))
+}
+
+func getPatientV1(c *gin.Context, db *gorm.DB) {
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newPatientResponse(patient))
+}
+
+func updatePatientV1(c *gin.Context, db *gorm.DB) {
+	var body patientBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := patient.Update(db, body.fields()); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newPatientResponse(patient))
+}
+
+func deletePatientV1(c *gin.Context, db *gorm.DB) {
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := patient.Delete(db); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+func listPatientSchedulesV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	schedules, total, err := patient.ListSchedules(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[scheduleResponse]{
+		Data:    make([]scheduleResponse, len(schedules)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range schedules {
+		if page.Data[i], err = newScheduleResponse(db, &schedules[i]); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	c.JSON(200, page)
+}
+
+func listPatientDroppersV1(c *gin.Context, db *gorm.DB) {
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	droppers, err := patient.ListDroppers(db)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response := make([]dropperResponse, len(droppers))
+	for i := range droppers {
+		response[i] = newDropperResponse(&droppers[i])
+	}
+	c.JSON(200, response)
+}
+
+type linkDropperBody struct {
+	Dropper uuid.UUID `json:"dropper_id" binding:"required"`
+}
+
+func linkPatientDropperV1(c *gin.Context, db *gorm.DB) {
+	var body linkDropperBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+	dropper, err := authorizedDropper(c, db, body.Dropper)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := patient.LinkDropper(db, dropper); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newDropperResponse(dropper))
+}
+
+func unlinkPatientDropperV1(c *gin.Context, db *gorm.DB) {
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := patient.UnlinkDropper(db, dropper); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+type movePatientBody struct {
+	From uuid.UUID `json:"from" binding:"required"`
+	To   uuid.UUID `json:"to" binding:"required"`
+}
+
+type movePatientResponse struct {
+	Dropper dropperResponse `json:"dropper"`
+	// Número de horários passados para o novo dropper
+	MovedSchedules int64 `json:"moved_schedules"`
+}
+
+func movePatientV1(c *gin.Context, db *gorm.DB) {
+	var body movePatientBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+	from, err := authorizedDropper(c, db, body.From)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	to, err := authorizedDropper(c, db, body.To)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	moved, err := patient.MoveToDropper(db, from, to)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, movePatientResponse{Dropper: newDropperResponse(to), MovedSchedules: moved})
+}
@@ -0,0 +1,278 @@
+package http_api
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// Chaves do contexto gin usadas pela verificação de permissões
+const (
+	actorKey      = "actor"
+	permissionKey = "permission"
+	dropperKey    = "dropper"
+)
+
+// routePolicy é a permissão exigida por uma rota. Se dropper for verdadeiro a permissão é
+// verificada nos papéis do utilizador nesse dropper, caso contrário no seu papel no tenant.
+type routePolicy struct {
+	permission models.Permission
+	dropper    bool
+}
+
+// routePolicies contêm a permissão de cada rota protegida, pelo método e caminho registados no gin.
+// Rotas protegidas que não constem aqui são sempre recusadas.
+var routePolicies = map[string]routePolicy{
+	"GET /api/auth/me": {models.PermViewAccount, false},
+
+	"POST /api/dropper":                       {models.PermManageDevices, false},
+	"POST /api/dropper/section":               {models.PermManageDevices, true},
+	"POST /api/dropper/section/reload":        {models.PermReloadSection, true},
+	"POST /api/dropper/schedule":              {models.PermManageSchedules, true},
+	"GET /api/dropper/section/pills":          {models.PermViewDropper, true},
+	"GET /api/dropper/activate":               {models.PermManageDevices, true},
+	"GET /api/dropper/dispense":               {models.PermDispense, true},
+	"GET /api/dropper/discrepancies":          {models.PermViewDropper, true},
+	"POST /api/dropper/discrepancies/resolve": {models.PermManageDevices, true},
+
+	"GET /api/v1/droppers":                   {models.PermViewDropper, false},
+	"POST /api/v1/droppers":                  {models.PermManageDevices, false},
+	"GET /api/v1/droppers/:serial":           {models.PermViewDropper, true},
+	"PATCH /api/v1/droppers/:serial":         {models.PermManageDevices, true},
+	"DELETE /api/v1/droppers/:serial":        {models.PermManageDevices, true},
+	"POST /api/v1/droppers/:serial/dispense": {models.PermDispense, true},
+
+	"GET /api/v1/droppers/:serial/caregivers":          {models.PermManageAccess, true},
+	"POST /api/v1/droppers/:serial/caregivers":         {models.PermManageAccess, true},
+	"DELETE /api/v1/droppers/:serial/caregivers/:user": {models.PermManageAccess, true},
+
+	"GET /api/v1/members":          {models.PermManageAccess, false},
+	"POST /api/v1/members/invites": {models.PermManageAccess, false},
+	"PATCH /api/v1/members/:user":  {models.PermManageAccess, false},
+	"DELETE /api/v1/members/:user": {models.PermManageAccess, false},
+
+	"GET /api/v1/droppers/:serial/sections":                    {models.PermViewDropper, true},
+	"POST /api/v1/droppers/:serial/sections":                   {models.PermManageDevices, true},
+	"GET /api/v1/droppers/:serial/sections/:section":           {models.PermViewDropper, true},
+	"DELETE /api/v1/droppers/:serial/sections/:section":        {models.PermManageDevices, true},
+	"GET /api/v1/droppers/:serial/sections/:section/positions": {models.PermViewDropper, true},
+	"POST /api/v1/droppers/:serial/sections/:section/reload":   {models.PermReloadSection, true},
+
+	"GET /api/v1/patients":                              {models.PermViewPatients, false},
+	"POST /api/v1/patients":                             {models.PermManagePatients, false},
+	"GET /api/v1/patients/:patient":                     {models.PermViewPatients, false},
+	"PATCH /api/v1/patients/:patient":                   {models.PermManagePatients, false},
+	"DELETE /api/v1/patients/:patient":                  {models.PermManagePatients, false},
+	"GET /api/v1/patients/:patient/schedules":           {models.PermViewSchedules, false},
+	"GET /api/v1/patients/:patient/droppers":            {models.PermViewPatients, false},
+	"POST /api/v1/patients/:patient/droppers":           {models.PermManagePatients, true},
+	"DELETE /api/v1/patients/:patient/droppers/:serial": {models.PermManagePatients, true},
+	"POST /api/v1/patients/:patient/move":               {models.PermManagePatients, true},
+
+	"GET /api/v1/patients/:patient/prescriptions":   {models.PermViewSchedules, false},
+	"POST /api/v1/patients/:patient/prescriptions":  {models.PermManageSchedules, true},
+	"GET /api/v1/prescriptions/:prescription":       {models.PermViewSchedules, false},
+	"PATCH /api/v1/prescriptions/:prescription":     {models.PermManageSchedules, true},
+	"DELETE /api/v1/prescriptions/:prescription":    {models.PermManageSchedules, true},
+	"GET /api/v1/prescriptions/:prescription/doses": {models.PermViewSchedules, false},
+	"GET /api/v1/droppers/:serial/doses":            {models.PermViewSchedules, true},
+
+	"GET /api/v1/dose-limits":                {models.PermViewSchedules, false},
+	"POST /api/v1/dose-limits":               {models.PermManageSchedules, false},
+	"DELETE /api/v1/dose-limits/:limit":      {models.PermManageSchedules, false},
+	"GET /api/v1/alerts":                     {models.PermViewSchedules, false},
+	"POST /api/v1/alerts/:alert/acknowledge": {models.PermAckAlerts, false},
+
+	"GET /api/v1/droppers/:serial/schedules":              {models.PermViewSchedules, true},
+	"POST /api/v1/droppers/:serial/schedules":             {models.PermManageSchedules, true},
+	"GET /api/v1/droppers/:serial/schedules/:schedule":    {models.PermViewSchedules, true},
+	"PATCH /api/v1/droppers/:serial/schedules/:schedule":  {models.PermManageSchedules, true},
+	"DELETE /api/v1/droppers/:serial/schedules/:schedule": {models.PermManageSchedules, true},
+
+	"POST /api/v1/droppers/:serial/schedules/:schedule/prn-requests": {models.PermRequestPRN, true},
+	"GET /api/v1/droppers/:serial/prn-requests":                      {models.PermViewSchedules, true},
+
+	"POST /api/v1/droppers/:serial/schedules/:schedule/pause":   {models.PermControlSchedule, true},
+	"POST /api/v1/droppers/:serial/schedules/:schedule/resume":  {models.PermControlSchedule, true},
+	"POST /api/v1/droppers/:serial/schedules/:schedule/skip":    {models.PermControlSchedule, true},
+	"GET /api/v1/droppers/:serial/schedules/:schedule/controls": {models.PermViewSchedules, true},
+	"POST /api/v1/patients/:patient/pause":                      {models.PermControlSchedule, false},
+	"POST /api/v1/patients/:patient/resume":                     {models.PermControlSchedule, false},
+
+	"GET /api/v1/droppers/:serial/reminders":                   {models.PermViewSchedules, true},
+	"POST /api/v1/droppers/:serial/reminders/:reminder/snooze": {models.PermSnoozeDose, true},
+
+	"POST /api/v1/droppers/:serial/doses/:dose/confirm": {models.PermConfirmDose, true},
+	"GET /api/v1/patients/:patient/adherence":           {models.PermViewSchedules, false},
+
+	"GET /api/v1/reports":                  {models.PermExportReports, false},
+	"POST /api/v1/reports":                 {models.PermExportReports, false},
+	"GET /api/v1/reports/:report":          {models.PermExportReports, false},
+	"GET /api/v1/reports/:report/download": {models.PermExportReports, false},
+
+	"POST /api/v1/patients/:patient/calendar-feeds": {models.PermShareCalendar, false},
+	"POST /api/v1/droppers/:serial/calendar-feeds":  {models.PermShareCalendar, true},
+	"GET /api/v1/calendar-feeds":                    {models.PermShareCalendar, false},
+	"DELETE /api/v1/calendar-feeds/:feed":           {models.PermShareCalendar, false},
+
+	"GET /api/v1/fhir/Patient/:patient/MedicationRequest":        {models.PermViewSchedules, false},
+	"GET /api/v1/fhir/Patient/:patient/MedicationDispense":       {models.PermViewSchedules, false},
+	"GET /api/v1/fhir/Patient/:patient/MedicationAdministration": {models.PermViewSchedules, false},
+	"POST /api/v1/fhir": {models.PermManageSchedules, true},
+
+	"POST /api/v1/imports": {models.PermImportData, false},
+
+	"GET /api/v1/events":    {models.PermViewDropper, true},
+	"GET /api/v1/events/ws": {models.PermViewDropper, true},
+
+	"GET /api/v1/notification-preferences":   {models.PermViewAccount, false},
+	"PATCH /api/v1/notification-preferences": {models.PermViewAccount, false},
+	"GET /api/v1/notifications":              {models.PermViewAccount, false},
+
+	"GET /api/v1/audit": {models.PermViewAudit, false},
+
+	"GET /api/v1/webhooks":                                       {models.PermManageWebhooks, false},
+	"POST /api/v1/webhooks":                                      {models.PermManageWebhooks, false},
+	"GET /api/v1/webhooks/:webhook":                              {models.PermManageWebhooks, false},
+	"PATCH /api/v1/webhooks/:webhook":                            {models.PermManageWebhooks, false},
+	"DELETE /api/v1/webhooks/:webhook":                           {models.PermManageWebhooks, false},
+	"POST /api/v1/webhooks/:webhook/ping":                        {models.PermManageWebhooks, false},
+	"GET /api/v1/webhooks/:webhook/deliveries":                   {models.PermManageWebhooks, false},
+	"POST /api/v1/webhooks/:webhook/deliveries/replay":           {models.PermManageWebhooks, false},
+	"POST /api/v1/webhooks/:webhook/deliveries/:delivery/replay": {models.PermManageWebhooks, false},
+}
+
+// sensitivePermissions são verificadas com o tenant e o papel guardados na base de dados, e não
+// com os do access token, para que uma mudança de papel tenha efeito antes de o token expirar.
+// As rotas de um dropper são sempre verificadas assim, qualquer que seja a permissão.
+var sensitivePermissions = map[models.Permission]bool{
+	models.PermManageAccess:    true,
+	models.PermManageSchedules: true,
+	models.PermDispense:        true,
+	models.PermReloadSection:   true,
+	models.PermControlSchedule: true,
+	models.PermExportReports:   true,
+	models.PermImportData:      true,
+	models.PermManageWebhooks:  true,
+	models.PermViewAudit:       true,
+}
+
+// authorizeRoute aplica a routePolicy da rota. Nas rotas com `:serial` o dropper é verificado
+// aqui e guardado no contexto; nas rotas que recebem o dropper no corpo ou na query a permissão
+// fica no contexto e é verificada por authorizedDropper quando o handler procura o dropper.
+func authorizeRoute(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy, ok := routePolicies[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			respondError(c, newAPIError(403, CodeForbidden))
+			return
+		}
+		c.Set(permissionKey, policy.permission)
+
+		if policy.dropper || sensitivePermissions[policy.permission] {
+			user, err := models.FindUser(db, currentUserID(c))
+			if errors.Is(err, models.ErrUserNotFound) {
+				respondError(c, newAPIError(401, CodeUnauthorized))
+				return
+			} else if err != nil {
+				respondError(c, err)
+				return
+			}
+			c.Set(tenantIDKey, user.TenantID)
+			c.Set(actorKey, models.Actor{UserID: user.ID, TenantID: user.TenantID, Role: user.Role})
+		}
+
+		if !policy.dropper {
+			if !currentActor(c).Role.Can(policy.permission) {
+				respondError(c, newAPIError(403, CodeForbidden))
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if c.Param("serial") != "" {
+			serial, err := uuid.Parse(c.Param("serial"))
+			if err != nil {
+				respondError(c, models.ErrDropperNotFound)
+				return
+			}
+			dropper, err := authorizedDropper(c, db, serial)
+			if err != nil {
+				respondError(c, err)
+				return
+			}
+			c.Set(dropperKey, dropper)
+		}
+		c.Next()
+	}
+}
+
+// currentActor devolve o utilizador autenticado, o seu tenant e o seu papel
+func currentActor(c *gin.Context) models.Actor {
+	actor, _ := c.Get(actorKey)
+	value, _ := actor.(models.Actor)
+	return value
+}
+
+// requestDB devolve a ligação usada pelo pedido, cujas alterações ficam no histórico de
+// auditoria em nome do utilizador autenticado
+func requestDB(c *gin.Context, db *gorm.DB) *gorm.DB {
+	actor := models.AuditActor{Source: models.AuditSourceAPI}
+	if current := currentActor(c); current.UserID != 0 {
+		actor.UserID, actor.TenantID = &current.UserID, &current.TenantID
+	}
+	return models.AuditAs(db, actor)
+}
+
+// authorizedDropper procura o dropper acessível ao utilizador e confirma que este tem a
+// permissão exigida pela rota. Droppers inacessíveis respondem como inexistentes.
+func authorizedDropper(c *gin.Context, db *gorm.DB, serial uuid.UUID) (*models.Dropper, error) {
+	if cached, ok := c.Get(dropperKey); ok {
+		if dropper := cached.(*models.Dropper); dropper.SerialID == serial {
+			return dropper, nil
+		}
+	}
+
+	dropper, err := models.FindDropperBySerial(db, currentActor(c), serial)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDropperPermission(c, db, dropper); err != nil {
+		return nil, err
+	}
+	return dropper, nil
+}
+
+// authorizedDropperByID é igual a authorizedDropper, para as rotas que usam o id interno do dropper
+func authorizedDropperByID(c *gin.Context, db *gorm.DB, id uint) (*models.Dropper, error) {
+	dropper, err := models.FindDropper(db, currentActor(c), id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDropperPermission(c, db, dropper); err != nil {
+		return nil, err
+	}
+	return dropper, nil
+}
+
+func checkDropperPermission(c *gin.Context, db *gorm.DB, dropper *models.Dropper) error {
+	value, _ := c.Get(permissionKey)
+	permission, ok := value.(models.Permission)
+	if !ok {
+		return newAPIError(403, CodeForbidden)
+	}
+
+	allowed, err := currentActor(c).Can(db, dropper, permission)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return newAPIError(403, CodeForbidden)
+	}
+	return nil
+}
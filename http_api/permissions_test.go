@@ -0,0 +1,71 @@
+package http_api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/TomascpMarques/dropmedical/auth"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+func TestEveryProtectedRouteHasAPolicy(t *testing.T) {
+	r := gin.New()
+	ch := make(chan models.MqttActionRequest, 1)
+	SetupRoutesGroup(r, nil, &ch)
+
+	public := map[string]bool{}
+	for _, op := range apiOperations {
+		if op.Public {
+			public[op.Method+" "+op.Path] = true
+		}
+	}
+
+	for _, route := range r.Routes() {
+		key := route.Method + " " + route.Path
+		if public[key] {
+			continue
+		}
+		if _, ok := routePolicies[key]; !ok {
+			t.Errorf("Route %s has no permission policy", key)
+		}
+	}
+}
+
+func TestAuthorizeRouteByTenantRole(t *testing.T) {
+	t.Setenv("JWT_SECRET", "a-test-secret-that-is-long-enough-for-hs256")
+
+	r := gin.New()
+	api := r.Group("/api", requireAuth(), authorizeRoute(nil))
+	api.GET("/v1/droppers", func(ctx *gin.Context) { ctx.Status(200) })
+	api.POST("/v1/droppers", func(ctx *gin.Context) { ctx.Status(201) })
+	api.GET("/unlisted", func(ctx *gin.Context) { ctx.Status(200) })
+
+	patient, _, _ := auth.NewAccessToken(1, 1, string(models.RolePatient))
+	admin, _, _ := auth.NewAccessToken(2, 1, string(models.RoleAdmin))
+
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"GET", "/api/v1/droppers", patient, 200},
+		{"POST", "/api/v1/droppers", patient, 403},
+		{"POST", "/api/v1/droppers", admin, 201},
+		// Rotas sem política são sempre recusadas
+		{"GET", "/api/unlisted", admin, 403},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		if resp.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, resp.Code)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type prescriptionResponse struct {
+	ID               uint          `json:"id"`
+	PatientID        uint          `json:"patient_id"`
+	Medication       string        `json:"medication"`
+	Dose             uint          `json:"dose"`
+	Frequency        time.Duration `json:"frequency"`
+	StartDate        time.Time     `json:"start_date"`
+	Duration         time.Duration `json:"duration"`
+	EndDate          time.Time     `json:"end_date"`
+	Prescriber       string        `json:"prescriber"`
+	RefillsRemaining uint          `json:"refills_remaining"`
+	Instructions     string        `json:"instructions"`
+	Revision         uint          `json:"revision"`
+	Active           bool          `json:"active"`
+	// Horários gerados pela receita, o primeiro é o da revisão atual
+	Schedules []scheduleResponse `json:"schedules"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+func newPrescriptionResponse(db *gorm.DB, p *models.Prescription) (prescriptionResponse, error) {
+	response := prescriptionResponse{
+		ID:               p.ID,
+		PatientID:        p.PatientID,
+		Medication:       p.Medication,
+		Dose:             p.Dose,
+		Frequency:        p.Frequency,
+		StartDate:        p.StartDate,
+		Duration:         p.Duration,
+		EndDate:          p.EndDate(),
+		Prescriber:       p.Prescriber,
+		RefillsRemaining: p.RefillsRemaining,
+		Instructions:     p.Instructions,
+		Revision:         p.Revision,
+		Active:           p.Active,
+		CreatedAt:        p.CreatedAt,
+		UpdatedAt:        p.UpdatedAt,
+	}
+
+	schedules, err := p.ListSchedules(db)
+	if err != nil {
+		return response, err
+	}
+	response.Schedules = make([]scheduleResponse, len(schedules))
+	for i := range schedules {
+		if response.Schedules[i], err = newScheduleResponse(db, &schedules[i]); err != nil {
+			return response, err
+		}
+	}
+	return response, nil
+}
+
+// prescriptionBody é usado na alteração, campos omitidos não são alterados
+type prescriptionBody struct {
+	Medication *string `json:"medication"`
+	// Comprimidos por toma
+	Dose *uint `json:"dose"`
+	// Tempo entre tomas, em nanossegundos
+	Frequency *time.Duration `json:"frequency"`
+	StartDate *time.Time     `json:"start_date"`
+	// Duração do tratamento, em nanossegundos
+	Duration         *time.Duration `json:"duration"`
+	Prescriber       *string        `json:"prescriber"`
+	RefillsRemaining *uint          `json:"refills_remaining"`
+	Instructions     *string        `json:"instructions"`
+	// Motivo para gerar o horário apesar de interações graves, fica registado
+	OverrideReason string `json:"override_reason"`
+}
+
+func (b prescriptionBody) fields(c *gin.Context) models.PrescriptionFields {
+	return models.PrescriptionFields{
+		Medication:       b.Medication,
+		Dose:             b.Dose,
+		Frequency:        b.Frequency,
+		StartDate:        b.StartDate,
+		Duration:         b.Duration,
+		Prescriber:       b.Prescriber,
+		RefillsRemaining: b.RefillsRemaining,
+		Instructions:     b.Instructions,
+		Override:         overrideFrom(c, b.OverrideReason),
+	}
+}
+
+type createPrescriptionBody struct {
+	prescriptionBody
+	// Dropper onde os horários são criados, tem de estar associado ao paciente
+	Dropper uuid.UUID `json:"dropper_id" binding:"required"`
+}
+
+type doseResponse struct {
+	ID             uint            `json:"id"`
+	ScheduleID     *uint           `json:"schedule_id"`
+	PrescriptionID *uint           `json:"prescription_id"`
+	PatientID      *uint           `json:"patient_id"`
+	DueAt          time.Time       `json:"due_at"`
+	DispensedAt    *time.Time      `json:"dispensed_at"`
+	ConfirmBy      *time.Time      `json:"confirm_by"`
+	Source         string          `json:"source"`
+	Status         string          `json:"status"`
+	Reason         string          `json:"reason,omitempty"`
+	Pills          models.PillList `json:"pills"`
+	// Resultado da toma para a adesão: on_time, late, missed ou pending, vazio se não foi dispensada
+	Outcome      string                    `json:"outcome,omitempty"`
+	Confirmation *doseConfirmationResponse `json:"confirmation"`
+}
+
+func newDoseResponse(r *models.DispenseRecord) doseResponse {
+	return doseResponse{
+		ID:             r.ID,
+		ScheduleID:     r.ScheduleID,
+		PrescriptionID: r.PrescriptionID,
+		PatientID:      r.PatientID,
+		DueAt:          r.DueAt,
+		DispensedAt:    r.DispensedAt,
+		ConfirmBy:      r.ConfirmBy,
+		Source:         r.Source,
+		Status:         r.Status,
+		Reason:         r.Reason,
+		Pills:          r.Pills,
+		Outcome:        r.Outcome(time.Now().UTC()),
+		Confirmation:   newDoseConfirmationResponse(r.Confirmation),
+	}
+}
+
+func newDosePage(records []models.DispenseRecord, options models.ListOptions, total int64) pageResponse[doseResponse] {
+	page := pageResponse[doseResponse]{
+		Data:    make([]doseResponse, len(records)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range records {
+		page.Data[i] = newDoseResponse(&records[i])
+	}
+	return page
+}
+
+// prescriptionFromPath procura a receita do tenant identificada pelo parâmetro `:prescription`
+func prescriptionFromPath(c *gin.Context, db *gorm.DB) (*models.Prescription, bool) {
+	id, ok := idFromPath(c, "prescription", models.ErrPrescriptionNotFound)
+	if !ok {
+		return nil, false
+	}
+
+	prescription, err := models.FindPrescription(db, currentTenantID(c), id)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return prescription, true
+}
+
+// respondPrescription responde com a receita e os seus horários
+func respondPrescription(c *gin.Context, db *gorm.DB, status int, p *models.Prescription) {
+	response, err := newPrescriptionResponse(db, p)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(status, response)
+}
+
+func listPrescriptionsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	prescriptions, total, err := patient.ListPrescriptions(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[prescriptionResponse]{
+		Data:    make([]prescriptionResponse, len(prescriptions)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range prescriptions {
+		if page.Data[i], err = newPrescriptionResponse(db, &prescriptions[i]); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	c.JSON(200, page)
+}
+
+func createPrescriptionV1(c *gin.Context, db *gorm.DB) {
+	var body createPrescriptionBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	invalid := make([]fieldError, 0)
+	if body.Medication == nil || *body.Medication == "" {
+		invalid = append(invalid, fieldError{Field: "medication", Code: "required"})
+	}
+	if body.Dose == nil || *body.Dose < 1 {
+		invalid = append(invalid, fieldError{Field: "dose", Code: "positive"})
+	}
+	if body.Frequency == nil || *body.Frequency < models.MinScheduleInterval {
+		invalid = append(invalid, fieldError{Field: "frequency", Code: "min"})
+	}
+	if body.StartDate == nil {
+		invalid = append(invalid, fieldError{Field: "start_date", Code: "required"})
+	}
+	if body.Duration == nil || *body.Duration <= 0 {
+		invalid = append(invalid, fieldError{Field: "duration", Code: "positive"})
+	}
+	if len(invalid) > 0 {
+		respondError(c, invalidFields(invalid...))
+		return
+	}
+
+	patient, ok := patientFromPath(c, db)
+	if !ok {
+		return
+	}
+	dropper, err := authorizedDropper(c, db, body.Dropper)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	prescription, err := models.CreatePrescription(db, patient, dropper, body.fields(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	respondPrescription(c, db, 201, prescription)
+}
+
+func getPrescriptionV1(c *gin.Context, db *gorm.DB) {
+	prescription, ok := prescriptionFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	respondPrescription(c, db, 200, prescription)
+}
+
+func amendPrescriptionV1(c *gin.Context, db *gorm.DB) {
+	var body prescriptionBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	prescription, ok := prescriptionFromPath(c, db)
+	if !ok {
+		return
+	}
+	if _, err := authorizedDropperByID(c, db, prescription.DropperID); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := prescription.Amend(db, body.fields(c)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	respondPrescription(c, db, 200, prescription)
+}
+
+func cancelPrescriptionV1(c *gin.Context, db *gorm.DB) {
+	prescription, ok := prescriptionFromPath(c, db)
+	if !ok {
+		return
+	}
+	if _, err := authorizedDropperByID(c, db, prescription.DropperID); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := prescription.Cancel(db); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+func listPrescriptionDosesV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	prescription, ok := prescriptionFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	records, total, err := prescription.ListDoses(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newDosePage(records, options, total))
+}
+
+func listDropperDosesV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	records, total, err := dropper.ListDoses(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newDosePage(records, options, total))
+}
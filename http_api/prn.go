@@ -0,0 +1,89 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type prnRequestResponse struct {
+	ID         uint   `json:"id"`
+	ScheduleID uint   `json:"schedule_id"`
+	PatientID  *uint  `json:"patient_id"`
+	UserID     *uint  `json:"user_id"`
+	Source     string `json:"source"`
+	Granted    bool   `json:"granted"`
+	// Motivo da recusa: inactive, lockout, daily_cap, dose_limit ou not_enough_pills
+	Reason        string     `json:"reason,omitempty"`
+	NextAllowedAt *time.Time `json:"next_allowed_at"`
+	DoseID        *uint      `json:"dose_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func newPrnRequestResponse(r *models.PrnRequest) prnRequestResponse {
+	return prnRequestResponse{
+		ID:            r.ID,
+		ScheduleID:    r.ScheduleID,
+		PatientID:     r.PatientID,
+		UserID:        r.UserID,
+		Source:        r.Source,
+		Granted:       r.Granted,
+		Reason:        r.Reason,
+		NextAllowedAt: r.NextAllowedAt,
+		DoseID:        r.DoseID,
+		CreatedAt:     r.CreatedAt,
+	}
+}
+
+// requestPRNV1 pede uma toma em SOS pela app. O pedido fica sempre registado, aceite ou não,
+// e a resposta indica o motivo da recusa.
+func requestPRNV1(c *gin.Context, db *gorm.DB, ch *chan models.MqttActionRequest) {
+	_, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	userID := currentUserID(c)
+	request, commands, err := schedule.RequestPRN(db, models.PrnSourceApp, &userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	for _, command := range commands {
+		*ch <- command
+	}
+
+	c.JSON(201, newPrnRequestResponse(request))
+}
+
+func listPrnRequestsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	requests, total, err := dropper.ListPrnRequests(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[prnRequestResponse]{
+		Data:    make([]prnRequestResponse, len(requests)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range requests {
+		page.Data[i] = newPrnRequestResponse(&requests[i])
+	}
+	c.JSON(200, page)
+}
@@ -0,0 +1,71 @@
+package http_api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type dropperDiscrepanciesQuery struct {
+	Dropper         uuid.UUID `form:"dropper" binding:"required"`
+	IncludeResolved bool      `form:"include_resolved"`
+}
+
+func dropperDiscrepanciesGET(c *gin.Context, db *gorm.DB) {
+	var query dropperDiscrepanciesQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, err := authorizedDropper(c, db, query.Dropper)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	discrepancies, err := dropper.ListDiscrepancies(db, query.IncludeResolved)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, discrepancies)
+}
+
+type resolveDiscrepancyBody struct {
+	Dropper     uuid.UUID `form:"dropper_id" json:"dropper_id" binding:"required"`
+	Discrepancy uint      `form:"discrepancy_id" json:"discrepancy_id" binding:"required"`
+	// "device" ou "database"
+	Accept   string `form:"accept" json:"accept" binding:"required"`
+	PillName string `form:"pill_name" json:"pill_name"`
+}
+
+func resolveDropperDiscrepancyPOST(c *gin.Context, db *gorm.DB) {
+	var body resolveDiscrepancyBody
+
+	if err := c.ShouldBind(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, err := authorizedDropper(c, db, body.Dropper)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	discrepancy, err := dropper.ResolveDiscrepancy(db, body.Discrepancy, body.Accept, body.PillName)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if discrepancy.Resolution == models.ResolutionDevice {
+		dropper.PublishEvent(models.EventInventory, models.InventoryEvent{Reason: models.InventoryOccupancy})
+	}
+
+	c.JSON(200, discrepancy)
+}
@@ -0,0 +1,83 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type reminderResponse struct {
+	ID         uint      `json:"id"`
+	ScheduleID uint      `json:"schedule_id"`
+	DueAt      time.Time `json:"due_at"`
+	DispenseAt time.Time `json:"dispense_at"`
+	Reminded   bool      `json:"reminded"`
+	Snoozes    uint      `json:"snoozes"`
+}
+
+func newReminderResponse(r *models.DoseReminder) reminderResponse {
+	return reminderResponse{
+		ID:         r.ID,
+		ScheduleID: r.ScheduleID,
+		DueAt:      r.DueAt,
+		DispenseAt: r.DispenseAt,
+		Reminded:   r.Reminded,
+		Snoozes:    r.Snoozes,
+	}
+}
+
+func listRemindersV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	reminders, total, err := dropper.ListReminders(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[reminderResponse]{
+		Data:    make([]reminderResponse, len(reminders)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range reminders {
+		page.Data[i] = newReminderResponse(&reminders[i])
+	}
+	c.JSON(200, page)
+}
+
+// snoozeReminderV1 adia a toma do lembrete, como o botão do dropper
+func snoozeReminderV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+	id, ok := idFromPath(c, "reminder", models.ErrReminderNotFound)
+	if !ok {
+		return
+	}
+
+	reminder, err := dropper.FindReminder(db, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := reminder.Snooze(db); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newReminderResponse(reminder))
+}
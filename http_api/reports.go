@@ -0,0 +1,158 @@
+package http_api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// createReportBody pede um relatório de um paciente ou de um dropper, indicando apenas um deles
+type createReportBody struct {
+	Kind      string     `json:"kind" binding:"required,oneof=dispensing adherence"`
+	Format    string     `json:"format" binding:"required,oneof=csv json pdf"`
+	PatientID *uint      `json:"patient_id"`
+	Dropper   *uuid.UUID `json:"dropper"`
+	From      time.Time  `json:"from" binding:"required"`
+	To        time.Time  `json:"to" binding:"required"`
+	// Período da adesão: day, week ou month
+	Period string `json:"period" binding:"omitempty,oneof=day week month"`
+}
+
+type reportResponse struct {
+	ID        uint      `json:"id"`
+	UserID    uint      `json:"user_id"`
+	Kind      string    `json:"kind"`
+	Format    string    `json:"format"`
+	PatientID *uint     `json:"patient_id"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Period    string    `json:"period"`
+	// pending, ready ou failed
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	FileName    string     `json:"file_name,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+func newReportResponse(r *models.Report) reportResponse {
+	return reportResponse{
+		ID:          r.ID,
+		UserID:      r.UserID,
+		Kind:        r.Kind,
+		Format:      r.Format,
+		PatientID:   r.PatientID,
+		From:        r.From,
+		To:          r.To,
+		Period:      r.Period,
+		Status:      r.Status,
+		Error:       r.Error,
+		FileName:    r.FileName,
+		CreatedAt:   r.CreatedAt,
+		CompletedAt: r.CompletedAt,
+	}
+}
+
+// createReportV1 regista o pedido de relatório, gerado em segundo plano. O cliente consulta o
+// estado do relatório até estar pronto para descarregar.
+func createReportV1(c *gin.Context, db *gorm.DB) {
+	var body createReportBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	fields := models.ReportFields{
+		Kind:      body.Kind,
+		Format:    body.Format,
+		PatientID: body.PatientID,
+		From:      body.From,
+		To:        body.To,
+		Period:    body.Period,
+	}
+	if body.Dropper != nil {
+		dropper, err := authorizedDropper(c, db, *body.Dropper)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		fields.DropperID = &dropper.ID
+	}
+
+	report, err := models.RequestReport(db, currentTenantID(c), currentUserID(c), fields)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(202, newReportResponse(report))
+}
+
+func listReportsV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	list, total, err := models.ListReports(db, currentTenantID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[reportResponse]{
+		Data:    make([]reportResponse, len(list)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range list {
+		page.Data[i] = newReportResponse(&list[i])
+	}
+	c.JSON(200, page)
+}
+
+func reportFromPath(c *gin.Context, db *gorm.DB) (*models.Report, bool) {
+	id, ok := idFromPath(c, "report", models.ErrReportNotFound)
+	if !ok {
+		return nil, false
+	}
+
+	report, err := models.FindReport(db, currentTenantID(c), id)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return report, true
+}
+
+func getReportV1(c *gin.Context, db *gorm.DB) {
+	report, ok := reportFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newReportResponse(report))
+}
+
+// downloadReportV1 envia o ficheiro do relatório, se já estiver pronto
+func downloadReportV1(c *gin.Context, db *gorm.DB) {
+	report, ok := reportFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	content, contentType, err := report.Download(db)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+report.FileName+`"`)
+	c.Data(200, contentType, content)
+}
@@ -0,0 +1,763 @@
+package http_api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/interactions"
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// setupV1Routes regista a API orientada a recursos com o prefixo `/api/v1`
+func setupV1Routes(api *gin.RouterGroup, db *gorm.DB, ch *chan models.MqttActionRequest) {
+	v1 := api.Group("/v1")
+	// ------------------------
+	v1.GET("/droppers", func(ctx *gin.Context) { listDroppersV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers", func(ctx *gin.Context) { createDropperV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial", func(ctx *gin.Context) { getDropperV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/droppers/:serial", func(ctx *gin.Context) { updateDropperV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/droppers/:serial", func(ctx *gin.Context) { deleteDropperV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/dispense", func(ctx *gin.Context) { dispenseV1(ctx, requestDB(ctx, db), ch) })
+
+	v1.GET("/droppers/:serial/caregivers", func(ctx *gin.Context) { listCaregiversV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/caregivers", func(ctx *gin.Context) { inviteCaregiverV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/droppers/:serial/caregivers/:user", func(ctx *gin.Context) { revokeCaregiverV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/members", func(ctx *gin.Context) { listMembersV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/members/invites", func(ctx *gin.Context) { inviteMemberV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/members/:user", func(ctx *gin.Context) { updateMemberV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/members/:user", func(ctx *gin.Context) { removeMemberV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/droppers/:serial/sections", func(ctx *gin.Context) { listSectionsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/sections", func(ctx *gin.Context) { createSectionV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial/sections/:section", func(ctx *gin.Context) { getSectionV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/droppers/:serial/sections/:section", func(ctx *gin.Context) { deleteSectionV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial/sections/:section/positions", func(ctx *gin.Context) { listPositionsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/sections/:section/reload", func(ctx *gin.Context) { reloadSectionV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/droppers/:serial/schedules", func(ctx *gin.Context) { listSchedulesV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/schedules", func(ctx *gin.Context) { createScheduleV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial/schedules/:schedule", func(ctx *gin.Context) { getScheduleV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/droppers/:serial/schedules/:schedule", func(ctx *gin.Context) { updateScheduleV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/droppers/:serial/schedules/:schedule", func(ctx *gin.Context) { deleteScheduleV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/schedules/:schedule/prn-requests", func(ctx *gin.Context) { requestPRNV1(ctx, requestDB(ctx, db), ch) })
+	v1.GET("/droppers/:serial/prn-requests", func(ctx *gin.Context) { listPrnRequestsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/schedules/:schedule/pause", func(ctx *gin.Context) { pauseScheduleV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/schedules/:schedule/resume", func(ctx *gin.Context) { resumeScheduleV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/schedules/:schedule/skip", func(ctx *gin.Context) { skipDoseV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial/schedules/:schedule/controls", func(ctx *gin.Context) { listScheduleControlsV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial/reminders", func(ctx *gin.Context) { listRemindersV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/reminders/:reminder/snooze", func(ctx *gin.Context) { snoozeReminderV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/patients", func(ctx *gin.Context) { listPatientsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/patients", func(ctx *gin.Context) { createPatientV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/patients/:patient", func(ctx *gin.Context) { getPatientV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/patients/:patient", func(ctx *gin.Context) { updatePatientV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/patients/:patient", func(ctx *gin.Context) { deletePatientV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/patients/:patient/schedules", func(ctx *gin.Context) { listPatientSchedulesV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/patients/:patient/droppers", func(ctx *gin.Context) { listPatientDroppersV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/patients/:patient/droppers", func(ctx *gin.Context) { linkPatientDropperV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/patients/:patient/droppers/:serial", func(ctx *gin.Context) { unlinkPatientDropperV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/patients/:patient/move", func(ctx *gin.Context) { movePatientV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/patients/:patient/pause", func(ctx *gin.Context) { pausePatientV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/patients/:patient/resume", func(ctx *gin.Context) { resumePatientV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/patients/:patient/prescriptions", func(ctx *gin.Context) { listPrescriptionsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/patients/:patient/prescriptions", func(ctx *gin.Context) { createPrescriptionV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/prescriptions/:prescription", func(ctx *gin.Context) { getPrescriptionV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/prescriptions/:prescription", func(ctx *gin.Context) { amendPrescriptionV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/prescriptions/:prescription", func(ctx *gin.Context) { cancelPrescriptionV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/prescriptions/:prescription/doses", func(ctx *gin.Context) { listPrescriptionDosesV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/droppers/:serial/doses", func(ctx *gin.Context) { listDropperDosesV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/doses/:dose/confirm", func(ctx *gin.Context) { confirmDoseV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/patients/:patient/adherence", func(ctx *gin.Context) { patientAdherenceV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/dose-limits", func(ctx *gin.Context) { listDoseLimitsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/dose-limits", func(ctx *gin.Context) { setDoseLimitV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/dose-limits/:limit", func(ctx *gin.Context) { deleteDoseLimitV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/alerts", func(ctx *gin.Context) { listAlertsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/alerts/:alert/acknowledge", func(ctx *gin.Context) { acknowledgeAlertV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/reports", func(ctx *gin.Context) { listReportsV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/reports", func(ctx *gin.Context) { createReportV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/reports/:report", func(ctx *gin.Context) { getReportV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/reports/:report/download", func(ctx *gin.Context) { downloadReportV1(ctx, requestDB(ctx, db)) })
+
+	v1.POST("/patients/:patient/calendar-feeds", func(ctx *gin.Context) { createPatientCalendarFeedV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/droppers/:serial/calendar-feeds", func(ctx *gin.Context) { createDropperCalendarFeedV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/calendar-feeds", func(ctx *gin.Context) { listCalendarFeedsV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/calendar-feeds/:feed", func(ctx *gin.Context) { revokeCalendarFeedV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/fhir/Patient/:patient/MedicationRequest", func(ctx *gin.Context) { patientMedicationRequestsFHIR(ctx, requestDB(ctx, db)) })
+	v1.GET("/fhir/Patient/:patient/MedicationDispense", func(ctx *gin.Context) {
+		patientDosesFHIR(ctx, requestDB(ctx, db), (*models.Patient).FHIRMedicationDispenses)
+	})
+	v1.GET("/fhir/Patient/:patient/MedicationAdministration", func(ctx *gin.Context) {
+		patientDosesFHIR(ctx, requestDB(ctx, db), (*models.Patient).FHIRMedicationAdministrations)
+	})
+	v1.POST("/fhir", func(ctx *gin.Context) { importFHIRBundleV1(ctx, requestDB(ctx, db)) })
+
+	v1.POST("/imports", func(ctx *gin.Context) { importV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/events", func(ctx *gin.Context) { eventsSSE(ctx, requestDB(ctx, db)) })
+	v1.GET("/events/ws", func(ctx *gin.Context) { eventsWebSocket(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/notification-preferences", func(ctx *gin.Context) { getNotificationPreferenceV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/notification-preferences", func(ctx *gin.Context) { updateNotificationPreferenceV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/notifications", func(ctx *gin.Context) { listNotificationsV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/audit", func(ctx *gin.Context) { listAuditEntriesV1(ctx, requestDB(ctx, db)) })
+
+	v1.GET("/webhooks", func(ctx *gin.Context) { listWebhooksV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/webhooks", func(ctx *gin.Context) { createWebhookV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/webhooks/:webhook", func(ctx *gin.Context) { getWebhookV1(ctx, requestDB(ctx, db)) })
+	v1.PATCH("/webhooks/:webhook", func(ctx *gin.Context) { updateWebhookV1(ctx, requestDB(ctx, db)) })
+	v1.DELETE("/webhooks/:webhook", func(ctx *gin.Context) { deleteWebhookV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/webhooks/:webhook/ping", func(ctx *gin.Context) { pingWebhookV1(ctx, requestDB(ctx, db)) })
+	v1.GET("/webhooks/:webhook/deliveries", func(ctx *gin.Context) { listWebhookDeliveriesV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/webhooks/:webhook/deliveries/replay", func(ctx *gin.Context) { replayFailedWebhookDeliveriesV1(ctx, requestDB(ctx, db)) })
+	v1.POST("/webhooks/:webhook/deliveries/:delivery/replay", func(ctx *gin.Context) { replayWebhookDeliveryV1(ctx, requestDB(ctx, db)) })
+	// ------------------------
+}
+
+// ---------------------------------------------------------------------
+// Respostas
+
+type dropperResponse struct {
+	SerialID   uuid.UUID `json:"serial_id"`
+	Name       string    `json:"name"`
+	Active     bool      `json:"active"`
+	MachineURL string    `json:"machine_url"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newDropperResponse(d *models.Dropper) dropperResponse {
+	return dropperResponse{
+		SerialID:   d.SerialID,
+		Name:       d.Name,
+		Active:     d.Active,
+		MachineURL: d.MachineURL,
+		CreatedAt:  d.CreatedAt,
+		UpdatedAt:  d.UpdatedAt,
+	}
+}
+
+type positionResponse struct {
+	Position uint   `json:"position"`
+	PillName string `json:"pill_name"`
+	Empty    bool   `json:"is_empty"`
+}
+
+type sectionResponse struct {
+	ID              uint               `json:"id"`
+	Index           uint               `json:"index"`
+	Section         string             `json:"section"`
+	CurrentPosition uint               `json:"current_position"`
+	Empty           bool               `json:"is_empty"`
+	Positions       []positionResponse `json:"positions"`
+}
+
+func newSectionResponse(s *models.DropperSection, index uint) sectionResponse {
+	positions := make([]positionResponse, len(s.Positions))
+	for i, p := range s.Positions {
+		positions[i] = positionResponse{Position: p.Position, PillName: p.PillName, Empty: p.Empty}
+	}
+
+	return sectionResponse{
+		ID:              s.ID,
+		Index:           index,
+		Section:         s.Section,
+		CurrentPosition: s.CurrentPosition,
+		Empty:           s.Empty,
+		Positions:       positions,
+	}
+}
+
+type scheduleResponse struct {
+	ID          uint          `json:"id"`
+	Name        string        `json:"name"`
+	Active      bool          `json:"active"`
+	Description string        `json:"description"`
+	StartDate   time.Time     `json:"start_date"`
+	EndDate     time.Time     `json:"end_date"`
+	Interval    time.Duration `json:"interval"`
+	// scheduled ou prn, nos horários em SOS interval é o tempo mínimo entre tomas
+	Kind          string          `json:"kind"`
+	MaxDailyDoses uint            `json:"max_daily_doses"`
+	Pills         models.PillList `json:"pills"`
+	// Doses por fase, nos horários de desmame ou titulação
+	Phases    []models.SchedulePhase `json:"phases,omitempty"`
+	PatientID *uint                  `json:"patient_id"`
+	// Pausa em curso, sem resume_at dura até ser retomado
+	Paused   bool       `json:"paused"`
+	PausedAt *time.Time `json:"paused_at"`
+	ResumeAt *time.Time `json:"resume_at"`
+	// Lembretes antes de cada toma, em nanossegundos, 0 não envia
+	ReminderLead   time.Duration `json:"reminder_lead"`
+	MaxSnoozes     uint          `json:"max_snoozes"`
+	SnoozeDuration time.Duration `json:"snooze_duration"`
+	// Receita que gerou o horário
+	PrescriptionID *uint `json:"prescription_id"`
+	// Avisos de interações, só na resposta à criação ou alteração
+	Warnings []interactions.Warning `json:"warnings,omitempty"`
+}
+
+func newScheduleResponse(db *gorm.DB, s *models.DispenseSchedule) (scheduleResponse, error) {
+	pills, err := s.Pills(db)
+
+	return scheduleResponse{
+		ID:             s.ID,
+		Name:           s.Name,
+		Active:         s.Active,
+		Description:    s.Description,
+		StartDate:      s.StartDate,
+		EndDate:        s.EndDate,
+		Interval:       s.Interval,
+		Kind:           s.Kind,
+		MaxDailyDoses:  s.MaxDailyDoses,
+		Pills:          pills,
+		Phases:         s.Phases,
+		Paused:         s.Paused(),
+		PausedAt:       s.PausedAt,
+		ResumeAt:       s.ResumeAt,
+		ReminderLead:   s.ReminderLead,
+		MaxSnoozes:     s.MaxSnoozes,
+		SnoozeDuration: s.SnoozeDuration,
+		PatientID:      s.PatientID,
+		PrescriptionID: s.PrescriptionID,
+		Warnings:       s.Warnings,
+	}, err
+}
+
+type pageResponse[T any] struct {
+	Data    []T   `json:"data"`
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int64 `json:"total"`
+}
+
+// ---------------------------------------------------------------------
+// Auxiliares
+
+type listQuery struct {
+	Page    int    `form:"page"`
+	PerPage int    `form:"per_page"`
+	Active  *bool  `form:"active"`
+	Name    string `form:"name"`
+	Sort    string `form:"sort"`
+}
+
+func bindListOptions(c *gin.Context) (models.ListOptions, bool) {
+	var query listQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return models.ListOptions{}, false
+	}
+
+	return models.ListOptions{
+		Page:    query.Page,
+		PerPage: query.PerPage,
+		Active:  query.Active,
+		Name:    query.Name,
+		Sort:    query.Sort,
+	}, true
+}
+
+// dropperFromPath devolve o dropper identificado pelo parâmetro `:serial`, já autorizado por
+// authorizeRoute, respondendo 404 se não existir
+func dropperFromPath(c *gin.Context, db *gorm.DB) (*models.Dropper, bool) {
+	serial, err := uuid.Parse(c.Param("serial"))
+	if err != nil {
+		respondError(c, models.ErrDropperNotFound)
+		return nil, false
+	}
+
+	dropper, err := authorizedDropper(c, db, serial)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return dropper, true
+}
+
+// idFromPath lê um identificador numérico do caminho, respondendo com notFound se for inválido
+func idFromPath(c *gin.Context, param string, notFound error) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(param), 10, 64)
+	if err != nil {
+		respondError(c, notFound)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// ---------------------------------------------------------------------
+// Droppers
+
+func listDroppersV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	droppers, total, err := models.ListDroppers(db, currentActor(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[dropperResponse]{
+		Data:    make([]dropperResponse, len(droppers)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range droppers {
+		page.Data[i] = newDropperResponse(&droppers[i])
+	}
+	c.JSON(200, page)
+}
+
+func createDropperV1(c *gin.Context, db *gorm.DB) {
+	var body newDropper
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper := models.NewDropper(currentTenantID(c), body.Name, body.MachineUrl)
+	if _, err := dropper.Create(db); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, newDropperResponse(dropper))
+}
+
+func getDropperV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newDropperResponse(dropper))
+}
+
+type updateDropperBody struct {
+	Name       *string `json:"name"`
+	Active     *bool   `json:"active"`
+	MachineURL *string `json:"machine_url"`
+}
+
+func updateDropperV1(c *gin.Context, db *gorm.DB) {
+	var body updateDropperBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	err := dropper.Update(db, models.DropperChanges{
+		Name:       body.Name,
+		Active:     body.Active,
+		MachineURL: body.MachineURL,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newDropperResponse(dropper))
+}
+
+func deleteDropperV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := dropper.Delete(db); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+type dispenseBody struct {
+	Pills models.PillList `json:"pills" binding:"required"`
+}
+
+func dispenseV1(c *gin.Context, db *gorm.DB, ch *chan models.MqttActionRequest) {
+	var body dispenseBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	commands, err := dropper.DispensePills(db, body.Pills)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	for _, command := range commands {
+		*ch <- command
+	}
+
+	c.JSON(202, returnMessage("sucesso", "comprimidos enviados para dispensa"))
+}
+
+// ---------------------------------------------------------------------
+// Secções
+
+func listSectionsV1(c *gin.Context, db *gorm.DB) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	sections, err := dropper.ListSections(db)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response := make([]sectionResponse, len(sections))
+	for i := range sections {
+		response[i] = newSectionResponse(&sections[i], uint(i+1))
+	}
+	c.JSON(200, response)
+}
+
+type createSectionBody struct {
+	Name  string          `json:"name" binding:"required"`
+	Pills models.PillList `json:"pills"`
+}
+
+func createSectionV1(c *gin.Context, db *gorm.DB) {
+	var body createSectionBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	id, err := dropper.CreateDropperSection(db, body.Name, body.Pills)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	dropper.PublishEvent(models.EventInventory, models.InventoryEvent{Reason: models.InventorySectionCreated, Section: body.Name})
+
+	section, index, err := dropper.FindSection(db, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(201, newSectionResponse(section, index))
+}
+
+// sectionFromPath procura a secção identificada pelos parâmetros `:serial` e `:section`
+func sectionFromPath(c *gin.Context, db *gorm.DB) (*models.Dropper, *models.DropperSection, uint, bool) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return nil, nil, 0, false
+	}
+	id, ok := idFromPath(c, "section", models.ErrSectionNotFound)
+	if !ok {
+		return nil, nil, 0, false
+	}
+
+	section, index, err := dropper.FindSection(db, id)
+	if err != nil {
+		respondError(c, err)
+		return nil, nil, 0, false
+	}
+	return dropper, section, index, true
+}
+
+func getSectionV1(c *gin.Context, db *gorm.DB) {
+	_, section, index, ok := sectionFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newSectionResponse(section, index))
+}
+
+func deleteSectionV1(c *gin.Context, db *gorm.DB) {
+	dropper, section, _, ok := sectionFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := dropper.DeleteSection(db, section.ID); err != nil {
+		respondError(c, err)
+		return
+	}
+	dropper.PublishEvent(models.EventInventory, models.InventoryEvent{Reason: models.InventorySectionDeleted, Section: section.Section})
+
+	c.Status(204)
+}
+
+func listPositionsV1(c *gin.Context, db *gorm.DB) {
+	_, section, index, ok := sectionFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newSectionResponse(section, index).Positions)
+}
+
+type reloadSectionBody struct {
+	PillName string `json:"pill_name" binding:"required"`
+	Quantity uint   `json:"pill_quantity" binding:"required"`
+}
+
+func reloadSectionV1(c *gin.Context, db *gorm.DB) {
+	var body reloadSectionBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	dropper, section, index, ok := sectionFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := dropper.ReloadSection(db, index, body.PillName, body.Quantity); err != nil {
+		respondError(c, err)
+		return
+	}
+	dropper.PublishEvent(models.EventInventory, models.InventoryEvent{Reason: models.InventoryReload, Section: section.Section})
+
+	section, index, err := dropper.FindSection(db, section.ID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, newSectionResponse(section, index))
+}
+
+// ---------------------------------------------------------------------
+// Horários
+
+func listSchedulesV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	schedules, total, err := dropper.ListSchedules(db, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[scheduleResponse]{
+		Data:    make([]scheduleResponse, len(schedules)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range schedules {
+		if page.Data[i], err = newScheduleResponse(db, &schedules[i]); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	c.JSON(200, page)
+}
+
+func createScheduleV1(c *gin.Context, db *gorm.DB) {
+	var body createDispenseScheduleBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	invalid := make([]fieldError, 0)
+	if body.Name == "" {
+		invalid = append(invalid, fieldError{Field: "name", Code: "required"})
+	}
+	if body.Interval <= 0 {
+		invalid = append(invalid, fieldError{Field: "interval", Code: "positive"})
+	}
+	if !body.EndDate.After(body.StartDate) {
+		invalid = append(invalid, fieldError{Field: "end_date", Code: "after_start"})
+	}
+	if len(invalid) > 0 {
+		respondError(c, invalidFields(invalid...))
+		return
+	}
+
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	schedule, err := dropper.CreateDispenseSchedule(db, body.spec(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response, err := newScheduleResponse(db, schedule)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(201, response)
+}
+
+// scheduleFromPath procura o horário identificado pelos parâmetros `:serial` e `:schedule`
+func scheduleFromPath(c *gin.Context, db *gorm.DB) (*models.Dropper, *models.DispenseSchedule, bool) {
+	dropper, ok := dropperFromPath(c, db)
+	if !ok {
+		return nil, nil, false
+	}
+	id, ok := idFromPath(c, "schedule", models.ErrScheduleNotFound)
+	if !ok {
+		return nil, nil, false
+	}
+
+	schedule, err := dropper.FindSchedule(db, id)
+	if err != nil {
+		respondError(c, err)
+		return nil, nil, false
+	}
+	return dropper, schedule, true
+}
+
+func getScheduleV1(c *gin.Context, db *gorm.DB) {
+	_, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	response, err := newScheduleResponse(db, schedule)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+type updateScheduleBody struct {
+	Name        *string        `json:"name"`
+	Active      *bool          `json:"active"`
+	Description *string        `json:"description"`
+	StartDate   *time.Time     `json:"start_date"`
+	EndDate     *time.Time     `json:"end_date"`
+	Interval    *time.Duration `json:"interval"`
+	// Só nos horários em SOS
+	MaxDailyDoses *uint           `json:"max_daily_doses"`
+	Pills         models.PillList `json:"pills"`
+	// Substitui as fases, uma lista vazia volta a uma dose constante
+	Phases         []models.SchedulePhase `json:"phases"`
+	ReminderLead   *time.Duration         `json:"reminder_lead"`
+	MaxSnoozes     *uint                  `json:"max_snoozes"`
+	SnoozeDuration *time.Duration         `json:"snooze_duration"`
+	// Motivo para alterar o horário apesar de interações graves, fica registado
+	OverrideReason string `json:"override_reason"`
+}
+
+func updateScheduleV1(c *gin.Context, db *gorm.DB) {
+	var body updateScheduleBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if body.Interval != nil && *body.Interval <= 0 {
+		respondError(c, invalidFields(fieldError{Field: "interval", Code: "positive"}))
+		return
+	}
+
+	dropper, current, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	start, end := current.StartDate, current.EndDate
+	if body.StartDate != nil {
+		start = *body.StartDate
+	}
+	if body.EndDate != nil {
+		end = *body.EndDate
+	}
+	if !end.After(start) {
+		respondError(c, invalidFields(fieldError{Field: "end_date", Code: "after_start"}))
+		return
+	}
+
+	schedule, err := dropper.UpdateDispenseSchedule(db, current.ID, models.ScheduleChanges{
+		Name:           body.Name,
+		Active:         body.Active,
+		Description:    body.Description,
+		StartDate:      body.StartDate,
+		EndDate:        body.EndDate,
+		Interval:       body.Interval,
+		MaxDailyDoses:  body.MaxDailyDoses,
+		Pills:          body.Pills,
+		Phases:         body.Phases,
+		ReminderLead:   body.ReminderLead,
+		MaxSnoozes:     body.MaxSnoozes,
+		SnoozeDuration: body.SnoozeDuration,
+		Override:       overrideFrom(c, body.OverrideReason),
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response, err := newScheduleResponse(db, schedule)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(200, response)
+}
+
+func deleteScheduleV1(c *gin.Context, db *gorm.DB) {
+	dropper, schedule, ok := scheduleFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := dropper.DeleteDispenseSchedule(db, schedule.ID); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
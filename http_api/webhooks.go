@@ -0,0 +1,283 @@
+package http_api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+type webhookBody struct {
+	URL *string `json:"url"`
+	// Tipos de evento subscritos, ex: ["dispense", "alert"]
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+func (b webhookBody) fields() models.WebhookFields {
+	return models.WebhookFields{URL: b.URL, EventTypes: b.Events, Active: b.Active}
+}
+
+type webhookResponse struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newWebhookResponse(w *models.Webhook) webhookResponse {
+	return webhookResponse{
+		ID:        w.ID,
+		URL:       w.URL,
+		Events:    w.EventTypes,
+		Active:    w.Active,
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+}
+
+// createdWebhookResponse inclui o segredo das assinaturas, devolvido apenas na criação do webhook
+type createdWebhookResponse struct {
+	webhookResponse
+	Secret string `json:"secret"`
+}
+
+type webhookDeliveryResponse struct {
+	ID             uint            `json:"id"`
+	EventID        uint64          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus int             `json:"response_status"`
+	Error          string          `json:"error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+func newWebhookDeliveryResponse(d *models.WebhookDelivery) webhookDeliveryResponse {
+	return webhookDeliveryResponse{
+		ID:             d.ID,
+		EventID:        d.EventID,
+		EventType:      d.EventType,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		NextAttemptAt:  d.NextAttemptAt,
+		LastAttemptAt:  d.LastAttemptAt,
+		ResponseStatus: d.ResponseStatus,
+		Error:          d.Error,
+		DeliveredAt:    d.DeliveredAt,
+		CreatedAt:      d.CreatedAt,
+		Payload:        d.Payload,
+	}
+}
+
+type webhookDeliveriesQuery struct {
+	listQuery
+	Status string `form:"status" binding:"omitempty,oneof=pending delivered failed"`
+}
+
+type replayResponse struct {
+	Replayed int64 `json:"replayed"`
+}
+
+// webhookFromPath procura o webhook do tenant identificado pelo parâmetro `:webhook`
+func webhookFromPath(c *gin.Context, db *gorm.DB) (*models.Webhook, bool) {
+	id, ok := idFromPath(c, "webhook", models.ErrWebhookNotFound)
+	if !ok {
+		return nil, false
+	}
+
+	webhook, err := models.FindWebhook(db, currentTenantID(c), id)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return webhook, true
+}
+
+func listWebhooksV1(c *gin.Context, db *gorm.DB) {
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	list, total, err := models.ListWebhooks(db, currentTenantID(c), options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[webhookResponse]{
+		Data:    make([]webhookResponse, len(list)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range list {
+		page.Data[i] = newWebhookResponse(&list[i])
+	}
+	c.JSON(200, page)
+}
+
+func createWebhookV1(c *gin.Context, db *gorm.DB) {
+	var body webhookBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if body.URL == nil {
+		respondError(c, invalidFields(fieldError{Field: "url", Code: "required"}))
+		return
+	}
+	if body.Events == nil {
+		respondError(c, invalidFields(fieldError{Field: "events", Code: "required"}))
+		return
+	}
+
+	webhook, err := models.CreateWebhook(db, currentTenantID(c), currentUserID(c), body.fields())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(201, createdWebhookResponse{webhookResponse: newWebhookResponse(webhook), Secret: webhook.Secret})
+}
+
+func getWebhookV1(c *gin.Context, db *gorm.DB) {
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newWebhookResponse(webhook))
+}
+
+func updateWebhookV1(c *gin.Context, db *gorm.DB) {
+	var body webhookBody
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := webhook.Update(db, body.fields()); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(200, newWebhookResponse(webhook))
+}
+
+func deleteWebhookV1(c *gin.Context, db *gorm.DB) {
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	if err := webhook.Delete(db); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// pingWebhookV1 põe na fila um evento de teste para o endereço do webhook
+func pingWebhookV1(c *gin.Context, db *gorm.DB) {
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	delivery, err := webhook.Ping(db)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(202, newWebhookDeliveryResponse(delivery))
+}
+
+// listWebhookDeliveriesV1 lista o registo de entregas do webhook, `?status=failed` devolve só as falhadas
+func listWebhookDeliveriesV1(c *gin.Context, db *gorm.DB) {
+	var query webhookDeliveriesQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	options, ok := bindListOptions(c)
+	if !ok {
+		return
+	}
+
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	list, total, err := webhook.ListDeliveries(db, query.Status, options)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := pageResponse[webhookDeliveryResponse]{
+		Data:    make([]webhookDeliveryResponse, len(list)),
+		Page:    options.Page,
+		PerPage: options.PerPage,
+		Total:   total,
+	}
+	for i := range list {
+		page.Data[i] = newWebhookDeliveryResponse(&list[i])
+	}
+	c.JSON(200, page)
+}
+
+func replayWebhookDeliveryV1(c *gin.Context, db *gorm.DB) {
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+	id, ok := idFromPath(c, "delivery", models.ErrDeliveryNotFound)
+	if !ok {
+		return
+	}
+
+	delivery, err := webhook.ReplayDelivery(db, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(202, newWebhookDeliveryResponse(delivery))
+}
+
+func replayFailedWebhookDeliveriesV1(c *gin.Context, db *gorm.DB) {
+	webhook, ok := webhookFromPath(c, db)
+	if !ok {
+		return
+	}
+
+	replayed, err := webhook.ReplayFailed(db)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(202, replayResponse{Replayed: replayed})
+}
@@ -0,0 +1,132 @@
+// Package ical escreve calendários iCalendar (RFC 5545) com eventos e alarmes, para serem
+// subscritos nas aplicações de calendário
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLineOctets é o tamanho máximo de uma linha, as linhas maiores são dobradas
+const maxLineOctets = 75
+
+const timeLayout = "20060102T150405Z"
+
+// Calendar é um calendário publicado. RefreshInterval indica aos clientes de quanto em quanto
+// tempo devem voltar a buscar o calendário.
+type Calendar struct {
+	Name            string
+	Description     string
+	RefreshInterval time.Duration
+	Events          []Event
+}
+
+// Event é um evento do calendário. UID tem de ser estável entre pedidos, para que os clientes
+// atualizem o evento em vez de o duplicar.
+type Event struct {
+	UID          string
+	Start        time.Time
+	Duration     time.Duration
+	Summary      string
+	Description  string
+	LastModified time.Time
+	// Antecedência do alarme em relação ao início, nil não cria alarme
+	Alarm *time.Duration
+}
+
+// Duration escreve a duração no formato do iCalendar, ex: -PT15M
+func Duration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+
+	value := "PT"
+	if hours := d / time.Hour; hours > 0 {
+		value += fmt.Sprintf("%dH", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		value += fmt.Sprintf("%dM", minutes)
+		d -= minutes * time.Minute
+	}
+	if seconds := d / time.Second; seconds > 0 || value == "PT" {
+		value += fmt.Sprintf("%dS", seconds)
+	}
+	return sign + value
+}
+
+// escape escapa o texto de uma propriedade
+func escape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// writer escreve as linhas terminadas em CRLF, dobrando as que excedem maxLineOctets sem
+// partir caracteres UTF-8
+type writer struct {
+	out *bufio.Writer
+}
+
+func (w *writer) line(name, value string) {
+	line := name + ":" + value
+	for len(line) > maxLineOctets {
+		cut := maxLineOctets
+		for !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.out.WriteString(line[:cut] + "\r\n")
+		// As linhas de continuação começam com um espaço, que conta para o tamanho
+		line = " " + line[cut:]
+	}
+	w.out.WriteString(line + "\r\n")
+}
+
+// Write escreve o calendário em out
+func Write(out io.Writer, calendar *Calendar, now time.Time) error {
+	w := writer{out: bufio.NewWriter(out)}
+	stamp := now.UTC().Format(timeLayout)
+
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//dropmedical//tomas//PT")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", escape(calendar.Name))
+	if calendar.Description != "" {
+		w.line("X-WR-CALDESC", escape(calendar.Description))
+	}
+	if calendar.RefreshInterval > 0 {
+		w.line("REFRESH-INTERVAL;VALUE=DURATION", Duration(calendar.RefreshInterval))
+		w.line("X-PUBLISHED-TTL", Duration(calendar.RefreshInterval))
+	}
+
+	for _, event := range calendar.Events {
+		w.line("BEGIN", "VEVENT")
+		w.line("UID", event.UID)
+		w.line("DTSTAMP", stamp)
+		w.line("DTSTART", event.Start.UTC().Format(timeLayout))
+		w.line("DURATION", Duration(event.Duration))
+		if !event.LastModified.IsZero() {
+			w.line("LAST-MODIFIED", event.LastModified.UTC().Format(timeLayout))
+		}
+		w.line("SUMMARY", escape(event.Summary))
+		if event.Description != "" {
+			w.line("DESCRIPTION", escape(event.Description))
+		}
+		if event.Alarm != nil {
+			w.line("BEGIN", "VALARM")
+			w.line("ACTION", "DISPLAY")
+			w.line("DESCRIPTION", escape(event.Summary))
+			w.line("TRIGGER", Duration(-*event.Alarm))
+			w.line("END", "VALARM")
+		}
+		w.line("END", "VEVENT")
+	}
+
+	w.line("END", "VCALENDAR")
+	return w.out.Flush()
+}
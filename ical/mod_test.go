@@ -0,0 +1,71 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                             "PT0S",
+		15 * time.Minute:              "PT15M",
+		-15 * time.Minute:             "-PT15M",
+		time.Hour + 30*time.Minute:    "PT1H30M",
+		26*time.Hour + 10*time.Second: "PT26H10S",
+		-(2*time.Hour + 5*time.Minute + 3*time.Second): "-PT2H5M3S",
+	}
+	for d, expected := range cases {
+		if value := Duration(d); value != expected {
+			t.Errorf("%s: expected %s, got %s", d, expected, value)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	lead := 10 * time.Minute
+	calendar := Calendar{
+		Name:            "Tomas de João",
+		RefreshInterval: time.Hour,
+		Events: []Event{{
+			UID:         "dose-1-1714550400@dropmedical",
+			Start:       start,
+			Duration:    15 * time.Minute,
+			Summary:     "Toma: Aspirina x1, Brufen x2",
+			Description: strings.Repeat("Tomar com água; depois da refeição. ", 4),
+			Alarm:       &lead,
+		}},
+	}
+
+	var out bytes.Buffer
+	if err := Write(&out, &calendar, start); err != nil {
+		t.Fatal(err)
+	}
+	ics := out.String()
+
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTART:20240501T080000Z\r\n",
+		"SUMMARY:Toma: Aspirina x1\\, Brufen x2\r\n",
+		"TRIGGER:-PT10M\r\n",
+		"REFRESH-INTERVAL;VALUE=DURATION:PT1H\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(ics, expected) {
+			t.Fatalf("Expected %q in:\n%s", expected, ics)
+		}
+	}
+
+	// As linhas longas são dobradas e nenhuma excede 75 octetos
+	for _, line := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Fatalf("Line longer than %d octets: %q", maxLineOctets, line)
+		}
+	}
+	unfolded := strings.ReplaceAll(ics, "\r\n ", "")
+	if !strings.Contains(unfolded, "DESCRIPTION:"+strings.Repeat("Tomar com água\\; depois da refeição. ", 4)) {
+		t.Fatal("Expected the folded description to unfold to the original text")
+	}
+}
@@ -0,0 +1,226 @@
+// Package interactions verifica interações entre medicamentos e alergias do paciente,
+// a partir de um dataset local carregado de um ficheiro, sem acesso à rede
+package interactions
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+var ErrInvalidDataset = errors.New("dataset de interações inválido")
+
+//go:embed dataset.json
+var defaultDataset []byte
+
+// Severity é a gravidade de um aviso, avisos Severe bloqueiam a criação do horário
+type Severity int
+
+const (
+	Minor Severity = iota + 1
+	Moderate
+	Severe
+)
+
+var severityNames = map[Severity]string{Minor: "minor", Moderate: "moderate", Severe: "severe"}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	if _, ok := severityNames[s]; !ok {
+		return nil, fmt.Errorf("gravidade desconhecida: %d", s)
+	}
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	for severity, name := range severityNames {
+		if name == string(text) {
+			*s = severity
+			return nil
+		}
+	}
+	return fmt.Errorf("gravidade desconhecida: %q", text)
+}
+
+// Tipos de aviso
+const (
+	KindInteraction = "interaction"
+	KindAllergy     = "allergy"
+)
+
+// Warning descreve uma interação do medicamento com outro, ou com uma alergia do paciente
+type Warning struct {
+	Kind     string   `json:"kind"`
+	Severity Severity `json:"severity"`
+	// Medicamento a adicionar
+	Medication string `json:"medication"`
+	// Medicamento ou alergia com que interage
+	With        string `json:"with"`
+	Description string `json:"description"`
+}
+
+// Checker verifica os avisos de juntar medications aos medicamentos current,
+// para um paciente com as alergias indicadas
+type Checker interface {
+	Check(medications, current, allergies []string) []Warning
+}
+
+// Blocking indica se algum dos avisos é grave
+func Blocking(warnings []Warning) bool {
+	for _, warning := range warnings {
+		if warning.Severity >= Severe {
+			return true
+		}
+	}
+	return false
+}
+
+type datasetFile struct {
+	// Nomes alternativos, ex: nomes comerciais ou em inglês, para o nome usado no dataset
+	Aliases      map[string]string `json:"aliases"`
+	Interactions []struct {
+		Drugs       [2]string `json:"drugs"`
+		Severity    Severity  `json:"severity"`
+		Description string    `json:"description"`
+	} `json:"interactions"`
+	// Medicamentos a evitar por cada alergia, a alergia ao próprio medicamento é sempre considerada
+	Allergies []struct {
+		Allergen    string   `json:"allergen"`
+		Medications []string `json:"medications"`
+	} `json:"allergies"`
+}
+
+type rule struct {
+	severity    Severity
+	description string
+}
+
+// Dataset é o Checker baseado num ficheiro de interações
+type Dataset struct {
+	aliases      map[string]string
+	interactions map[[2]string]rule
+	allergies    map[string][]string
+}
+
+// normalize converte o nome de um medicamento para o nome usado no dataset
+func (d *Dataset) normalize(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := d.aliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func pairKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// Parse lê um dataset em JSON
+func Parse(r io.Reader) (*Dataset, error) {
+	var file datasetFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDataset, err.Error())
+	}
+
+	dataset := &Dataset{
+		aliases:      make(map[string]string, len(file.Aliases)),
+		interactions: make(map[[2]string]rule, len(file.Interactions)),
+		allergies:    make(map[string][]string, len(file.Allergies)),
+	}
+	for alias, name := range file.Aliases {
+		dataset.aliases[strings.ToLower(alias)] = strings.ToLower(name)
+	}
+	for _, interaction := range file.Interactions {
+		if _, ok := severityNames[interaction.Severity]; !ok || interaction.Drugs[0] == "" || interaction.Drugs[1] == "" {
+			return nil, fmt.Errorf("%w: interação %v sem medicamentos ou gravidade", ErrInvalidDataset, interaction.Drugs)
+		}
+		key := pairKey(dataset.normalize(interaction.Drugs[0]), dataset.normalize(interaction.Drugs[1]))
+		dataset.interactions[key] = rule{interaction.Severity, interaction.Description}
+	}
+	for _, allergy := range file.Allergies {
+		allergen := dataset.normalize(allergy.Allergen)
+		for _, medication := range allergy.Medications {
+			dataset.allergies[allergen] = append(dataset.allergies[allergen], dataset.normalize(medication))
+		}
+	}
+	return dataset, nil
+}
+
+// Load lê o dataset do ficheiro em path
+func Load(path string) (*Dataset, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// LoadFromEnv lê o dataset do ficheiro em INTERACTIONS_DATASET, ou o dataset de exemplo
+// incluído no binário se a variável não estiver definida
+func LoadFromEnv() (*Dataset, error) {
+	path, ok := os.LookupEnv("INTERACTIONS_DATASET")
+	if !ok || path == "" {
+		log.Println("INTERACTIONS_DATASET não definida, a usar o dataset de interações de exemplo")
+		return Parse(bytes.NewReader(defaultDataset))
+	}
+	return Load(path)
+}
+
+// Check devolve os avisos de cada medicamento de medications com os restantes, com os
+// medicamentos current e com as alergias. Os nomes não distinguem maiúsculas.
+func (d *Dataset) Check(medications, current, allergies []string) []Warning {
+	warnings := make([]Warning, 0)
+
+	for i, medication := range medications {
+		name := d.normalize(medication)
+
+		others := append(append([]string{}, medications[i+1:]...), current...)
+		for _, other := range others {
+			if rule, ok := d.interactions[pairKey(name, d.normalize(other))]; ok {
+				warnings = append(warnings, Warning{
+					Kind:        KindInteraction,
+					Severity:    rule.severity,
+					Medication:  medication,
+					With:        other,
+					Description: rule.description,
+				})
+			}
+		}
+
+		for _, allergy := range allergies {
+			allergen := d.normalize(allergy)
+			if allergen == name || slices.Contains(d.allergies[allergen], name) {
+				warnings = append(warnings, Warning{
+					Kind:        KindAllergy,
+					Severity:    Severe,
+					Medication:  medication,
+					With:        allergy,
+					Description: "O paciente é alérgico a " + allergy,
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+// None é o Checker que não encontra interações
+type None struct{}
+
+func (None) Check(medications, current, allergies []string) []Warning {
+	return []Warning{}
+}
@@ -0,0 +1,59 @@
+package interactions
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDefaultDatasetLoads(t *testing.T) {
+	t.Setenv("INTERACTIONS_DATASET", "")
+
+	dataset, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if len(dataset.interactions) == 0 || len(dataset.allergies) == 0 {
+		t.Fatal("The default dataset should not be empty")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dataset, err := Parse(strings.NewReader(`{
+		"aliases": {"warfarin": "varfarina", "aspirin": "aspirina"},
+		"interactions": [
+			{"drugs": ["varfarina", "aspirina"], "severity": "severe", "description": "hemorragia"},
+			{"drugs": ["ibuprofeno", "aspirina"], "severity": "moderate", "description": "efeito reduzido"}
+		],
+		"allergies": [{"allergen": "penicilina", "medications": ["amoxicilina"]}]
+	}`))
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+
+	warnings := dataset.Check([]string{"Aspirin"}, []string{"Ibuprofeno"}, nil)
+	if len(warnings) != 1 || warnings[0].Severity != Moderate || Blocking(warnings) {
+		t.Fatalf("Expected one moderate warning, got %+v", warnings)
+	}
+
+	warnings = dataset.Check([]string{"Warfarin", "aspirina"}, nil, nil)
+	if len(warnings) != 1 || warnings[0].Kind != KindInteraction || !Blocking(warnings) {
+		t.Fatalf("Expected a severe interaction between the new medications, got %+v", warnings)
+	}
+
+	warnings = dataset.Check([]string{"Amoxicilina"}, nil, []string{"Penicilina"})
+	if len(warnings) != 1 || warnings[0].Kind != KindAllergy || !Blocking(warnings) {
+		t.Fatalf("Expected an allergy warning, got %+v", warnings)
+	}
+
+	if warnings := dataset.Check([]string{"Paracetamol"}, []string{"Aspirin"}, []string{"penicilina"}); len(warnings) != 0 {
+		t.Fatalf("Expected no warnings, got %+v", warnings)
+	}
+}
+
+func TestInvalidDataset(t *testing.T) {
+	_, err := Parse(strings.NewReader(`{"interactions": [{"drugs": ["a", "b"], "severity": "fatal"}]}`))
+	if !errors.Is(err, ErrInvalidDataset) {
+		t.Fatalf("Expected an invalid dataset, got %v", err)
+	}
+}
@@ -6,12 +6,11 @@ import (
 	"net"
 	"os"
 	"sync"
-	"time"
 
-	"github.com/gin-contrib/cors"
 	listeners "github.com/wind-c/comqtt/v2/mqtt/listeners"
 
 	database "github.com/TomascpMarques/dropmedical/database"
+	migrations "github.com/TomascpMarques/dropmedical/migrations"
 	models "github.com/TomascpMarques/dropmedical/models"
 	mqtt_api "github.com/TomascpMarques/dropmedical/mqtt_api"
 	setup "github.com/TomascpMarques/dropmedical/setup"
@@ -21,6 +20,11 @@ var wg sync.WaitGroup
 var interop_mqtt_channel chan models.MqttActionRequest = make(chan models.MqttActionRequest, 20)
 
 func main() {
+	// Subcomandos, ex: import
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Load env files
 	setup.LoadEnvironment()
 
@@ -29,9 +33,18 @@ func main() {
 		log.Printf("DB Error: %s\n", err)
 		os.Exit(1)
 	}
+	// As migrações só são aplicadas pelo subcomando migrate
+	if err := migrations.Check(db); err != nil {
+		log.Fatalf("Esquema da base de dados incompatível: %s", err.Error())
+	}
+	if err := models.RegisterAudit(db); err != nil {
+		log.Fatalf("Falha ao registar o histórico de auditoria: %s", err.Error())
+	}
+	// As alterações feitas pelas tarefas periódicas ficam no histórico em nome do scheduler
+	scheduler := models.AuditAs(db, models.AuditActor{Source: models.AuditSourceScheduler})
 
 	// Inicialização do servidor de MQTT
-	server := mqtt_api.NewMqttServer()
+	server := mqtt_api.NewMqttServer(db)
 	tcp_listener_mqtt := listeners.NewTCP("tcp_mqtt_1", ":1883", nil)
 
 	err = server.AddListener(tcp_listener_mqtt)
@@ -75,24 +88,6 @@ func main() {
 		log.Fatal(err)
 	}
 	go func() {
-		app.Use(cors.New(cors.Config{
-			// AllowOrigins: []string{
-			// 	"http://192.168.55.76:8080/*",
-			// 	"http://192.168.54.217:3000/*",
-			// 	"http://192.168.54.217:8080/*",
-			// 	"http://localhost:3000/*",
-			// 	"http://localhost:3000/recarregar",
-			// },
-			AllowAllOrigins:  true,
-			AllowMethods:     []string{"POST", "GET"},
-			AllowHeaders:     []string{"Origin", "Access-Control-Allow-Origin"},
-			ExposeHeaders:    []string{"Content-Length"},
-			AllowCredentials: true,
-			/* AllowOriginFunc: func(origin string) bool {
-				return origin == "https://github.com"
-			}, */
-			MaxAge: 12 * time.Hour,
-		}))
 		err = app.RunListener(tcp_listener_gin)
 		if err != nil {
 			log.Fatal(err)
@@ -105,13 +100,71 @@ func main() {
 	wg.Add(1)
 	go func() {
 		for {
-			if err := models.PillDispenseBGJob(db, interop_mqtt_channel); err != nil {
+			if err := models.PillDispenseBGJob(scheduler, interop_mqtt_channel); err != nil {
 				log.Fatalf("Erro de cronjob: %+e", err)
 				break
 			}
 		}
 		wg.Done()
 	}()
+
+	// Geração dos relatórios pedidos na API
+	wg.Add(1)
+	go func() {
+		for {
+			if err := models.ReportBGJob(scheduler); err != nil {
+				log.Fatalf("Erro na geração de relatórios: %+e", err)
+				break
+			}
+		}
+		wg.Done()
+	}()
+
+	// Alertas das tomas por confirmar e envio das notificações aos cuidadores
+	wg.Add(1)
+	go func() {
+		for {
+			if err := models.NotificationBGJob(scheduler); err != nil {
+				log.Fatalf("Erro no envio de notificações: %+e", err)
+				break
+			}
+		}
+		wg.Done()
+	}()
+
+	// Entrega dos eventos aos webhooks dos parceiros
+	wg.Add(1)
+	go func() {
+		for {
+			if err := models.WebhookEventsBGJob(scheduler); err != nil {
+				log.Fatalf("Erro na subscrição dos eventos dos webhooks: %+e", err)
+				break
+			}
+		}
+		wg.Done()
+	}()
+	wg.Add(1)
+	go func() {
+		for {
+			if err := models.WebhookBGJob(scheduler); err != nil {
+				log.Fatalf("Erro na entrega de webhooks: %+e", err)
+				break
+			}
+		}
+		wg.Done()
+	}()
+
+	// Selagem do histórico de auditoria
+	wg.Add(1)
+	go func() {
+		for {
+			if err := models.AuditBGJob(db); err != nil {
+				log.Fatalf("Erro na selagem do histórico de auditoria: %+e", err)
+				break
+			}
+		}
+		wg.Done()
+	}()
 	// ----------------------------------
 
 	wg.Wait()
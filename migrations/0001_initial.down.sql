@@ -0,0 +1,32 @@
+-- Apaga o esquema inicial
+
+DROP TABLE IF EXISTS "audit_entries" CASCADE;
+DROP TABLE IF EXISTS "notifications" CASCADE;
+DROP TABLE IF EXISTS "notification_preferences" CASCADE;
+DROP TABLE IF EXISTS "webhook_deliveries" CASCADE;
+DROP TABLE IF EXISTS "webhooks" CASCADE;
+DROP TABLE IF EXISTS "calendar_feeds" CASCADE;
+DROP TABLE IF EXISTS "reports" CASCADE;
+DROP TABLE IF EXISTS "dose_confirmations" CASCADE;
+DROP TABLE IF EXISTS "dose_reminders" CASCADE;
+DROP TABLE IF EXISTS "schedule_controls" CASCADE;
+DROP TABLE IF EXISTS "prn_requests" CASCADE;
+DROP TABLE IF EXISTS "alerts" CASCADE;
+DROP TABLE IF EXISTS "dose_limits" CASCADE;
+DROP TABLE IF EXISTS "interaction_overrides" CASCADE;
+DROP TABLE IF EXISTS "dispense_records" CASCADE;
+DROP TABLE IF EXISTS "prescriptions" CASCADE;
+DROP TABLE IF EXISTS "patient_contacts" CASCADE;
+DROP TABLE IF EXISTS "patient_droppers" CASCADE;
+DROP TABLE IF EXISTS "patients" CASCADE;
+DROP TABLE IF EXISTS "dropper_grants" CASCADE;
+DROP TABLE IF EXISTS "refresh_tokens" CASCADE;
+DROP TABLE IF EXISTS "users" CASCADE;
+DROP TABLE IF EXISTS "slot_discrepancies" CASCADE;
+DROP TABLE IF EXISTS "pills" CASCADE;
+DROP TABLE IF EXISTS "scheduled_pills" CASCADE;
+DROP TABLE IF EXISTS "positions" CASCADE;
+DROP TABLE IF EXISTS "dropper_sections" CASCADE;
+DROP TABLE IF EXISTS "dispense_schedules" CASCADE;
+DROP TABLE IF EXISTS "droppers" CASCADE;
+DROP TABLE IF EXISTS "tenants" CASCADE;
@@ -0,0 +1,511 @@
+-- Esquema inicial, igual ao criado pelo gorm.AutoMigrate dos modelos até esta versão
+
+CREATE TABLE "tenants" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"name" text,
+	PRIMARY KEY ("id")
+);
+
+CREATE TABLE "droppers" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"tenant_id" bigint,
+	"serial_id" text DEFAULT gen_random_uuid(),
+	"active" boolean,
+	"machine_url" text DEFAULT null,
+	"name" text,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_tenants_droppers" FOREIGN KEY ("tenant_id") REFERENCES "tenants"("id") ON DELETE SET NULL
+);
+CREATE INDEX "idx_droppers_deleted_at" ON "droppers" ("deleted_at");
+CREATE UNIQUE INDEX "idx_droppers_machine_url" ON "droppers" ("machine_url");
+CREATE INDEX "idx_droppers_serial_id" ON "droppers" ("serial_id");
+CREATE INDEX "idx_droppers_tenant_id" ON "droppers" ("tenant_id");
+
+CREATE TABLE "dispense_schedules" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"dropper_id" bigint,
+	"patient_id" bigint,
+	"prescription_id" bigint,
+	"name" text,
+	"active" boolean DEFAULT true,
+	"description" text,
+	"start_date" timestamptz,
+	"end_date" timestamptz,
+	"interval" bigint,
+	"kind" text NOT NULL DEFAULT 'scheduled',
+	"max_daily_doses" bigint,
+	"phases" text,
+	"paused_at" timestamptz,
+	"resume_at" timestamptz,
+	"reminder_lead" bigint,
+	"max_snoozes" bigint,
+	"snooze_duration" bigint,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_droppers_dispense_schedules" FOREIGN KEY ("dropper_id") REFERENCES "droppers"("id") ON DELETE SET NULL
+);
+CREATE INDEX "idx_dispense_schedules_prescription_id" ON "dispense_schedules" ("prescription_id");
+CREATE INDEX "idx_dispense_schedules_patient_id" ON "dispense_schedules" ("patient_id");
+CREATE UNIQUE INDEX "uniqueSchedule" ON "dispense_schedules" ("dropper_id","name");
+CREATE INDEX "idx_dispense_schedules_deleted_at" ON "dispense_schedules" ("deleted_at");
+
+CREATE TABLE "dropper_sections" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"dropper_id" bigint,
+	"section" text,
+	"current_position" bigint,
+	"empty" boolean,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_droppers_sections" FOREIGN KEY ("dropper_id") REFERENCES "droppers"("id") ON DELETE SET NULL
+);
+CREATE INDEX "idx_dropper_sections_deleted_at" ON "dropper_sections" ("deleted_at");
+
+CREATE TABLE "positions" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"dropper_section_id" bigint,
+	"position" bigint,
+	"pill_name" text,
+	"empty" boolean,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_dropper_sections_positions" FOREIGN KEY ("dropper_section_id") REFERENCES "dropper_sections"("id")
+);
+CREATE INDEX "idx_positions_deleted_at" ON "positions" ("deleted_at");
+
+CREATE TABLE "scheduled_pills" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"dispense_schedule_id" bigint,
+	"dispensed" boolean DEFAULT false,
+	"dispensed_time" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_scheduled_pills_deleted_at" ON "scheduled_pills" ("deleted_at");
+
+CREATE TABLE "pills" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"scheduled_pills_id" bigint,
+	"name" text,
+	"count" bigint,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_pills_deleted_at" ON "pills" ("deleted_at");
+
+CREATE TABLE "slot_discrepancies" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"dropper_id" bigint,
+	"dropper_section_id" bigint,
+	"position_id" bigint,
+	"section" bigint,
+	"position" bigint,
+	"kind" text,
+	"device_occupied" boolean,
+	"database_occupied" boolean,
+	"resolved" boolean DEFAULT false,
+	"resolution" text,
+	"resolved_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_slot_discrepancies_resolved" ON "slot_discrepancies" ("resolved");
+CREATE INDEX "idx_slot_discrepancies_dropper_id" ON "slot_discrepancies" ("dropper_id");
+
+CREATE TABLE "users" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"tenant_id" bigint,
+	"role" text NOT NULL DEFAULT 'admin',
+	"email" text NOT NULL,
+	"name" text,
+	"password_hash" text NOT NULL,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_tenants_users" FOREIGN KEY ("tenant_id") REFERENCES "tenants"("id") ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX "idx_users_email" ON "users" ("email");
+CREATE INDEX "idx_users_tenant_id" ON "users" ("tenant_id");
+
+CREATE TABLE "refresh_tokens" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"user_id" bigint NOT NULL,
+	"token_hash" text NOT NULL,
+	"expires_at" timestamptz,
+	"revoked_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_refresh_tokens_token_hash" ON "refresh_tokens" ("token_hash");
+CREATE INDEX "idx_refresh_tokens_user_id" ON "refresh_tokens" ("user_id");
+
+CREATE TABLE "dropper_grants" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"dropper_id" bigint NOT NULL,
+	"user_id" bigint NOT NULL,
+	"role" text NOT NULL,
+	"granted_by" bigint,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_dropper_grants_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE,
+	CONSTRAINT "fk_droppers_grants" FOREIGN KEY ("dropper_id") REFERENCES "droppers"("id") ON DELETE CASCADE
+);
+CREATE INDEX "idx_dropper_grants_user_id" ON "dropper_grants" ("user_id");
+CREATE UNIQUE INDEX "idx_dropper_grant" ON "dropper_grants" ("dropper_id","user_id");
+
+CREATE TABLE "patients" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"deleted_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"name" text NOT NULL,
+	"birth_date" timestamptz,
+	"sex" text,
+	"time_zone" text NOT NULL DEFAULT 'UTC',
+	"allergies" text,
+	"notes" text,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_patients_tenant_id" ON "patients" ("tenant_id");
+CREATE INDEX "idx_patients_deleted_at" ON "patients" ("deleted_at");
+
+CREATE TABLE "patient_droppers" (
+	"patient_id" bigint,
+	"dropper_id" bigint,
+	PRIMARY KEY ("patient_id","dropper_id"),
+	CONSTRAINT "fk_patient_droppers_patient" FOREIGN KEY ("patient_id") REFERENCES "patients"("id"),
+	CONSTRAINT "fk_patient_droppers_dropper" FOREIGN KEY ("dropper_id") REFERENCES "droppers"("id")
+);
+
+CREATE TABLE "patient_contacts" (
+	"id" bigserial,
+	"patient_id" bigint NOT NULL,
+	"name" text,
+	"relationship" text,
+	"phone" text,
+	"email" text,
+	"primary" boolean,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_patients_contacts" FOREIGN KEY ("patient_id") REFERENCES "patients"("id") ON DELETE CASCADE
+);
+CREATE INDEX "idx_patient_contacts_patient_id" ON "patient_contacts" ("patient_id");
+
+CREATE TABLE "prescriptions" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"patient_id" bigint NOT NULL,
+	"dropper_id" bigint NOT NULL,
+	"medication" text NOT NULL,
+	"dose" bigint NOT NULL,
+	"frequency" bigint NOT NULL,
+	"start_date" timestamptz NOT NULL,
+	"duration" bigint NOT NULL,
+	"prescriber" text,
+	"refills_remaining" bigint,
+	"instructions" text,
+	"revision" bigint NOT NULL DEFAULT 1,
+	"active" boolean NOT NULL DEFAULT true,
+	PRIMARY KEY ("id")
+);
+ALTER TABLE "dispense_schedules" ADD CONSTRAINT "fk_prescriptions_schedules" FOREIGN KEY ("prescription_id") REFERENCES "prescriptions"("id") ON DELETE SET NULL;
+CREATE INDEX "idx_prescriptions_dropper_id" ON "prescriptions" ("dropper_id");
+CREATE INDEX "idx_prescriptions_patient_id" ON "prescriptions" ("patient_id");
+CREATE INDEX "idx_prescriptions_tenant_id" ON "prescriptions" ("tenant_id");
+
+CREATE TABLE "dispense_records" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"dropper_id" bigint NOT NULL,
+	"schedule_id" bigint,
+	"prescription_id" bigint,
+	"patient_id" bigint,
+	"due_at" timestamptz NOT NULL,
+	"dispensed_at" timestamptz,
+	"confirm_by" timestamptz,
+	"source" text NOT NULL,
+	"status" text NOT NULL,
+	"reason" text,
+	"pills" text,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_dispense_records_patient_id" ON "dispense_records" ("patient_id");
+CREATE INDEX "idx_dispense_records_prescription_id" ON "dispense_records" ("prescription_id");
+CREATE UNIQUE INDEX "idx_schedule_dose" ON "dispense_records" ("schedule_id","due_at");
+CREATE INDEX "idx_dispense_records_dropper_id" ON "dispense_records" ("dropper_id");
+
+CREATE TABLE "interaction_overrides" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"schedule_id" bigint NOT NULL,
+	"patient_id" bigint,
+	"user_id" bigint NOT NULL,
+	"reason" text NOT NULL,
+	"warnings" text,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_interaction_overrides_schedule_id" ON "interaction_overrides" ("schedule_id");
+CREATE INDEX "idx_interaction_overrides_patient_id" ON "interaction_overrides" ("patient_id");
+
+CREATE TABLE "dose_limits" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"patient_id" bigint,
+	"medication" text NOT NULL,
+	"max_single" bigint,
+	"max_daily" bigint,
+	"max_weekly" bigint,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_dose_limits_patient_id" ON "dose_limits" ("patient_id");
+CREATE INDEX "idx_dose_limits_tenant_id" ON "dose_limits" ("tenant_id");
+
+CREATE TABLE "alerts" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"dropper_id" bigint,
+	"patient_id" bigint,
+	"schedule_id" bigint,
+	"dose_id" bigint,
+	"kind" text NOT NULL,
+	"message" text NOT NULL,
+	"details" text,
+	"acknowledged_at" timestamptz,
+	"acknowledged_by" bigint,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_alerts_dropper_id" ON "alerts" ("dropper_id");
+CREATE INDEX "idx_alerts_tenant_id" ON "alerts" ("tenant_id");
+CREATE INDEX "idx_alerts_dose_id" ON "alerts" ("dose_id");
+CREATE INDEX "idx_alerts_patient_id" ON "alerts" ("patient_id");
+
+CREATE TABLE "prn_requests" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"dropper_id" bigint NOT NULL,
+	"schedule_id" bigint NOT NULL,
+	"patient_id" bigint,
+	"user_id" bigint,
+	"source" text NOT NULL,
+	"granted" boolean,
+	"reason" text,
+	"next_allowed_at" timestamptz,
+	"dose_id" bigint,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_prn_requests_patient_id" ON "prn_requests" ("patient_id");
+CREATE INDEX "idx_prn_requests_schedule_id" ON "prn_requests" ("schedule_id");
+CREATE INDEX "idx_prn_requests_dropper_id" ON "prn_requests" ("dropper_id");
+
+CREATE TABLE "schedule_controls" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"schedule_id" bigint NOT NULL,
+	"patient_id" bigint,
+	"user_id" bigint NOT NULL,
+	"action" text NOT NULL,
+	"reason" text,
+	"resume_at" timestamptz,
+	"due_at" timestamptz,
+	"patient_wide" boolean,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_schedule_controls_patient_id" ON "schedule_controls" ("patient_id");
+CREATE INDEX "idx_schedule_controls_schedule_id" ON "schedule_controls" ("schedule_id");
+
+CREATE TABLE "dose_reminders" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"schedule_id" bigint NOT NULL,
+	"dropper_id" bigint NOT NULL,
+	"due_at" timestamptz NOT NULL,
+	"dispense_at" timestamptz NOT NULL,
+	"remind_at" timestamptz NOT NULL,
+	"reminded" boolean,
+	"snoozes" bigint,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_dose_reminders_dispense_at" ON "dose_reminders" ("dispense_at");
+CREATE INDEX "idx_dose_reminders_dropper_id" ON "dose_reminders" ("dropper_id");
+CREATE UNIQUE INDEX "idx_reminder_dose" ON "dose_reminders" ("schedule_id","due_at");
+
+CREATE TABLE "dose_confirmations" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"dose_id" bigint NOT NULL,
+	"dropper_id" bigint NOT NULL,
+	"user_id" bigint,
+	"event" text NOT NULL,
+	"taken_at" timestamptz NOT NULL,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_dispense_records_confirmation" FOREIGN KEY ("dose_id") REFERENCES "dispense_records"("id") ON DELETE CASCADE
+);
+CREATE INDEX "idx_dose_confirmations_dropper_id" ON "dose_confirmations" ("dropper_id");
+CREATE UNIQUE INDEX "idx_dose_confirmations_dose_id" ON "dose_confirmations" ("dose_id");
+
+CREATE TABLE "reports" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"user_id" bigint NOT NULL,
+	"kind" text NOT NULL,
+	"format" text NOT NULL,
+	"patient_id" bigint,
+	"dropper_id" bigint,
+	"from" timestamptz NOT NULL,
+	"to" timestamptz NOT NULL,
+	"period" text,
+	"status" text NOT NULL,
+	"error" text,
+	"file_name" text,
+	"content" bytea,
+	"completed_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_reports_status" ON "reports" ("status");
+CREATE INDEX "idx_reports_dropper_id" ON "reports" ("dropper_id");
+CREATE INDEX "idx_reports_patient_id" ON "reports" ("patient_id");
+CREATE INDEX "idx_reports_tenant_id" ON "reports" ("tenant_id");
+
+CREATE TABLE "calendar_feeds" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"user_id" bigint NOT NULL,
+	"patient_id" bigint,
+	"dropper_id" bigint,
+	"name" text,
+	"token_hash" text NOT NULL,
+	"last_used_at" timestamptz,
+	"revoked_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_calendar_feeds_user_id" ON "calendar_feeds" ("user_id");
+CREATE INDEX "idx_calendar_feeds_tenant_id" ON "calendar_feeds" ("tenant_id");
+CREATE UNIQUE INDEX "idx_calendar_feeds_token_hash" ON "calendar_feeds" ("token_hash");
+CREATE INDEX "idx_calendar_feeds_dropper_id" ON "calendar_feeds" ("dropper_id");
+CREATE INDEX "idx_calendar_feeds_patient_id" ON "calendar_feeds" ("patient_id");
+
+CREATE TABLE "webhooks" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"created_by" bigint,
+	"url" text NOT NULL,
+	"event_types" text,
+	"secret" text NOT NULL,
+	"active" boolean NOT NULL,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_webhooks_tenant_id" ON "webhooks" ("tenant_id");
+
+CREATE TABLE "webhook_deliveries" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"webhook_id" bigint NOT NULL,
+	"event_id" bigint,
+	"event_type" text NOT NULL,
+	"payload" bytea NOT NULL,
+	"status" text NOT NULL,
+	"attempts" bigint NOT NULL,
+	"next_attempt_at" timestamptz,
+	"last_attempt_at" timestamptz,
+	"response_status" bigint,
+	"error" text,
+	"delivered_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_webhook_deliveries_next_attempt_at" ON "webhook_deliveries" ("next_attempt_at");
+CREATE INDEX "idx_webhook_deliveries_status" ON "webhook_deliveries" ("status");
+CREATE INDEX "idx_webhook_deliveries_webhook_id" ON "webhook_deliveries" ("webhook_id");
+
+CREATE TABLE "notification_preferences" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"user_id" bigint NOT NULL,
+	"channels" text,
+	"phone" text,
+	"push_token" text,
+	"language" text NOT NULL DEFAULT 'pt',
+	"time_zone" text NOT NULL DEFAULT 'UTC',
+	"quiet_start" text,
+	"quiet_end" text,
+	"muted" text,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_notification_preferences_user_id" ON "notification_preferences" ("user_id");
+
+CREATE TABLE "notifications" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"user_id" bigint NOT NULL,
+	"alert_id" bigint,
+	"kind" text NOT NULL,
+	"channel" text NOT NULL,
+	"address" text NOT NULL,
+	"dedup_key" text NOT NULL,
+	"subject" text,
+	"body" text,
+	"status" text NOT NULL,
+	"attempts" bigint NOT NULL,
+	"send_at" timestamptz NOT NULL,
+	"sent_at" timestamptz,
+	"error" text,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_notifications_send_at" ON "notifications" ("send_at");
+CREATE INDEX "idx_notifications_status" ON "notifications" ("status");
+CREATE INDEX "idx_notifications_alert_id" ON "notifications" ("alert_id");
+CREATE INDEX "idx_notification_dedup" ON "notifications" ("user_id","channel","dedup_key");
+CREATE INDEX "idx_notifications_tenant_id" ON "notifications" ("tenant_id");
+
+CREATE TABLE "audit_entries" (
+	"id" bigserial,
+	"created_at" timestamptz NOT NULL,
+	"seq" bigint,
+	"source" text NOT NULL,
+	"user_id" bigint,
+	"tenant_id" bigint,
+	"device" text,
+	"action" text NOT NULL,
+	"entity" text NOT NULL,
+	"entity_id" text NOT NULL,
+	"before" bytea,
+	"after" bytea,
+	"prev_hash" text,
+	"hash" text,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_audit_entries_seq" ON "audit_entries" ("seq");
+CREATE INDEX "idx_audit_entries_hash" ON "audit_entries" ("hash");
+CREATE INDEX "idx_audit_entity" ON "audit_entries" ("entity","entity_id");
+CREATE INDEX "idx_audit_entries_tenant_id" ON "audit_entries" ("tenant_id");
+CREATE INDEX "idx_audit_entries_user_id" ON "audit_entries" ("user_id");
@@ -0,0 +1,4 @@
+-- Reverte schedule_interval_nanoseconds
+UPDATE "dispense_schedules"
+SET "interval" = "interval" / 1000000000
+WHERE "interval" >= 1000000000;
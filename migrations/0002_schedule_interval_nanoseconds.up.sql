@@ -0,0 +1,8 @@
+-- Os intervalos dos horários passam de segundos a nanossegundos, a unidade do time.Duration com
+-- que são lidos. Um intervalo abaixo de um segundo só pode estar em segundos, o mínimo de um
+-- horário é um minuto, e por isso os valores já convertidos não mudam.
+UPDATE "dispense_schedules"
+SET "interval" = "interval" * 1000000000
+WHERE "interval" > 0 AND "interval" < 1000000000;
+
+ALTER TABLE "dispense_schedules" ALTER COLUMN "interval" DROP DEFAULT;
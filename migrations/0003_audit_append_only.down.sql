@@ -0,0 +1,3 @@
+-- Reverte audit_append_only
+DROP TRIGGER IF EXISTS "audit_entries_append_only" ON "audit_entries";
+DROP FUNCTION IF EXISTS audit_entries_append_only();
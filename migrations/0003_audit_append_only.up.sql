@@ -0,0 +1,19 @@
+-- O histórico de auditoria só é acrescentado; as entradas só podem ser alteradas uma vez, para
+-- serem seladas pelo AuditBGJob. Fora do esquema inicial para que também seja criado nas bases
+-- de dados marcadas pelo `migrate baseline`, que podem já o ter.
+CREATE OR REPLACE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND OLD.seq IS NULL AND
+		(NEW.id, NEW.created_at, NEW.source, NEW.user_id, NEW.tenant_id, NEW.device, NEW.action,
+			NEW.entity, NEW.entity_id, NEW.before, NEW.after) IS NOT DISTINCT FROM
+		(OLD.id, OLD.created_at, OLD.source, OLD.user_id, OLD.tenant_id, OLD.device, OLD.action,
+			OLD.entity, OLD.entity_id, OLD.before, OLD.after) THEN
+		RETURN NEW;
+	END IF;
+	RAISE EXCEPTION 'o histórico de auditoria não pode ser alterado';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "audit_entries_append_only" ON "audit_entries";
+CREATE TRIGGER audit_entries_append_only BEFORE UPDATE OR DELETE ON audit_entries
+	FOR EACH ROW EXECUTE FUNCTION audit_entries_append_only();
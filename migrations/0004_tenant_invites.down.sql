@@ -0,0 +1,2 @@
+-- Reverte tenant_invites
+DROP TABLE IF EXISTS "tenant_invites" CASCADE;
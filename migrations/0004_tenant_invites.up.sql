@@ -0,0 +1,16 @@
+-- Convites para entrar num tenant com um papel, aceites com o token enviado a quem é convidado
+CREATE TABLE "tenant_invites" (
+	"id" bigserial,
+	"created_at" timestamptz,
+	"tenant_id" bigint NOT NULL,
+	"email" text NOT NULL,
+	"role" text NOT NULL,
+	"invited_by" bigint,
+	"token_hash" text NOT NULL,
+	"expires_at" timestamptz,
+	"accepted_at" timestamptz,
+	PRIMARY KEY ("id"),
+	CONSTRAINT "fk_tenant_invites_tenant" FOREIGN KEY ("tenant_id") REFERENCES "tenants"("id") ON DELETE CASCADE
+);
+CREATE INDEX "idx_tenant_invites_tenant_id" ON "tenant_invites" ("tenant_id");
+CREATE UNIQUE INDEX "idx_tenant_invites_token_hash" ON "tenant_invites" ("token_hash");
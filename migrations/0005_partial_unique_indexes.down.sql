@@ -0,0 +1,5 @@
+-- Reverte partial_unique_indexes, falha se já houver registos repetidos entre os removidos
+DROP INDEX IF EXISTS "uniqueSchedule";
+CREATE UNIQUE INDEX "uniqueSchedule" ON "dispense_schedules" ("dropper_id","name");
+DROP INDEX IF EXISTS "idx_droppers_machine_url";
+CREATE UNIQUE INDEX "idx_droppers_machine_url" ON "droppers" ("machine_url");
@@ -0,0 +1,6 @@
+-- Os registos removidos (soft delete) deixam de contar para os índices únicos, para que o nome de
+-- um horário removido e o endereço de um dropper removido possam voltar a ser usados
+DROP INDEX IF EXISTS "uniqueSchedule";
+CREATE UNIQUE INDEX "uniqueSchedule" ON "dispense_schedules" ("dropper_id","name") WHERE deleted_at IS NULL;
+DROP INDEX IF EXISTS "idx_droppers_machine_url";
+CREATE UNIQUE INDEX "idx_droppers_machine_url" ON "droppers" ("machine_url") WHERE deleted_at IS NULL;
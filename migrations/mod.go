@@ -0,0 +1,282 @@
+// Package migrations contém as migrações SQL versionadas do esquema, embutidas no binário. Cada
+// migração tem o ficheiro <versão>_<nome>.up.sql e o <versão>_<nome>.down.sql que a reverte. As
+// versões aplicadas ficam na tabela schema_migrations e as migrações só são aplicadas pelo
+// subcomando `migrate`, nunca no arranque do servidor.
+package migrations
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// lockKey é a chave do advisory lock que só deixa um processo migrar o esquema de cada vez
+const lockKey = 0x6d6967
+
+// BaselineVersion é a versão do esquema criado pelo gorm.AutoMigrate antes de haver migrações.
+// As migrações seguintes, ex: o trigger do histórico de auditoria, são sempre aplicadas.
+const BaselineVersion = 1
+
+var (
+	ErrNewerSchema       = errors.New("o esquema da base de dados é mais recente do que esta versão da aplicação")
+	ErrPendingMigrations = errors.New("há migrações por aplicar, corra `dropmedical migrate up`")
+	ErrInvalidMigration  = errors.New("migração inválida")
+	ErrAlreadyMigrated   = errors.New("a base de dados já tem migrações aplicadas")
+)
+
+// Migration é uma alteração do esquema
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Applied é uma migração aplicada à base de dados
+type Applied struct {
+	Version   uint      `gorm:"primarykey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (Applied) TableName() string {
+	return "schema_migrations"
+}
+
+// fileName é o formato dos ficheiros, ex: 0002_patient_notes.up.sql
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Load lê as migrações dos ficheiros de fsys, ordenadas pela versão. Cada versão tem de ter os
+// dois ficheiros e as versões começam em 1 sem falhas.
+func Load(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, path := range paths {
+		match := fileName.FindStringSubmatch(path)
+		if match == nil {
+			return nil, fmt.Errorf("%w: nome de ficheiro %s", ErrInvalidMigration, path)
+		}
+		version, _ := strconv.ParseUint(match[1], 10, 32)
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[uint(version)] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("%w: versão %d repetida", ErrInvalidMigration, version)
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+	for version := uint(1); version <= uint(len(byVersion)); version++ {
+		migration, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: falta a versão %d", ErrInvalidMigration, version)
+		}
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("%w: a versão %d precisa do .up.sql e do .down.sql", ErrInvalidMigration, version)
+		}
+		list = append(list, *migration)
+	}
+	return list, nil
+}
+
+// all são as migrações embutidas no binário
+var all = func() []Migration {
+	list, err := Load(files)
+	if err != nil {
+		panic(err)
+	}
+	return list
+}()
+
+// All devolve as migrações embutidas, ordenadas pela versão
+func All() []Migration {
+	return slices.Clone(all)
+}
+
+// Latest devolve a versão do esquema esperada por esta versão da aplicação
+func Latest() uint {
+	return uint(len(all))
+}
+
+// Current devolve a versão do esquema da base de dados, zero se nenhuma migração foi aplicada
+func Current(db *gorm.DB) (uint, error) {
+	if !db.Migrator().HasTable(&Applied{}) {
+		return 0, nil
+	}
+
+	var version uint
+	err := db.Model(&Applied{}).Select("coalesce(max(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// Check confirma que a base de dados tem o esquema desta versão da aplicação. O servidor não
+// arranca com um esquema mais recente, de uma versão posterior, nem com migrações por aplicar.
+func Check(db *gorm.DB) error {
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current > Latest():
+		return fmt.Errorf("%w: versão %d, esperada %d", ErrNewerSchema, current, Latest())
+	case current < Latest():
+		return fmt.Errorf("%w: versão %d, esperada %d", ErrPendingMigrations, current, Latest())
+	}
+	return nil
+}
+
+// Status devolve as migrações aplicadas, pela versão
+func Status(db *gorm.DB) ([]Applied, error) {
+	applied := make([]Applied, 0)
+	if !db.Migrator().HasTable(&Applied{}) {
+		return applied, nil
+	}
+
+	err := db.Order("version").Find(&applied).Error
+	return applied, err
+}
+
+// migrate corre fn numa transação com o esquema bloqueado e a versão atual
+func migrate(db *gorm.DB, fn func(tx *gorm.DB, current uint) error) error {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" (
+	"version" bigint PRIMARY KEY,
+	"name" text NOT NULL,
+	"applied_at" timestamptz NOT NULL
+)`).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", lockKey).Error; err != nil {
+			return err
+		}
+		current, err := Current(tx)
+		if err != nil {
+			return err
+		}
+		if current > Latest() {
+			return fmt.Errorf("%w: versão %d, esperada %d", ErrNewerSchema, current, Latest())
+		}
+		return fn(tx, current)
+	})
+}
+
+// Up aplica as migrações por aplicar até à versão target, ou até à última se target for zero.
+// Cada migração é aplicada na sua transação; se uma falhar as anteriores ficam aplicadas.
+func Up(db *gorm.DB, target uint) ([]Migration, error) {
+	if target == 0 || target > Latest() {
+		target = Latest()
+	}
+
+	applied := make([]Migration, 0)
+	for {
+		var next *Migration
+		err := migrate(db, func(tx *gorm.DB, current uint) error {
+			if current >= target {
+				return nil
+			}
+			next = &all[current]
+
+			if err := tx.Exec(next.Up).Error; err != nil {
+				return fmt.Errorf("migração %d_%s: %w", next.Version, next.Name, err)
+			}
+			return tx.Create(&Applied{Version: next.Version, Name: next.Name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil || next == nil {
+			return applied, err
+		}
+		applied = append(applied, *next)
+	}
+}
+
+// Down reverte as últimas steps migrações aplicadas
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	reverted := make([]Migration, 0, steps)
+	for range steps {
+		var last *Migration
+		err := migrate(db, func(tx *gorm.DB, current uint) error {
+			if current == 0 {
+				return nil
+			}
+			last = &all[current-1]
+
+			if err := tx.Exec(last.Down).Error; err != nil {
+				return fmt.Errorf("migração %d_%s: %w", last.Version, last.Name, err)
+			}
+			return tx.Delete(&Applied{}, last.Version).Error
+		})
+		if err != nil || last == nil {
+			return reverted, err
+		}
+		reverted = append(reverted, *last)
+	}
+	return reverted, nil
+}
+
+// Baseline marca as migrações até à BaselineVersion como aplicadas sem as correr. Serve para as
+// bases de dados criadas pelo gorm.AutoMigrate antes de haver migrações, que já têm o esquema
+// inicial; as restantes são aplicadas pelo Up seguinte.
+func Baseline(db *gorm.DB) error {
+	return migrate(db, func(tx *gorm.DB, current uint) error {
+		if current > 0 {
+			return ErrAlreadyMigrated
+		}
+		now := time.Now().UTC()
+		for _, migration := range all[:BaselineVersion] {
+			err := tx.Create(&Applied{Version: migration.Version, Name: migration.Name, AppliedAt: now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Create escreve os ficheiros vazios da próxima migração no diretório dir, com as migrações do
+// código fonte, e devolve os seus caminhos
+func Create(dir string, name string) (up string, down string, err error) {
+	existing, err := Load(os.DirFS(dir))
+	if err != nil {
+		return
+	}
+	prefix := fmt.Sprintf("%04d_%s", len(existing)+1, name)
+	if !fileName.MatchString(prefix + ".up.sql") {
+		return "", "", fmt.Errorf("%w: o nome só pode ter minúsculas, algarismos e _", ErrInvalidMigration)
+	}
+
+	up, down = filepath.Join(dir, prefix+".up.sql"), filepath.Join(dir, prefix+".down.sql")
+	if err = os.WriteFile(up, []byte("-- "+name+"\n"), 0o644); err != nil {
+		return
+	}
+	err = os.WriteFile(down, []byte("-- Reverte "+name+"\n"), 0o644)
+	return
+}
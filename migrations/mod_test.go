@@ -0,0 +1,89 @@
+package migrations
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	file := func(content string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(content)} }
+
+	list, err := Load(fstest.MapFS{
+		"0002_notes.up.sql":     file("ALTER TABLE patients ADD COLUMN notes text;"),
+		"0002_notes.down.sql":   file("ALTER TABLE patients DROP COLUMN notes;"),
+		"0001_initial.up.sql":   file("CREATE TABLE patients (id bigserial);"),
+		"0001_initial.down.sql": file("DROP TABLE patients;"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "initial" || list[1].Version != 2 || !strings.Contains(list[1].Down, "DROP COLUMN") {
+		t.Fatalf("Unexpected migrations %+v", list)
+	}
+
+	invalid := map[string]fstest.MapFS{
+		"missing down": {"0001_initial.up.sql": file("SELECT 1;")},
+		"gap": {
+			"0001_initial.up.sql": file("SELECT 1;"), "0001_initial.down.sql": file("SELECT 1;"),
+			"0003_later.up.sql": file("SELECT 1;"), "0003_later.down.sql": file("SELECT 1;"),
+		},
+		"repeated version": {
+			"0001_initial.up.sql": file("SELECT 1;"), "0001_initial.down.sql": file("SELECT 1;"),
+			"0001_other.up.sql": file("SELECT 1;"), "0001_other.down.sql": file("SELECT 1;"),
+		},
+		"bad name": {"initial.sql": file("SELECT 1;")},
+	}
+	for name, fsys := range invalid {
+		if _, err := Load(fsys); !errors.Is(err, ErrInvalidMigration) {
+			t.Errorf("%s: expected ErrInvalidMigration, got %v", name, err)
+		}
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	if Latest() == 0 || All()[0].Name != "initial" {
+		t.Fatal("Expected the initial migration to be embedded")
+	}
+
+	// Os ficheiros embutidos são os do diretório
+	source, err := Load(os.DirFS("."))
+	if err != nil || len(source) != int(Latest()) {
+		t.Fatalf("Unexpected source migrations: %d %v", len(source), err)
+	}
+
+	// O trigger do histórico de auditoria nunca é saltado pelo baseline
+	for _, migration := range All() {
+		if strings.Contains(migration.Up, "CREATE TRIGGER audit_entries_append_only") != (migration.Name == "audit_append_only") {
+			t.Errorf("Unexpected audit trigger in %04d_%s", migration.Version, migration.Name)
+		}
+		if migration.Name == "audit_append_only" && migration.Version <= BaselineVersion {
+			t.Error("The baseline should not skip the audit trigger")
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0001_initial.up.sql", "0001_initial.down.sql"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("SELECT 1;"), 0o644)
+	}
+
+	up, down, err := Create(dir, "patient_notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(up) != "0002_patient_notes.up.sql" || filepath.Base(down) != "0002_patient_notes.down.sql" {
+		t.Fatalf("Unexpected files %s %s", up, down)
+	}
+	if _, err := Load(os.DirFS(dir)); err != nil {
+		t.Fatalf("The new migration should be valid: %v", err)
+	}
+
+	if _, _, err := Create(dir, "Patient Notes"); !errors.Is(err, ErrInvalidMigration) {
+		t.Fatalf("Expected ErrInvalidMigration, got %v", err)
+	}
+}
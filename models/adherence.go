@@ -0,0 +1,416 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrDoseNotFound         = errors.New("toma não encontrada")
+	ErrDoseNotDispensed     = errors.New("a toma não foi dispensada")
+	ErrDoseAlreadyConfirmed = errors.New("a toma já foi confirmada")
+	ErrInvalidConfirmation  = errors.New("confirmação da toma inválida")
+	ErrInvalidPeriod        = errors.New("período de adesão inválido")
+)
+
+// Eventos que confirmam que uma toma foi feita
+const (
+	// O dropper detetou que o copo foi retirado
+	ConfirmCupRemoved = "cup_removed"
+	// O dropper detetou que os comprimidos foram tomados
+	ConfirmPillTaken = "pill_taken"
+	// Confirmada na app
+	ConfirmManual = "manual"
+)
+
+// Resultado de uma toma dispensada, para a adesão
+const (
+	AdherenceOnTime  = "on_time"
+	AdherenceLate    = "late"
+	AdherenceMissed  = "missed"
+	AdherencePending = "pending"
+)
+
+// Períodos em que a adesão é agrupada, no fuso horário do paciente
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+const (
+	// DeviceConfirmLookback é quanto tempo para trás um evento do dropper confirma tomas dispensadas
+	DeviceConfirmLookback = 12 * time.Hour
+	// ConfirmClockSkew é quanto uma confirmação pode estar no futuro, pela diferença dos relógios
+	ConfirmClockSkew = time.Minute
+	// MaxAdherenceRange é o maior intervalo de um relatório de adesão
+	MaxAdherenceRange = 366 * 24 * time.Hour
+	// DefaultAdherenceRange é o intervalo do relatório quando o início não é indicado
+	DefaultAdherenceRange = 30 * 24 * time.Hour
+)
+
+// DoseConfirmation confirma que uma toma dispensada foi feita, pelo dropper ou na app.
+// Cada toma tem no máximo uma confirmação.
+type DoseConfirmation struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	DoseID    uint  `gorm:"uniqueIndex;not null" json:"dose_id"`
+	DropperID uint  `gorm:"index;not null" json:"-"`
+	UserID    *uint `json:"user_id"`
+
+	Event string `gorm:"not null" json:"event"`
+	// Hora a que a toma foi feita
+	TakenAt time.Time `gorm:"not null" json:"taken_at"`
+}
+
+// confirmDeadline devolve o fim da janela de confirmação da toma
+func (r *DispenseRecord) confirmDeadline() *time.Time {
+	if r.ConfirmBy != nil {
+		return r.ConfirmBy
+	}
+	if r.DispensedAt != nil {
+		// Tomas dispensadas antes de existir a janela de confirmação
+		deadline := r.DispensedAt.Add(ConfirmationWindow)
+		return &deadline
+	}
+	return nil
+}
+
+// Outcome devolve o resultado da toma para a adesão, vazio se não foi dispensada.
+// Uma toma confirmada depois da janela é tardia, sem confirmação é falhada quando a janela termina.
+func (r *DispenseRecord) Outcome(now time.Time) string {
+	deadline := r.confirmDeadline()
+	if r.Status != DoseDispensed || deadline == nil {
+		return ""
+	}
+
+	if r.Confirmation != nil {
+		if r.Confirmation.TakenAt.After(*deadline) {
+			return AdherenceLate
+		}
+		return AdherenceOnTime
+	}
+	if now.Before(*deadline) {
+		return AdherencePending
+	}
+	return AdherenceMissed
+}
+
+// Confirm confirma que a toma dispensada foi feita em takenAt
+func (r *DispenseRecord) Confirm(db *gorm.DB, event string, userID *uint, takenAt time.Time) error {
+	if r.Status != DoseDispensed || r.DispensedAt == nil {
+		return ErrDoseNotDispensed
+	}
+	takenAt = takenAt.UTC()
+	if takenAt.Before(r.DispensedAt.Truncate(time.Second)) || takenAt.After(time.Now().UTC().Add(ConfirmClockSkew)) {
+		return ErrInvalidConfirmation
+	}
+
+	confirmation := DoseConfirmation{
+		DoseID:    r.ID,
+		DropperID: r.DropperID,
+		UserID:    userID,
+		Event:     event,
+		TakenAt:   takenAt,
+	}
+	err := db.Create(&confirmation).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDoseAlreadyConfirmed
+	} else if err != nil {
+		log.Printf("Erro inesperado ao confirmar toma: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	r.Confirmation = &confirmation
+	log.Printf("Toma <%d> confirmada (%s) às %s", r.ID, event, takenAt)
+	return nil
+}
+
+// FindDose procura uma toma registada no dropper, com a sua confirmação
+func (d *Dropper) FindDose(db *gorm.DB, id uint) (*DispenseRecord, error) {
+	var record DispenseRecord
+
+	err := db.Preload("Confirmation").First(&record, "id = ? and dropper_id = ?", id, d.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDoseNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &record, nil
+}
+
+// ConfirmFromDevice confirma as tomas do dropper dispensadas nas últimas DeviceConfirmLookback
+// que ainda não foram confirmadas, quando o dropper deteta que o copo foi retirado ou os
+// comprimidos tomados. Os comprimidos de várias tomas ficam no mesmo copo, por isso são todas
+// confirmadas. Devolve as tomas confirmadas.
+func ConfirmFromDevice(db *gorm.DB, serial uuid.UUID, event string, takenAt time.Time) ([]DispenseRecord, error) {
+	takenAt = takenAt.UTC()
+	if event != ConfirmCupRemoved && event != ConfirmPillTaken {
+		return nil, ErrInvalidConfirmation
+	}
+	// Um relógio do dropper adiantado não pode confirmar tomas no futuro
+	if takenAt.After(time.Now().UTC().Add(ConfirmClockSkew)) {
+		return nil, ErrInvalidConfirmation
+	}
+
+	var dropper Dropper
+	err := db.First(&dropper, "serial_id = ?", serial).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	records := make([]DispenseRecord, 0)
+	err = db.
+		Joins("left join dose_confirmations on dose_confirmations.dose_id = dispense_records.id").
+		Where("dispense_records.dropper_id = ? and dispense_records.status = ?", dropper.ID, DoseDispensed).
+		Where("dispense_records.dispensed_at between ? and ?", takenAt.Add(-DeviceConfirmLookback), takenAt).
+		Where("dose_confirmations.id is null").
+		Order("dispense_records.dispensed_at").
+		Find(&records).
+		Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	confirmed := make([]DispenseRecord, 0, len(records))
+	for i := range records {
+		confirmation := DoseConfirmation{DoseID: records[i].ID, DropperID: dropper.ID, Event: event, TakenAt: takenAt}
+		// A toma pode ter sido confirmada na app entretanto
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&confirmation)
+		if result.Error != nil {
+			log.Printf("Erro inesperado ao confirmar toma <%d>: %s", records[i].ID, result.Error.Error())
+			return confirmed, ErrUnexpectedError
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		records[i].Confirmation = &confirmation
+		confirmed = append(confirmed, records[i])
+	}
+	return confirmed, nil
+}
+
+// AdherenceQuery filtra o relatório de adesão de um paciente
+type AdherenceQuery struct {
+	From time.Time
+	To   time.Time
+	// Apenas as tomas com este medicamento, vazio inclui todos
+	Medication string
+	Period     string
+}
+
+// normalize preenche os valores por omissão e valida o intervalo
+func (q *AdherenceQuery) normalize(now time.Time) error {
+	if q.To.IsZero() {
+		q.To = now
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-DefaultAdherenceRange)
+	}
+	if q.Period == "" {
+		q.Period = PeriodWeek
+	}
+	q.From, q.To = q.From.UTC(), q.To.UTC()
+
+	if !q.From.Before(q.To) || q.To.Sub(q.From) > MaxAdherenceRange {
+		return ErrInvalidPeriod
+	}
+	if q.Period != PeriodDay && q.Period != PeriodWeek && q.Period != PeriodMonth {
+		return ErrInvalidPeriod
+	}
+	return nil
+}
+
+// AdherenceCounts contam o resultado das tomas dispensadas. As tomas pendentes ainda estão na
+// janela de confirmação e não contam para as percentagens.
+type AdherenceCounts struct {
+	Doses   uint `json:"doses"`
+	OnTime  uint `json:"on_time"`
+	Late    uint `json:"late"`
+	Missed  uint `json:"missed"`
+	Pending uint `json:"pending"`
+}
+
+func (c *AdherenceCounts) add(outcome string) {
+	c.Doses++
+	switch outcome {
+	case AdherenceOnTime:
+		c.OnTime++
+	case AdherenceLate:
+		c.Late++
+	case AdherenceMissed:
+		c.Missed++
+	case AdherencePending:
+		c.Pending++
+	}
+}
+
+// Rate devolve a percentagem de tomas com o resultado indicado, das tomas já decididas
+func (c AdherenceCounts) Rate(outcome string) float64 {
+	decided := c.OnTime + c.Late + c.Missed
+	if decided == 0 {
+		return 0
+	}
+
+	var count uint
+	switch outcome {
+	case AdherenceOnTime:
+		count = c.OnTime
+	case AdherenceLate:
+		count = c.Late
+	case AdherenceMissed:
+		count = c.Missed
+	}
+	return 100 * float64(count) / float64(decided)
+}
+
+// AdherencePeriod é a adesão num dia, semana ou mês, de Start inclusive a End exclusive
+type AdherencePeriod struct {
+	Start time.Time
+	End   time.Time
+	AdherenceCounts
+}
+
+// MedicationAdherence é a adesão às tomas com um medicamento
+type MedicationAdherence struct {
+	Medication string
+	AdherenceCounts
+	Periods []AdherencePeriod
+}
+
+// AdherenceReport é a adesão do paciente às tomas previstas no intervalo, no total, por
+// medicamento e por período
+type AdherenceReport struct {
+	PatientID uint
+	Query     AdherenceQuery
+	AdherenceCounts
+	Periods     []AdherencePeriod
+	Medications []MedicationAdherence
+}
+
+// periodStart devolve o início do período que contém t, no fuso horário location.
+// As semanas começam à segunda-feira.
+func periodStart(t time.Time, period string, location *time.Location) time.Time {
+	t = t.In(location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+
+	switch period {
+	case PeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case PeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+func nextPeriod(start time.Time, period string) time.Time {
+	switch period {
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case PeriodMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// emptyPeriods devolve os períodos que cobrem [from, to), sem tomas
+func emptyPeriods(query AdherenceQuery, location *time.Location) []AdherencePeriod {
+	periods := make([]AdherencePeriod, 0)
+	for start := periodStart(query.From, query.Period, location); start.Before(query.To); {
+		end := nextPeriod(start, query.Period)
+		periods = append(periods, AdherencePeriod{Start: start.UTC(), End: end.UTC()})
+		start = end
+	}
+	return periods
+}
+
+// addToPeriod soma o resultado ao período que contém due
+func addToPeriod(periods []AdherencePeriod, due time.Time, outcome string) {
+	index := sort.Search(len(periods), func(i int) bool { return periods[i].End.After(due) })
+	if index < len(periods) && !due.Before(periods[index].Start) {
+		periods[index].add(outcome)
+	}
+}
+
+// adherenceReport calcula a adesão a partir das tomas dispensadas. Cada toma conta para cada
+// medicamento que inclui.
+func adherenceReport(patientID uint, records []DispenseRecord, query AdherenceQuery, location *time.Location, now time.Time) AdherenceReport {
+	report := AdherenceReport{PatientID: patientID, Query: query, Periods: emptyPeriods(query, location)}
+	medications := make(map[string]*MedicationAdherence)
+
+	for i := range records {
+		record := &records[i]
+		outcome := record.Outcome(now)
+		if outcome == "" {
+			continue
+		}
+
+		counted := false
+		for name := range record.Pills {
+			if query.Medication != "" && !strings.EqualFold(name, query.Medication) {
+				continue
+			}
+			counted = true
+
+			medication, ok := medications[name]
+			if !ok {
+				medication = &MedicationAdherence{Medication: name, Periods: emptyPeriods(query, location)}
+				medications[name] = medication
+			}
+			medication.add(outcome)
+			addToPeriod(medication.Periods, record.DueAt, outcome)
+		}
+		if !counted {
+			continue
+		}
+
+		report.add(outcome)
+		addToPeriod(report.Periods, record.DueAt, outcome)
+	}
+
+	report.Medications = make([]MedicationAdherence, 0, len(medications))
+	for _, medication := range medications {
+		report.Medications = append(report.Medications, *medication)
+	}
+	sort.Slice(report.Medications, func(i, j int) bool {
+		return report.Medications[i].Medication < report.Medications[j].Medication
+	})
+	return report
+}
+
+// Adherence calcula a adesão do paciente às tomas dispensadas previstas no intervalo da query.
+// As tomas falhadas por limites ou falta de comprimidos e as saltadas não contam.
+func (p *Patient) Adherence(db *gorm.DB, query AdherenceQuery) (*AdherenceReport, error) {
+	now := time.Now().UTC()
+	if err := query.normalize(now); err != nil {
+		return nil, err
+	}
+
+	records := make([]DispenseRecord, 0)
+	err := db.
+		Preload("Confirmation").
+		Where("patient_id = ? and status = ? and due_at >= ? and due_at < ?", p.ID, DoseDispensed, query.From, query.To).
+		Order("due_at").
+		Find(&records).
+		Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	report := adherenceReport(p.ID, records, query, p.Location(), now)
+	return &report, nil
+}
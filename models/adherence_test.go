@@ -0,0 +1,119 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDoseOutcome(t *testing.T) {
+	dispensed := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	deadline := dispensed.Add(ConfirmationWindow)
+	record := DispenseRecord{Status: DoseDispensed, DispensedAt: &dispensed, ConfirmBy: &deadline}
+
+	if outcome := record.Outcome(dispensed.Add(time.Minute)); outcome != AdherencePending {
+		t.Fatalf("Expected %s inside the window, got %s", AdherencePending, outcome)
+	}
+	if outcome := record.Outcome(deadline); outcome != AdherenceMissed {
+		t.Fatalf("Expected %s after the window, got %s", AdherenceMissed, outcome)
+	}
+
+	record.Confirmation = &DoseConfirmation{TakenAt: deadline}
+	if outcome := record.Outcome(deadline.Add(time.Hour)); outcome != AdherenceOnTime {
+		t.Fatalf("Expected %s, got %s", AdherenceOnTime, outcome)
+	}
+	record.Confirmation.TakenAt = deadline.Add(time.Second)
+	if outcome := record.Outcome(deadline.Add(time.Hour)); outcome != AdherenceLate {
+		t.Fatalf("Expected %s, got %s", AdherenceLate, outcome)
+	}
+
+	// Tomas falhadas ou saltadas não contam para a adesão
+	failed := DispenseRecord{Status: DoseFailed}
+	if outcome := failed.Outcome(deadline); outcome != "" {
+		t.Fatalf("Expected no outcome for a failed dose, got %s", outcome)
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	lisbon, _ := time.LoadLocation("Europe/Lisbon")
+	// Quinta-feira, 23h30 em UTC, já sexta em Lisboa no verão
+	at := time.Date(2024, 5, 2, 23, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		period string
+		start  time.Time
+	}{
+		{PeriodDay, time.Date(2024, 5, 3, 0, 0, 0, 0, lisbon)},
+		{PeriodWeek, time.Date(2024, 4, 29, 0, 0, 0, 0, lisbon)},
+		{PeriodMonth, time.Date(2024, 5, 1, 0, 0, 0, 0, lisbon)},
+	}
+	for _, c := range cases {
+		if start := periodStart(at, c.period, lisbon); !start.Equal(c.start) {
+			t.Errorf("%s: expected %s, got %s", c.period, c.start, start)
+		}
+	}
+}
+
+func TestAdherenceReport(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	query := AdherenceQuery{From: from, To: from.Add(48 * time.Hour), Period: PeriodDay}
+
+	dose := func(due time.Time, pills PillList, taken *time.Duration) DispenseRecord {
+		deadline := due.Add(ConfirmationWindow)
+		record := DispenseRecord{DueAt: due, DispensedAt: &due, ConfirmBy: &deadline, Status: DoseDispensed, Pills: pills}
+		if taken != nil {
+			record.Confirmation = &DoseConfirmation{TakenAt: due.Add(*taken)}
+		}
+		return record
+	}
+	onTime, late := 10*time.Minute, time.Hour
+	records := []DispenseRecord{
+		dose(from.Add(8*time.Hour), PillList{"Aspirin": 1, "Brufen": 1}, &onTime),
+		dose(from.Add(20*time.Hour), PillList{"Aspirin": 1}, &late),
+		dose(from.Add(32*time.Hour), PillList{"Aspirin": 1}, nil),
+	}
+
+	report := adherenceReport(1, records, query, time.UTC, from.Add(48*time.Hour))
+	if report.Doses != 3 || report.OnTime != 1 || report.Late != 1 || report.Missed != 1 {
+		t.Fatalf("Unexpected totals: %+v", report.AdherenceCounts)
+	}
+	if len(report.Periods) != 2 || report.Periods[0].Doses != 2 || report.Periods[1].Missed != 1 {
+		t.Fatalf("Unexpected periods: %+v", report.Periods)
+	}
+	if len(report.Medications) != 2 || report.Medications[0].Medication != "Aspirin" || report.Medications[1].OnTime != 1 {
+		t.Fatalf("Unexpected medications: %+v", report.Medications)
+	}
+	if rate := report.Rate(AdherenceOnTime); rate < 33.3 || rate > 33.4 {
+		t.Fatalf("Expected a third of the doses on time, got %f", rate)
+	}
+
+	query.Medication = "brufen"
+	report = adherenceReport(1, records, query, time.UTC, from.Add(48*time.Hour))
+	if report.Doses != 1 || len(report.Medications) != 1 {
+		t.Fatalf("Expected only the Brufen dose: %+v", report)
+	}
+}
+
+func TestAdherenceQueryNormalize(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	query := AdherenceQuery{}
+	if err := query.normalize(now); err != nil || !query.From.Equal(now.Add(-DefaultAdherenceRange)) || query.Period != PeriodWeek {
+		t.Fatalf("Unexpected defaults: %+v %v", query, err)
+	}
+
+	query = AdherenceQuery{From: now.Add(-2 * MaxAdherenceRange), To: now}
+	if err := query.normalize(now); err != ErrInvalidPeriod {
+		t.Fatalf("Expected %s, got %v", ErrInvalidPeriod, err)
+	}
+}
+
+func TestConfirmFromDeviceRejectsFutureTimes(t *testing.T) {
+	// A validação é feita antes de qualquer consulta à base de dados
+	_, err := ConfirmFromDevice(nil, uuid.New(), ConfirmCupRemoved, time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrInvalidConfirmation) {
+		t.Fatalf("Expected ErrInvalidConfirmation for a confirmation in the future, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAlertNotFound = errors.New("alerta não encontrado")
+)
+
+// Tipos de alerta
+const (
+	// Uma dose foi recusada por ultrapassar o limite do medicamento
+	AlertDoseLimit = "dose_limit"
+	// Uma toma dispensada não foi confirmada dentro da janela de confirmação
+	AlertMissedDose = "missed_dose"
+	// Restam poucos comprimidos de um medicamento no dropper
+	AlertLowStock = "low_stock"
+	// O dropper desligou-se do servidor MQTT
+	AlertDeviceOffline = "device_offline"
+)
+
+// Alert é um evento de segurança que precisa da atenção de um utilizador do tenant
+type Alert struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	TenantID   uint  `gorm:"index;not null" json:"-"`
+	DropperID  *uint `gorm:"index" json:"dropper_id"`
+	PatientID  *uint `gorm:"index" json:"patient_id"`
+	ScheduleID *uint `json:"schedule_id"`
+	DoseID     *uint `gorm:"index" json:"dose_id"`
+
+	Kind    string `gorm:"not null" json:"kind"`
+	Message string `gorm:"not null" json:"message"`
+	// Dados do alerta usados nas notificações, ex: o medicamento e os comprimidos que restam
+	Details map[string]any `gorm:"serializer:json" json:"details,omitempty"`
+
+	AcknowledgedAt *time.Time `json:"acknowledged_at"`
+	AcknowledgedBy *uint      `json:"acknowledged_by"`
+}
+
+// raiseAlert regista, publica e notifica o alerta, fora de uma transação. Numa transação o
+// alerta é registado com createAlert e só publicado com publishAlert depois do commit, para que
+// uma transação desfeita não anuncie um alerta que não existe.
+func raiseAlert(db *gorm.DB, alert Alert) {
+	if createAlert(db, &alert) {
+		publishAlert(db, &alert)
+	}
+}
+
+// createAlert regista o alerta num savepoint, se db for uma transação, e indica se foi criado.
+// Falhar a criação do alerta nunca impede a recusa que o originou nem desfaz a transação.
+func createAlert(db *gorm.DB, alert *Alert) bool {
+	if alert == nil {
+		return false
+	}
+	log.Printf("ALERTA [%s] tenant <%d>: %s", alert.Kind, alert.TenantID, alert.Message)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(alert).Error
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao registar alerta: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// publishAlert publica o alerta já registado e põe na fila as notificações dos cuidadores
+func publishAlert(db *gorm.DB, alert *Alert) {
+	publishDropperEvent(db, alert.TenantID, alert.DropperID, EventAlert, *alert)
+	if err := notifyAlert(db, alert, time.Now().UTC()); err != nil {
+		log.Printf("Erro ao notificar o alerta <%d>: %s", alert.ID, err.Error())
+	}
+}
+
+// inTransaction indica se db é uma transação por terminar
+func inTransaction(db *gorm.DB) bool {
+	committer, ok := db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok && committer != nil
+}
+
+// ListAlerts devolve uma página dos alertas do tenant, dos mais recentes para os mais antigos.
+// O filtro Active devolve os alertas por confirmar.
+func ListAlerts(db *gorm.DB, tenantID uint, options ListOptions) ([]Alert, int64, error) {
+	alerts := make([]Alert, 0)
+
+	query := db.Model(&Alert{}).Where("tenant_id = ?", tenantID)
+	if options.Active != nil {
+		if *options.Active {
+			query = query.Where("acknowledged_at is null")
+		} else {
+			query = query.Where("acknowledged_at is not null")
+		}
+	}
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	total, err := options.find(query, &alerts, "created_at", "kind")
+
+	return alerts, total, err
+}
+
+// AcknowledgeAlert marca o alerta do tenant como visto pelo utilizador
+func AcknowledgeAlert(db *gorm.DB, tenantID uint, id uint, userID uint) (*Alert, error) {
+	var alert Alert
+
+	err := db.First(&alert, "id = ? and tenant_id = ?", id, tenantID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAlertNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	if alert.AcknowledgedAt != nil {
+		return &alert, nil
+	}
+
+	now := time.Now().UTC()
+	alert.AcknowledgedAt, alert.AcknowledgedBy = &now, &userID
+	if err := db.Save(&alert).Error; err != nil {
+		log.Printf("Erro inesperado ao confirmar alerta: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &alert, nil
+}
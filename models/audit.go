@@ -0,0 +1,517 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Ações registadas no histórico de auditoria
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// Origens das alterações
+const (
+	AuditSourceAPI       = "api"
+	AuditSourceScheduler = "scheduler"
+	AuditSourceDevice    = "device"
+	AuditSourceCLI       = "cli"
+	// Alterações feitas sem origem conhecida, ex: migrações
+	AuditSourceSystem = "system"
+)
+
+const (
+	// AuditTick é o intervalo entre execuções do AuditBGJob
+	AuditTick = 2 * time.Second
+	// auditBatch é o número de entradas seladas ou verificadas de cada vez
+	auditBatch = 500
+	// auditLockKey é a chave do advisory lock que só deixa um processo selar entradas
+	auditLockKey = 0x617564
+)
+
+var (
+	AuditActions = []string{AuditCreate, AuditUpdate, AuditDelete}
+	AuditSources = []string{AuditSourceAPI, AuditSourceScheduler, AuditSourceDevice, AuditSourceCLI, AuditSourceSystem}
+)
+
+// auditIgnored são as tabelas que não são auditadas: o próprio histórico e os dados operacionais
+// que não afetam a medicação
+var auditIgnored = []string{"audit_entries", "refresh_tokens", "reports", "notifications", "webhook_deliveries"}
+
+// auditRedacted são as colunas com segredos, nunca guardadas no histórico
+var auditRedacted = []string{"password_hash", "secret", "token_hash"}
+
+// AuditActor é quem fez as alterações, guardado no contexto da ligação à base de dados
+type AuditActor struct {
+	Source   string
+	UserID   *uint
+	TenantID *uint
+	// Serial do dropper nas alterações feitas pelos dispositivos
+	Device string
+}
+
+type auditActorKey struct{}
+
+// AuditAs devolve uma ligação cujas alterações são registadas em nome do ator
+func AuditAs(db *gorm.DB, actor AuditActor) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, auditActorKey{}, actor))
+}
+
+// auditActor devolve o ator guardado no contexto, ou a origem system
+func auditActor(ctx context.Context) AuditActor {
+	if ctx != nil {
+		if actor, ok := ctx.Value(auditActorKey{}).(AuditActor); ok {
+			return actor
+		}
+	}
+	return AuditActor{Source: AuditSourceSystem}
+}
+
+// AuditEntry é uma alteração de um registo. As entradas só são acrescentadas e, depois de
+// gravadas, o AuditBGJob sela-as por ordem numa cadeia de hashes: cada Hash inclui o Hash da
+// entrada anterior, por isso alterar ou apagar uma entrada quebra a cadeia a partir dela.
+//
+// A selagem é feita fora da transação da alteração, para que as transações não esperem umas
+// pelas outras pela cabeça da cadeia. Até ser selada, cerca de AuditTick depois, uma entrada só
+// está protegida pelo trigger audit_entries_append_only, que deixa apenas preencher seq,
+// prev_hash e hash; quem o possa desativar, o dono da tabela, pode alterá-la sem que a cadeia o
+// mostre. As entradas por selar são contadas em AuditVerification.Unsealed.
+type AuditEntry struct {
+	ID        uint64    `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+
+	// Posição na cadeia, nula até a entrada ser selada
+	Seq *uint64 `gorm:"uniqueIndex" json:"seq"`
+
+	Source   string `gorm:"not null" json:"source"`
+	UserID   *uint  `gorm:"index" json:"user_id"`
+	TenantID *uint  `gorm:"index" json:"tenant_id"`
+	Device   string `json:"device,omitempty"`
+
+	Action string `gorm:"not null" json:"action"`
+	// Tabela e chave primária do registo alterado
+	Entity   string `gorm:"index:idx_audit_entity;not null" json:"entity"`
+	EntityID string `gorm:"index:idx_audit_entity;not null" json:"entity_id"`
+	// Estado do registo antes e depois da alteração, em JSON
+	Before []byte `json:"-"`
+	After  []byte `json:"-"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `gorm:"index" json:"hash"`
+}
+
+// digest calcula o hash da entrada, encadeado com PrevHash
+func (e *AuditEntry) digest() string {
+	optional := func(value *uint) string {
+		if value == nil {
+			return ""
+		}
+		return fmt.Sprint(*value)
+	}
+	var seq uint64
+	if e.Seq != nil {
+		seq = *e.Seq
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s\n", seq, e.PrevHash, e.CreatedAt.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", e.Source, optional(e.UserID), optional(e.TenantID), e.Device)
+	fmt.Fprintf(h, "%s\n%s\n%s\n", e.Action, e.Entity, e.EntityID)
+	fmt.Fprintf(h, "%d:%s\n%d:%s\n", len(e.Before), e.Before, len(e.After), e.After)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// seal põe a entrada na posição seq da cadeia, a seguir à entrada com o hash prev
+func (e *AuditEntry) seal(seq uint64, prev string) {
+	e.Seq = &seq
+	e.PrevHash = prev
+	e.Hash = e.digest()
+}
+
+// RegisterAudit regista os callbacks que gravam uma AuditEntry por cada registo criado, alterado
+// ou apagado pela ligação. As entradas são gravadas na mesma transação da alteração.
+func RegisterAudit(db *gorm.DB) error {
+	callbacks := []error{
+		db.Callback().Create().After("gorm:create").Register("audit:create", auditCreated),
+		db.Callback().Update().Before("gorm:update").Register("audit:before_update", auditBefore),
+		db.Callback().Update().After("gorm:update").Register("audit:update", auditAfter(AuditUpdate)),
+		db.Callback().Delete().Before("gorm:delete").Register("audit:before_delete", auditBefore),
+		db.Callback().Delete().After("gorm:delete").Register("audit:delete", auditAfter(AuditDelete)),
+	}
+	for _, err := range callbacks {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// audited indica se a alteração do statement é registada
+func audited(db *gorm.DB) bool {
+	stmt := db.Statement
+	return db.Error == nil && !db.DryRun && stmt.Schema != nil && len(stmt.Schema.PrimaryFields) > 0 &&
+		!slices.Contains(auditIgnored, stmt.Table)
+}
+
+// auditQuery começa uma consulta na tabela do statement, na mesma transação
+func auditQuery(stmt *gorm.Statement) *gorm.DB {
+	return stmt.DB.Session(&gorm.Session{NewDB: true, SkipHooks: true}).
+		Model(reflect.New(stmt.Schema.ModelType).Interface()).
+		Table(stmt.Table)
+}
+
+// auditRows lê os registos, como colunas e valores
+func auditRows(query *gorm.DB) ([]map[string]any, error) {
+	rows := make([]map[string]any, 0)
+	err := query.Find(&rows).Error
+	return rows, err
+}
+
+// auditKeys devolve a condição sobre a chave primária dos registos indicados
+func auditKeys(stmt *gorm.Statement, keys [][]any) clause.Expression {
+	column, values := schema.ToQueryValues(stmt.Table, stmt.Schema.PrimaryFieldDBNames, keys)
+	return clause.IN{Column: column, Values: values}
+}
+
+// auditKey devolve a chave primária de um registo lido por auditRows
+func auditKey(stmt *gorm.Statement, row map[string]any) []any {
+	key := make([]any, len(stmt.Schema.PrimaryFieldDBNames))
+	for i, name := range stmt.Schema.PrimaryFieldDBNames {
+		key[i] = row[name]
+	}
+	return key
+}
+
+// auditBefore guarda os registos que vão ser alterados ou apagados, com as mesmas condições que
+// o gorm usa: as do statement e a chave primária do valor
+func auditBefore(db *gorm.DB) {
+	if !audited(db) {
+		return
+	}
+	stmt := db.Statement
+
+	query := auditQuery(stmt)
+	if stmt.Unscoped {
+		query = query.Unscoped()
+	}
+	conditions := 0
+	if where, ok := stmt.Clauses["WHERE"]; ok && where.Expression != nil {
+		query = query.Clauses(where.Expression)
+		conditions++
+	}
+	if stmt.ReflectValue.IsValid() {
+		_, keys := schema.GetIdentityFieldValuesMap(stmt.Context, stmt.ReflectValue, stmt.Schema.PrimaryFields)
+		if len(keys) > 0 {
+			query = query.Clauses(clause.Where{Exprs: []clause.Expression{auditKeys(stmt, keys)}})
+			conditions++
+		}
+	}
+	// Sem condições o gorm recusa a alteração
+	if conditions == 0 {
+		return
+	}
+
+	rows, err := auditRows(query)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	db.InstanceSet("audit:before", rows)
+}
+
+// auditCreated regista os registos criados
+func auditCreated(db *gorm.DB) {
+	if !audited(db) || !db.Statement.ReflectValue.IsValid() {
+		return
+	}
+	stmt := db.Statement
+
+	_, keys := schema.GetIdentityFieldValuesMap(stmt.Context, stmt.ReflectValue, stmt.Schema.PrimaryFields)
+	if len(keys) == 0 {
+		return
+	}
+	after, err := auditRows(auditQuery(stmt).Unscoped().Where(auditKeys(stmt, keys)))
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	db.AddError(writeAudit(stmt, AuditCreate, nil, after))
+}
+
+// auditAfter regista o estado dos registos guardados por auditBefore depois da alteração. Os
+// registos apagados de vez ficam sem estado final.
+func auditAfter(action string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet("audit:before")
+		if !ok || !audited(db) {
+			return
+		}
+		stmt := db.Statement
+		before := value.([]map[string]any)
+		if len(before) == 0 || db.RowsAffected == 0 {
+			return
+		}
+
+		keys := make([][]any, len(before))
+		for i, row := range before {
+			keys[i] = auditKey(stmt, row)
+		}
+		after, err := auditRows(auditQuery(stmt).Unscoped().Where(auditKeys(stmt, keys)))
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		db.AddError(writeAudit(stmt, action, before, after))
+	}
+}
+
+// auditState converte um registo no JSON guardado, sem as colunas secretas
+func auditState(row map[string]any) ([]byte, error) {
+	if row == nil {
+		return nil, nil
+	}
+	for _, column := range auditRedacted {
+		delete(row, column)
+	}
+	return json.Marshal(row)
+}
+
+// writeAudit grava uma entrada por registo, emparelhando os estados pela chave primária
+func writeAudit(stmt *gorm.Statement, action string, before []map[string]any, after []map[string]any) error {
+	actor := auditActor(stmt.Context)
+	now := time.Now().UTC()
+
+	id := func(row map[string]any) string {
+		parts := make([]string, 0, len(stmt.Schema.PrimaryFieldDBNames))
+		for _, value := range auditKey(stmt, row) {
+			parts = append(parts, fmt.Sprint(value))
+		}
+		return strings.Join(parts, ",")
+	}
+	// Pares com o estado anterior e o final de cada registo
+	changes := make([][2]map[string]any, 0, max(len(before), len(after)))
+	if before == nil {
+		for _, row := range after {
+			changes = append(changes, [2]map[string]any{nil, row})
+		}
+	} else {
+		afterByID := make(map[string]map[string]any, len(after))
+		for _, row := range after {
+			afterByID[id(row)] = row
+		}
+		for _, row := range before {
+			changes = append(changes, [2]map[string]any{row, afterByID[id(row)]})
+		}
+	}
+
+	entries := make([]AuditEntry, 0, len(changes))
+	for _, change := range changes {
+		old, current := change[0], change[1]
+		row := current
+		if row == nil {
+			row = old
+		}
+
+		entry := AuditEntry{
+			CreatedAt: now,
+			Source:    actor.Source,
+			UserID:    actor.UserID,
+			TenantID:  actor.TenantID,
+			Device:    actor.Device,
+			Action:    action,
+			Entity:    stmt.Table,
+			EntityID:  id(row),
+		}
+		if entry.TenantID == nil {
+			if tenant, ok := row["tenant_id"].(int64); ok && tenant > 0 {
+				value := uint(tenant)
+				entry.TenantID = &value
+			}
+		}
+
+		var err error
+		if entry.Before, err = auditState(old); err != nil {
+			return err
+		}
+		if entry.After, err = auditState(current); err != nil {
+			return err
+		}
+		// Alterações que não mudam nada não são registadas
+		if action == AuditUpdate && string(entry.Before) == string(entry.After) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return stmt.DB.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Create(&entries).Error
+}
+
+// AuditFilter limita a listagem do histórico, os campos vazios não filtram
+type AuditFilter struct {
+	Entity   string
+	EntityID string
+	Action   string
+	Source   string
+	UserID   *uint
+}
+
+// ListAuditEntries devolve uma página do histórico do tenant, da alteração mais recente para a
+// mais antiga
+func ListAuditEntries(db *gorm.DB, tenantID uint, filter AuditFilter, options ListOptions) ([]AuditEntry, int64, error) {
+	list := make([]AuditEntry, 0)
+
+	query := db.Model(&AuditEntry{}).Where("tenant_id = ?", tenantID)
+	if filter.Entity != "" {
+		query = query.Where("entity = ?", filter.Entity)
+	}
+	if filter.EntityID != "" {
+		query = query.Where("entity_id = ?", filter.EntityID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Source != "" {
+		query = query.Where("source = ?", filter.Source)
+	}
+	if filter.UserID != nil {
+		query = query.Where("user_id = ?", *filter.UserID)
+	}
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-id"
+	}
+	total, err := options.find(query, &list, "id", "created_at")
+
+	return list, total, err
+}
+
+// SealAuditEntries acrescenta à cadeia as entradas gravadas desde a última execução, pela ordem
+// em que foram gravadas, e devolve quantas foram seladas
+func SealAuditEntries(db *gorm.DB) (sealed int, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditLockKey).Error; err != nil {
+			return err
+		}
+
+		var last AuditEntry
+		if err := tx.Where("seq is not null").Order("seq desc").Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+		var seq uint64
+		if last.Seq != nil {
+			seq = *last.Seq
+		}
+
+		pending := make([]AuditEntry, 0)
+		if err := tx.Where("seq is null").Order("id").Limit(auditBatch).Find(&pending).Error; err != nil {
+			return err
+		}
+		prev := last.Hash
+		for i := range pending {
+			entry := &pending[i]
+			seq++
+			entry.seal(seq, prev)
+			prev = entry.Hash
+
+			err := tx.Model(entry).Updates(map[string]any{"seq": entry.Seq, "prev_hash": entry.PrevHash, "hash": entry.Hash}).Error
+			if err != nil {
+				return err
+			}
+		}
+		sealed = len(pending)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao selar o histórico de auditoria: %s", err.Error())
+		return 0, ErrUnexpectedError
+	}
+	return
+}
+
+// AuditBGJob corre a cada AuditTick e sela as novas entradas do histórico
+func AuditBGJob(db *gorm.DB) error {
+	time.Sleep(AuditTick)
+	for {
+		sealed, err := SealAuditEntries(db)
+		if err != nil || sealed < auditBatch {
+			return err
+		}
+	}
+}
+
+// AuditVerification é o resultado da verificação da cadeia do histórico
+type AuditVerification struct {
+	// Entradas seladas verificadas
+	Entries int64
+	// Entradas ainda por selar
+	Unsealed int64
+	// Hash da última entrada verificada
+	Head string
+	// Primeira posição da cadeia adulterada, zero se a cadeia estiver intacta
+	BrokenSeq uint64
+	Problem   string
+}
+
+// check continua a verificação com as entradas seguintes da cadeia, devolve false na primeira
+// entrada adulterada
+func (v *AuditVerification) check(entries []AuditEntry) bool {
+	for i := range entries {
+		entry := &entries[i]
+		switch {
+		case entry.Seq == nil || *entry.Seq != uint64(v.Entries)+1:
+			v.Problem = "a entrada foi apagada"
+		case entry.PrevHash != v.Head:
+			v.Problem = "o hash anterior não corresponde à entrada anterior"
+		case entry.Hash != entry.digest():
+			v.Problem = "o conteúdo da entrada foi alterado"
+		default:
+			v.Entries++
+			v.Head = entry.Hash
+			continue
+		}
+		v.BrokenSeq = uint64(v.Entries) + 1
+		return false
+	}
+	return true
+}
+
+// VerifyAudit percorre a cadeia do histórico e confirma que nenhuma entrada selada foi alterada ou
+// apagada. A remoção das últimas entradas só é detetada comparando Head com um valor guardado.
+func VerifyAudit(db *gorm.DB) (*AuditVerification, error) {
+	var verification AuditVerification
+
+	for {
+		batch := make([]AuditEntry, 0, auditBatch)
+		err := db.Where("seq > ?", verification.Entries).Order("seq").Limit(auditBatch).Find(&batch).Error
+		if err != nil {
+			log.Printf("Erro inesperado: %s", err.Error())
+			return nil, ErrUnexpectedError
+		}
+		if !verification.check(batch) || len(batch) < auditBatch {
+			break
+		}
+	}
+
+	if err := db.Model(&AuditEntry{}).Where("seq is null").Count(&verification.Unsealed).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &verification, nil
+}
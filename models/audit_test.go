@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// auditChain sela as entradas numa cadeia nova
+func auditChain(entries []AuditEntry) []AuditEntry {
+	prev := ""
+	for i := range entries {
+		entries[i].seal(uint64(i+1), prev)
+		prev = entries[i].Hash
+	}
+	return entries
+}
+
+func TestAuditChain(t *testing.T) {
+	user := uint(3)
+	created := time.Date(2024, 5, 1, 8, 0, 0, 123456000, time.UTC)
+	entries := func() []AuditEntry {
+		return auditChain([]AuditEntry{
+			{CreatedAt: created, Source: AuditSourceAPI, UserID: &user, Action: AuditCreate, Entity: "dropper_sections", EntityID: "1", After: []byte(`{"id":1}`)},
+			{CreatedAt: created, Source: AuditSourceScheduler, Action: AuditUpdate, Entity: "positions", EntityID: "4", Before: []byte(`{"pill_id":2}`), After: []byte(`{"pill_id":null}`)},
+			{CreatedAt: created, Source: AuditSourceDevice, Device: "f1e2", Action: AuditCreate, Entity: "dose_confirmations", EntityID: "9", After: []byte(`{"id":9}`)},
+		})
+	}
+
+	var verification AuditVerification
+	if !verification.check(entries()) || verification.Entries != 3 {
+		t.Fatalf("Expected an intact chain: %+v", verification)
+	}
+
+	// A hora lida da base de dados noutro fuso horário tem o mesmo hash
+	chain := entries()
+	chain[0].CreatedAt = chain[0].CreatedAt.In(time.FixedZone("WEST", 3600))
+	if chain[0].digest() != chain[0].Hash {
+		t.Fatal("The hash should not depend on the time zone")
+	}
+
+	// Refazer o hash de uma entrada alterada quebra a cadeia na seguinte
+	rehashed := entries()
+	rehashed[1].Action = AuditDelete
+	rehashed[1].Hash = rehashed[1].digest()
+	if verification := (AuditVerification{}); verification.check(rehashed) || verification.BrokenSeq != 3 {
+		t.Fatalf("Expected the chain to break at 3, got %+v", verification)
+	}
+
+	tampered := map[string]func([]AuditEntry) []AuditEntry{
+		"content": func(chain []AuditEntry) []AuditEntry {
+			chain[1].Before = []byte(`{"pill_id":5}`)
+			return chain
+		},
+		"actor": func(chain []AuditEntry) []AuditEntry {
+			other := uint(4)
+			chain[1].UserID = &other
+			return chain
+		},
+		"deleted": func(chain []AuditEntry) []AuditEntry {
+			return append(chain[:1], chain[2:]...)
+		},
+	}
+	for name, tamper := range tampered {
+		var verification AuditVerification
+		if verification.check(tamper(entries())) || verification.BrokenSeq != 2 {
+			t.Errorf("%s: expected the chain to break at 2, got %+v", name, verification)
+		}
+	}
+}
+
+func TestAuditActor(t *testing.T) {
+	if actor := auditActor(context.Background()); actor.Source != AuditSourceSystem {
+		t.Fatalf("Expected the system source, got %+v", actor)
+	}
+
+	user := uint(7)
+	ctx := context.WithValue(context.Background(), auditActorKey{}, AuditActor{Source: AuditSourceAPI, UserID: &user})
+	if actor := auditActor(ctx); actor.Source != AuditSourceAPI || *actor.UserID != 7 {
+		t.Fatalf("Unexpected actor %+v", actor)
+	}
+
+	state, err := auditState(map[string]any{"id": 1, "email": "a@b.pt", "password_hash": "x", "secret": "y"})
+	if err != nil || string(state) != `{"email":"a@b.pt","id":1}` {
+		t.Fatalf("Secrets should be removed from the audit state, got %s %v", state, err)
+	}
+}
@@ -0,0 +1,263 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/ical"
+)
+
+var ErrCalendarFeedNotFound = errors.New("calendário não encontrado")
+
+const (
+	// CalendarHorizon é até quando o calendário mostra as próximas tomas
+	CalendarHorizon = 14 * 24 * time.Hour
+	// CalendarRefresh é o intervalo sugerido aos clientes para voltarem a buscar o calendário
+	CalendarRefresh = time.Hour
+	// CalendarEventDuration é a duração de cada toma no calendário
+	CalendarEventDuration = 15 * time.Minute
+)
+
+// CalendarFeed é um calendário iCalendar público das próximas tomas de um paciente ou de um
+// dropper. O acesso é feito apenas com o token secreto, do qual só o hash é guardado, e enquanto
+// quem o criou puder partilhar as tomas do paciente ou do dropper.
+type CalendarFeed struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	TenantID uint `gorm:"index;not null" json:"-"`
+	// Utilizador que criou o calendário, só ele o vê e revoga
+	UserID uint `gorm:"index;not null" json:"user_id"`
+	// O calendário é de um paciente ou de um dropper
+	PatientID *uint `gorm:"index" json:"patient_id"`
+	DropperID *uint `gorm:"index" json:"-"`
+
+	Name       string     `json:"name"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// newCalendarFeed gera o token do calendário, devolvido uma única vez a quem o cria
+func newCalendarFeed(db *gorm.DB, feed *CalendarFeed) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	feed.TokenHash = hashRefreshToken(token)
+
+	if err := db.Create(feed).Error; err != nil {
+		log.Printf("Erro inesperado ao criar calendário: %s", err.Error())
+		return "", ErrUnexpectedError
+	}
+	return token, nil
+}
+
+// CreateCalendarFeed cria o calendário das tomas do paciente e devolve o seu token
+func (p *Patient) CreateCalendarFeed(db *gorm.DB, userID uint) (*CalendarFeed, string, error) {
+	feed := CalendarFeed{TenantID: p.TenantID, UserID: userID, PatientID: &p.ID, Name: p.Name}
+	token, err := newCalendarFeed(db, &feed)
+	return &feed, token, err
+}
+
+// CreateCalendarFeed cria o calendário das tomas do dropper e devolve o seu token
+func (d *Dropper) CreateCalendarFeed(db *gorm.DB, tenantID uint, userID uint) (*CalendarFeed, string, error) {
+	feed := CalendarFeed{TenantID: tenantID, UserID: userID, DropperID: &d.ID, Name: d.Name}
+	token, err := newCalendarFeed(db, &feed)
+	return &feed, token, err
+}
+
+// ListCalendarFeeds devolve uma página dos calendários criados pelo utilizador
+func ListCalendarFeeds(db *gorm.DB, userID uint, options ListOptions) ([]CalendarFeed, int64, error) {
+	list := make([]CalendarFeed, 0)
+
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	query := db.Model(&CalendarFeed{}).Where("user_id = ?", userID)
+	total, err := options.find(query, &list, "created_at", "name")
+
+	return list, total, err
+}
+
+// RevokeCalendarFeed revoga um calendário do utilizador, o seu endereço deixa de funcionar
+func RevokeCalendarFeed(db *gorm.DB, userID uint, id uint) error {
+	result := db.Model(&CalendarFeed{}).
+		Where("id = ? and user_id = ? and revoked_at is null", id, userID).
+		Update("revoked_at", time.Now().UTC())
+	if result.Error != nil {
+		log.Printf("Erro inesperado ao revogar calendário: %s", result.Error.Error())
+		return ErrUnexpectedError
+	}
+	if result.RowsAffected == 0 {
+		return ErrCalendarFeedNotFound
+	}
+	return nil
+}
+
+// revokeCalendarFeeds revoga os calendários ativos da query, ex: os de um utilizador num dropper
+func revokeCalendarFeeds(db *gorm.DB, query *gorm.DB) error {
+	return db.Model(&CalendarFeed{}).
+		Where(query).
+		Where("revoked_at is null").
+		Update("revoked_at", time.Now().UTC()).
+		Error
+}
+
+// authorized confirma que quem criou o calendário ainda tem a permissão PermShareCalendar, no
+// tenant para os calendários de um paciente ou no dropper, pelo tenant ou por um acesso concedido
+func (f *CalendarFeed) authorized(db *gorm.DB, dropper *Dropper) (bool, error) {
+	var user User
+	err := db.Limit(1).Find(&user, f.UserID).Error
+	if err != nil || user.ID == 0 {
+		return false, err
+	}
+
+	actor := Actor{UserID: user.ID, TenantID: user.TenantID, Role: user.Role}
+	if dropper == nil {
+		return actor.TenantID == f.TenantID && actor.Role.Can(PermShareCalendar), nil
+	}
+	return actor.Can(db, dropper, PermShareCalendar)
+}
+
+// FindCalendarFeed procura o calendário ativo com o token
+func FindCalendarFeed(db *gorm.DB, token string) (*CalendarFeed, error) {
+	var feed CalendarFeed
+
+	err := db.First(&feed, "token_hash = ? and revoked_at is null", hashRefreshToken(token)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCalendarFeedNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &feed, nil
+}
+
+// Render escreve o calendário com as tomas previstas entre now e CalendarHorizon. Como é gerado
+// a cada pedido, reflete sempre os horários atuais. Se quem o criou já não puder partilhar as
+// tomas, ex: porque o seu acesso ao dropper foi retirado, o calendário deixa de ser encontrado.
+func (f *CalendarFeed) Render(db *gorm.DB, out io.Writer) error {
+	now := time.Now().UTC()
+
+	calendar := ical.Calendar{RefreshInterval: CalendarRefresh}
+	var scope *gorm.DB
+	var dropper *Dropper
+	if f.PatientID != nil {
+		patient, err := FindPatient(db, f.TenantID, *f.PatientID)
+		if errors.Is(err, ErrPatientNotFound) {
+			return ErrCalendarFeedNotFound
+		} else if err != nil {
+			return err
+		}
+		scope = db.Where("patient_id = ?", patient.ID)
+		calendar.Name = "Tomas de " + patient.Name
+	} else {
+		dropper = &Dropper{}
+		err := db.First(dropper, *f.DropperID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCalendarFeedNotFound
+		} else if err != nil {
+			log.Printf("Erro inesperado: %s", err.Error())
+			return ErrUnexpectedError
+		}
+		scope = db.Where("dropper_id = ?", dropper.ID)
+		calendar.Name = "Tomas do dropper " + dropper.Name
+	}
+
+	authorized, err := f.authorized(db, dropper)
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	if !authorized {
+		return ErrCalendarFeedNotFound
+	}
+
+	to := now.Add(CalendarHorizon)
+	schedules := make([]DispenseSchedule, 0)
+	err = db.
+		Where(scope).
+		Where("active = true and kind = ? and start_date < ? and end_date >= ?", ScheduleKindScheduled, to, now).
+		Order("id").
+		Find(&schedules).
+		Error
+	if err != nil {
+		log.Printf("Erro inesperado ao gerar calendário: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	for i := range schedules {
+		schedule := &schedules[i]
+		pills, err := schedule.Pills(db)
+		if err != nil {
+			log.Printf("Erro inesperado ao gerar calendário: %s", err.Error())
+			return ErrUnexpectedError
+		}
+		// As tomas já registadas, ex: saltadas, não aparecem no calendário
+		recorded := make([]time.Time, 0)
+		err = db.Model(&DispenseRecord{}).
+			Where("schedule_id = ? and due_at >= ? and due_at < ?", schedule.ID, now, to).
+			Pluck("due_at", &recorded).
+			Error
+		if err != nil {
+			log.Printf("Erro inesperado ao gerar calendário: %s", err.Error())
+			return ErrUnexpectedError
+		}
+		calendar.Events = append(calendar.Events, schedule.calendarEvents(pills, recorded, now, to)...)
+	}
+
+	// Exec não passa pelos callbacks de auditoria: cada atualização feita pelo cliente de
+	// calendário acrescentaria uma entrada ao histórico
+	db.Exec(`UPDATE "calendar_feeds" SET "last_used_at" = ? WHERE "id" = ?`, now, f.ID)
+	return ical.Write(out, &calendar, now)
+}
+
+// calendarEvents devolve as tomas do horário em [from, to) que não estão em pausa nem em recorded.
+// O UID depende só do horário e da hora da toma, para os clientes atualizarem o mesmo evento.
+func (s *DispenseSchedule) calendarEvents(pills PillList, recorded []time.Time, from, to time.Time) []ical.Event {
+	events := make([]ical.Event, 0)
+
+occurrences:
+	for _, due := range s.Occurrences(from, to) {
+		if s.pausedAt(due) {
+			continue
+		}
+		for _, at := range recorded {
+			if at.Equal(due) {
+				continue occurrences
+			}
+		}
+
+		dosePills := pills
+		if phase := s.phaseAt(due); len(s.Phases) > 0 && phase != nil {
+			dosePills = phase.Pills
+		}
+		description := []string{"Horário: " + s.Name, "Comprimidos: " + formatPills(dosePills)}
+		if s.Description != "" {
+			description = append(description, s.Description)
+		}
+		alarm := s.ReminderLead
+
+		events = append(events, ical.Event{
+			UID:          fmt.Sprintf("dose-%d-%d@dropmedical", s.ID, due.Unix()),
+			Start:        due,
+			Duration:     CalendarEventDuration,
+			Summary:      "Toma: " + formatPills(dosePills),
+			Description:  strings.Join(description, "\n"),
+			LastModified: s.UpdatedAt,
+			Alarm:        &alarm,
+		})
+	}
+	return events
+}
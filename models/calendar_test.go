@@ -0,0 +1,49 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendarEvents(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	paused, resume := start.Add(24*time.Hour), start.Add(48*time.Hour)
+	schedule := DispenseSchedule{
+		Name: "Manhã e noite", Description: "Depois da refeição",
+		StartDate: start, EndDate: start.Add(30 * 24 * time.Hour), Interval: 12 * time.Hour,
+		PausedAt: &paused, ResumeAt: &resume, ReminderLead: 10 * time.Minute,
+	}
+	schedule.ID = 7
+
+	// Três dias: 6 tomas, 2 em pausa e 1 já saltada
+	events := schedule.calendarEvents(PillList{"Brufen": 2, "Aspirina": 1}, []time.Time{start.Add(12 * time.Hour)}, start, start.Add(72*time.Hour))
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+
+	event := events[0]
+	if event.UID != "dose-7-1714550400@dropmedical" || !event.Start.Equal(start) {
+		t.Fatalf("Unexpected event %s at %s", event.UID, event.Start)
+	}
+	if event.Summary != "Toma: Aspirina x1, Brufen x2" || !strings.Contains(event.Description, "Depois da refeição") {
+		t.Fatalf("Unexpected event details %q, %q", event.Summary, event.Description)
+	}
+	if event.Alarm == nil || *event.Alarm != 10*time.Minute {
+		t.Fatal("The alarm should follow the reminder lead")
+	}
+	if !events[1].Start.Equal(resume) {
+		t.Fatalf("Expected the dose after the pause at %s, got %s", resume, events[1].Start)
+	}
+
+	// Nos horários por fases os comprimidos são os da fase
+	schedule.PausedAt, schedule.ResumeAt = nil, nil
+	schedule.Phases = []SchedulePhase{
+		{StartDate: start, EndDate: start.Add(24 * time.Hour), Pills: PillList{"Prednisolona": 4}},
+		{StartDate: start.Add(24 * time.Hour), EndDate: schedule.EndDate, Pills: PillList{"Prednisolona": 2}},
+	}
+	events = schedule.calendarEvents(nil, nil, start.Add(12*time.Hour), start.Add(36*time.Hour))
+	if len(events) != 2 || events[0].Summary != "Toma: Prednisolona x4" || events[1].Summary != "Toma: Prednisolona x2" {
+		t.Fatalf("Expected the phase doses, got %+v", events)
+	}
+}
@@ -0,0 +1,288 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrScheduleNotPaused = errors.New("o horário não está em pausa")
+	ErrNoUpcomingDose    = errors.New("o horário não tem mais tomas previstas")
+	ErrInvalidResumeTime = errors.New("a hora de retoma tem de ser futura")
+)
+
+// Ações registadas no ScheduleControl
+const (
+	ControlPause  = "pause"
+	ControlResume = "resume"
+	ControlSkip   = "skip"
+)
+
+// ScheduleControl regista cada pausa, retoma ou toma saltada de um horário, quem a fez e porquê
+type ScheduleControl struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	ScheduleID uint  `gorm:"index;not null" json:"schedule_id"`
+	PatientID  *uint `gorm:"index" json:"patient_id"`
+	UserID     uint  `gorm:"not null" json:"user_id"`
+
+	Action string `gorm:"not null" json:"action"`
+	Reason string `json:"reason"`
+	// Retoma automática da pausa, se existir
+	ResumeAt *time.Time `json:"resume_at"`
+	// Toma saltada
+	DueAt *time.Time `json:"due_at"`
+	// A pausa ou retoma abrangeu todos os horários do paciente, ex: internamento
+	PatientWide bool `json:"patient_wide"`
+}
+
+// ScheduleControlFields contêm quem controla o horário e porquê
+type ScheduleControlFields struct {
+	UserID uint
+	Reason string
+	// Só nas pausas, nil pausa até à retoma manual
+	ResumeAt *time.Time
+}
+
+// pausedAt indica se a toma prevista para t calha numa pausa do horário
+func (s *DispenseSchedule) pausedAt(t time.Time) bool {
+	if s.PausedAt == nil || t.Before(*s.PausedAt) {
+		return false
+	}
+	return s.ResumeAt == nil || t.Before(*s.ResumeAt)
+}
+
+// Paused indica se o horário está em pausa agora
+func (s *DispenseSchedule) Paused() bool {
+	return s.pausedAt(time.Now().UTC())
+}
+
+// pause coloca o horário em pausa a partir de now; uma pausa em curso é prolongada
+func (s *DispenseSchedule) pause(tx *gorm.DB, fields ScheduleControlFields, now time.Time, patientWide bool) error {
+	if !s.Paused() {
+		s.PausedAt = &now
+	}
+	s.ResumeAt = nil
+	if fields.ResumeAt != nil {
+		resume := fields.ResumeAt.UTC()
+		s.ResumeAt = &resume
+	}
+
+	if err := tx.Model(s).Select("paused_at", "resume_at").Updates(s).Error; err != nil {
+		return err
+	}
+	return tx.Create(&ScheduleControl{
+		ScheduleID:  s.ID,
+		PatientID:   s.PatientID,
+		UserID:      fields.UserID,
+		Action:      ControlPause,
+		Reason:      fields.Reason,
+		ResumeAt:    s.ResumeAt,
+		PatientWide: patientWide,
+	}).Error
+}
+
+// resume termina a pausa do horário
+func (s *DispenseSchedule) resume(tx *gorm.DB, fields ScheduleControlFields, patientWide bool) error {
+	s.PausedAt, s.ResumeAt = nil, nil
+	if err := tx.Model(s).Select("paused_at", "resume_at").Updates(s).Error; err != nil {
+		return err
+	}
+	return tx.Create(&ScheduleControl{
+		ScheduleID:  s.ID,
+		PatientID:   s.PatientID,
+		UserID:      fields.UserID,
+		Action:      ControlResume,
+		Reason:      fields.Reason,
+		PatientWide: patientWide,
+	}).Error
+}
+
+// Pause coloca o horário em pausa até fields.ResumeAt, ou até ser retomado.
+// As tomas previstas durante a pausa ficam registadas como saltadas.
+func (s *DispenseSchedule) Pause(db *gorm.DB, fields ScheduleControlFields) error {
+	now := time.Now().UTC()
+	if fields.ResumeAt != nil && !fields.ResumeAt.After(now) {
+		return ErrInvalidResumeTime
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return s.pause(tx, fields, now, false)
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao pausar horário: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	log.Printf("Horário <%d> em pausa por <%d>: %s", s.ID, fields.UserID, fields.Reason)
+	return nil
+}
+
+// Resume retoma o horário em pausa
+func (s *DispenseSchedule) Resume(db *gorm.DB, fields ScheduleControlFields) error {
+	if !s.Paused() {
+		return ErrScheduleNotPaused
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return s.resume(tx, fields, false)
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao retomar horário: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	log.Printf("Horário <%d> retomado por <%d>", s.ID, fields.UserID)
+	return nil
+}
+
+// SkipNext salta a próxima toma do horário que ainda não foi registada, registando-a como saltada
+func (s *DispenseSchedule) SkipNext(db *gorm.DB, fields ScheduleControlFields) (*DispenseRecord, error) {
+	now := time.Now().UTC()
+
+	recorded := make([]time.Time, 0)
+	if err := db.Model(&DispenseRecord{}).Where("schedule_id = ? and due_at >= ?", s.ID, now).Pluck("due_at", &recorded).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	due, ok := s.nextOccurrence(now, recorded)
+	if !ok {
+		return nil, ErrNoUpcomingDose
+	}
+
+	record := DispenseRecord{
+		DropperID:      s.DropperID,
+		ScheduleID:     &s.ID,
+		PrescriptionID: s.PrescriptionID,
+		PatientID:      s.PatientID,
+		DueAt:          due,
+		Source:         DoseSourceSchedule,
+		Status:         DoseSkipped,
+		Reason:         fields.Reason,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+		return tx.Create(&ScheduleControl{
+			ScheduleID: s.ID,
+			PatientID:  s.PatientID,
+			UserID:     fields.UserID,
+			Action:     ControlSkip,
+			Reason:     fields.Reason,
+			DueAt:      &due,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// A toma foi dispensada entretanto
+		return nil, ErrNoUpcomingDose
+	} else if err != nil {
+		log.Printf("Erro inesperado ao saltar toma: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("Toma das %s do horário <%d> saltada por <%d>: %s", due, s.ID, fields.UserID, fields.Reason)
+	return &record, nil
+}
+
+// nextOccurrence devolve a primeira toma a partir de from que não está em recorded
+func (s *DispenseSchedule) nextOccurrence(from time.Time, recorded []time.Time) (time.Time, bool) {
+	if s.Interval < MinScheduleInterval {
+		return time.Time{}, false
+	}
+
+	// Procura em blocos para não gerar todas as tomas de horários longos
+	step := 64 * s.Interval
+	for start := from; !start.After(s.EndDate); start = start.Add(step) {
+	occurrences:
+		for _, due := range s.Occurrences(start, start.Add(step)) {
+			for _, at := range recorded {
+				if at.Equal(due) {
+					continue occurrences
+				}
+			}
+			return due, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ListControls devolve uma página das pausas, retomas e tomas saltadas do horário, das mais recentes para as mais antigas
+func (s *DispenseSchedule) ListControls(db *gorm.DB, options ListOptions) ([]ScheduleControl, int64, error) {
+	controls := make([]ScheduleControl, 0)
+
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	query := db.Model(&ScheduleControl{}).Where("schedule_id = ?", s.ID)
+	total, err := options.find(query, &controls, "created_at", "action")
+
+	return controls, total, err
+}
+
+// activeSchedules devolve os horários ativos do paciente que ainda não terminaram
+func (p *Patient) activeSchedules(db *gorm.DB, now time.Time) ([]DispenseSchedule, error) {
+	schedules := make([]DispenseSchedule, 0)
+	err := db.Where("patient_id = ? and active = true and end_date > ?", p.ID, now).Order("id").Find(&schedules).Error
+	return schedules, err
+}
+
+// PauseSchedules pausa todos os horários ativos do paciente, ex: durante um internamento,
+// e devolve os horários pausados
+func (p *Patient) PauseSchedules(db *gorm.DB, fields ScheduleControlFields) ([]DispenseSchedule, error) {
+	now := time.Now().UTC()
+	if fields.ResumeAt != nil && !fields.ResumeAt.After(now) {
+		return nil, ErrInvalidResumeTime
+	}
+
+	var schedules []DispenseSchedule
+	err := db.Transaction(func(tx *gorm.DB) (err error) {
+		if schedules, err = p.activeSchedules(tx, now); err != nil {
+			return err
+		}
+		for i := range schedules {
+			if err := schedules[i].pause(tx, fields, now, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao pausar horários do paciente: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("%d horários do paciente <%d> em pausa por <%d>: %s", len(schedules), p.ID, fields.UserID, fields.Reason)
+	return schedules, nil
+}
+
+// ResumeSchedules retoma todos os horários do paciente que estão em pausa e devolve-os
+func (p *Patient) ResumeSchedules(db *gorm.DB, fields ScheduleControlFields) ([]DispenseSchedule, error) {
+	resumed := make([]DispenseSchedule, 0)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		schedules, err := p.activeSchedules(tx, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		for i := range schedules {
+			if !schedules[i].Paused() {
+				continue
+			}
+			if err := schedules[i].resume(tx, fields, true); err != nil {
+				return err
+			}
+			resumed = append(resumed, schedules[i])
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao retomar horários do paciente: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("%d horários do paciente <%d> retomados por <%d>", len(resumed), p.ID, fields.UserID)
+	return resumed, nil
+}
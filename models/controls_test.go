@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulePause(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	paused, resume := start.Add(24*time.Hour), start.Add(72*time.Hour)
+	schedule := DispenseSchedule{StartDate: start, EndDate: start.Add(30 * 24 * time.Hour), Interval: 12 * time.Hour, PausedAt: &paused, ResumeAt: &resume}
+
+	if schedule.pausedAt(start) || !schedule.pausedAt(paused) || !schedule.pausedAt(resume.Add(-time.Second)) || schedule.pausedAt(resume) {
+		t.Fatal("Only doses between the pause and the resume time should be paused")
+	}
+
+	// Sem hora de retoma a pausa não acaba
+	schedule.ResumeAt = nil
+	if !schedule.pausedAt(start.Add(29 * 24 * time.Hour)) {
+		t.Fatal("A pause without a resume time should last until resumed")
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	schedule := DispenseSchedule{StartDate: start, EndDate: start.Add(2000 * time.Hour), Interval: time.Hour}
+
+	next, ok := schedule.nextOccurrence(start.Add(90*time.Minute), nil)
+	if !ok || !next.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("Expected the dose at %s, got %s", start.Add(2*time.Hour), next)
+	}
+
+	// Tomas já registadas, ex: já saltadas, não contam
+	next, ok = schedule.nextOccurrence(start.Add(90*time.Minute), []time.Time{start.Add(2 * time.Hour), start.Add(3 * time.Hour)})
+	if !ok || !next.Equal(start.Add(4*time.Hour)) {
+		t.Fatalf("Expected the dose at %s, got %s", start.Add(4*time.Hour), next)
+	}
+
+	// Procura para além do primeiro bloco de tomas
+	recorded := make([]time.Time, 0, 100)
+	for i := 2; i < 102; i++ {
+		recorded = append(recorded, start.Add(time.Duration(i)*time.Hour))
+	}
+	next, ok = schedule.nextOccurrence(start.Add(90*time.Minute), recorded)
+	if !ok || !next.Equal(start.Add(102*time.Hour)) {
+		t.Fatalf("Expected the dose at %s, got %s", start.Add(102*time.Hour), next)
+	}
+
+	if _, ok := schedule.nextOccurrence(start.Add(2001*time.Hour), nil); ok {
+		t.Fatal("There should be no dose after the end of the schedule")
+	}
+}
@@ -0,0 +1,381 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Estados de uma toma registada
+const (
+	DoseDispensed = "dispensed"
+	DoseFailed    = "failed"
+	// Saltada manualmente ou por o horário estar em pausa
+	DoseSkipped = "skipped"
+)
+
+// Origem de uma toma registada
+const (
+	DoseSourceSchedule = "schedule"
+	DoseSourceManual   = "manual"
+	DoseSourcePRN      = "prn"
+)
+
+// ReasonPaused é o motivo das tomas saltadas durante uma pausa
+const ReasonPaused = "horário em pausa"
+
+const (
+	// DispenseTick é o intervalo entre execuções do PillDispenseBGJob
+	DispenseTick = 10 * time.Second
+	// DispenseLookback é quanto tempo para trás o job procura tomas por dispensar,
+	// para recuperar de atrasos ou de um reinício do servidor
+	DispenseLookback = 2 * time.Minute
+	// MinScheduleInterval é o intervalo mínimo entre tomas de um horário
+	MinScheduleInterval = time.Minute
+)
+
+// DispenseRecord regista cada toma dispensada, ou que falhou, com a ligação ao horário,
+// à receita e ao paciente de que resultou. Uma toma de um horário é registada uma única vez.
+type DispenseRecord struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	DropperID      uint  `gorm:"index;not null" json:"-"`
+	ScheduleID     *uint `gorm:"uniqueIndex:idx_schedule_dose" json:"schedule_id"`
+	PrescriptionID *uint `gorm:"index" json:"prescription_id"`
+	PatientID      *uint `gorm:"index" json:"patient_id"`
+
+	// Hora prevista da toma
+	DueAt time.Time `gorm:"uniqueIndex:idx_schedule_dose;not null" json:"due_at"`
+	// Hora a que os comprimidos foram enviados para o dropper
+	DispensedAt *time.Time `json:"dispensed_at"`
+	// Fim da janela para confirmar que a toma foi feita, a partir da dispensa
+	ConfirmBy *time.Time `json:"confirm_by"`
+	Source    string     `gorm:"not null" json:"source"`
+	Status    string     `gorm:"not null" json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	Pills     PillList   `gorm:"serializer:json" json:"pills"`
+
+	Confirmation *DoseConfirmation `gorm:"foreignKey:DoseID;constraint:OnDelete:CASCADE;" json:"confirmation,omitempty"`
+}
+
+// Occurrences devolve as horas das tomas do horário no intervalo [from, to).
+// As tomas começam em StartDate e repetem-se a cada Interval até EndDate, inclusive.
+// Os horários em SOS não têm tomas previstas e nos horários por fases não há tomas nas fases sem comprimidos.
+func (s *DispenseSchedule) Occurrences(from, to time.Time) []time.Time {
+	occurrences := make([]time.Time, 0)
+	if s.Interval < MinScheduleInterval || s.Kind == ScheduleKindPRN {
+		return occurrences
+	}
+
+	start := s.StartDate.UTC()
+	if from.Before(start) {
+		from = start
+	}
+	if end := s.EndDate.UTC().Add(time.Nanosecond); to.After(end) {
+		to = end
+	}
+	if !from.Before(to) {
+		return occurrences
+	}
+
+	// Primeira toma igual ou posterior a from
+	steps := from.Sub(start) / s.Interval
+	next := start.Add(steps * s.Interval)
+	if next.Before(from) {
+		next = next.Add(s.Interval)
+	}
+
+	for ; next.Before(to); next = next.Add(s.Interval) {
+		if len(s.Phases) > 0 {
+			if phase := s.phaseAt(next); phase == nil || len(phase.Pills) == 0 {
+				continue
+			}
+		}
+		occurrences = append(occurrences, next)
+	}
+	return occurrences
+}
+
+// reservePills reserva as posições com os comprimidos pedidos, marca-as como vazias
+// e devolve os comandos a enviar ao dropper. As posições ficam bloqueadas até ao fim da
+// transação e as já reservadas por outra dispensa são saltadas, para que o mesmo comprimido
+// nunca seja dispensado duas vezes.
+func (d *Dropper) reservePills(tx *gorm.DB, pills PillList) ([]MqttActionRequest, error) {
+	commands := make([]MqttActionRequest, 0)
+
+	for name, count := range pills {
+		if count < 1 {
+			continue
+		}
+
+		positions := make([]Position, 0, count)
+		err := tx.
+			Model(&Position{}).
+			Joins("join dropper_sections on dropper_sections.id = positions.dropper_section_id and dropper_sections.deleted_at is null").
+			Where("dropper_sections.dropper_id = ? and positions.empty = false and positions.pill_name = ?", d.ID, name).
+			Order("dropper_sections.id, positions.position").
+			Limit(count).
+			Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "positions"}, Options: "SKIP LOCKED"}).
+			Find(&positions).
+			Error
+		if err != nil {
+			return nil, err
+		}
+		if len(positions) < count {
+			return nil, ErrNotEnoughPills
+		}
+
+		for _, position := range positions {
+			result := tx.Model(&position).Where("empty = false").Update("empty", true)
+			if result.Error != nil {
+				return nil, result.Error
+			}
+			if result.RowsAffected == 0 {
+				return nil, ErrNotEnoughPills
+			}
+			commands = append(commands, NewDispenseCommand(d.ID, position.Position))
+		}
+	}
+	return commands, nil
+}
+
+// DispensePills dispensa manualmente os comprimidos pedidos, registando a toma, e devolve os
+// comandos a enviar ao dropper. Se faltar algum comprimido ou a dose ultrapassar os limites
+// nada é alterado. A toma é atribuída ao paciente do dropper, se tiver apenas um.
+func (d *Dropper) DispensePills(db *gorm.DB, pills PillList) ([]MqttActionRequest, error) {
+	var commands []MqttActionRequest
+	var record DispenseRecord
+
+	patientID, err := d.solePatient(db)
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	now := time.Now().UTC()
+	err = db.Transaction(func(tx *gorm.DB) (err error) {
+		if err := checkDispenseLimits(tx, d.TenantID, d.ID, patientID, pills, now); err != nil {
+			return err
+		}
+
+		commands, err = d.reservePills(tx, pills)
+		if err != nil {
+			return err
+		}
+
+		confirmBy := now.Add(ConfirmationWindow)
+		record = DispenseRecord{
+			DropperID:   d.ID,
+			PatientID:   patientID,
+			DueAt:       now,
+			DispensedAt: &now,
+			ConfirmBy:   &confirmBy,
+			Source:      DoseSourceManual,
+			Status:      DoseDispensed,
+			Pills:       pills,
+		}
+		return tx.Create(&record).Error
+	})
+	if errors.Is(err, ErrDoseLimitExceeded) {
+		raiseLimitAlert(db, d.TenantID, d.ID, patientID, nil, err)
+		return nil, err
+	} else if errors.Is(err, ErrNotEnoughPills) {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao dispensar: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	publishDispense(db, record, commands)
+	checkLowStock(db, d.TenantID, d.ID, pills)
+	return commands, nil
+}
+
+// dispenseScheduled dispensa a toma do horário prevista para due. Devolve false se a toma já
+// tinha sido registada. Se faltarem comprimidos ou a dose ultrapassar os limites a toma é
+// registada como falhada, e se o horário estiver em pausa é registada como saltada.
+func dispenseScheduled(db *gorm.DB, schedule *DispenseSchedule, due time.Time) (commands []MqttActionRequest, created bool, err error) {
+	record := DispenseRecord{
+		DropperID:      schedule.DropperID,
+		ScheduleID:     &schedule.ID,
+		PrescriptionID: schedule.PrescriptionID,
+		PatientID:      schedule.PatientID,
+		DueAt:          due,
+		Source:         DoseSourceSchedule,
+	}
+
+	if schedule.pausedAt(due) {
+		record.Status, record.Reason = DoseSkipped, ReasonPaused
+		if err := db.Create(&record).Error; errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		log.Printf("Toma das %s do horário <%d> saltada: %s", due, schedule.ID, ReasonPaused)
+		publishDispense(db, record, nil)
+		return nil, true, nil
+	}
+
+	record.Pills, err = schedule.PillsAt(db, due)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var tenantID uint
+	var alert *Alert
+	err = db.Transaction(func(tx *gorm.DB) (err error) {
+		// O registo é criado primeiro, para que a mesma toma nunca seja dispensada duas vezes
+		record.Status = DoseDispensed
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+
+		tenantID, err = scheduleTenant(tx, schedule)
+		if err != nil {
+			return err
+		}
+		if err := checkDispenseLimits(tx, tenantID, schedule.DropperID, schedule.PatientID, record.Pills, due); errors.Is(err, ErrDoseLimitExceeded) {
+			if alert = limitAlert(tenantID, schedule.DropperID, schedule.PatientID, &schedule.ID, err); !createAlert(tx, alert) {
+				alert = nil
+			}
+			record.Status, record.Reason = DoseFailed, err.Error()
+			return tx.Model(&record).Updates(map[string]any{"status": record.Status, "reason": record.Reason}).Error
+		} else if err != nil {
+			return err
+		}
+
+		// Savepoint, a reserva é desfeita se faltar algum dos comprimidos
+		var reserved []MqttActionRequest
+		err = tx.Transaction(func(tx *gorm.DB) (err error) {
+			dropper := Dropper{Model: gorm.Model{ID: schedule.DropperID}}
+			reserved, err = dropper.reservePills(tx, record.Pills)
+			return err
+		})
+		if errors.Is(err, ErrNotEnoughPills) {
+			record.Status, record.Reason = DoseFailed, err.Error()
+			return tx.Model(&record).Updates(map[string]any{"status": record.Status, "reason": record.Reason}).Error
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		confirmBy := now.Add(ConfirmationWindow)
+		commands = reserved
+		record.DispensedAt, record.ConfirmBy = &now, &confirmBy
+		return tx.Model(&record).Updates(map[string]any{"dispensed_at": now, "confirm_by": confirmBy}).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if record.Status == DoseFailed {
+		log.Printf("Toma das %s do horário <%d> falhou: %s", due, schedule.ID, record.Reason)
+	} else {
+		log.Printf("Toma das %s do horário <%d> dispensada", due, schedule.ID)
+	}
+	publishDispense(db, record, commands)
+	if alert != nil {
+		publishAlert(db, alert)
+	}
+	if record.Status == DoseDispensed {
+		checkLowStock(db, tenantID, schedule.DropperID, record.Pills)
+	}
+	return commands, true, nil
+}
+
+// activeDroppers é a subquery dos droppers ativos e não removidos, os únicos que recebem tomas
+// e lembretes
+func activeDroppers(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true}).Model(&Dropper{}).Select("id").Where("active = true")
+}
+
+// DispenseDueDoses dispensa as tomas dos horários ativos previstas no intervalo [from, to)
+// que ainda não foram registadas, enviando os comandos para ch
+func DispenseDueDoses(db *gorm.DB, ch chan MqttActionRequest, from, to time.Time) error {
+	schedules := make([]DispenseSchedule, 0)
+	err := db.
+		Where("active = true and kind = ? and start_date < ? and end_date >= ?", ScheduleKindScheduled, to, from).
+		Where("dropper_id in (?)", activeDroppers(db)).
+		Find(&schedules).
+		Error
+	if err != nil {
+		log.Printf("Erro ao buscar horários: %s", err.Error())
+		return err
+	}
+
+	for i := range schedules {
+		schedule := &schedules[i]
+
+		// As tomas adiadas são dispensadas mais tarde, por dispenseSnoozedDoses
+		snoozed := map[time.Time]time.Time{}
+		if schedule.ReminderLead > 0 {
+			if snoozed, err = schedule.snoozedDoses(db, from, to); err != nil {
+				log.Printf("Erro ao buscar tomas adiadas do horário <%d>: %s", schedule.ID, err.Error())
+				continue
+			}
+		}
+
+		for _, due := range schedule.Occurrences(from, to) {
+			if at, ok := snoozed[due]; ok && at.After(due) {
+				continue
+			}
+			commands, _, err := dispenseScheduled(db, schedule, due)
+			if err != nil {
+				log.Printf("Erro ao dispensar a toma das %s do horário <%d>: %s", due, schedule.ID, err.Error())
+				continue
+			}
+			for _, command := range commands {
+				ch <- command
+			}
+		}
+	}
+	return dispenseSnoozedDoses(db, ch, from, to)
+}
+
+// PillDispenseBGJob corre a cada DispenseTick, envia os lembretes e dispensa as tomas dos
+// horários que estão previstas
+func PillDispenseBGJob(db *gorm.DB, ch chan MqttActionRequest) error {
+	time.Sleep(DispenseTick)
+
+	now := time.Now().UTC()
+	if err := SendDueReminders(db, ch, now); err != nil {
+		return err
+	}
+	return DispenseDueDoses(db, ch, now.Add(-DispenseLookback), now)
+}
+
+// ListDoses devolve uma página das tomas registadas no dropper, das mais recentes para as mais antigas
+func (d *Dropper) ListDoses(db *gorm.DB, options ListOptions) ([]DispenseRecord, int64, error) {
+	return listDoses(db.Where("dropper_id = ?", d.ID), options)
+}
+
+func listDoses(query *gorm.DB, options ListOptions) ([]DispenseRecord, int64, error) {
+	records := make([]DispenseRecord, 0)
+
+	// As tomas não têm nome nem estado ativo
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-due_at"
+	}
+	total, err := options.find(query.Model(&DispenseRecord{}).Preload("Confirmation"), &records, "due_at", "status")
+
+	return records, total, err
+}
+
+// solePatient devolve o paciente associado ao dropper, se for o único
+func (d *Dropper) solePatient(db *gorm.DB) (*uint, error) {
+	ids := make([]uint, 0)
+	if err := db.Table("patient_droppers").Where("dropper_id = ?", d.ID).Limit(2).Pluck("patient_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) != 1 {
+		return nil, nil
+	}
+	return &ids[0], nil
+}
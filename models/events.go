@@ -0,0 +1,126 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/events"
+)
+
+// Tipos dos eventos em tempo real
+const (
+	// Uma toma foi dispensada, falhou ou foi saltada. Os dados são um DispenseEvent.
+	EventDispense = "dispense"
+	// O dropper respondeu a um comando, os dados são um DeviceAck
+	EventDeviceAck = "device.ack"
+	// Os comprimidos carregados no dropper mudaram, os dados são um InventoryEvent
+	EventInventory = "inventory"
+	// O dropper ligou-se ou desligou-se do servidor MQTT
+	EventDeviceOnline  = "device.online"
+	EventDeviceOffline = "device.offline"
+	// Foi registado um alerta, os dados são o Alert
+	EventAlert = "alert"
+)
+
+// Motivos das alterações de inventário
+const (
+	InventoryReload         = "reload"
+	InventorySectionCreated = "section_created"
+	InventorySectionDeleted = "section_deleted"
+	InventoryOccupancy      = "occupancy"
+	InventoryImport         = "import"
+)
+
+// EventHistory é o número de eventos guardados para os clientes retomarem a ligação
+const EventHistory = 1000
+
+// Events é o broker dos eventos em tempo real, partilhado pela API, pelo servidor MQTT e pelos cronjobs
+var Events = events.NewBroker(EventHistory)
+
+// DispenseEvent é a toma registada e as posições que o dropper recebeu ordem de dispensar
+type DispenseEvent struct {
+	DispenseRecord
+	Positions []uint `json:"positions"`
+}
+
+// DeviceAck é a resposta do dropper a um comando, ex: depois de rodar até à posição pedida
+type DeviceAck struct {
+	Command  string `json:"command"`
+	Position uint   `json:"position,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// InventoryEvent indica porque mudaram os comprimidos do dropper
+type InventoryEvent struct {
+	Reason  string `json:"reason"`
+	Section string `json:"section,omitempty"`
+	// Discrepâncias novas encontradas no relatório de ocupação
+	Discrepancies int `json:"discrepancies,omitempty"`
+}
+
+// PublishEvent publica um evento do dropper
+func (d *Dropper) PublishEvent(kind string, data any) {
+	Events.Publish(events.Event{
+		Type:      kind,
+		TenantID:  d.TenantID,
+		DropperID: d.ID,
+		Dropper:   d.SerialID.String(),
+		Data:      data,
+	})
+}
+
+// publishDropperEvent publica um evento do dropper com o id indicado, ou só do tenant sem dropper
+func publishDropperEvent(db *gorm.DB, tenantID uint, dropperID *uint, kind string, data any) {
+	if dropperID == nil {
+		Events.Publish(events.Event{Type: kind, TenantID: tenantID, Data: data})
+		return
+	}
+
+	var dropper Dropper
+	if err := db.Unscoped().Select("id", "tenant_id", "serial_id").First(&dropper, *dropperID).Error; err != nil {
+		log.Printf("Erro ao publicar o evento <%s> do dropper <%d>: %s", kind, *dropperID, err.Error())
+		return
+	}
+	dropper.PublishEvent(kind, data)
+}
+
+// publishDispense publica a toma e as posições dos comandos enviados ao dropper
+func publishDispense(db *gorm.DB, record DispenseRecord, commands []MqttActionRequest) {
+	positions := make([]uint, 0, len(commands))
+	for _, command := range commands {
+		var position uint
+		if _, err := fmt.Sscanf(string(command.Value), "0,%d", &position); err == nil {
+			positions = append(positions, position)
+		}
+	}
+	publishDropperEvent(db, 0, &record.DropperID, EventDispense, DispenseEvent{DispenseRecord: record, Positions: positions})
+}
+
+// PublishDeviceEvent publica um evento enviado pelo dropper com o serial indicado, ex: respostas
+// a comandos ou a ligação ao servidor MQTT. Quando o dropper se desliga é levantado um alerta.
+func PublishDeviceEvent(db *gorm.DB, serial uuid.UUID, kind string, data any) error {
+	var dropper Dropper
+	err := db.Select("id", "tenant_id", "serial_id", "name").First(&dropper, "serial_id = ?", serial).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	dropper.PublishEvent(kind, data)
+	if kind == EventDeviceOffline {
+		raiseAlert(db, Alert{
+			TenantID:  dropper.TenantID,
+			DropperID: &dropper.ID,
+			Kind:      AlertDeviceOffline,
+			Message:   fmt.Sprintf("O dropper %s desligou-se", dropper.Name),
+		})
+	}
+	return nil
+}
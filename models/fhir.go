@@ -0,0 +1,504 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/fhir"
+)
+
+var (
+	ErrInvalidFHIR          = errors.New("recurso FHIR inválido")
+	ErrMedicationNotStocked = errors.New("o medicamento não está carregado no dropper")
+)
+
+// FHIREntryError indica a entrada do Bundle que falhou a importação e, nos recursos inválidos,
+// o elemento que a invalida
+type FHIREntryError struct {
+	Index int
+	Field string
+	// Código do problema, ex: required, unsupported ou not_stocked
+	Code string
+	Err  error
+}
+
+func (e *FHIREntryError) Error() string {
+	return fmt.Sprintf("entrada %d: %s", e.Index, e.Err.Error())
+}
+
+func (e *FHIREntryError) Unwrap() error {
+	return e.Err
+}
+
+// Os ids dos recursos são gerados a partir dos models. Um horário ou uma toma com vários
+// comprimidos dá origem a um recurso por medicamento, identificado pelo nome.
+func prescriptionResourceID(id uint) string {
+	return fmt.Sprintf("prescription-%d", id)
+}
+
+func scheduleResourceID(id uint, medication string) string {
+	return fmt.Sprintf("schedule-%d-%s", id, resourceSlug(medication))
+}
+
+// resourceSlug adapta o nome do medicamento aos caracteres permitidos nos ids FHIR
+func resourceSlug(name string) string {
+	slug := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+	if len(slug) > 40 {
+		slug = slug[:40]
+	}
+	return slug
+}
+
+func patientReference(p *Patient) fhir.Reference {
+	return fhir.Reference{Reference: fmt.Sprintf("Patient/%d", p.ID), Display: p.Name}
+}
+
+func sortedPills(pills PillList) []string {
+	names := make([]string, 0, len(pills))
+	for name := range pills {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MedicationRequest representa a receita em FHIR, com a revisão atual como versão
+func (p *Prescription) MedicationRequest(patient *Patient, now time.Time) fhir.MedicationRequest {
+	status := "active"
+	if !p.Active {
+		status = "stopped"
+	} else if p.EndDate().Before(now) {
+		status = "completed"
+	}
+
+	start, end := p.StartDate, p.EndDate()
+	repeat := fhir.RepeatEvery(p.Frequency)
+	repeat.BoundsPeriod = &fhir.Period{Start: &start, End: &end}
+	refills := p.RefillsRemaining
+
+	request := fhir.MedicationRequest{
+		ResourceType:              fhir.TypeMedicationRequest,
+		ID:                        prescriptionResourceID(p.ID),
+		Meta:                      &fhir.Meta{VersionID: strconv.Itoa(int(p.Revision)), LastUpdated: &p.UpdatedAt},
+		Status:                    status,
+		Intent:                    "order",
+		MedicationCodeableConcept: &fhir.CodeableConcept{Text: p.Medication},
+		Subject:                   patientReference(patient),
+		AuthoredOn:                &p.CreatedAt,
+		DosageInstruction: []fhir.Dosage{{
+			Sequence:           1,
+			PatientInstruction: p.Instructions,
+			Timing:             &fhir.Timing{Repeat: repeat},
+			DoseAndRate:        []fhir.DoseAndRate{{DoseQuantity: fhir.Tablets(int(p.Dose))}},
+		}},
+		DispenseRequest: &fhir.DispenseRequest{NumberOfRepeatsAllowed: &refills},
+	}
+	if p.Prescriber != "" {
+		request.Requester = &fhir.Reference{Display: p.Prescriber}
+	}
+	return request
+}
+
+// medicationRequests representa o horário criado sem receita, um pedido por medicamento.
+// Nos horários por fases cada fase é uma instrução de dosagem com o seu período.
+func (s *DispenseSchedule) medicationRequests(pills PillList, patient *Patient, now time.Time) []fhir.MedicationRequest {
+	status := "active"
+	if !s.Active {
+		status = "stopped"
+	} else if s.EndDate.Before(now) {
+		status = "completed"
+	} else if s.pausedAt(now) {
+		status = "on-hold"
+	}
+
+	// Todos os medicamentos do horário, incluindo os que só existem nalgumas fases
+	medications := make(PillList)
+	for name, count := range pills {
+		medications[name] = count
+	}
+	for _, phase := range s.Phases {
+		for name, count := range phase.Pills {
+			medications[name] = count
+		}
+	}
+
+	dosage := func(sequence int, start, end time.Time, count int) fhir.Dosage {
+		repeat := fhir.RepeatEvery(s.Interval)
+		repeat.BoundsPeriod = &fhir.Period{Start: &start, End: &end}
+		dosage := fhir.Dosage{
+			Sequence:    sequence,
+			Timing:      &fhir.Timing{Repeat: repeat},
+			DoseAndRate: []fhir.DoseAndRate{{DoseQuantity: fhir.Tablets(count)}},
+		}
+		if s.Kind == ScheduleKindPRN {
+			asNeeded := true
+			dosage.AsNeededBoolean = &asNeeded
+		}
+		return dosage
+	}
+
+	requests := make([]fhir.MedicationRequest, 0, len(medications))
+	for _, name := range sortedPills(medications) {
+		request := fhir.MedicationRequest{
+			ResourceType:              fhir.TypeMedicationRequest,
+			ID:                        scheduleResourceID(s.ID, name),
+			Meta:                      &fhir.Meta{LastUpdated: &s.UpdatedAt},
+			Status:                    status,
+			Intent:                    "plan",
+			MedicationCodeableConcept: &fhir.CodeableConcept{Text: name},
+			Subject:                   patientReference(patient),
+			AuthoredOn:                &s.CreatedAt,
+		}
+		if s.Description != "" {
+			request.Note = []fhir.Annotation{{Text: s.Description}}
+		}
+		if len(s.Phases) == 0 {
+			request.DosageInstruction = []fhir.Dosage{dosage(1, s.StartDate, s.EndDate, pills[name])}
+		}
+		for _, phase := range s.Phases {
+			if count := phase.Pills[name]; count > 0 {
+				request.DosageInstruction = append(request.DosageInstruction, dosage(len(request.DosageInstruction)+1, phase.StartDate, phase.EndDate, count))
+			}
+		}
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// authorizingRequest devolve a referência ao pedido que originou a toma do medicamento
+func (r *DispenseRecord) authorizingRequest(medication string) *fhir.Reference {
+	if r.PrescriptionID != nil {
+		return &fhir.Reference{Reference: "MedicationRequest/" + prescriptionResourceID(*r.PrescriptionID)}
+	}
+	if r.ScheduleID != nil {
+		return &fhir.Reference{Reference: "MedicationRequest/" + scheduleResourceID(*r.ScheduleID, medication)}
+	}
+	return nil
+}
+
+func (r *DispenseRecord) dispenseResourceID(medication string) string {
+	return fmt.Sprintf("dose-%d-%s", r.ID, resourceSlug(medication))
+}
+
+// medicationDispenses representa a toma registada, um recurso por medicamento
+func (r *DispenseRecord) medicationDispenses(patient *Patient) []fhir.MedicationDispense {
+	status := map[string]string{DoseDispensed: "completed", DoseFailed: "stopped", DoseSkipped: "declined"}[r.Status]
+	subject := patientReference(patient)
+
+	dispenses := make([]fhir.MedicationDispense, 0, len(r.Pills))
+	for _, name := range sortedPills(r.Pills) {
+		dispense := fhir.MedicationDispense{
+			ResourceType:              fhir.TypeMedicationDispense,
+			ID:                        r.dispenseResourceID(name),
+			Status:                    status,
+			MedicationCodeableConcept: &fhir.CodeableConcept{Text: name},
+			Subject:                   &subject,
+			Quantity:                  fhir.Tablets(r.Pills[name]),
+			WhenPrepared:              &r.DueAt,
+			WhenHandedOver:            r.DispensedAt,
+		}
+		if r.Reason != "" {
+			dispense.StatusReasonCodeableConcept = &fhir.CodeableConcept{Text: r.Reason}
+		}
+		if request := r.authorizingRequest(name); request != nil {
+			dispense.AuthorizingPrescription = []fhir.Reference{*request}
+		}
+		dispenses = append(dispenses, dispense)
+	}
+	return dispenses
+}
+
+// medicationAdministrations representa a confirmação da toma, um recurso por medicamento
+func (r *DispenseRecord) medicationAdministrations(patient *Patient) []fhir.MedicationAdministration {
+	if r.Confirmation == nil {
+		return nil
+	}
+
+	administrations := make([]fhir.MedicationAdministration, 0, len(r.Pills))
+	for _, name := range sortedPills(r.Pills) {
+		administration := fhir.MedicationAdministration{
+			ResourceType:              fhir.TypeMedicationAdministration,
+			ID:                        fmt.Sprintf("taken-%d-%s", r.Confirmation.ID, resourceSlug(name)),
+			Status:                    "completed",
+			MedicationCodeableConcept: &fhir.CodeableConcept{Text: name},
+			Subject:                   patientReference(patient),
+			SupportingInformation:     []fhir.Reference{{Reference: "MedicationDispense/" + r.dispenseResourceID(name)}},
+			EffectiveDateTime:         &r.Confirmation.TakenAt,
+			Request:                   r.authorizingRequest(name),
+			Note:                      []fhir.Annotation{{Text: "Confirmação: " + r.Confirmation.Event}},
+			Dosage:                    &fhir.AdministrationDosage{Dose: fhir.Tablets(r.Pills[name])},
+		}
+		administrations = append(administrations, administration)
+	}
+	return administrations
+}
+
+// FHIRMedicationRequests devolve as receitas do paciente e os horários criados sem receita
+func (p *Patient) FHIRMedicationRequests(db *gorm.DB) (*fhir.Bundle, error) {
+	now := time.Now().UTC()
+	bundle := fhir.NewBundle(fhir.BundleSearchset, now)
+
+	prescriptions := make([]Prescription, 0)
+	if err := db.Where("patient_id = ?", p.ID).Order("id").Find(&prescriptions).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	for i := range prescriptions {
+		bundle.Add(prescriptions[i].MedicationRequest(p, now), nil)
+	}
+
+	schedules := make([]DispenseSchedule, 0)
+	if err := db.Where("patient_id = ? and prescription_id is null", p.ID).Order("id").Find(&schedules).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	for i := range schedules {
+		pills, err := schedules[i].Pills(db)
+		if err != nil {
+			log.Printf("Erro inesperado: %s", err.Error())
+			return nil, ErrUnexpectedError
+		}
+		for _, request := range schedules[i].medicationRequests(pills, p, now) {
+			bundle.Add(request, nil)
+		}
+	}
+	return bundle, nil
+}
+
+// doseRecords devolve as tomas do paciente previstas no período, com as confirmações
+func (p *Patient) doseRecords(db *gorm.DB, query AdherenceQuery) ([]DispenseRecord, error) {
+	if err := query.normalize(time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	records := make([]DispenseRecord, 0)
+	err := db.
+		Preload("Confirmation").
+		Where("patient_id = ? and due_at >= ? and due_at < ?", p.ID, query.From, query.To).
+		Order("due_at, id").
+		Find(&records).
+		Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return records, nil
+}
+
+// FHIRMedicationDispenses devolve as tomas do paciente previstas no período
+func (p *Patient) FHIRMedicationDispenses(db *gorm.DB, query AdherenceQuery) (*fhir.Bundle, error) {
+	records, err := p.doseRecords(db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := fhir.NewBundle(fhir.BundleSearchset, time.Now().UTC())
+	for i := range records {
+		for _, dispense := range records[i].medicationDispenses(p) {
+			bundle.Add(dispense, nil)
+		}
+	}
+	return bundle, nil
+}
+
+// FHIRMedicationAdministrations devolve as confirmações das tomas do paciente previstas no período
+func (p *Patient) FHIRMedicationAdministrations(db *gorm.DB, query AdherenceQuery) (*fhir.Bundle, error) {
+	records, err := p.doseRecords(db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := fhir.NewBundle(fhir.BundleSearchset, time.Now().UTC())
+	for i := range records {
+		for _, administration := range records[i].medicationAdministrations(p) {
+			bundle.Add(administration, nil)
+		}
+	}
+	return bundle, nil
+}
+
+// importedRequest é uma receita lida de um MedicationRequest
+type importedRequest struct {
+	PatientID uint
+	Fields    PrescriptionFields
+}
+
+// parseMedicationRequest converte o MedicationRequest nos campos de uma receita. Só são aceites
+// pedidos ativos de um comprimido, com uma única instrução de dosagem a intervalos regulares.
+func parseMedicationRequest(raw json.RawMessage, now time.Time) (*importedRequest, *FHIREntryError) {
+	invalid := func(field, code string) *FHIREntryError {
+		return &FHIREntryError{Field: field, Code: code, Err: ErrInvalidFHIR}
+	}
+
+	var request fhir.MedicationRequest
+	if err := json.Unmarshal(raw, &request); err != nil {
+		return nil, invalid("resource", "invalid")
+	}
+	if request.ResourceType != fhir.TypeMedicationRequest {
+		return nil, invalid("resourceType", "unsupported")
+	}
+	if request.Status != "active" {
+		return nil, invalid("status", "unsupported")
+	}
+	if request.Intent != "order" && request.Intent != "original-order" {
+		return nil, invalid("intent", "unsupported")
+	}
+
+	reference, found := strings.CutPrefix(request.Subject.Reference, "Patient/")
+	patientID, err := strconv.ParseUint(reference, 10, 64)
+	if !found || err != nil {
+		return nil, invalid("subject", "invalid")
+	}
+
+	medication := request.MedicationCodeableConcept.Name()
+	if medication == "" {
+		return nil, invalid("medicationCodeableConcept", "required")
+	}
+
+	if len(request.DosageInstruction) != 1 {
+		return nil, invalid("dosageInstruction", "unsupported")
+	}
+	dosage := request.DosageInstruction[0]
+	if dosage.AsNeededBoolean != nil && *dosage.AsNeededBoolean {
+		return nil, invalid("dosageInstruction.0.asNeededBoolean", "unsupported")
+	}
+	if len(dosage.DoseAndRate) != 1 {
+		return nil, invalid("dosageInstruction.0.doseAndRate", "required")
+	}
+	dose, ok := dosage.DoseAndRate[0].DoseQuantity.Count()
+	if !ok {
+		return nil, invalid("dosageInstruction.0.doseAndRate.0.doseQuantity", "positive")
+	}
+	if dosage.Timing == nil || dosage.Timing.Repeat == nil {
+		return nil, invalid("dosageInstruction.0.timing", "required")
+	}
+	repeat := dosage.Timing.Repeat
+	frequency, ok := repeat.Interval()
+	if !ok || frequency < MinScheduleInterval {
+		return nil, invalid("dosageInstruction.0.timing.repeat", "invalid")
+	}
+
+	// O tratamento começa no início do período ou na data da receita e dura até ao fim do
+	// período ou durante boundsDuration
+	var start time.Time
+	if repeat.BoundsPeriod != nil && repeat.BoundsPeriod.Start != nil {
+		start = *repeat.BoundsPeriod.Start
+	} else if request.AuthoredOn != nil {
+		start = *request.AuthoredOn
+	} else {
+		start = now
+	}
+	var duration time.Duration
+	if repeat.BoundsPeriod != nil && repeat.BoundsPeriod.End != nil {
+		duration = repeat.BoundsPeriod.End.Sub(start)
+	} else if repeat.BoundsDuration != nil {
+		duration, _ = repeat.BoundsDuration.Duration()
+	} else {
+		return nil, invalid("dosageInstruction.0.timing.repeat.boundsPeriod", "required")
+	}
+	if duration <= 0 {
+		return nil, invalid("dosageInstruction.0.timing.repeat.boundsPeriod", "after_start")
+	}
+
+	instructions := dosage.PatientInstruction
+	if instructions == "" {
+		instructions = dosage.Text
+	}
+	fields := PrescriptionFields{
+		Medication:   &medication,
+		Dose:         &dose,
+		Frequency:    &frequency,
+		StartDate:    &start,
+		Duration:     &duration,
+		Instructions: &instructions,
+	}
+	if request.Requester != nil && request.Requester.Display != "" {
+		fields.Prescriber = &request.Requester.Display
+	}
+	if request.DispenseRequest != nil && request.DispenseRequest.NumberOfRepeatsAllowed != nil {
+		fields.RefillsRemaining = request.DispenseRequest.NumberOfRepeatsAllowed
+	}
+
+	return &importedRequest{PatientID: uint(patientID), Fields: fields}, nil
+}
+
+// stock devolve quantos comprimidos do medicamento estão carregados no dropper
+func (d *Dropper) stock(db *gorm.DB, medication string) (int64, error) {
+	var count int64
+	err := db.
+		Model(&Position{}).
+		Joins("join dropper_sections on dropper_sections.id = positions.dropper_section_id and dropper_sections.deleted_at is null").
+		Where("dropper_sections.dropper_id = ? and positions.empty = false and positions.pill_name = ?", d.ID, medication).
+		Count(&count).
+		Error
+	return count, err
+}
+
+// ImportMedicationRequests cria as receitas de um Bundle FHIR do tipo transaction no dropper,
+// gerando os seus horários. Cada medicamento tem de estar carregado no dropper para pelo menos
+// uma toma. As entradas são importadas todas ou nenhuma.
+func ImportMedicationRequests(db *gorm.DB, tenantID uint, dropper *Dropper, bundle *fhir.Bundle) ([]Prescription, error) {
+	if bundle.ResourceType != fhir.TypeBundle || bundle.Type != fhir.BundleTransaction || len(bundle.Entry) == 0 {
+		return nil, ErrInvalidFHIR
+	}
+
+	now := time.Now().UTC()
+	requests := make([]*importedRequest, len(bundle.Entry))
+	patients := make(map[uint]*Patient)
+	for i, entry := range bundle.Entry {
+		request, entry_err := parseMedicationRequest(entry.Resource, now)
+		if entry_err != nil {
+			entry_err.Index = i
+			return nil, entry_err
+		}
+		requests[i] = request
+
+		if _, ok := patients[request.PatientID]; !ok {
+			patient, err := FindPatient(db, tenantID, request.PatientID)
+			if err != nil {
+				return nil, &FHIREntryError{Index: i, Field: "subject", Code: "not_found", Err: err}
+			}
+			patients[request.PatientID] = patient
+		}
+
+		stock, err := dropper.stock(db, *request.Fields.Medication)
+		if err != nil {
+			log.Printf("Erro inesperado ao verificar o inventário: %s", err.Error())
+			return nil, ErrUnexpectedError
+		}
+		if stock < int64(*request.Fields.Dose) {
+			return nil, &FHIREntryError{Index: i, Field: "medicationCodeableConcept", Code: "not_stocked", Err: ErrMedicationNotStocked}
+		}
+	}
+
+	prescriptions := make([]Prescription, len(requests))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, request := range requests {
+			prescription, err := CreatePrescription(tx, patients[request.PatientID], dropper, request.Fields)
+			if err != nil {
+				return &FHIREntryError{Index: i, Err: err}
+			}
+			prescriptions[i] = *prescription
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%d receitas importadas de FHIR para o dropper <%d>", len(prescriptions), dropper.ID)
+	return prescriptions, nil
+}
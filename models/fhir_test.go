@@ -0,0 +1,109 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFHIRMedicationRequestImport(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	resource := `{
+		"resourceType": "MedicationRequest",
+		"status": "active",
+		"intent": "order",
+		"subject": {"reference": "Patient/12"},
+		"requester": {"display": "Dra. Ana"},
+		"medicationCodeableConcept": {"coding": [{"system": "http://snomed.info/sct", "display": "Aspirina"}]},
+		"dosageInstruction": [{
+			"patientInstruction": "Depois da refeição",
+			"timing": {"repeat": {"frequency": 3, "period": 1, "periodUnit": "d", "boundsDuration": {"value": 10, "code": "d"}}},
+			"doseAndRate": [{"doseQuantity": {"value": 2}}]
+		}],
+		"dispenseRequest": {"numberOfRepeatsAllowed": 1}
+	}`
+
+	request, entry_err := parseMedicationRequest(json.RawMessage(resource), now)
+	if entry_err != nil {
+		t.Fatalf("Unexpected error: %+v", entry_err)
+	}
+	fields := request.Fields
+	if request.PatientID != 12 || *fields.Medication != "Aspirina" || *fields.Dose != 2 || *fields.Frequency != 8*time.Hour {
+		t.Fatalf("Unexpected prescription: %+v", request)
+	}
+	if !fields.StartDate.Equal(now) || *fields.Duration != 240*time.Hour || *fields.Prescriber != "Dra. Ana" || *fields.RefillsRemaining != 1 {
+		t.Fatalf("Unexpected prescription: %+v", request)
+	}
+
+	// Pedidos que as receitas não suportam indicam o elemento inválido
+	for resource, field := range map[string]string{
+		`{"resourceType": "MedicationDispense"}`:                                                                            "resourceType",
+		`{"resourceType": "MedicationRequest", "status": "draft", "intent": "order"}`:                                       "status",
+		`{"resourceType": "MedicationRequest", "status": "active", "intent": "order", "subject": {"reference": "Group/1"}}`: "subject",
+		`{"resourceType": "MedicationRequest", "status": "active", "intent": "order", "subject": {"reference": "Patient/1"},
+			"medicationCodeableConcept": {"text": "Aspirina"}, "dosageInstruction": [{"doseAndRate": [{"doseQuantity": {"value": 0.5}}]}]}`: "dosageInstruction.0.doseAndRate.0.doseQuantity",
+	} {
+		_, entry_err := parseMedicationRequest(json.RawMessage(resource), now)
+		if entry_err == nil || entry_err.Field != field || entry_err.Err != ErrInvalidFHIR {
+			t.Errorf("Expected %s to be invalid, got %+v", field, entry_err)
+		}
+	}
+}
+
+func TestFHIRDoseResources(t *testing.T) {
+	due := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	dispensed := due.Add(time.Minute)
+	scheduleID := uint(3)
+	patient := Patient{ID: 12, Name: "Rui"}
+	record := DispenseRecord{
+		ID: 40, ScheduleID: &scheduleID, DueAt: due, DispensedAt: &dispensed,
+		Status: DoseDispensed, Pills: PillList{"Brufen 400": 1, "Aspirina": 2},
+		Confirmation: &DoseConfirmation{ID: 9, Event: ConfirmPillTaken, TakenAt: dispensed.Add(5 * time.Minute)},
+	}
+
+	dispenses := record.medicationDispenses(&patient)
+	if len(dispenses) != 2 || dispenses[1].ID != "dose-40-brufen-400" || dispenses[1].Status != "completed" {
+		t.Fatalf("Unexpected dispenses: %+v", dispenses)
+	}
+	if dispenses[0].AuthorizingPrescription[0].Reference != "MedicationRequest/schedule-3-aspirina" || dispenses[0].Quantity.Value != 2 {
+		t.Fatalf("Unexpected dispense: %+v", dispenses[0])
+	}
+
+	administrations := record.medicationAdministrations(&patient)
+	if len(administrations) != 2 || !administrations[0].EffectiveDateTime.Equal(record.Confirmation.TakenAt) {
+		t.Fatalf("Unexpected administrations: %+v", administrations)
+	}
+	if administrations[0].SupportingInformation[0].Reference != "MedicationDispense/dose-40-aspirina" {
+		t.Fatalf("The administration should point to its dispense: %+v", administrations[0])
+	}
+
+	record.Confirmation = nil
+	if len(record.medicationAdministrations(&patient)) != 0 {
+		t.Fatal("Unconfirmed doses have no administration")
+	}
+}
+
+func TestFHIRScheduleRequests(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	schedule := DispenseSchedule{
+		Active: true, StartDate: start, EndDate: start.Add(48 * time.Hour), Interval: 12 * time.Hour,
+		Phases: []SchedulePhase{
+			{StartDate: start, EndDate: start.Add(24 * time.Hour), Pills: PillList{"Prednisolona": 4, "Omeprazol": 1}},
+			{StartDate: start.Add(24 * time.Hour), EndDate: start.Add(48 * time.Hour), Pills: PillList{"Prednisolona": 2}},
+		},
+	}
+	schedule.ID = 5
+
+	requests := schedule.medicationRequests(nil, &Patient{ID: 12}, start)
+	if len(requests) != 2 || requests[1].ID != "schedule-5-prednisolona" || requests[1].Status != "active" {
+		t.Fatalf("Unexpected requests: %+v", requests)
+	}
+	// Uma instrução de dosagem por fase em que o medicamento é tomado
+	if len(requests[0].DosageInstruction) != 1 || len(requests[1].DosageInstruction) != 2 {
+		t.Fatalf("Expected one dosage per phase: %+v", requests)
+	}
+	dosage := requests[1].DosageInstruction[1]
+	if dosage.Sequence != 2 || dosage.DoseAndRate[0].DoseQuantity.Value != 2 || dosage.Timing.Repeat.PeriodUnit != "h" || dosage.Timing.Repeat.Period != 12 {
+		t.Fatalf("Unexpected dosage: %+v", dosage)
+	}
+}
@@ -0,0 +1,478 @@
+package models
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidImport = errors.New("ficheiro de importação inválido")
+
+// Tipos de linha de uma importação
+const (
+	// Cria um dropper, referido nas linhas seguintes pelo nome
+	ImportDropper = "dropper"
+	// Cria uma secção com os comprimidos em pills
+	ImportSection = "section"
+	// Carrega count comprimidos de pill numa secção
+	ImportLoad = "load"
+	// Cria um horário de dispensa
+	ImportSchedule = "schedule"
+)
+
+// Formatos dos ficheiros de importação
+const (
+	ImportCSV  = "csv"
+	ImportJSON = "json"
+)
+
+// MaxImportRows é o número máximo de linhas de uma importação
+const MaxImportRows = 2000
+
+// ImportRow é uma linha do ficheiro de importação. Os campos usados dependem de Kind.
+// Nos CSV as colunas têm os nomes das chaves JSON e pills é escrito como "Aspirina:2;Brufen:1".
+type ImportRow struct {
+	Kind string `json:"kind"`
+	// Serial de um dropper do tenant ou nome de um dropper criado numa linha anterior
+	Dropper    string `json:"dropper"`
+	Name       string `json:"name"`
+	MachineURL string `json:"machine_url"`
+	// Nome ou índice (1 - 9) da secção
+	Section string   `json:"section"`
+	Pill    string   `json:"pill"`
+	Count   uint     `json:"count"`
+	Pills   PillList `json:"pills"`
+
+	PatientID     *uint     `json:"patient_id"`
+	Description   string    `json:"description"`
+	StartDate     time.Time `json:"start_date"`
+	EndDate       time.Time `json:"end_date"`
+	ScheduleKind  string    `json:"schedule_kind"`
+	MaxDailyDoses uint      `json:"max_daily_doses"`
+	// Durações no formato de Go, ex: 8h ou 30m
+	Interval     string `json:"interval"`
+	ReminderLead string `json:"reminder_lead"`
+}
+
+// ImportError indica a linha, a começar em 1, e o campo que falharam a importação
+type ImportError struct {
+	Row   int
+	Field string
+	// Código do problema nas linhas inválidas, ex: required ou invalid
+	Code string
+	Err  error
+}
+
+func (e *ImportError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("linha %d, %s: %s", e.Row, e.Field, e.Code)
+	}
+	return fmt.Sprintf("linha %d: %s", e.Row, e.Err.Error())
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+func invalidImportField(field, code string) *ImportError {
+	return &ImportError{Field: field, Code: code, Err: ErrInvalidImport}
+}
+
+// ImportResult resume a importação. Com erros, ou em modo de validação, nada é guardado.
+type ImportResult struct {
+	DryRun  bool
+	Applied bool
+	Rows    int
+	// Registos criados por tipo de linha
+	Created map[string]int
+	Errors  []ImportError
+}
+
+// parseImportRows lê as linhas do ficheiro. As linhas que não são lidas ficam nos erros e as
+// restantes continuam a ser validadas.
+func parseImportRows(r io.Reader, format string) ([]*ImportRow, []ImportError, error) {
+	switch format {
+	case ImportCSV:
+		return parseImportCSV(r)
+	case ImportJSON:
+		return parseImportJSON(r)
+	}
+	return nil, nil, ErrInvalidImport
+}
+
+func parseImportJSON(r io.Reader) ([]*ImportRow, []ImportError, error) {
+	raw := make([]json.RawMessage, 0)
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, nil, ErrInvalidImport
+	}
+	if len(raw) > MaxImportRows {
+		return nil, nil, ErrInvalidImport
+	}
+
+	rows := make([]*ImportRow, len(raw))
+	errs := make([]ImportError, 0)
+	for i, value := range raw {
+		var row ImportRow
+		if err := json.Unmarshal(value, &row); err != nil {
+			field := ""
+			var type_err *json.UnmarshalTypeError
+			if errors.As(err, &type_err) {
+				field = type_err.Field
+			}
+			errs = append(errs, ImportError{Row: i + 1, Field: field, Code: "invalid_type", Err: ErrInvalidImport})
+			continue
+		}
+		rows[i] = &row
+	}
+	return rows, errs, nil
+}
+
+// parsePillList lê os comprimidos no formato "Aspirina:2;Brufen:1"
+func parsePillList(value string) (PillList, bool) {
+	pills := make(PillList)
+	for _, part := range strings.Split(value, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, count, found := strings.Cut(part, ":")
+		number, err := strconv.Atoi(strings.TrimSpace(count))
+		if !found || err != nil || number < 1 || strings.TrimSpace(name) == "" {
+			return nil, false
+		}
+		pills[strings.TrimSpace(name)] += number
+	}
+	return pills, true
+}
+
+// csvField copia o valor da coluna para a linha
+func (row *ImportRow) csvField(column, value string) *ImportError {
+	parseUint := func(target *uint) *ImportError {
+		number, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return invalidImportField(column, "invalid_type")
+		}
+		*target = uint(number)
+		return nil
+	}
+	parseTime := func(target *time.Time) *ImportError {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return invalidImportField(column, "invalid_type")
+		}
+		*target = t
+		return nil
+	}
+
+	if value == "" {
+		return nil
+	}
+	switch column {
+	case "kind":
+		row.Kind = value
+	case "dropper":
+		row.Dropper = value
+	case "name":
+		row.Name = value
+	case "machine_url":
+		row.MachineURL = value
+	case "section":
+		row.Section = value
+	case "pill":
+		row.Pill = value
+	case "count":
+		return parseUint(&row.Count)
+	case "pills":
+		pills, ok := parsePillList(value)
+		if !ok {
+			return invalidImportField(column, "invalid")
+		}
+		row.Pills = pills
+	case "patient_id":
+		var id uint
+		if err := parseUint(&id); err != nil {
+			return err
+		}
+		row.PatientID = &id
+	case "description":
+		row.Description = value
+	case "start_date":
+		return parseTime(&row.StartDate)
+	case "end_date":
+		return parseTime(&row.EndDate)
+	case "schedule_kind":
+		row.ScheduleKind = value
+	case "max_daily_doses":
+		return parseUint(&row.MaxDailyDoses)
+	case "interval":
+		row.Interval = value
+	case "reminder_lead":
+		row.ReminderLead = value
+	default:
+		return invalidImportField(column, "unsupported")
+	}
+	return nil
+}
+
+func parseImportCSV(r io.Reader) ([]*ImportRow, []ImportError, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, ErrInvalidImport
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		if err := (&ImportRow{}).csvField(header[i], "x"); err != nil && err.Code == "unsupported" {
+			return nil, nil, ErrInvalidImport
+		}
+	}
+
+	rows := make([]*ImportRow, 0)
+	errs := make([]ImportError, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, ErrInvalidImport
+		}
+		if len(rows) == MaxImportRows {
+			return nil, nil, ErrInvalidImport
+		}
+
+		row := &ImportRow{}
+		for i, value := range record {
+			if entry_err := row.csvField(header[i], strings.TrimSpace(value)); entry_err != nil {
+				entry_err.Row = len(rows) + 1
+				errs = append(errs, *entry_err)
+				row = nil
+				break
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, errs, nil
+}
+
+// importer guarda os droppers criados na importação, pelo nome, e os droppers cujo inventário mudou
+type importer struct {
+	tenantID uint
+	droppers map[string]*Dropper
+	changed  map[uint]*Dropper
+}
+
+// dropper procura o dropper da linha, pelo serial nos droppers do tenant ou pelo nome nos criados
+func (im *importer) dropper(tx *gorm.DB, reference string) (*Dropper, error) {
+	if reference == "" {
+		return nil, invalidImportField("dropper", "required")
+	}
+	if dropper, ok := im.droppers[reference]; ok {
+		return dropper, nil
+	}
+
+	serial, err := uuid.Parse(reference)
+	if err != nil {
+		return nil, &ImportError{Field: "dropper", Code: "not_found", Err: ErrDropperNotFound}
+	}
+	var dropper Dropper
+	err = tx.First(&dropper, "tenant_id = ? and serial_id = ?", im.tenantID, serial).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &ImportError{Field: "dropper", Code: "not_found", Err: ErrDropperNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	return &dropper, nil
+}
+
+// sectionIndex devolve o índice (1 - 9) da secção, procurada pelo nome ou pelo índice
+func (im *importer) sectionIndex(tx *gorm.DB, dropper *Dropper, section string) (uint, error) {
+	dropper.reloadDropperData(tx)
+	for i, s := range dropper.Sections {
+		if s.Section == section {
+			return uint(i + 1), nil
+		}
+	}
+	if index, err := strconv.ParseUint(section, 10, 32); err == nil && index >= 1 && int(index) <= len(dropper.Sections) {
+		return uint(index), nil
+	}
+	return 0, &ImportError{Field: "section", Code: "not_found", Err: ErrSectionNotFound}
+}
+
+func parseImportDuration(field, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, invalidImportField(field, "invalid")
+	}
+	return d, nil
+}
+
+// apply cria o registo da linha
+func (im *importer) apply(tx *gorm.DB, row *ImportRow) error {
+	switch row.Kind {
+	case ImportDropper:
+		if row.Name == "" {
+			return invalidImportField("name", "required")
+		}
+		if _, exists := im.droppers[row.Name]; exists {
+			return &ImportError{Field: "name", Code: "duplicate", Err: ErrDropperExists}
+		}
+		dropper := NewDropper(im.tenantID, row.Name, row.MachineURL)
+		if _, err := dropper.Create(tx); err != nil {
+			return err
+		}
+		im.droppers[row.Name] = dropper
+		return nil
+
+	case ImportSection:
+		dropper, err := im.dropper(tx, row.Dropper)
+		if err != nil {
+			return err
+		}
+		if row.Section == "" {
+			return invalidImportField("section", "required")
+		}
+		if _, err = dropper.CreateDropperSection(tx, row.Section, row.Pills); err != nil {
+			return err
+		}
+		im.changed[dropper.ID] = dropper
+		return nil
+
+	case ImportLoad:
+		dropper, err := im.dropper(tx, row.Dropper)
+		if err != nil {
+			return err
+		}
+		if row.Pill == "" {
+			return invalidImportField("pill", "required")
+		}
+		if row.Count < 1 || row.Count > 9 {
+			return invalidImportField("count", "invalid")
+		}
+		index, err := im.sectionIndex(tx, dropper, row.Section)
+		if err != nil {
+			return err
+		}
+		// Cada carregamento ocupa uma posição da secção
+		for range row.Count {
+			if err := dropper.ReloadSection(tx, index, row.Pill, 1); err != nil {
+				return err
+			}
+		}
+		im.changed[dropper.ID] = dropper
+		return nil
+
+	case ImportSchedule:
+		dropper, err := im.dropper(tx, row.Dropper)
+		if err != nil {
+			return err
+		}
+		if row.Name == "" {
+			return invalidImportField("name", "required")
+		}
+		if row.StartDate.IsZero() {
+			return invalidImportField("start_date", "required")
+		}
+		if !row.EndDate.After(row.StartDate) {
+			return invalidImportField("end_date", "after_start")
+		}
+		interval, err := parseImportDuration("interval", row.Interval)
+		if err != nil {
+			return err
+		}
+		lead, err := parseImportDuration("reminder_lead", row.ReminderLead)
+		if err != nil {
+			return err
+		}
+
+		_, err = dropper.CreateDispenseSchedule(tx, ScheduleSpec{
+			Name:          row.Name,
+			Active:        true,
+			Description:   row.Description,
+			Start:         row.StartDate,
+			End:           row.EndDate,
+			Interval:      interval,
+			Pills:         row.Pills,
+			PatientID:     row.PatientID,
+			Kind:          row.ScheduleKind,
+			MaxDailyDoses: row.MaxDailyDoses,
+			ReminderLead:  lead,
+		})
+		return err
+	}
+	return invalidImportField("kind", "unsupported")
+}
+
+// errImportRollback desfaz a transação da importação sem ser um erro
+var errImportRollback = errors.New("importação desfeita")
+
+// Import lê e aplica o ficheiro de droppers, secções, carregamentos e horários no tenant.
+// Todas as linhas são validadas numa transação, cada uma no seu savepoint, para reportar os
+// erros de todas. A transação só é confirmada se nenhuma linha falhar e não for dryRun.
+func Import(db *gorm.DB, tenantID uint, r io.Reader, format string, dryRun bool) (*ImportResult, error) {
+	rows, errs, err := parseImportRows(r, format)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrInvalidImport
+	}
+
+	result := &ImportResult{DryRun: dryRun, Rows: len(rows), Created: make(map[string]int), Errors: errs}
+	im := importer{tenantID: tenantID, droppers: make(map[string]*Dropper), changed: make(map[uint]*Dropper)}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i, row := range rows {
+			if row == nil {
+				continue
+			}
+			if err := tx.SavePoint("import_row").Error; err != nil {
+				return err
+			}
+			if err := im.apply(tx, row); err != nil {
+				if err := tx.RollbackTo("import_row").Error; err != nil {
+					return err
+				}
+
+				var row_err *ImportError
+				if !errors.As(err, &row_err) {
+					row_err = &ImportError{Err: err}
+				}
+				row_err.Row = i + 1
+				result.Errors = append(result.Errors, *row_err)
+				continue
+			}
+			result.Created[row.Kind]++
+		}
+
+		if dryRun || len(result.Errors) > 0 {
+			return errImportRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errImportRollback) {
+		log.Printf("Erro inesperado na importação: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	result.Applied = err == nil
+	if result.Applied {
+		log.Printf("Importação de %d linhas aplicada no tenant <%d>", result.Rows, tenantID)
+		for _, dropper := range im.changed {
+			dropper.PublishEvent(EventInventory, InventoryEvent{Reason: InventoryImport})
+		}
+	}
+	return result, nil
+}
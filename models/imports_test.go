@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	file := strings.Join([]string{
+		"Kind, dropper, name, pills, count, start_date, interval",
+		"section,Casa,,Aspirina:2;Brufen:1,,,",
+		"load,Casa,,,3,,",
+		"schedule,Casa,Manhã,Aspirina:1,,2030-01-01T08:00:00Z,8h",
+		"load,Casa,,,três,,",
+		"section,Casa,,Aspirina,,,",
+	}, "\n")
+
+	rows, errs, err := parseImportRows(strings.NewReader(file), ImportCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("Expected 5 rows, got %d", len(rows))
+	}
+	if rows[0].Pills["Aspirina"] != 2 || rows[0].Pills["Brufen"] != 1 || rows[1].Count != 3 {
+		t.Fatalf("Unexpected rows %+v, %+v", rows[0], rows[1])
+	}
+	if !rows[2].StartDate.Equal(time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)) || rows[2].Interval != "8h" {
+		t.Fatalf("Unexpected schedule row %+v", rows[2])
+	}
+
+	// As linhas ilegíveis ficam nos erros, com o número da linha e o campo
+	if len(errs) != 2 || rows[3] != nil || rows[4] != nil {
+		t.Fatalf("Expected 2 invalid rows, got %+v", errs)
+	}
+	if errs[0].Row != 4 || errs[0].Field != "count" || errs[0].Code != "invalid_type" || errs[1].Field != "pills" {
+		t.Fatalf("Unexpected errors %+v", errs)
+	}
+	if !errors.Is(&errs[0], ErrInvalidImport) {
+		t.Fatal("Row errors should wrap ErrInvalidImport")
+	}
+
+	if _, _, err := parseImportRows(strings.NewReader("kind,colour\n"), ImportCSV); !errors.Is(err, ErrInvalidImport) {
+		t.Fatal("Unknown columns should be rejected")
+	}
+}
+
+func TestParseImportJSON(t *testing.T) {
+	file := `[
+		{"kind": "dropper", "name": "Casa", "machine_url": "http://casa"},
+		{"kind": "section", "dropper": "Casa", "section": "A", "pills": {"Aspirina": 2}},
+		{"kind": "load", "dropper": "Casa", "count": "3"}
+	]`
+
+	rows, errs, err := parseImportRows(strings.NewReader(file), ImportJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].MachineURL != "http://casa" || rows[1].Pills["Aspirina"] != 2 {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+	if len(errs) != 1 || errs[0].Row != 3 || errs[0].Field != "count" {
+		t.Fatalf("Unexpected errors %+v", errs)
+	}
+
+	if _, _, err := parseImportRows(strings.NewReader(`{"kind": "dropper"}`), ImportJSON); !errors.Is(err, ErrInvalidImport) {
+		t.Fatal("Only arrays of rows are accepted")
+	}
+	if _, _, err := parseImportRows(strings.NewReader(`[]`), "xml"); !errors.Is(err, ErrInvalidImport) {
+		t.Fatal("Unknown formats should be rejected")
+	}
+}
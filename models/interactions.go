@@ -0,0 +1,142 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/interactions"
+)
+
+var (
+	ErrSevereInteraction = errors.New("o horário tem interações graves, é necessário um motivo para o criar")
+)
+
+// interactionChecker é usado na criação e alteração de horários, definido por SetInteractionChecker
+var interactionChecker interactions.Checker = interactions.None{}
+
+// SetInteractionChecker define o verificador de interações usado pelos horários
+func SetInteractionChecker(checker interactions.Checker) {
+	interactionChecker = checker
+}
+
+// InteractionError é devolvido quando um horário tem interações graves sem Override
+type InteractionError struct {
+	Warnings []interactions.Warning
+}
+
+func (e *InteractionError) Error() string {
+	return ErrSevereInteraction.Error()
+}
+
+func (e *InteractionError) Is(target error) bool {
+	return target == ErrSevereInteraction
+}
+
+// Override permite criar um horário com interações graves, o motivo fica registado
+type Override struct {
+	Reason string
+	UserID uint
+}
+
+// InteractionOverride regista cada horário criado ou alterado apesar de interações graves
+type InteractionOverride struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	ScheduleID uint  `gorm:"index;not null" json:"schedule_id"`
+	PatientID  *uint `gorm:"index" json:"patient_id"`
+	// Utilizador que autorizou
+	UserID   uint                   `gorm:"not null" json:"user_id"`
+	Reason   string                 `gorm:"not null" json:"reason"`
+	Warnings []interactions.Warning `gorm:"serializer:json" json:"warnings"`
+}
+
+// checkInteractions verifica os comprimidos do horário contra os restantes horários ativos do
+// paciente, ou do dropper se não tiver paciente, que se sobreponham às suas tomas futuras, e
+// contra as alergias do paciente. Interações graves só são aceites com um Override com motivo.
+func checkInteractions(db *gorm.DB, schedule *DispenseSchedule, pills PillList, override *Override) ([]interactions.Warning, error) {
+	medications := make([]string, 0, len(pills))
+	for name := range pills {
+		medications = append(medications, name)
+	}
+	slices.Sort(medications)
+
+	// Só as tomas que ainda vão ser dispensadas podem interagir
+	from := time.Now().UTC()
+	if schedule.StartDate.After(from) {
+		from = schedule.StartDate
+	}
+	others := func() *gorm.DB {
+		query := db.
+			Table("dispense_schedules").
+			Where("dispense_schedules.deleted_at is null and dispense_schedules.active = true").
+			Where("dispense_schedules.start_date < ? and dispense_schedules.end_date > ?", schedule.EndDate, from).
+			Where("dispense_schedules.id <> ?", schedule.ID)
+		if schedule.PatientID != nil {
+			return query.Where("dispense_schedules.patient_id = ?", *schedule.PatientID)
+		}
+		return query.Where("dispense_schedules.dropper_id = ?", schedule.DropperID)
+	}
+
+	current := make([]string, 0)
+	err := others().
+		Distinct("pills.name").
+		Joins("join scheduled_pills on scheduled_pills.dispense_schedule_id = dispense_schedules.id and scheduled_pills.deleted_at is null").
+		Joins("join pills on pills.scheduled_pills_id = scheduled_pills.id and pills.deleted_at is null").
+		Pluck("pills.name", &current).
+		Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	// Os comprimidos dos horários por fases estão nas fases
+	phased := make([]DispenseSchedule, 0)
+	if err := others().Select("id", "phases").Where("phases is not null and phases <> 'null'").Find(&phased).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	for i := range phased {
+		for name := range phased[i].dosePills(nil) {
+			if !slices.Contains(current, name) {
+				current = append(current, name)
+			}
+		}
+	}
+
+	allergies := make([]string, 0)
+	if schedule.PatientID != nil {
+		var patient Patient
+		if err := db.Select("allergies").First(&patient, *schedule.PatientID).Error; err != nil {
+			log.Printf("Erro inesperado: %s", err.Error())
+			return nil, ErrUnexpectedError
+		}
+		allergies = patient.Allergies
+	}
+
+	warnings := interactionChecker.Check(medications, current, allergies)
+	if interactions.Blocking(warnings) && (override == nil || override.Reason == "") {
+		return warnings, &InteractionError{Warnings: warnings}
+	}
+	return warnings, nil
+}
+
+// recordOverride regista no log o Override de um horário com interações graves
+func recordOverride(tx *gorm.DB, schedule *DispenseSchedule, warnings []interactions.Warning, override *Override) error {
+	if override == nil || !interactions.Blocking(warnings) {
+		return nil
+	}
+
+	log.Printf("Horário <%d> criado com interações graves, autorizado por <%d>: %s", schedule.ID, override.UserID, override.Reason)
+	return tx.Create(&InteractionOverride{
+		ScheduleID: schedule.ID,
+		PatientID:  schedule.PatientID,
+		UserID:     override.UserID,
+		Reason:     override.Reason,
+		Warnings:   warnings,
+	}).Error
+}
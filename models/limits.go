@@ -0,0 +1,391 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDoseLimitExceeded = errors.New("a dose máxima do medicamento seria ultrapassada")
+	ErrInvalidDoseLimit  = errors.New("limite de dose inválido")
+	ErrDoseLimitNotFound = errors.New("limite de dose não encontrado")
+	ErrIntervalTooShort  = errors.New("o intervalo entre tomas é inferior ao mínimo permitido")
+)
+
+// Períodos de um limite de dose
+const (
+	LimitSingle = "single"
+	LimitDaily  = "daily"
+	LimitWeekly = "weekly"
+)
+
+// DoseLimit é a quantidade máxima de comprimidos de um medicamento por toma, em 24 horas e em
+// 7 dias. Sem paciente o limite faz parte do catálogo do tenant; o limite de um paciente
+// substitui o do catálogo para esse medicamento. Os limites são verificados na criação dos
+// horários e antes de cada dispensa.
+type DoseLimit struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	TenantID  uint  `gorm:"index;not null" json:"-"`
+	PatientID *uint `gorm:"index" json:"patient_id"`
+
+	// Nome do comprimido, sem distinção de maiúsculas
+	Medication string `gorm:"not null" json:"medication"`
+	// Máximos em comprimidos, 0 não limita
+	MaxSingle uint `json:"max_single"`
+	MaxDaily  uint `json:"max_daily"`
+	MaxWeekly uint `json:"max_weekly"`
+}
+
+// DoseLimitFields contêm os dados de um limite de dose
+type DoseLimitFields struct {
+	PatientID  *uint
+	Medication string
+	MaxSingle  uint
+	MaxDaily   uint
+	MaxWeekly  uint
+}
+
+func (f DoseLimitFields) valid() bool {
+	if strings.TrimSpace(f.Medication) == "" || f.MaxSingle+f.MaxDaily+f.MaxWeekly == 0 {
+		return false
+	}
+	// Um limite mais curto não pode ser maior que um mais longo
+	if f.MaxSingle > 0 && ((f.MaxDaily > 0 && f.MaxSingle > f.MaxDaily) || (f.MaxWeekly > 0 && f.MaxSingle > f.MaxWeekly)) {
+		return false
+	}
+	return f.MaxDaily == 0 || f.MaxWeekly == 0 || f.MaxDaily <= f.MaxWeekly
+}
+
+// DoseLimitError indica o limite que uma dose ou horário ultrapassaria
+type DoseLimitError struct {
+	Medication string
+	Period     string
+	Max        uint
+	Requested  uint
+}
+
+func (e *DoseLimitError) Error() string {
+	return fmt.Sprintf("limite %s de %s ultrapassado: máximo %d, pedido %d", e.Period, e.Medication, e.Max, e.Requested)
+}
+
+func (e *DoseLimitError) Is(target error) bool {
+	return target == ErrDoseLimitExceeded
+}
+
+// doseAmounts são as quantidades de um medicamento numa toma, em 24 horas e em 7 dias
+type doseAmounts struct {
+	single, daily, weekly uint
+}
+
+// exceeded devolve o primeiro limite ultrapassado pelas quantidades, ou nil
+func (l *DoseLimit) exceeded(medication string, amounts doseAmounts) *DoseLimitError {
+	checks := []struct {
+		period         string
+		max, requested uint
+	}{
+		{LimitSingle, l.MaxSingle, amounts.single},
+		{LimitDaily, l.MaxDaily, amounts.daily},
+		{LimitWeekly, l.MaxWeekly, amounts.weekly},
+	}
+	for _, check := range checks {
+		if check.max > 0 && check.requested > check.max {
+			return &DoseLimitError{Medication: medication, Period: check.period, Max: check.max, Requested: check.requested}
+		}
+	}
+	return nil
+}
+
+// SetDoseLimit cria ou substitui o limite do medicamento no catálogo do tenant, ou do paciente
+func SetDoseLimit(db *gorm.DB, tenantID uint, fields DoseLimitFields) (limit *DoseLimit, created bool, err error) {
+	if !fields.valid() {
+		return nil, false, ErrInvalidDoseLimit
+	}
+	if fields.PatientID != nil {
+		if _, err := FindPatient(db, tenantID, *fields.PatientID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	limit = &DoseLimit{}
+	query := db.Where("tenant_id = ? and lower(medication) = ?", tenantID, strings.ToLower(fields.Medication))
+	if fields.PatientID != nil {
+		query = query.Where("patient_id = ?", *fields.PatientID)
+	} else {
+		query = query.Where("patient_id is null")
+	}
+	err = query.First(limit).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		created = true
+		limit = &DoseLimit{TenantID: tenantID, PatientID: fields.PatientID}
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, false, ErrUnexpectedError
+	}
+
+	limit.Medication = fields.Medication
+	limit.MaxSingle, limit.MaxDaily, limit.MaxWeekly = fields.MaxSingle, fields.MaxDaily, fields.MaxWeekly
+	if err := db.Save(limit).Error; err != nil {
+		log.Printf("Erro inesperado ao guardar limite de dose: %s", err.Error())
+		return nil, false, ErrUnexpectedError
+	}
+	return limit, created, nil
+}
+
+// ListDoseLimits devolve uma página dos limites do tenant, do catálogo e dos pacientes.
+// O filtro de nome aplica-se ao medicamento.
+func ListDoseLimits(db *gorm.DB, tenantID uint, options ListOptions) ([]DoseLimit, int64, error) {
+	limits := make([]DoseLimit, 0)
+
+	query := db.Model(&DoseLimit{}).Where("tenant_id = ?", tenantID)
+	if options.Name != "" {
+		query = query.Where("medication ILIKE ?", "%"+options.Name+"%")
+	}
+	options.Active, options.Name = nil, ""
+	total, err := options.find(query, &limits, "medication", "patient_id", "created_at")
+
+	return limits, total, err
+}
+
+// DeleteDoseLimit remove um limite do tenant
+func DeleteDoseLimit(db *gorm.DB, tenantID uint, id uint) error {
+	result := db.Where("id = ? and tenant_id = ?", id, tenantID).Delete(&DoseLimit{})
+	if result.Error != nil {
+		log.Printf("Erro inesperado ao remover limite de dose: %s", result.Error.Error())
+		return ErrUnexpectedError
+	}
+	if result.RowsAffected == 0 {
+		return ErrDoseLimitNotFound
+	}
+	return nil
+}
+
+// effectiveLimits devolve o limite aplicável a cada medicamento, pelo nome em minúsculas.
+// O limite do paciente tem prioridade sobre o do catálogo.
+func effectiveLimits(db *gorm.DB, tenantID uint, patientID *uint, pills PillList) (map[string]DoseLimit, error) {
+	names := make([]string, 0, len(pills))
+	for name := range pills {
+		names = append(names, strings.ToLower(name))
+	}
+
+	limits := make([]DoseLimit, 0)
+	query := db.Where("tenant_id = ? and lower(medication) in ?", tenantID, names)
+	if patientID != nil {
+		query = query.Where("patient_id is null or patient_id = ?", *patientID)
+	} else {
+		query = query.Where("patient_id is null")
+	}
+	if err := query.Find(&limits).Error; err != nil {
+		return nil, err
+	}
+
+	effective := make(map[string]DoseLimit, len(limits))
+	for _, limit := range limits {
+		name := strings.ToLower(limit.Medication)
+		if _, exists := effective[name]; !exists || limit.PatientID != nil {
+			effective[name] = limit
+		}
+	}
+	return effective, nil
+}
+
+// scheduleTenant devolve o tenant cujos limites se aplicam ao horário: o do paciente ou o do dropper
+func scheduleTenant(db *gorm.DB, schedule *DispenseSchedule) (tenantID uint, err error) {
+	if schedule.PatientID != nil {
+		err = db.Model(&Patient{}).Where("id = ?", *schedule.PatientID).Pluck("tenant_id", &tenantID).Error
+	} else {
+		err = db.Model(&Dropper{}).Where("id = ?", schedule.DropperID).Pluck("tenant_id", &tenantID).Error
+	}
+	return
+}
+
+// maxOccurrences é o número máximo de tomas do horário em qualquer janela de duração window.
+// Nos horários em SOS é o máximo que o intervalo mínimo e o limite diário permitem pedir.
+func (s *DispenseSchedule) maxOccurrences(window time.Duration) uint {
+	if s.Interval < MinScheduleInterval || s.EndDate.Before(s.StartDate) {
+		return 0
+	}
+	perWindow := (window + s.Interval - 1) / s.Interval
+	total := s.EndDate.Sub(s.StartDate)/s.Interval + 1
+	if s.Kind == ScheduleKindPRN && s.MaxDailyDoses > 0 {
+		days := (window + 24*time.Hour - 1) / (24 * time.Hour)
+		perWindow = min(perWindow, time.Duration(s.MaxDailyDoses)*days)
+	}
+	return uint(min(perWindow, total))
+}
+
+// checkScheduleLimits confirma que o horário, somado aos restantes horários ativos do paciente
+// (ou do dropper, se não tiver paciente) que se sobrepõem a ele, não ultrapassa os limites
+// Nos horários por fases pills é a maior dose de cada comprimido entre as fases.
+func checkScheduleLimits(db *gorm.DB, schedule *DispenseSchedule, pills PillList) error {
+	if !schedule.Active || len(pills) == 0 {
+		return nil
+	}
+
+	tenantID, err := scheduleTenant(db, schedule)
+	if err != nil {
+		return err
+	}
+	limits, err := effectiveLimits(db, tenantID, schedule.PatientID, pills)
+	if err != nil || len(limits) == 0 {
+		return err
+	}
+
+	others := make([]DispenseSchedule, 0)
+	query := db.Where(
+		"active = true and id <> ? and start_date <= ? and end_date >= ?",
+		schedule.ID, schedule.EndDate, schedule.StartDate,
+	)
+	if schedule.PatientID != nil {
+		query = query.Where("patient_id = ?", *schedule.PatientID)
+	} else {
+		query = query.Where("dropper_id = ?", schedule.DropperID)
+	}
+	if err := query.Find(&others).Error; err != nil {
+		return err
+	}
+
+	amounts := make(map[string]doseAmounts, len(pills))
+	add := func(s *DispenseSchedule, list PillList) {
+		daily, weekly := s.maxAmounts(list, 24*time.Hour), s.maxAmounts(list, 7*24*time.Hour)
+		for name := range limits {
+			total := amounts[name]
+			total.daily += daily[name]
+			total.weekly += weekly[name]
+			amounts[name] = total
+		}
+	}
+
+	add(schedule, pills)
+	for i := range others {
+		list, err := others[i].Pills(db)
+		if err != nil {
+			return err
+		}
+		add(&others[i], list)
+	}
+
+	for name, count := range pills {
+		limit, limited := limits[strings.ToLower(name)]
+		if !limited {
+			continue
+		}
+		total := amounts[strings.ToLower(name)]
+		total.single = uint(count)
+		if exceeded := limit.exceeded(name, total); exceeded != nil {
+			return exceeded
+		}
+	}
+	return nil
+}
+
+// Espaços das chaves dos advisory locks que serializam as dispensas de um paciente ou dropper
+const (
+	patientLimitLock = 0x706174
+	dropperLimitLock = 0x64726f
+)
+
+// checkDispenseLimits confirma que dispensar os comprimidos em at, somados ao que já foi
+// dispensado ao paciente (ou no dropper, se não houver paciente), não ultrapassa os limites.
+// Corre na transação da dispensa e bloqueia o paciente ou o dropper até ao fim dela, para que
+// duas dispensas simultâneas não passem ambas os limites.
+func checkDispenseLimits(db *gorm.DB, tenantID uint, dropperID uint, patientID *uint, pills PillList, at time.Time) error {
+	limits, err := effectiveLimits(db, tenantID, patientID, pills)
+	if err != nil || len(limits) == 0 {
+		return err
+	}
+
+	key := int64(dropperLimitLock)<<40 | int64(dropperID)
+	if patientID != nil {
+		key = int64(patientLimitLock)<<40 | int64(*patientID)
+	}
+	if err := db.Exec("SELECT pg_advisory_xact_lock(?)", key).Error; err != nil {
+		return err
+	}
+
+	records := make([]DispenseRecord, 0)
+	query := db.Where("status = ? and dispensed_at > ?", DoseDispensed, at.Add(-7*24*time.Hour))
+	if patientID != nil {
+		query = query.Where("patient_id = ?", *patientID)
+	} else {
+		query = query.Where("dropper_id = ?", dropperID)
+	}
+	if err := query.Find(&records).Error; err != nil {
+		return err
+	}
+
+	for name, count := range pills {
+		limit, limited := limits[strings.ToLower(name)]
+		if !limited || count < 1 {
+			continue
+		}
+
+		amounts := doseAmounts{single: uint(count), daily: uint(count), weekly: uint(count)}
+		for _, record := range records {
+			for dispensed, n := range record.Pills {
+				if !strings.EqualFold(dispensed, name) {
+					continue
+				}
+				amounts.weekly += uint(n)
+				if record.DispensedAt.After(at.Add(-24 * time.Hour)) {
+					amounts.daily += uint(n)
+				}
+			}
+		}
+		if exceeded := limit.exceeded(name, amounts); exceeded != nil {
+			return exceeded
+		}
+	}
+	return nil
+}
+
+// limitAlert devolve o alerta de um limite ultrapassado, ou nil se err não for um DoseLimitError
+func limitAlert(tenantID uint, dropperID uint, patientID, scheduleID *uint, err error) *Alert {
+	var exceeded *DoseLimitError
+	if !errors.As(err, &exceeded) {
+		return nil
+	}
+
+	return &Alert{
+		TenantID:   tenantID,
+		DropperID:  &dropperID,
+		PatientID:  patientID,
+		ScheduleID: scheduleID,
+		Kind:       AlertDoseLimit,
+		Message:    exceeded.Error(),
+	}
+}
+
+// raiseLimitAlert regista o alerta de um limite ultrapassado, se err for um DoseLimitError
+func raiseLimitAlert(db *gorm.DB, tenantID uint, dropperID uint, patientID, scheduleID *uint, err error) {
+	if alert := limitAlert(tenantID, dropperID, patientID, scheduleID, err); alert != nil {
+		raiseAlert(db, *alert)
+	}
+}
+
+// raiseScheduleLimitAlert é igual a raiseLimitAlert, para um horário recusado. Dentro de uma
+// transação, ex: a de uma receita ou de uma importação, o horário recusado desfaz a transação e
+// o alerta fica para quem a fez, depois de desfeita.
+func raiseScheduleLimitAlert(db *gorm.DB, schedule *DispenseSchedule, err error) {
+	if !errors.Is(err, ErrDoseLimitExceeded) || inTransaction(db) {
+		return
+	}
+
+	tenantID, tenantErr := scheduleTenant(db, schedule)
+	if tenantErr != nil {
+		log.Printf("Erro inesperado: %s", tenantErr.Error())
+		return
+	}
+	var scheduleID *uint
+	if schedule.ID != 0 {
+		scheduleID = &schedule.ID
+	}
+	raiseLimitAlert(db, tenantID, schedule.DropperID, schedule.PatientID, scheduleID, err)
+}
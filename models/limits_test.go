@@ -0,0 +1,76 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestDoseLimitExceeded(t *testing.T) {
+	limit := DoseLimit{MaxSingle: 2, MaxDaily: 4, MaxWeekly: 20}
+
+	if exceeded := limit.exceeded("Ibuprofeno", doseAmounts{single: 2, daily: 4, weekly: 20}); exceeded != nil {
+		t.Fatalf("Amounts at the limit should be allowed, got %s", exceeded.Error())
+	}
+	exceeded := limit.exceeded("Ibuprofeno", doseAmounts{single: 1, daily: 6, weekly: 6})
+	if exceeded == nil || exceeded.Period != LimitDaily || exceeded.Max != 4 || exceeded.Requested != 6 {
+		t.Fatalf("Expected the daily limit to trip, got %+v", exceeded)
+	}
+	if !errors.Is(exceeded, ErrDoseLimitExceeded) {
+		t.Fatal("A DoseLimitError should match ErrDoseLimitExceeded")
+	}
+
+	unlimited := DoseLimit{MaxWeekly: 10}
+	if exceeded := unlimited.exceeded("Ibuprofeno", doseAmounts{single: 5, daily: 10, weekly: 10}); exceeded != nil {
+		t.Fatalf("Zero limits should not limit, got %s", exceeded.Error())
+	}
+
+	if (DoseLimitFields{Medication: "Ibuprofeno", MaxSingle: 5, MaxDaily: 4}).valid() {
+		t.Fatal("A single dose limit above the daily limit should be invalid")
+	}
+	if (DoseLimitFields{Medication: "Ibuprofeno"}).valid() {
+		t.Fatal("A limit without maximums should be invalid")
+	}
+}
+
+func TestScheduleMaxOccurrences(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	schedule := DispenseSchedule{StartDate: start, EndDate: start.Add(30 * 24 * time.Hour), Interval: 6 * time.Hour}
+
+	if daily := schedule.maxOccurrences(24 * time.Hour); daily != 4 {
+		t.Fatalf("Expected 4 doses a day, got %d", daily)
+	}
+	if weekly := schedule.maxOccurrences(7 * 24 * time.Hour); weekly != 28 {
+		t.Fatalf("Expected 28 doses a week, got %d", weekly)
+	}
+
+	// Um horário curto não chega a ter as tomas de um dia completo
+	schedule.EndDate = start.Add(6 * time.Hour)
+	if daily := schedule.maxOccurrences(24 * time.Hour); daily != 2 {
+		t.Fatalf("Expected 2 doses, got %d", daily)
+	}
+}
+
+func TestLimitAlert(t *testing.T) {
+	patient := uint(4)
+	exceeded := &DoseLimitError{Medication: "Ibuprofeno", Period: LimitDaily, Max: 4, Requested: 6}
+
+	alert := limitAlert(1, 2, &patient, nil, exceeded)
+	if alert == nil || alert.Kind != AlertDoseLimit || *alert.DropperID != 2 || alert.Message != exceeded.Error() {
+		t.Fatalf("Unexpected alert %+v", alert)
+	}
+	if limitAlert(1, 2, &patient, nil, ErrNotEnoughPills) != nil || createAlert(nil, nil) {
+		t.Fatal("Only exceeded limits raise alerts")
+	}
+
+	// Os alertas dos horários recusados numa transação ficam para depois de desfeita
+	if inTransaction(&gorm.DB{Statement: &gorm.Statement{ConnPool: &sql.DB{}}}) {
+		t.Fatal("A connection pool is not a transaction")
+	}
+	if !inTransaction(&gorm.DB{Statement: &gorm.Statement{ConnPool: &sql.Tx{}}}) {
+		t.Fatal("Expected a transaction")
+	}
+}
@@ -0,0 +1,237 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/mail"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// InviteTTL é durante quanto tempo um convite para um tenant pode ser aceite
+const InviteTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInviteNotFound = errors.New("convite inválido ou expirado")
+	ErrMemberNotFound = errors.New("o utilizador não pertence a este tenant")
+	ErrLastAdmin      = errors.New("o tenant tem de ter pelo menos um administrador")
+)
+
+// TenantInvite convida um novo utilizador para um tenant com um papel. Quem o aceita cria a conta
+// já nesse tenant; só o hash do token é guardado, o token é devolvido uma única vez a quem convida.
+type TenantInvite struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	TenantID uint   `gorm:"index;not null" json:"-"`
+	Email    string `gorm:"not null" json:"email"`
+	Role     Role   `gorm:"not null" json:"role"`
+	// Utilizador que fez o convite
+	InvitedBy  uint       `json:"invited_by"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+}
+
+// ListMembers devolve os utilizadores do tenant
+func ListMembers(db *gorm.DB, tenantID uint) ([]User, error) {
+	members := make([]User, 0)
+
+	if err := db.Where("tenant_id = ?", tenantID).Order("created_at").Find(&members).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return members, nil
+}
+
+// InviteMember convida o email para o tenant do ator com o papel indicado. Cada utilizador só
+// pertence a um tenant, por isso os já registados recebem acesso por dropper (ver Dropper.Grant).
+func InviteMember(db *gorm.DB, actor Actor, email string, role Role) (*TenantInvite, string, error) {
+	if !role.Valid() {
+		return nil, "", ErrInvalidRole
+	}
+	email = normalizeEmail(email)
+	if _, err := mail.ParseAddress(email); err != nil {
+		return nil, "", ErrInvalidEmail
+	}
+
+	var existing int64
+	if err := db.Model(&User{}).Where("email = ?", email).Count(&existing).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, "", ErrUnexpectedError
+	}
+	if existing > 0 {
+		return nil, "", ErrUserExists
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	invite := TenantInvite{
+		TenantID:  actor.TenantID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: actor.UserID,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().UTC().Add(InviteTTL),
+	}
+	if err := db.Create(&invite).Error; err != nil {
+		log.Printf("Erro inesperado ao criar convite: %s", err.Error())
+		return nil, "", ErrUnexpectedError
+	}
+
+	log.Printf("Utilizador <%d> convidou %s para o tenant <%d> com o papel %s", actor.UserID, email, actor.TenantID, role)
+	return &invite, token, nil
+}
+
+// AcceptInvite cria a conta convidada no tenant do convite, com o papel do convite
+func AcceptInvite(db *gorm.DB, token, name, password string) (*User, error) {
+	var invite TenantInvite
+
+	err := db.First(&invite, "token_hash = ? and accepted_at is null and expires_at > ?", hashRefreshToken(token), time.Now().UTC()).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInviteNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	user, err := newUser(name, invite.Email, password, invite.Role)
+	if err != nil {
+		return nil, err
+	}
+	user.TenantID = invite.TenantID
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Um convite só é aceite uma vez, mesmo com pedidos simultâneos
+		result := tx.Model(&invite).Where("accepted_at is null").Update("accepted_at", time.Now().UTC())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInviteNotFound
+		}
+		return tx.Create(user).Error
+	})
+	if errors.Is(err, ErrInviteNotFound) {
+		return nil, err
+	} else if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrUserExists
+	} else if err != nil {
+		log.Printf("Erro inesperado ao aceitar convite: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("Utilizador <%d> entrou no tenant <%d> com o papel %s", user.ID, user.TenantID, user.Role)
+	return user, nil
+}
+
+// lockMember bloqueia o tenant, para que as verificações de administradores não se cruzem, e
+// procura o utilizador no tenant
+func lockMember(tx *gorm.DB, tenantID, userID uint) (*User, error) {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Tenant{}, tenantID).Error; err != nil {
+		return nil, err
+	}
+
+	var member User
+	if err := tx.Limit(1).Find(&member, "id = ? and tenant_id = ?", userID, tenantID).Error; err != nil {
+		return nil, err
+	}
+	if member.ID == 0 {
+		return nil, ErrMemberNotFound
+	}
+	return &member, nil
+}
+
+// keepAdmin confirma que o tenant continua com um administrador se member deixar de o ser
+func keepAdmin(tx *gorm.DB, member *User) error {
+	if member.Role != RoleAdmin {
+		return nil
+	}
+
+	var admins int64
+	err := tx.Model(&User{}).Where("tenant_id = ? and role = ?", member.TenantID, RoleAdmin).Count(&admins).Error
+	if err != nil {
+		return err
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// SetMemberRole muda o papel do utilizador no tenant. O novo papel é usado nas rotas sensíveis e
+// no próximo refresh; os calendários que deixe de poder partilhar deixam de ser servidos.
+func SetMemberRole(db *gorm.DB, tenantID, userID uint, role Role) (*User, error) {
+	if !role.Valid() {
+		return nil, ErrInvalidRole
+	}
+
+	var member *User
+	err := db.Transaction(func(tx *gorm.DB) (err error) {
+		if member, err = lockMember(tx, tenantID, userID); err != nil {
+			return err
+		}
+		if role == member.Role {
+			return nil
+		}
+		if err := keepAdmin(tx, member); err != nil {
+			return err
+		}
+		member.Role = role
+		return tx.Model(member).Update("role", role).Error
+	})
+	if errors.Is(err, ErrMemberNotFound) || errors.Is(err, ErrLastAdmin) {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao mudar papel: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("Utilizador <%d> tem agora o papel %s no tenant <%d>", userID, role, tenantID)
+	return member, nil
+}
+
+// RemoveMember retira o utilizador do tenant. A conta passa para um tenant próprio, de que é
+// administrador como no registo, e as suas sessões e calendários no tenant são revogados.
+func RemoveMember(db *gorm.DB, tenantID, userID uint) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		member, err := lockMember(tx, tenantID, userID)
+		if err != nil {
+			return err
+		}
+		if err := keepAdmin(tx, member); err != nil {
+			return err
+		}
+
+		tenant := Tenant{Name: member.Name}
+		if err := tx.Create(&tenant).Error; err != nil {
+			return err
+		}
+		err = tx.Model(member).Updates(map[string]any{"tenant_id": tenant.ID, "role": RoleAdmin}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := revokeSessions(tx, userID); err != nil {
+			return err
+		}
+		return revokeCalendarFeeds(tx, tx.Where("user_id = ? and tenant_id = ?", userID, tenantID))
+	})
+	if errors.Is(err, ErrMemberNotFound) || errors.Is(err, ErrLastAdmin) {
+		return err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao remover utilizador do tenant: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	log.Printf("Utilizador <%d> saiu do tenant <%d>", userID, tenantID)
+	return nil
+}
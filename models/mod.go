@@ -3,28 +3,34 @@ package models
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/interactions"
 )
 
 type Dropper struct {
-	// OwnerID    uuid.UUID `db:"owner_id"`
 	gorm.Model `json:"-"`
 
+	// Tenant dono do dropper, só os seus utilizadores o podem ver ou controlar
+	TenantID uint `gorm:"index" json:"-"`
+
 	// Allow read and create of field SerialID
 	SerialID   uuid.UUID `gorm:"<-;index;default:gen_random_uuid();" json:"serial_id"`
 	Active     bool      `json:"active"`
-	MachineURL string    `gorm:"<-;default:null;uniqueIndex" json:"machine_url"`
+	MachineURL string    `gorm:"<-;default:null;uniqueIndex:idx_droppers_machine_url,where:deleted_at IS NULL" json:"machine_url"`
 	Name       string    `json:"name"`
 
 	// A dropper has many Schedules
 	DispenseSchedules []DispenseSchedule `gorm:"constraint:OnDelete:SET NULL;" json:"schedules"`
 
 	Sections []DropperSection `gorm:"constraint:OnDelete:SET NULL;" json:"sections"`
+
+	// Acessos concedidos a utilizadores, incluindo de outros tenants
+	Grants []DropperGrant `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
 }
 
 // DispenseSchedule Stores dropper medicine dispense schedule
@@ -32,14 +38,36 @@ type DispenseSchedule struct {
 	gorm.Model `json:"-"`
 
 	// Dropper foreign key
-	DropperID uint `gorm:"uniqueIndex:uniqueSchedule" json:"-"`
+	DropperID uint `gorm:"uniqueIndex:uniqueSchedule,where:deleted_at IS NULL" json:"-"`
+	// Paciente a quem o horário se destina, opcional
+	PatientID *uint `gorm:"index" json:"patient_id"`
+	// Receita de que o horário foi gerado, se existir
+	PrescriptionID *uint `gorm:"index" json:"prescription_id"`
 
-	Name        string        `gorm:"uniqueIndex:uniqueSchedule" json:"name"`
+	Name        string        `gorm:"uniqueIndex:uniqueSchedule,where:deleted_at IS NULL" json:"name"`
 	Active      bool          `gorm:"default:true;" json:"active"`
 	Description string        `json:"description"`
 	StartDate   time.Time     `json:"start_date"`
 	EndDate     time.Time     `json:"end_date"`
-	Interval    time.Duration `gorm:"default:6;" json:"interval"`
+	Interval    time.Duration `json:"interval"`
+	// ScheduleKindScheduled ou ScheduleKindPRN, nos horários em SOS Interval é o tempo mínimo entre tomas
+	Kind string `gorm:"not null;default:scheduled" json:"kind"`
+	// Máximo de tomas em SOS em 24 horas, 0 não limita
+	MaxDailyDoses uint `json:"max_daily_doses"`
+	// Fases com doses diferentes, substituem os comprimidos do horário
+	Phases []SchedulePhase `gorm:"serializer:json" json:"phases"`
+	// Pausa em curso, as tomas entre PausedAt e ResumeAt são saltadas. Sem ResumeAt a pausa
+	// dura até o horário ser retomado.
+	PausedAt *time.Time `json:"paused_at"`
+	ResumeAt *time.Time `json:"resume_at"`
+	// Antecedência do lembrete enviado ao dropper antes de cada toma, 0 não envia lembretes
+	ReminderLead time.Duration `json:"reminder_lead"`
+	// Quantas vezes, e por quanto tempo de cada vez, o paciente pode adiar a toma
+	MaxSnoozes     uint          `json:"max_snoozes"`
+	SnoozeDuration time.Duration `json:"snooze_duration"`
+
+	// Avisos de interações da última criação ou alteração, não são guardados
+	Warnings []interactions.Warning `gorm:"-" json:"warnings,omitempty"`
 }
 
 type ScheduledPills struct {
@@ -93,13 +121,20 @@ type Position struct {
 */
 
 var (
-	ErrDropperNotFound = errors.New("nenhum dropper encontrado")
-	ErrSectionFull     = errors.New("secção cheia")
-	ErrTooManyPills    = errors.New("demasiados comprimidos fornecidos")
-	ErrTooFewPills     = errors.New("poucos comprimidos fornecidos")
-	ErrInvalidPosition = errors.New("posição de secção fora do intervalo permitido")
-	ErrUnexpectedError = errors.New("erro inesperado encontrado")
-	ErrSectionIsFull   = errors.New("secção cheia")
+	ErrDropperNotFound  = errors.New("nenhum dropper encontrado")
+	ErrSectionFull      = errors.New("secção cheia")
+	ErrTooManyPills     = errors.New("demasiados comprimidos fornecidos")
+	ErrTooFewPills      = errors.New("poucos comprimidos fornecidos")
+	ErrInvalidPosition  = errors.New("posição de secção fora do intervalo permitido")
+	ErrUnexpectedError  = errors.New("erro inesperado encontrado")
+	ErrSectionIsFull    = errors.New("secção cheia")
+	ErrSectionNotFound  = errors.New("secção não encontrada")
+	ErrScheduleExists   = errors.New("já existe um horário com este nome")
+	ErrScheduleNotFound = errors.New("horário não encontrado")
+	ErrNotEnoughPills   = errors.New("comprimidos insuficientes no dropper")
+	ErrDropperExists    = errors.New("este dropper já existe")
+	ErrInvalidSort      = errors.New("campo de ordenação inválido")
+	ErrSectionExists    = errors.New("esta secção e/ou os seus comprimidos já foram definidos")
 )
 
 type MqttActionRequest struct {
@@ -107,166 +142,147 @@ type MqttActionRequest struct {
 	Value []byte
 }
 
-// TODO - Scan all dropper sections, to find which have the pills necessary to fulfil the request
-
-// PillDispenseBGJob runs every five seconds, checks the schedules for ones that should be delivered now
-func PillDispenseBGJob(db *gorm.DB, ch chan MqttActionRequest) (err error) {
-	// Delay function execution
-	time.Sleep(time.Second * 10)
-
-	time_now := time.Now().UTC()
-	ceiling_up, ceiling_down :=
-		time_now.Add(time.Second*5).UTC(),
-		time_now.Add(time.Second*5*-1).UTC()
+// ScheduleSpec contêm os dados de um novo horário de dispensa
+type ScheduleSpec struct {
+	Name        string
+	Active      bool
+	Description string
+	Start, End  time.Time
+	Interval    time.Duration
+	Pills       PillList
+	// Paciente a quem o horário se destina, tem de estar associado ao dropper
+	PatientID *uint
+	// Receita de que o horário é gerado
+	PrescriptionID *uint
+	// Vazio é ScheduleKindScheduled
+	Kind          string
+	MaxDailyDoses uint
+	// Fases contíguas do início ao fim do horário, exclusivas com Pills
+	Phases []SchedulePhase
+	// Lembretes antes de cada toma e adiamentos permitidos
+	ReminderLead   time.Duration
+	MaxSnoozes     uint
+	SnoozeDuration time.Duration
+	// Necessário para criar o horário com interações graves
+	Override *Override
+}
 
-	schedules := make([]DispenseSchedule, 0, 15)
-	err = db.
-		Model(&DispenseSchedule{}).
-		Where("active = true and (? <= end_date and start_date <= ?) and end_date > ?", ceiling_up, ceiling_down, time_now).
-		Find(&schedules).
-		Error
+// CreateDispenseSchedule cria um horário de dispensa para o dropper, juntamente com os comprimidos a dispensar
+func (d *Dropper) CreateDispenseSchedule(db *gorm.DB, spec ScheduleSpec) (*DispenseSchedule, error) {
+	schedule := DispenseSchedule{
+		DropperID:      d.ID,
+		PatientID:      spec.PatientID,
+		PrescriptionID: spec.PrescriptionID,
+		Name:           spec.Name,
+		Active:         spec.Active,
+		Description:    spec.Description,
+		StartDate:      spec.Start.UTC(),
+		EndDate:        spec.End.UTC(),
+		Interval:       spec.Interval,
+		Kind:           spec.Kind,
+		MaxDailyDoses:  spec.MaxDailyDoses,
+		ReminderLead:   spec.ReminderLead,
+		MaxSnoozes:     spec.MaxSnoozes,
+		SnoozeDuration: spec.SnoozeDuration,
+	}
+	if schedule.Kind == "" {
+		schedule.Kind = ScheduleKindScheduled
+	}
+	if err := schedule.validKind(); err != nil {
+		return nil, err
+	}
+	if schedule.Interval < MinScheduleInterval {
+		return nil, ErrIntervalTooShort
+	}
+	if err := schedule.setPhases(spec.Phases, spec.Pills); err != nil {
+		return nil, err
+	}
+	if err := schedule.validReminders(); err != nil {
+		return nil, err
+	}
+	pills := schedule.dosePills(spec.Pills)
 
-	if err != nil {
-		log.Printf("Erro ao buscar schedules")
-		return
-	}
-
-	if len(schedules) == 0 {
-		log.Println("No schedules found")
-		return
-	}
-	log.Println("Schedules found")
-
-	for _, schedule := range schedules {
-		interval, _ := time.ParseDuration(fmt.Sprintf("%v", schedule.Interval*time.Second))
-		log.Printf("Interval: %+v", interval)
-
-		// schedule_start := schedule.StartDate.UTC()
-		// interval_subtraction := time.Date(
-		// 	schedule_start.Year(),
-		// 	schedule_start.Month(),
-		// 	schedule_start.Day(),
-		// 	// ------------------
-		// 	time_now.UTC().Hour(),
-		// 	time_now.UTC().Minute(),
-		// 	time_now.UTC().Second(),
-		// 	time_now.UTC().Nanosecond(),
-		// 	// ------------------
-		// 	time.UTC,
-		// )
-		// time_diference := interval_subtraction.Sub(schedule_start)
-		// time_diference := (schedule_start).Sub(interval_subtraction)
-
-		// interval_above := time_diference > interval+time.Second*5
-		// interval_bellow := time_diference < interval-time.Second*5
-
-		// if interval_above || interval_bellow {
-		// 	log.Printf("Skipping - %s", schedule.Name)
-		// 	continue
-		// }
-
-		var dropper Dropper
-		err = db.Preload("Sections.Positions").Find(&dropper, schedule.DropperID).Error
+	if spec.PatientID != nil {
+		linked, err := (&Patient{ID: *spec.PatientID}).linkedTo(db, d.ID)
 		if err != nil {
-			log.Printf("Erro de base de dados: %e", err)
-			return
+			return nil, err
 		}
-
-		var scheduled_pills ScheduledPills
-		err = db.Select("id").Find(&scheduled_pills, &ScheduledPills{DispenseScheduleID: schedule.ID}).Error
-		if err != nil {
-			log.Printf("Erro de base de dados: %e", err)
-			return
+		if !linked {
+			return nil, ErrPatientNotLinked
 		}
+	}
 
-		pills := new([]Pill)
-		err = db.Where("scheduled_pills_id = ?", scheduled_pills.ID).Find(&pills).Error
-		if err != nil {
-			log.Printf("Erro de base de dados: %e", err)
-			return
-		}
+	warnings, err := checkInteractions(db, &schedule, pills, spec.Override)
+	if err != nil {
+		return nil, err
+	}
+	schedule.Warnings = warnings
+
+	if err := checkScheduleLimits(db, &schedule, pills); errors.Is(err, ErrDoseLimitExceeded) {
+		raiseScheduleLimitAlert(db, &schedule, err)
+		return nil, err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao verificar limites de dose: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
 
-		// Go get the pills sections and positions
-
-		for _, pill := range *pills {
-			val := map[string]interface{}{}
-			err = db.
-				Model(&Position{}).
-				Select("dropper_section_id", "position").
-				Where("empty = ? and pill_name = ?", false, pill.Name).
-				Find(&val).
-				Limit(int(pill.Count)).
-				Error
-
-			if err != nil {
-				log.Printf("Erro de base de dados: %e", err)
-				continue
-			}
-			ch <- MqttActionRequest{
-				Topic: fmt.Sprintf("angle%d", schedule.DropperID),
-				Value: []byte(fmt.Sprintf("0,%d", val["position"])),
-			}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Create if not exists
+		if err := tx.Create(&schedule).Error; err != nil {
+			return err
+		}
+		if err := replaceSchedulePills(tx, schedule.ID, spec.Pills); err != nil {
+			return err
 		}
+		return recordOverride(tx, &schedule, warnings, spec.Override)
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrScheduleExists
+	} else if err != nil {
+		log.Printf("Erro inesperado ao criar drop schedule: %s", err)
+		return nil, ErrUnexpectedError
 	}
 
-	log.Println("Ran schedule search")
-	return
+	return &schedule, nil
 }
 
-func (d *Dropper) CreateDispenseSchedule(
-	db *gorm.DB,
-	active bool,
-	name, descricao string,
-	start, end time.Time,
-	interval time.Duration,
-	pills map[string]int,
-) (err error) {
-	schedule := DispenseSchedule{
-		DropperID:   d.ID,
-		Name:        name,
-		Active:      active,
-		Description: descricao,
-		StartDate:   start.UTC(),
-		EndDate:     end.UTC(),
-		Interval:    interval,
+// replaceSchedulePills substitui os comprimidos associados a um horário pelos fornecidos
+func replaceSchedulePills(tx *gorm.DB, scheduleID uint, pills map[string]int) error {
+	var previous []ScheduledPills
+	if err := tx.Where("dispense_schedule_id = ?", scheduleID).Find(&previous).Error; err != nil {
+		return err
 	}
-
-	// Create if not exists
-	err = db.Create(&schedule).Error
-	if err != nil {
-		log.Printf("Erro inesperado ao criar drop schedule: %s", err)
-		return
+	for _, old := range previous {
+		if err := tx.Where("scheduled_pills_id = ?", old.ID).Delete(&Pill{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&old).Error; err != nil {
+			return err
+		}
 	}
 
 	// Create scheduled pills
 	scheduled_pills := ScheduledPills{
-		DispenseScheduleID: schedule.ID,
+		DispenseScheduleID: scheduleID,
 		Dispensed:          false,
 	}
-	err = db.Create(&scheduled_pills).Error
-	if err != nil {
-		log.Printf("Erro inesperado ao criar pill schedule: %s", err)
-		return
+	if err := tx.Create(&scheduled_pills).Error; err != nil {
+		return err
+	}
+
+	if len(pills) == 0 {
+		return nil
 	}
 
-	pill_list := make([]Pill, len(pills))
-	log.Printf("LEN: %d", len(pill_list))
-	i := 0
+	pill_list := make([]Pill, 0, len(pills))
 	for k, v := range pills {
-		pill_list[i] = Pill{
+		pill_list = append(pill_list, Pill{
 			ScheduledPillsID: scheduled_pills.ID,
 			Name:             k,
 			Count:            uint(v),
-		}
-		i += 1
+		})
 	}
-	err = db.Create(&pill_list).Error
-	if err != nil {
-		log.Printf("Erro inesperado ao criar pill schedule: %s", err)
-		return
-	}
-
-	return
+	return tx.Create(&pill_list).Error
 }
 
 // ReloadSection recebe um ponteiro gorm.DB, uma secção, o nome do comprimido e a sua quantidade
@@ -297,6 +313,9 @@ func (dp *Dropper) ReloadSection(db *gorm.DB, section uint, pillName string, cou
 	if len(dp.Sections) < 1 {
 		return ErrDropperNotFound
 	}
+	if int(section) >= len(dp.Sections) {
+		return ErrSectionNotFound
+	}
 
 	if len(dp.Sections[section].Positions) > 8 {
 		return ErrSectionIsFull
@@ -309,7 +328,7 @@ func (dp *Dropper) ReloadSection(db *gorm.DB, section uint, pillName string, cou
 	})
 	db.Save(dp)
 	// Update the runtime instance of the dropper
-	db.Preload("Sections.Positions").Find(dp, "id", dp.ID)
+	dp.reloadDropperData(db)
 
 	return nil
 }
@@ -330,7 +349,7 @@ func (dp *Dropper) CreateDropperSection(db *gorm.DB, name string, pills PillList
 
 	err := db.First(&Dropper{}, dp.ID).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return 0, errors.New("nenhum dropper encontrado para o id fornecido")
+		return 0, ErrDropperNotFound
 	}
 
 	if len(pills) == 0 {
@@ -344,10 +363,10 @@ func (dp *Dropper) CreateDropperSection(db *gorm.DB, name string, pills PillList
 		err := db.Create(&newSection).Error
 
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
-			return 0, errors.New("esta secção já existe")
+			return 0, ErrSectionExists
 		} else if err != nil {
 			log.Printf("Erro inesperado: %s", err.Error())
-			return 0, errors.New("erro inesperado")
+			return 0, ErrUnexpectedError
 		}
 
 		return newSection.ID, nil
@@ -355,7 +374,7 @@ func (dp *Dropper) CreateDropperSection(db *gorm.DB, name string, pills PillList
 
 	// If each section has 1 pill per position, we cant have more than 9 pills in the list
 	if len(pills) > 9 {
-		return 0, errors.New("to many pills")
+		return 0, ErrTooManyPills
 	}
 
 	// Any configuration of pills is accepted, as long its not larger than 9
@@ -363,7 +382,7 @@ func (dp *Dropper) CreateDropperSection(db *gorm.DB, name string, pills PillList
 	for pill := range pills {
 		pillCount += int(pills[pill])
 		if pillCount > 9 {
-			return 0, errors.New("defined to many pills")
+			return 0, ErrTooManyPills
 		}
 	}
 
@@ -386,10 +405,10 @@ func (dp *Dropper) CreateDropperSection(db *gorm.DB, name string, pills PillList
 
 	err = db.Create(&newSection).Error
 	if errors.Is(err, gorm.ErrDuplicatedKey) {
-		return 0, errors.New("esta secção e/ou os seus comprimidos já foram definidos")
+		return 0, ErrSectionExists
 	} else if err != nil {
 		log.Printf("Erro inesperado: %s\n", err.Error())
-		return 0, errors.New("erro inesperado")
+		return 0, ErrUnexpectedError
 	}
 
 	dp.Sections = append(dp.Sections, newSection)
@@ -401,28 +420,46 @@ func (dp *Dropper) CreateDropperSection(db *gorm.DB, name string, pills PillList
 }
 
 // NewDropper creates a new dropper struct instance
-func NewDropper(name string, machine_url string) *Dropper {
+func NewDropper(tenantID uint, name string, machine_url string) *Dropper {
 	return &Dropper{
+		TenantID:   tenantID,
 		Name:       name,
 		Active:     false,
 		MachineURL: machine_url,
 	}
 }
 
+// reloadDropperData recarrega as secções e posições do dropper, ordenadas pela ordem de criação,
+// para que o índice de uma secção (1 - 9) corresponda sempre à mesma secção física
 func (d *Dropper) reloadDropperData(db *gorm.DB) {
-	db.Preload("Sections.Positions").Find(d, "id", d.ID)
+	db.
+		Preload("Sections", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Sections.Positions", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Find(d, "id", d.ID)
 }
 
 func (d *Dropper) Create(db *gorm.DB) (uint, error) {
-	result := db.Create(d)
+	err := db.Create(d).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return 0, ErrDropperExists
+	}
 
-	return d.ID, result.Error
+	return d.ID, err
 }
 
-// MigrateAll runs all migrations for the models defined in this folder
-func MigrateAll(db *gorm.DB) {
-	err := db.AutoMigrate(&Dropper{}, &DispenseSchedule{}, &DropperSection{}, &Position{}, &ScheduledPills{}, &Pill{})
-	if err != nil {
-		log.Fatalf("Failed to migrate gorm models: %s", err.Error())
-	}
+// schemaModels são os modelos guardados na base de dados. O esquema é criado pelas migrações SQL do
+// pacote migrations, que têm de ter todas as colunas destes modelos.
+var schemaModels = []any{
+	&Tenant{}, &Dropper{}, &DispenseSchedule{}, &DropperSection{}, &Position{}, &ScheduledPills{}, &Pill{},
+	&SlotDiscrepancy{},
+	&User{}, &RefreshToken{}, &DropperGrant{}, &TenantInvite{},
+	&Patient{}, &PatientContact{},
+	&Prescription{}, &DispenseRecord{},
+	&InteractionOverride{},
+	&DoseLimit{}, &Alert{}, &PrnRequest{},
+	&ScheduleControl{}, &DoseReminder{}, &DoseConfirmation{},
+	&Report{}, &CalendarFeed{},
+	&Webhook{}, &WebhookDelivery{},
+	&NotificationPreference{}, &Notification{},
+	&AuditEntry{},
 }
@@ -1,11 +1,16 @@
 package models
 
 import (
+	"errors"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/TomascpMarques/dropmedical/database"
+	"github.com/TomascpMarques/dropmedical/migrations"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"gorm.io/gorm"
 )
 
 func TestSetupDatabase(t *testing.T) {
@@ -15,23 +20,142 @@ func TestSetupDatabase(t *testing.T) {
 	}
 
 	db, _ := database.NewPostgresConnection()
-	MigrateAll(db)
+	if _, err := migrations.Up(db, 0); err != nil {
+		t.Fatalf("Failed to migrate the database: %s", err.Error())
+	}
+}
+
+func testTenant(t *testing.T, db *gorm.DB) uint {
+	tenant, err := CreateTenant(db, t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create a tenant: %s", err.Error())
+	}
+	return tenant.ID
 }
 
 func TestCreateDropper(t *testing.T) {
 	db, _ := database.NewPostgresConnection()
 
-	dropper := NewDropper("SupaOne", "SupaOne")
+	dropper := NewDropper(testTenant(t, db), "SupaOne", "SupaOne")
 	_, err := dropper.Create(db)
 	if err != nil {
 		t.Fatalf("Failed to create a dropper")
 	}
 }
 
+func TestDropperTenantIsolation(t *testing.T) {
+	db, _ := database.NewPostgresConnection()
+
+	owner, other := testTenant(t, db), testTenant(t, db)
+	dropper := NewDropper(owner, "SupaIsolated", uuid.NewString())
+	if _, err := dropper.Create(db); err != nil {
+		t.Fatalf("Failed to create a dropper: %s", err.Error())
+	}
+	// Recarrega o serial gerado pela base de dados
+	db.First(dropper, dropper.ID)
+
+	if _, err := FindDropperBySerial(db, Actor{TenantID: owner}, dropper.SerialID); err != nil {
+		t.Fatalf("The owner should find its dropper: %s", err.Error())
+	}
+	if _, err := FindDropperBySerial(db, Actor{TenantID: other}, dropper.SerialID); !errors.Is(err, ErrDropperNotFound) {
+		t.Fatalf("Another tenant should not find the dropper, got %v", err)
+	}
+	if _, err := FindDropper(db, Actor{TenantID: other}, dropper.ID); !errors.Is(err, ErrDropperNotFound) {
+		t.Fatalf("Another tenant should not find the dropper by id, got %v", err)
+	}
+
+	droppers, total, err := ListDroppers(db, Actor{TenantID: other}, ListOptions{})
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if total != 0 || len(droppers) != 0 {
+		t.Fatalf("Another tenant should list no droppers, got %d", total)
+	}
+}
+
+func TestInactiveDropperStopsDispensing(t *testing.T) {
+	db, _ := database.NewPostgresConnection()
+
+	dropper := NewDropper(testTenant(t, db), "SupaInactive", uuid.NewString())
+	if _, err := dropper.Create(db); err != nil {
+		t.Fatalf("Failed to create a dropper: %s", err.Error())
+	}
+	if _, err := dropper.CreateDropperSection(db, "S1", PillList{"Aspirin": 4}); err != nil {
+		t.Fatalf("Failed to create a section: %s", err.Error())
+	}
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	schedule, err := dropper.CreateDispenseSchedule(db, ScheduleSpec{
+		Name: "INACTIVE", Active: true, Start: start, End: start.Add(24 * time.Hour),
+		Interval: time.Hour, Pills: PillList{"Aspirin": 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a schedule: %s", err.Error())
+	}
+
+	// Um dropper desativado não dispensa, mesmo com horários ativos
+	active := false
+	if err := dropper.Update(db, DropperChanges{Active: &active}); err != nil {
+		t.Fatalf("Failed to deactivate the dropper: %s", err.Error())
+	}
+	ch := make(chan MqttActionRequest, 10)
+	if err := DispenseDueDoses(db, ch, start, start.Add(time.Minute)); err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if len(ch) != 0 {
+		t.Fatalf("Expected no commands for an inactive dropper, got %d", len(ch))
+	}
+
+	// Remover o dropper desativa os seus horários
+	if err := dropper.Delete(db); err != nil {
+		t.Fatalf("Failed to delete the dropper: %s", err.Error())
+	}
+	db.First(schedule, schedule.ID)
+	if schedule.Active {
+		t.Fatal("Expected the deleted dropper's schedule to be inactive")
+	}
+}
+
+func TestDeletedPatientStopsDispensing(t *testing.T) {
+	db, _ := database.NewPostgresConnection()
+
+	tenantID := testTenant(t, db)
+	dropper := NewDropper(tenantID, "SupaOrphan", uuid.NewString())
+	if _, err := dropper.Create(db); err != nil {
+		t.Fatalf("Failed to create a dropper: %s", err.Error())
+	}
+	name := "Orphan"
+	patient, err := CreatePatient(db, tenantID, PatientFields{Name: &name})
+	if err != nil {
+		t.Fatalf("Failed to create a patient: %s", err.Error())
+	}
+	if err := patient.LinkDropper(db, dropper); err != nil {
+		t.Fatalf("Failed to link the dropper: %s", err.Error())
+	}
+
+	start := time.Now().Truncate(time.Second).UTC()
+	schedule, err := dropper.CreateDispenseSchedule(db, ScheduleSpec{
+		Name: "ORPHAN", Active: true, Start: start, End: start.Add(24 * time.Hour),
+		Interval: time.Hour, Pills: PillList{"Aspirin": 1}, PatientID: &patient.ID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a schedule: %s", err.Error())
+	}
+
+	// Os horários de um paciente removido ficam no dropper, mas desativados
+	if err := patient.Delete(db); err != nil {
+		t.Fatalf("Failed to delete the patient: %s", err.Error())
+	}
+	db.First(schedule, schedule.ID)
+	if schedule.Active || schedule.PatientID != nil {
+		t.Fatalf("Expected an inactive schedule without patient, got active=%t patient=%v", schedule.Active, schedule.PatientID)
+	}
+}
+
 func TestReloadDropperSection(t *testing.T) {
 	db, _ := database.NewPostgresConnection()
 
-	dropper := NewDropper("SupaTwo", "SupaTwo")
+	dropper := NewDropper(testTenant(t, db), "SupaTwo", "SupaTwo")
 	id, err := dropper.Create(db)
 	if err != nil {
 		t.Fatalf("Failed to create a dropper")
@@ -63,7 +187,7 @@ func TestReloadDropperSection(t *testing.T) {
 func TestCreateSection(t *testing.T) {
 	db, _ := database.NewPostgresConnection()
 
-	dropper := NewDropper("SupaThree", "SupaThree")
+	dropper := NewDropper(testTenant(t, db), "SupaThree", "SupaThree")
 	_, err := dropper.Create(db)
 	if err != nil {
 		t.Fatalf("Failed to create a dropper")
@@ -105,3 +229,44 @@ func TestCreateSection(t *testing.T) {
 		t.Fatalf("Failed to not create a dropper section that has 10 pills")
 	}
 }
+
+func TestDiffOccupancy(t *testing.T) {
+	sections := []DropperSection{
+		{
+			Positions: []Position{
+				NewSectionPosition("Aspirin", 1, false),
+				NewSectionPosition("Aspirin", 2, false),
+				NewSectionPosition("Brufen", 3, true),
+			},
+		},
+	}
+
+	// O dispositivo deteta a posição 2 vazia e comprimidos nas posições 3 e 5
+	report := OccupancyReport{
+		Sections: []SectionOccupancy{{Section: 1, Occupied: []uint{1, 3, 5}}},
+	}
+
+	found, err := diffOccupancy(1, sections, report)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if len(found) != 3 {
+		t.Fatalf("Expected 3 discrepancies, got %d", len(found))
+	}
+
+	expected := map[uint]string{
+		2: DiscrepancyUnexpectedEmpty,
+		3: DiscrepancyPhantomPill,
+		5: DiscrepancyPhantomPill,
+	}
+	for _, discrepancy := range found {
+		if expected[discrepancy.Position] != discrepancy.Kind {
+			t.Fatalf("Position %d: expected %s, got %s", discrepancy.Position, expected[discrepancy.Position], discrepancy.Kind)
+		}
+	}
+
+	_, err = diffOccupancy(1, sections, OccupancyReport{Sections: []SectionOccupancy{{Section: 2}}})
+	if err == nil {
+		t.Fatal("Expected an error for a section that does not exist")
+	}
+}
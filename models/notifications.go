@@ -0,0 +1,549 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/TomascpMarques/dropmedical/notify"
+)
+
+var ErrInvalidNotificationPreference = errors.New("preferências de notificação inválidas")
+
+// Estados de uma notificação
+const (
+	NotificationPending = "pending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+)
+
+const (
+	// NotificationDedupWindow é o tempo em que o mesmo alerta não volta a ser notificado ao
+	// utilizador no mesmo canal, ex: um dropper que se desliga várias vezes seguidas
+	NotificationDedupWindow = 6 * time.Hour
+	// NotificationMaxAttempts é o número de tentativas de envio até a notificação ficar falhada
+	NotificationMaxAttempts = 3
+	// NotificationRetry é a espera entre tentativas de envio
+	NotificationRetry = 5 * time.Minute
+	// NotificationTick é o intervalo entre execuções do NotificationBGJob
+	NotificationTick = 10 * time.Second
+	// MissedDoseLookback é até quando, depois do fim da janela de confirmação, uma toma por
+	// confirmar levanta o alerta
+	MissedDoseLookback = 12 * time.Hour
+	// LowStockPills é o número de comprimidos de um medicamento abaixo do qual o dropper alerta
+	LowStockPills = 3
+)
+
+// NotificationChannels são os canais que o utilizador pode escolher
+var NotificationChannels = []string{notify.ChannelEmail, notify.ChannelSMS, notify.ChannelPush}
+
+// AlertKinds são os tipos de alerta que o utilizador pode silenciar
+var AlertKinds = []string{AlertDoseLimit, AlertMissedDose, AlertLowStock, AlertDeviceOffline}
+
+// notificationChannels envia as notificações, definido por SetNotificationChannels. As
+// notificações de canais não configurados não são criadas.
+var notificationChannels = map[string]notify.Channel{}
+
+// SetNotificationChannels define os canais usados no envio das notificações
+func SetNotificationChannels(channels map[string]notify.Channel) {
+	notificationChannels = channels
+}
+
+// NotificationPreference são os canais por onde o utilizador recebe os alertas, o idioma e as
+// horas de silêncio. Sem preferências guardadas os alertas são enviados por email, em português.
+type NotificationPreference struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	UserID uint `gorm:"uniqueIndex;not null" json:"-"`
+
+	Channels  []string `gorm:"serializer:json" json:"channels"`
+	Phone     string   `json:"phone"`
+	PushToken string   `json:"push_token"`
+	Language  string   `gorm:"not null;default:pt" json:"language"`
+	TimeZone  string   `gorm:"not null;default:UTC" json:"time_zone"`
+	// Horas de silêncio, HH:MM na hora local, vazias se não existirem
+	QuietStart string `json:"quiet_start"`
+	QuietEnd   string `json:"quiet_end"`
+	// Tipos de alerta que não são notificados
+	Muted []string `gorm:"serializer:json" json:"muted"`
+}
+
+// NotificationPreferenceFields são as alterações às preferências, os campos nil não mudam
+type NotificationPreferenceFields struct {
+	Channels   []string
+	Phone      *string
+	PushToken  *string
+	Language   *string
+	TimeZone   *string
+	QuietStart *string
+	QuietEnd   *string
+	Muted      []string
+}
+
+// Notification é uma notificação de um alerta a um utilizador num canal e o resultado do envio
+type Notification struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	TenantID uint  `gorm:"index;not null" json:"-"`
+	UserID   uint  `gorm:"index:idx_notification_dedup;not null" json:"user_id"`
+	AlertID  *uint `gorm:"index" json:"alert_id"`
+
+	Kind    string `gorm:"not null" json:"kind"`
+	Channel string `gorm:"index:idx_notification_dedup;not null" json:"channel"`
+	Address string `gorm:"not null" json:"address"`
+	// Identifica o alerta para a deduplicação
+	DedupKey string `gorm:"index:idx_notification_dedup;not null" json:"-"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+
+	Status   string `gorm:"index;not null" json:"status"`
+	Attempts int    `gorm:"not null" json:"attempts"`
+	// Hora a partir da qual a notificação é enviada, depois das horas de silêncio
+	SendAt time.Time  `gorm:"index;not null" json:"send_at"`
+	SentAt *time.Time `json:"sent_at"`
+	Error  string     `json:"error,omitempty"`
+}
+
+func defaultNotificationPreference(userID uint) NotificationPreference {
+	return NotificationPreference{
+		UserID:   userID,
+		Channels: []string{notify.ChannelEmail},
+		Language: notify.LangPT,
+		TimeZone: "UTC",
+		Muted:    []string{},
+	}
+}
+
+// apply valida e copia os campos definidos para as preferências
+func (f NotificationPreferenceFields) apply(p *NotificationPreference) error {
+	if f.Channels != nil {
+		channels := make([]string, 0, len(f.Channels))
+		for _, channel := range f.Channels {
+			if !slices.Contains(NotificationChannels, channel) {
+				return ErrInvalidNotificationPreference
+			}
+			if !slices.Contains(channels, channel) {
+				channels = append(channels, channel)
+			}
+		}
+		p.Channels = channels
+	}
+	if f.Phone != nil {
+		p.Phone = *f.Phone
+	}
+	if f.PushToken != nil {
+		p.PushToken = *f.PushToken
+	}
+	if f.Language != nil {
+		if *f.Language != notify.LangPT && *f.Language != notify.LangEN {
+			return ErrInvalidNotificationPreference
+		}
+		p.Language = *f.Language
+	}
+	if f.TimeZone != nil {
+		if _, err := time.LoadLocation(*f.TimeZone); err != nil || *f.TimeZone == "" {
+			return ErrInvalidTimeZone
+		}
+		p.TimeZone = *f.TimeZone
+	}
+	if f.QuietStart != nil {
+		p.QuietStart = *f.QuietStart
+	}
+	if f.QuietEnd != nil {
+		p.QuietEnd = *f.QuietEnd
+	}
+	if f.Muted != nil {
+		for _, kind := range f.Muted {
+			if !slices.Contains(AlertKinds, kind) {
+				return ErrInvalidNotificationPreference
+			}
+		}
+		p.Muted = f.Muted
+	}
+	return p.validate()
+}
+
+// validate confirma que os canais escolhidos têm endereço e que as horas de silêncio estão completas
+func (p *NotificationPreference) validate() error {
+	if slices.Contains(p.Channels, notify.ChannelSMS) && p.Phone == "" {
+		return ErrInvalidNotificationPreference
+	}
+	if slices.Contains(p.Channels, notify.ChannelPush) && p.PushToken == "" {
+		return ErrInvalidNotificationPreference
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return ErrInvalidNotificationPreference
+	}
+	if p.QuietStart != "" {
+		if _, err := notify.ParseClock(p.QuietStart); err != nil {
+			return ErrInvalidNotificationPreference
+		}
+		if _, err := notify.ParseClock(p.QuietEnd); err != nil {
+			return ErrInvalidNotificationPreference
+		}
+	}
+	return nil
+}
+
+// quietHours devolve as horas de silêncio, vazias se não estiverem definidas
+func (p *NotificationPreference) quietHours() notify.QuietHours {
+	start, err := notify.ParseClock(p.QuietStart)
+	if err != nil {
+		return notify.QuietHours{}
+	}
+	end, err := notify.ParseClock(p.QuietEnd)
+	if err != nil {
+		return notify.QuietHours{}
+	}
+	return notify.QuietHours{Start: start, End: end}
+}
+
+func (p *NotificationPreference) location() *time.Location {
+	location, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// address devolve o endereço do utilizador no canal
+func (p *NotificationPreference) address(channel string, user *User) string {
+	switch channel {
+	case notify.ChannelEmail:
+		return user.Email
+	case notify.ChannelSMS:
+		return p.Phone
+	case notify.ChannelPush:
+		return p.PushToken
+	}
+	return ""
+}
+
+// FindNotificationPreference devolve as preferências do utilizador, ou as preferências por omissão
+func FindNotificationPreference(db *gorm.DB, userID uint) (*NotificationPreference, error) {
+	preference := defaultNotificationPreference(userID)
+
+	err := db.First(&preference, "user_id = ?", userID).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &preference, nil
+}
+
+// Update altera as preferências do utilizador, guardando-as na primeira alteração
+func (p *NotificationPreference) Update(db *gorm.DB, fields NotificationPreferenceFields) error {
+	if err := fields.apply(p); err != nil {
+		return err
+	}
+
+	if err := db.Save(p).Error; err != nil {
+		log.Printf("Erro inesperado ao alterar preferências de notificação: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// ListNotifications devolve uma página das notificações enviadas ao utilizador
+func ListNotifications(db *gorm.DB, userID uint, options ListOptions) ([]Notification, int64, error) {
+	list := make([]Notification, 0)
+
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	query := db.Model(&Notification{}).Where("user_id = ?", userID)
+	total, err := options.find(query, &list, "created_at", "send_at")
+
+	return list, total, err
+}
+
+// dedupKey identifica o alerta: o tipo, o que o originou e a mensagem
+func (a *Alert) dedupKey() string {
+	id := func(value *uint) uint {
+		if value == nil {
+			return 0
+		}
+		return *value
+	}
+	key := fmt.Sprintf("%s|%d|%d|%d|%d|%s", a.Kind, id(a.DropperID), id(a.PatientID), id(a.ScheduleID), id(a.DoseID), a.Message)
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// alertRecipients devolve os utilizadores que confirmam os alertas: os do tenant com essa
+// permissão e os que a têm no dropper do alerta
+func alertRecipients(db *gorm.DB, alert *Alert) ([]User, error) {
+	roles := make([]Role, 0)
+	for role := range rolePermissions {
+		if role.Can(PermAckAlerts) {
+			roles = append(roles, role)
+		}
+	}
+
+	users := make([]User, 0)
+	query := db.Where("tenant_id = ? and role in ?", alert.TenantID, roles)
+	if alert.DropperID != nil {
+		granted := db.Model(&DropperGrant{}).Select("user_id").Where("dropper_id = ? and role in ?", *alert.DropperID, roles)
+		query = db.Where("(tenant_id = ? and role in ?) or id in (?)", alert.TenantID, roles, granted)
+	}
+	err := query.Order("id").Find(&users).Error
+	return users, err
+}
+
+// notificationData reúne os nomes do dropper e do paciente do alerta para os modelos
+func notificationData(db *gorm.DB, alert *Alert) notify.Data {
+	data := notify.Data{Message: alert.Message, Details: alert.Details}
+	if alert.DropperID != nil {
+		var dropper Dropper
+		if db.Unscoped().Select("id", "name").First(&dropper, *alert.DropperID).Error == nil {
+			data.Dropper = dropper.Name
+		}
+	}
+	if alert.PatientID != nil {
+		var patient Patient
+		if db.Unscoped().Select("id", "name").First(&patient, *alert.PatientID).Error == nil {
+			data.Patient = patient.Name
+		}
+	}
+	return data
+}
+
+// notifyAlert põe na fila as notificações do alerta, nos canais e no idioma de cada
+// destinatário. As notificações esperam pelo fim das horas de silêncio e não são repetidas
+// se o mesmo alerta já foi notificado no canal há menos de NotificationDedupWindow.
+func notifyAlert(db *gorm.DB, alert *Alert, now time.Time) error {
+	if len(notificationChannels) == 0 {
+		return nil
+	}
+
+	users, err := alertRecipients(db, alert)
+	if err != nil || len(users) == 0 {
+		return err
+	}
+	ids := make([]uint, len(users))
+	for i := range users {
+		ids[i] = users[i].ID
+	}
+	stored := make([]NotificationPreference, 0)
+	if err := db.Where("user_id in ?", ids).Find(&stored).Error; err != nil {
+		return err
+	}
+	preferences := make(map[uint]NotificationPreference, len(stored))
+	for _, preference := range stored {
+		preferences[preference.UserID] = preference
+	}
+
+	data := notificationData(db, alert)
+	key := alert.dedupKey()
+	for i := range users {
+		user := &users[i]
+		preference, ok := preferences[user.ID]
+		if !ok {
+			preference = defaultNotificationPreference(user.ID)
+		}
+		if slices.Contains(preference.Muted, alert.Kind) {
+			continue
+		}
+
+		location := preference.location()
+		data.Time = alert.CreatedAt.In(location).Format("15:04")
+		subject, body, err := notify.Render(alert.Kind, preference.Language, data)
+		if err != nil {
+			return err
+		}
+		sendAt := preference.quietHours().Until(now.In(location)).UTC()
+
+		for _, channel := range preference.Channels {
+			address := preference.address(channel, user)
+			if _, ok := notificationChannels[channel]; !ok || address == "" {
+				continue
+			}
+
+			var duplicates int64
+			err := db.Model(&Notification{}).
+				Where("user_id = ? and channel = ? and dedup_key = ? and created_at > ?", user.ID, channel, key, now.Add(-NotificationDedupWindow)).
+				Count(&duplicates).
+				Error
+			if err != nil {
+				return err
+			}
+			if duplicates > 0 {
+				continue
+			}
+
+			notification := Notification{
+				TenantID: alert.TenantID,
+				UserID:   user.ID,
+				AlertID:  &alert.ID,
+				Kind:     alert.Kind,
+				Channel:  channel,
+				Address:  address,
+				DedupKey: key,
+				Subject:  subject,
+				Body:     body,
+				Status:   NotificationPending,
+				SendAt:   sendAt,
+			}
+			if err := db.Create(&notification).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// send envia a notificação pelo seu canal. Se falhar é repetida depois de NotificationRetry,
+// até NotificationMaxAttempts tentativas.
+func (n *Notification) send(channel notify.Channel, now time.Time) {
+	n.Attempts++
+
+	err := notify.ErrNoChannel
+	if channel != nil {
+		err = channel.Send(context.Background(), notify.Message{Kind: n.Kind, To: n.Address, Subject: n.Subject, Body: n.Body})
+	}
+
+	switch {
+	case err == nil:
+		n.Status, n.Error, n.SentAt = NotificationSent, "", &now
+	case n.Attempts >= NotificationMaxAttempts || channel == nil:
+		n.Status, n.Error = NotificationFailed, err.Error()
+	default:
+		n.Error, n.SendAt = err.Error(), now.Add(NotificationRetry)
+	}
+}
+
+// SendNotifications envia as notificações pendentes até now
+func SendNotifications(db *gorm.DB, now time.Time) error {
+	for {
+		sent := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var notification Notification
+			err := tx.
+				Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? and send_at <= ?", NotificationPending, now).
+				Order("send_at").
+				First(&notification).
+				Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			sent = true
+
+			notification.send(notificationChannels[notification.Channel], now)
+			if notification.Status != NotificationSent {
+				log.Printf("Erro no envio da notificação <%d> por %s: %s", notification.ID, notification.Channel, notification.Error)
+			}
+			return tx.Model(&notification).
+				Select("status", "attempts", "send_at", "sent_at", "error").
+				Updates(&notification).
+				Error
+		})
+		if err != nil {
+			log.Printf("Erro ao enviar notificações: %s", err.Error())
+			return err
+		}
+		if !sent {
+			return nil
+		}
+	}
+}
+
+// RaiseMissedDoseAlerts levanta um alerta para cada toma dispensada cuja janela de confirmação
+// terminou, há menos de MissedDoseLookback, sem confirmação
+func RaiseMissedDoseAlerts(db *gorm.DB, now time.Time) error {
+	records := make([]DispenseRecord, 0)
+	err := db.
+		Where("status = ? and confirm_by <= ? and confirm_by > ?", DoseDispensed, now, now.Add(-MissedDoseLookback)).
+		Where("not exists (select 1 from dose_confirmations where dose_confirmations.dose_id = dispense_records.id)").
+		Where("not exists (select 1 from alerts where alerts.dose_id = dispense_records.id and alerts.kind = ?)", AlertMissedDose).
+		Find(&records).
+		Error
+	if err != nil {
+		return err
+	}
+
+	for i := range records {
+		record := &records[i]
+		var dropper Dropper
+		if err := db.Unscoped().Select("id", "tenant_id", "name").First(&dropper, record.DropperID).Error; err != nil {
+			return err
+		}
+		location := time.UTC
+		if record.PatientID != nil {
+			var patient Patient
+			if err := db.Unscoped().Select("id", "time_zone").First(&patient, *record.PatientID).Error; err == nil {
+				location = patient.Location()
+			}
+		}
+
+		due := record.DueAt.In(location).Format("15:04")
+		raiseAlert(db, Alert{
+			TenantID:   dropper.TenantID,
+			DropperID:  &dropper.ID,
+			PatientID:  record.PatientID,
+			ScheduleID: record.ScheduleID,
+			DoseID:     &record.ID,
+			Kind:       AlertMissedDose,
+			Message:    fmt.Sprintf("A toma das %s no dropper %s não foi confirmada", due, dropper.Name),
+			Details:    map[string]any{"due": due},
+		})
+	}
+	return nil
+}
+
+// checkLowStock levanta um alerta para cada medicamento dispensado cujos comprimidos no dropper
+// ficaram abaixo de LowStockPills com esta toma
+func checkLowStock(db *gorm.DB, tenantID uint, dropperID uint, pills PillList) {
+	for name, count := range pills {
+		var remaining int64
+		err := db.
+			Model(&Position{}).
+			Joins("join dropper_sections on dropper_sections.id = positions.dropper_section_id and dropper_sections.deleted_at is null").
+			Where("dropper_sections.dropper_id = ? and positions.empty = false and positions.pill_name = ?", dropperID, name).
+			Count(&remaining).
+			Error
+		if err != nil {
+			log.Printf("Erro ao verificar os comprimidos do dropper <%d>: %s", dropperID, err.Error())
+			return
+		}
+		if remaining >= LowStockPills || remaining+int64(count) < LowStockPills {
+			continue
+		}
+
+		raiseAlert(db, Alert{
+			TenantID:  tenantID,
+			DropperID: &dropperID,
+			Kind:      AlertLowStock,
+			Message:   fmt.Sprintf("Restam %d comprimidos de %s no dropper", remaining, name),
+			Details:   map[string]any{"pill": name, "remaining": remaining},
+		})
+	}
+}
+
+// NotificationBGJob corre a cada NotificationTick, levanta os alertas das tomas por confirmar
+// e envia as notificações pendentes
+func NotificationBGJob(db *gorm.DB) error {
+	time.Sleep(NotificationTick)
+
+	now := time.Now().UTC()
+	if err := RaiseMissedDoseAlerts(db, now); err != nil {
+		log.Printf("Erro ao procurar tomas por confirmar: %s", err.Error())
+		return err
+	}
+	return SendNotifications(db, now)
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/dropmedical/notify"
+)
+
+func TestNotificationPreferenceFields(t *testing.T) {
+	invalid := []NotificationPreferenceFields{
+		{Channels: []string{"fax"}},
+		{Channels: []string{notify.ChannelSMS}},
+		{Channels: []string{notify.ChannelPush}, Phone: strPtr("+351910000000")},
+		{Language: strPtr("fr")},
+		{QuietStart: strPtr("22:00")},
+		{QuietStart: strPtr("22:00"), QuietEnd: strPtr("7h")},
+		{Muted: []string{"unknown"}},
+	}
+	for _, fields := range invalid {
+		preference := defaultNotificationPreference(1)
+		if err := fields.apply(&preference); !errors.Is(err, ErrInvalidNotificationPreference) {
+			t.Errorf("Expected %+v to be invalid, got %v", fields, err)
+		}
+	}
+
+	preference := defaultNotificationPreference(1)
+	fields := NotificationPreferenceFields{
+		Channels:   []string{notify.ChannelEmail, notify.ChannelSMS, notify.ChannelSMS},
+		Phone:      strPtr("+351910000000"),
+		TimeZone:   strPtr("Europe/Lisbon"),
+		QuietStart: strPtr("22:00"),
+		QuietEnd:   strPtr("07:00"),
+		Muted:      []string{AlertLowStock},
+	}
+	if err := fields.apply(&preference); err != nil {
+		t.Fatal(err)
+	}
+	if len(preference.Channels) != 2 || preference.quietHours() != (notify.QuietHours{Start: 22 * 60, End: 7 * 60}) {
+		t.Fatalf("Unexpected preference %+v", preference)
+	}
+	user := User{Email: "cuidador@example.com"}
+	if preference.address(notify.ChannelEmail, &user) != user.Email || preference.address(notify.ChannelSMS, &user) != "+351910000000" {
+		t.Fatal("Unexpected channel addresses")
+	}
+}
+
+func TestAlertDedupKey(t *testing.T) {
+	dropper, first, second := uint(1), uint(10), uint(11)
+	offline := Alert{Kind: AlertDeviceOffline, DropperID: &dropper, Message: "O dropper Cozinha desligou-se"}
+	again := offline
+	again.ID = 2
+	if offline.dedupKey() != again.dedupKey() {
+		t.Fatal("The same alert should have the same key")
+	}
+
+	missed := Alert{Kind: AlertMissedDose, DropperID: &dropper, DoseID: &first}
+	other := Alert{Kind: AlertMissedDose, DropperID: &dropper, DoseID: &second}
+	if missed.dedupKey() == other.dedupKey() {
+		t.Fatal("Different doses should be notified separately")
+	}
+}
+
+// channelFunc é um canal de teste
+type channelFunc func(notify.Message) error
+
+func (f channelFunc) Send(ctx context.Context, message notify.Message) error {
+	return f(message)
+}
+
+func TestNotificationSend(t *testing.T) {
+	now := time.Now().UTC()
+	failing := channelFunc(func(notify.Message) error { return errors.New("servidor indisponível") })
+	notification := Notification{Kind: AlertLowStock, Address: "cuidador@example.com", Status: NotificationPending, SendAt: now}
+
+	notification.send(failing, now)
+	if notification.Status != NotificationPending || !notification.SendAt.Equal(now.Add(NotificationRetry)) {
+		t.Fatalf("Expected a retry, got %+v", notification)
+	}
+	for notification.Status == NotificationPending {
+		notification.send(failing, now)
+	}
+	if notification.Attempts != NotificationMaxAttempts || notification.Status != NotificationFailed {
+		t.Fatalf("Expected the notification to fail, got %+v", notification)
+	}
+
+	var received notify.Message
+	notification = Notification{Kind: AlertLowStock, Address: "cuidador@example.com", Subject: "Poucos comprimidos", Status: NotificationPending}
+	notification.send(channelFunc(func(m notify.Message) error { received = m; return nil }), now)
+	if notification.Status != NotificationSent || received.To != "cuidador@example.com" || received.Subject != "Poucos comprimidos" {
+		t.Fatalf("Unexpected delivery %+v %+v", notification, received)
+	}
+
+	notification = Notification{Status: NotificationPending}
+	if notification.send(nil, now); notification.Status != NotificationFailed || notification.Error != notify.ErrNoChannel.Error() {
+		t.Fatalf("Notifications of unconfigured channels should fail, got %+v", notification)
+	}
+}
@@ -0,0 +1,324 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPatientNotFound    = errors.New("paciente não encontrado")
+	ErrPatientNotLinked   = errors.New("o paciente não está associado a este dropper")
+	ErrInvalidTimeZone    = errors.New("fuso horário inválido")
+	ErrSameDropper        = errors.New("o dropper de substituição tem de ser diferente do atual")
+	ErrInvalidPatientData = errors.New("dados do paciente inválidos")
+)
+
+// Patient é a pessoa a quem se destinam os horários de dispensa.
+// Os horários ficam associados ao paciente e ao dropper, para que o paciente
+// mantenha o seu regime e histórico se mudar para outro dropper.
+type Patient struct {
+	ID        uint           `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+
+	TenantID uint `gorm:"index;not null" json:"-"`
+
+	Name      string     `gorm:"not null" json:"name"`
+	BirthDate *time.Time `json:"birth_date"`
+	Sex       string     `json:"sex"`
+	// Fuso horário IANA do paciente, ex: Europe/Lisbon
+	TimeZone  string   `gorm:"not null;default:UTC" json:"time_zone"`
+	Allergies []string `gorm:"serializer:json" json:"allergies"`
+	Notes     string   `json:"notes"`
+
+	Contacts []PatientContact `gorm:"constraint:OnDelete:CASCADE;" json:"contacts"`
+	Droppers []Dropper        `gorm:"many2many:patient_droppers;" json:"-"`
+}
+
+// PatientContact é uma pessoa a contactar em nome do paciente
+type PatientContact struct {
+	ID        uint `gorm:"primarykey" json:"id"`
+	PatientID uint `gorm:"index;not null" json:"-"`
+
+	Name         string `json:"name"`
+	Relationship string `json:"relationship"`
+	Phone        string `json:"phone"`
+	Email        string `json:"email"`
+	Primary      bool   `json:"primary"`
+}
+
+// PatientFields contêm os campos alteráveis de um paciente, campos nil não são alterados
+type PatientFields struct {
+	Name      *string
+	BirthDate *time.Time
+	Sex       *string
+	TimeZone  *string
+	Allergies []string
+	Notes     *string
+	// Substitui todos os contactos quando não é nil
+	Contacts []PatientContact
+}
+
+// apply valida e copia os campos definidos para o paciente
+func (f PatientFields) apply(p *Patient) error {
+	if f.Name != nil {
+		if *f.Name == "" {
+			return ErrInvalidPatientData
+		}
+		p.Name = *f.Name
+	}
+	if f.BirthDate != nil {
+		birth := f.BirthDate.UTC()
+		if birth.After(time.Now()) {
+			return ErrInvalidPatientData
+		}
+		p.BirthDate = &birth
+	}
+	if f.Sex != nil {
+		p.Sex = *f.Sex
+	}
+	if f.TimeZone != nil {
+		if _, err := time.LoadLocation(*f.TimeZone); err != nil || *f.TimeZone == "" {
+			return ErrInvalidTimeZone
+		}
+		p.TimeZone = *f.TimeZone
+	}
+	if f.Allergies != nil {
+		p.Allergies = f.Allergies
+	}
+	if f.Notes != nil {
+		p.Notes = *f.Notes
+	}
+	return nil
+}
+
+// Location devolve o fuso horário do paciente, UTC se não for válido
+func (p *Patient) Location() *time.Location {
+	location, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// CreatePatient cria um paciente no tenant
+func CreatePatient(db *gorm.DB, tenantID uint, fields PatientFields) (*Patient, error) {
+	patient := Patient{TenantID: tenantID, TimeZone: "UTC", Allergies: []string{}}
+	if fields.Name == nil {
+		return nil, ErrInvalidPatientData
+	}
+	if err := fields.apply(&patient); err != nil {
+		return nil, err
+	}
+	patient.Contacts = fields.Contacts
+
+	if err := db.Create(&patient).Error; err != nil {
+		log.Printf("Erro inesperado ao criar paciente: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &patient, nil
+}
+
+// FindPatient procura um paciente do tenant pelo seu id
+func FindPatient(db *gorm.DB, tenantID uint, id uint) (*Patient, error) {
+	var patient Patient
+
+	err := db.Preload("Contacts").First(&patient, "id = ? and tenant_id = ?", id, tenantID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPatientNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &patient, nil
+}
+
+// ListPatients devolve uma página dos pacientes do tenant
+func ListPatients(db *gorm.DB, tenantID uint, options ListOptions) ([]Patient, int64, error) {
+	patients := make([]Patient, 0)
+
+	// Os pacientes não têm estado ativo
+	options.Active = nil
+	total, err := options.find(
+		db.Model(&Patient{}).Preload("Contacts").Where("tenant_id = ?", tenantID),
+		&patients,
+		"name", "created_at", "updated_at",
+	)
+
+	return patients, total, err
+}
+
+// Update altera os dados do paciente
+func (p *Patient) Update(db *gorm.DB, fields PatientFields) error {
+	if err := fields.apply(p); err != nil {
+		return err
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Contacts", "Droppers").Save(p).Error; err != nil {
+			return err
+		}
+		if fields.Contacts == nil {
+			return nil
+		}
+
+		if err := tx.Where("patient_id = ?", p.ID).Delete(&PatientContact{}).Error; err != nil {
+			return err
+		}
+		p.Contacts = fields.Contacts
+		for i := range p.Contacts {
+			p.Contacts[i].ID = 0
+			p.Contacts[i].PatientID = p.ID
+		}
+		if len(p.Contacts) == 0 {
+			return nil
+		}
+		return tx.Create(&p.Contacts).Error
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao alterar paciente: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// Delete remove o paciente e revoga os seus calendários. Os seus horários continuam no dropper,
+// sem paciente associado, mas são desativados.
+func (p *Patient) Delete(db *gorm.DB) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&DispenseSchedule{}).
+			Where("patient_id = ?", p.ID).
+			Updates(map[string]any{"patient_id": nil, "active": false}).
+			Error
+		if err != nil {
+			return err
+		}
+		if err := revokeCalendarFeeds(tx, tx.Where("patient_id = ?", p.ID)); err != nil {
+			return err
+		}
+		if err := tx.Model(p).Association("Droppers").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(p).Error
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao remover paciente: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// ListDroppers devolve os droppers associados ao paciente
+func (p *Patient) ListDroppers(db *gorm.DB) ([]Dropper, error) {
+	droppers := make([]Dropper, 0)
+
+	if err := db.Model(p).Order("id").Association("Droppers").Find(&droppers); err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return droppers, nil
+}
+
+// LinkDropper associa o dropper ao paciente
+func (p *Patient) LinkDropper(db *gorm.DB, d *Dropper) error {
+	if err := db.Model(p).Omit("Droppers.*").Association("Droppers").Append(d); err != nil {
+		log.Printf("Erro inesperado ao associar dropper: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// UnlinkDropper desassocia o dropper do paciente. Os horários do paciente nesse dropper são desativados.
+func (p *Patient) UnlinkDropper(db *gorm.DB, d *Dropper) error {
+	linked, err := p.linkedTo(db, d.ID)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		return ErrPatientNotLinked
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&DispenseSchedule{}).
+			Where("patient_id = ? and dropper_id = ?", p.ID, d.ID).
+			Update("active", false).
+			Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(p).Association("Droppers").Delete(d)
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao desassociar dropper: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+func (p *Patient) linkedTo(db *gorm.DB, dropperID uint) (bool, error) {
+	var count int64
+
+	err := db.Table("patient_droppers").Where("patient_id = ? and dropper_id = ?", p.ID, dropperID).Count(&count).Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return false, ErrUnexpectedError
+	}
+	return count > 0, nil
+}
+
+// ListSchedules devolve uma página dos horários do paciente, em todos os seus droppers
+func (p *Patient) ListSchedules(db *gorm.DB, options ListOptions) ([]DispenseSchedule, int64, error) {
+	schedules := make([]DispenseSchedule, 0)
+
+	total, err := options.find(
+		db.Model(&DispenseSchedule{}).Where("patient_id = ?", p.ID),
+		&schedules,
+		"name", "active", "start_date", "end_date", "created_at",
+	)
+
+	return schedules, total, err
+}
+
+// MoveToDropper passa os horários do paciente do dropper atual para um dropper de substituição,
+// mantendo os horários e o seu histórico. O paciente fica associado apenas ao novo dropper.
+func (p *Patient) MoveToDropper(db *gorm.DB, from, to *Dropper) (moved int64, err error) {
+	if from.ID == to.ID {
+		return 0, ErrSameDropper
+	}
+	linked, err := p.linkedTo(db, from.ID)
+	if err != nil {
+		return 0, err
+	}
+	if !linked {
+		return 0, ErrPatientNotLinked
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&DispenseSchedule{}).
+			Where("patient_id = ? and dropper_id = ?", p.ID, from.ID).
+			Update("dropper_id", to.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		moved = result.RowsAffected
+
+		if err := tx.Model(p).Omit("Droppers.*").Association("Droppers").Append(to); err != nil {
+			return err
+		}
+		return tx.Model(p).Association("Droppers").Delete(from)
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// O dropper de substituição já tem um horário com o mesmo nome
+		return 0, ErrScheduleExists
+	} else if err != nil {
+		log.Printf("Erro inesperado ao mudar de dropper: %s", err.Error())
+		return 0, ErrUnexpectedError
+	}
+
+	log.Printf("Paciente <%d> mudou do dropper <%d> para <%d> com %d horários", p.ID, from.ID, to.ID, moved)
+	return moved, nil
+}
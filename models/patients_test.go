@@ -0,0 +1,38 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPatientFields(t *testing.T) {
+	name, zone := "Maria", "Europe/Lisbon"
+	patient := Patient{TimeZone: "UTC"}
+
+	err := PatientFields{Name: &name, TimeZone: &zone, Allergies: []string{"penicilina"}}.apply(&patient)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if patient.Name != name || patient.Location().String() != zone || len(patient.Allergies) != 1 {
+		t.Fatalf("Fields were not applied: %+v", patient)
+	}
+
+	invalid := "Europe/Atlantis"
+	if err := (PatientFields{TimeZone: &invalid}).apply(&patient); !errors.Is(err, ErrInvalidTimeZone) {
+		t.Fatalf("Expected an invalid time zone, got %v", err)
+	}
+	if patient.TimeZone != zone {
+		t.Fatal("An invalid time zone should not replace the previous one")
+	}
+
+	future := time.Now().Add(24 * time.Hour)
+	if err := (PatientFields{BirthDate: &future}).apply(&patient); !errors.Is(err, ErrInvalidPatientData) {
+		t.Fatalf("Expected invalid patient data for a birth date in the future, got %v", err)
+	}
+
+	empty := ""
+	if err := (PatientFields{Name: &empty}).apply(&patient); !errors.Is(err, ErrInvalidPatientData) {
+		t.Fatalf("Expected invalid patient data for an empty name, got %v", err)
+	}
+}
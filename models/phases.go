@@ -0,0 +1,159 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidPhases      = errors.New("as fases do horário têm de ser contíguas e cobrir todo o horário")
+	ErrPhasesWithoutPills = errors.New("um horário sem fases precisa de comprimidos")
+)
+
+// SchedulePhase é um período de um horário com uma dose própria, ex: nos desmames de corticoides
+// 4 comprimidos durante 3 dias, depois 3 durante 3 dias. As fases de um horário são ordenadas,
+// contíguas e cobrem o horário do início ao fim.
+type SchedulePhase struct {
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+	// Comprimidos de cada toma durante a fase, vazio suspende as tomas
+	Pills PillList `json:"pills"`
+}
+
+// Duration é a duração da fase
+func (p SchedulePhase) Duration() time.Duration {
+	return p.EndDate.Sub(p.StartDate)
+}
+
+// PhaseError indica a fase inválida e o campo que a invalida
+type PhaseError struct {
+	Index int
+	Field string
+	// Código do problema: contiguous, after_start ou span
+	Code string
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("fase %d inválida: %s %s", e.Index, e.Field, e.Code)
+}
+
+func (e *PhaseError) Is(target error) bool {
+	return target == ErrInvalidPhases
+}
+
+// validPhases confirma que as fases começam em start, terminam em end e são contíguas
+func validPhases(start, end time.Time, phases []SchedulePhase) error {
+	previous := start
+	for i, phase := range phases {
+		if !phase.StartDate.Equal(previous) {
+			return &PhaseError{Index: i, Field: "start_date", Code: "contiguous"}
+		}
+		if !phase.EndDate.After(phase.StartDate) {
+			return &PhaseError{Index: i, Field: "end_date", Code: "after_start"}
+		}
+		previous = phase.EndDate
+	}
+	if len(phases) > 0 && !previous.Equal(end) {
+		return &PhaseError{Index: len(phases) - 1, Field: "end_date", Code: "span"}
+	}
+	return nil
+}
+
+// setPhases valida e guarda as fases do horário, em UTC. Horários com fases não têm
+// comprimidos próprios e não podem ser em SOS.
+func (s *DispenseSchedule) setPhases(phases []SchedulePhase, pills PillList) error {
+	if len(phases) == 0 {
+		s.Phases = nil
+		return nil
+	}
+	if len(pills) > 0 || s.Kind == ScheduleKindPRN {
+		return ErrInvalidPhases
+	}
+
+	normalized := make([]SchedulePhase, len(phases))
+	for i, phase := range phases {
+		normalized[i] = SchedulePhase{StartDate: phase.StartDate.UTC(), EndDate: phase.EndDate.UTC(), Pills: phase.Pills}
+	}
+	if err := validPhases(s.StartDate, s.EndDate, normalized); err != nil {
+		return err
+	}
+	s.Phases = normalized
+	return nil
+}
+
+// phaseAt devolve a fase em que t se encontra, o fim da última fase é inclusive
+func (s *DispenseSchedule) phaseAt(t time.Time) *SchedulePhase {
+	for i := range s.Phases {
+		phase := &s.Phases[i]
+		last := i == len(s.Phases)-1
+		if !t.Before(phase.StartDate) && (t.Before(phase.EndDate) || (last && t.Equal(phase.EndDate))) {
+			return phase
+		}
+	}
+	return nil
+}
+
+// PillsAt devolve os comprimidos da toma prevista para due, os da fase nos horários por fases
+func (s *DispenseSchedule) PillsAt(db *gorm.DB, due time.Time) (PillList, error) {
+	if len(s.Phases) == 0 {
+		return s.Pills(db)
+	}
+	if phase := s.phaseAt(due); phase != nil {
+		return phase.Pills, nil
+	}
+	return PillList{}, nil
+}
+
+// dosePills devolve os comprimidos usados nas verificações de interações e limites. Nos horários
+// por fases é cada comprimido das fases com a maior quantidade por toma.
+func (s *DispenseSchedule) dosePills(pills PillList) PillList {
+	if len(s.Phases) == 0 {
+		return pills
+	}
+
+	largest := make(PillList)
+	for _, phase := range s.Phases {
+		for name, count := range phase.Pills {
+			largest[name] = max(largest[name], count)
+		}
+	}
+	return largest
+}
+
+// maxAmounts devolve, pelo nome em minúsculas, a quantidade máxima de cada comprimido dispensada
+// pelo horário em qualquer janela de duração window. Nos horários por fases a dose varia por
+// patamares, por isso o máximo está numa janela que começa ou acaba num limite de fase.
+func (s *DispenseSchedule) maxAmounts(pills PillList, window time.Duration) map[string]uint {
+	amounts := make(map[string]uint)
+
+	if len(s.Phases) == 0 {
+		occurrences := s.maxOccurrences(window)
+		for name, count := range pills {
+			if count > 0 {
+				amounts[strings.ToLower(name)] += uint(count) * occurrences
+			}
+		}
+		return amounts
+	}
+
+	for _, phase := range s.Phases {
+		for _, from := range []time.Time{phase.StartDate, phase.EndDate.Add(-window)} {
+			inWindow := make(map[string]uint)
+			for _, due := range s.Occurrences(from, from.Add(window)) {
+				for name, count := range s.phaseAt(due).Pills {
+					if count > 0 {
+						inWindow[strings.ToLower(name)] += uint(count)
+					}
+				}
+			}
+			for name, total := range inWindow {
+				amounts[name] = max(amounts[name], total)
+			}
+		}
+	}
+	return amounts
+}
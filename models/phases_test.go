@@ -0,0 +1,81 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// taper é um desmame de 4, 3, 2 e 1 comprimidos, 3 dias cada, uma toma por dia
+func taper(start time.Time) DispenseSchedule {
+	day := 24 * time.Hour
+	phases := make([]SchedulePhase, 0, 4)
+	for i := 0; i < 4; i++ {
+		phases = append(phases, SchedulePhase{
+			StartDate: start.Add(time.Duration(i) * 3 * day),
+			EndDate:   start.Add(time.Duration(i+1) * 3 * day),
+			Pills:     PillList{"Prednisolona": 4 - i},
+		})
+	}
+	return DispenseSchedule{StartDate: start, EndDate: start.Add(12 * day), Interval: day, Phases: phases}
+}
+
+func TestSchedulePhases(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	schedule := taper(start)
+
+	if err := validPhases(schedule.StartDate, schedule.EndDate, schedule.Phases); err != nil {
+		t.Fatalf("The taper should be valid: %s", err)
+	}
+
+	counts := make([]int, 0)
+	for _, due := range schedule.Occurrences(start, schedule.EndDate.Add(time.Hour)) {
+		counts = append(counts, schedule.phaseAt(due).Pills["Prednisolona"])
+	}
+	expected := []int{4, 4, 4, 3, 3, 3, 2, 2, 2, 1, 1, 1, 1}
+	if len(counts) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, counts)
+		}
+	}
+
+	if largest := schedule.dosePills(nil); largest["Prednisolona"] != 4 {
+		t.Fatalf("Expected the largest dose to be 4, got %v", largest)
+	}
+	// A semana com mais comprimidos é a primeira: 3x4 + 3x3 + 1x2
+	if weekly := schedule.maxAmounts(nil, 7*24*time.Hour); weekly["prednisolona"] != 23 {
+		t.Fatalf("Expected 23 pills in the heaviest week, got %d", weekly["prednisolona"])
+	}
+
+	// Uma fase sem comprimidos suspende as tomas
+	schedule.Phases[1].Pills = PillList{}
+	if occurrences := schedule.Occurrences(start, schedule.EndDate); len(occurrences) != 9 {
+		t.Fatalf("Expected 9 doses with a pause, got %d", len(occurrences))
+	}
+}
+
+func TestSchedulePhasesContiguous(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+
+	gap := taper(start)
+	gap.Phases[2].StartDate = gap.Phases[2].StartDate.Add(time.Hour)
+	var phaseErr *PhaseError
+	err := validPhases(gap.StartDate, gap.EndDate, gap.Phases)
+	if !errors.As(err, &phaseErr) || phaseErr.Index != 2 || phaseErr.Code != "contiguous" || !errors.Is(err, ErrInvalidPhases) {
+		t.Fatalf("Expected phase 2 not to be contiguous, got %v", err)
+	}
+
+	short := taper(start)
+	short.EndDate = short.EndDate.Add(24 * time.Hour)
+	if err := validPhases(short.StartDate, short.EndDate, short.Phases); !errors.As(err, &phaseErr) || phaseErr.Code != "span" {
+		t.Fatalf("Expected the phases not to cover the schedule, got %v", err)
+	}
+
+	mixed := taper(start)
+	if err := mixed.setPhases(mixed.Phases, PillList{"Prednisolona": 1}); !errors.Is(err, ErrInvalidPhases) {
+		t.Fatalf("Phases and pills should be exclusive, got %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPrescriptionNotFound = errors.New("receita não encontrada")
+	ErrInvalidPrescription  = errors.New("dados da receita inválidos")
+	ErrPrescriptionInactive = errors.New("a receita foi cancelada ou já terminou")
+)
+
+// Prescription é a receita de um medicamento para um paciente. Os horários de dispensa são
+// gerados a partir dela e regenerados sempre que é alterada, mantendo a ligação à receita
+// para que cada toma possa ser seguida até à sua origem.
+type Prescription struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	TenantID  uint `gorm:"index;not null" json:"-"`
+	PatientID uint `gorm:"index;not null" json:"patient_id"`
+	// Dropper onde os horários da receita são criados
+	DropperID uint `gorm:"index;not null" json:"-"`
+
+	// Nome do comprimido, igual ao usado nas secções do dropper
+	Medication string `gorm:"not null" json:"medication"`
+	// Comprimidos por toma
+	Dose uint `gorm:"not null" json:"dose"`
+	// Tempo entre tomas
+	Frequency time.Duration `gorm:"not null" json:"frequency"`
+	StartDate time.Time     `gorm:"not null" json:"start_date"`
+	// Duração do tratamento a partir de StartDate
+	Duration         time.Duration `gorm:"not null" json:"duration"`
+	Prescriber       string        `json:"prescriber"`
+	RefillsRemaining uint          `json:"refills_remaining"`
+	Instructions     string        `json:"instructions"`
+
+	// Incrementada a cada alteração que regenera os horários
+	Revision uint `gorm:"not null;default:1" json:"revision"`
+	Active   bool `gorm:"not null;default:true" json:"active"`
+
+	Schedules []DispenseSchedule `gorm:"constraint:OnDelete:SET NULL;" json:"-"`
+}
+
+// PrescriptionFields contêm os campos alteráveis de uma receita, campos nil não são alterados
+type PrescriptionFields struct {
+	Medication       *string
+	Dose             *uint
+	Frequency        *time.Duration
+	StartDate        *time.Time
+	Duration         *time.Duration
+	Prescriber       *string
+	RefillsRemaining *uint
+	Instructions     *string
+	// Necessário para gerar o horário se tiver interações graves
+	Override *Override
+}
+
+// apply valida e copia os campos definidos para a receita. Devolve verdadeiro se
+// algum dos campos que definem os horários foi alterado.
+func (f PrescriptionFields) apply(p *Prescription) (regenerate bool, err error) {
+	if f.Medication != nil {
+		if *f.Medication == "" {
+			return false, ErrInvalidPrescription
+		}
+		regenerate = regenerate || *f.Medication != p.Medication
+		p.Medication = *f.Medication
+	}
+	if f.Dose != nil {
+		if *f.Dose < 1 {
+			return false, ErrInvalidPrescription
+		}
+		regenerate = regenerate || *f.Dose != p.Dose
+		p.Dose = *f.Dose
+	}
+	if f.Frequency != nil {
+		if *f.Frequency < MinScheduleInterval {
+			return false, ErrInvalidPrescription
+		}
+		regenerate = regenerate || *f.Frequency != p.Frequency
+		p.Frequency = *f.Frequency
+	}
+	if f.StartDate != nil {
+		if f.StartDate.IsZero() {
+			return false, ErrInvalidPrescription
+		}
+		regenerate = regenerate || !f.StartDate.Equal(p.StartDate)
+		p.StartDate = f.StartDate.UTC()
+	}
+	if f.Duration != nil {
+		if *f.Duration <= 0 {
+			return false, ErrInvalidPrescription
+		}
+		regenerate = regenerate || *f.Duration != p.Duration
+		p.Duration = *f.Duration
+	}
+	if f.Prescriber != nil {
+		p.Prescriber = *f.Prescriber
+	}
+	if f.RefillsRemaining != nil {
+		p.RefillsRemaining = *f.RefillsRemaining
+	}
+	if f.Instructions != nil {
+		regenerate = regenerate || *f.Instructions != p.Instructions
+		p.Instructions = *f.Instructions
+	}
+	return regenerate, nil
+}
+
+// EndDate é a data da última toma possível da receita
+func (p *Prescription) EndDate() time.Time {
+	return p.StartDate.Add(p.Duration)
+}
+
+// scheduleSpec gera o horário da revisão atual da receita com as tomas a partir de from.
+// As tomas mantêm-se alinhadas com StartDate. Devolve falso se já não houver tomas.
+func (p *Prescription) scheduleSpec(from time.Time) (ScheduleSpec, bool) {
+	start := p.StartDate.UTC()
+	if from.After(start) {
+		steps := (from.Sub(start) + p.Frequency - 1) / p.Frequency
+		start = start.Add(steps * p.Frequency)
+	}
+	if start.After(p.EndDate()) {
+		return ScheduleSpec{}, false
+	}
+
+	return ScheduleSpec{
+		Name:           fmt.Sprintf("Receita %d v%d: %s", p.ID, p.Revision, p.Medication),
+		Active:         true,
+		Description:    p.Instructions,
+		Start:          start,
+		End:            p.EndDate(),
+		Interval:       p.Frequency,
+		Pills:          PillList{p.Medication: int(p.Dose)},
+		PatientID:      &p.PatientID,
+		PrescriptionID: &p.ID,
+	}, true
+}
+
+// generateSchedule cria no dropper o horário da revisão atual da receita
+func (p *Prescription) generateSchedule(tx *gorm.DB, from time.Time, override *Override) error {
+	spec, ok := p.scheduleSpec(from)
+	if !ok {
+		return nil
+	}
+	spec.Override = override
+
+	dropper := Dropper{Model: gorm.Model{ID: p.DropperID}}
+	_, err := dropper.CreateDispenseSchedule(tx, spec)
+	return err
+}
+
+// stopSchedules desativa os horários da receita, terminando-os em now se ainda não tiverem terminado
+func (p *Prescription) stopSchedules(tx *gorm.DB, now time.Time) error {
+	err := tx.Model(&DispenseSchedule{}).
+		Where("prescription_id = ? and end_date > ?", p.ID, now).
+		Update("end_date", now).
+		Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&DispenseSchedule{}).Where("prescription_id = ?", p.ID).Update("active", false).Error
+}
+
+// CreatePrescription cria a receita do paciente e gera o seu horário no dropper,
+// ao qual o paciente tem de estar associado
+func CreatePrescription(db *gorm.DB, patient *Patient, dropper *Dropper, fields PrescriptionFields) (*Prescription, error) {
+	if fields.Medication == nil || fields.Dose == nil || fields.Frequency == nil ||
+		fields.StartDate == nil || fields.Duration == nil {
+		return nil, ErrInvalidPrescription
+	}
+
+	prescription := Prescription{
+		TenantID:  patient.TenantID,
+		PatientID: patient.ID,
+		DropperID: dropper.ID,
+		Revision:  1,
+		Active:    true,
+	}
+	if _, err := fields.apply(&prescription); err != nil {
+		return nil, err
+	}
+
+	linked, err := patient.linkedTo(db, dropper.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !linked {
+		return nil, ErrPatientNotLinked
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Schedules").Create(&prescription).Error; err != nil {
+			return err
+		}
+		return prescription.generateSchedule(tx, time.Now().UTC(), fields.Override)
+	})
+	if errors.Is(err, ErrDoseLimitExceeded) {
+		// O horário recusado dentro da transação deixou o alerta para depois de desfeita
+		raiseLimitAlert(db, prescription.TenantID, dropper.ID, &patient.ID, nil, err)
+		return nil, err
+	} else if errors.Is(err, ErrScheduleExists) || errors.Is(err, ErrSevereInteraction) || errors.Is(err, ErrIntervalTooShort) {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao criar receita: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("Receita <%d> criada para o paciente <%d>", prescription.ID, patient.ID)
+	return &prescription, nil
+}
+
+// FindPrescription procura uma receita do tenant pelo seu id
+func FindPrescription(db *gorm.DB, tenantID uint, id uint) (*Prescription, error) {
+	var prescription Prescription
+
+	err := db.First(&prescription, "id = ? and tenant_id = ?", id, tenantID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPrescriptionNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &prescription, nil
+}
+
+// ListPrescriptions devolve uma página das receitas do paciente
+func (p *Patient) ListPrescriptions(db *gorm.DB, options ListOptions) ([]Prescription, int64, error) {
+	prescriptions := make([]Prescription, 0)
+
+	query := db.Model(&Prescription{}).Where("patient_id = ?", p.ID)
+	// As receitas não têm nome, o filtro é aplicado ao medicamento
+	if options.Name != "" {
+		query = query.Where("medication ILIKE ?", "%"+options.Name+"%")
+		options.Name = ""
+	}
+	total, err := options.find(
+		query,
+		&prescriptions,
+		"medication", "active", "start_date", "created_at",
+	)
+
+	return prescriptions, total, err
+}
+
+// Amend altera a receita. Se mudar a toma, a frequência, as datas ou as instruções, os horários
+// anteriores terminam agora e é gerado um novo horário para as tomas seguintes.
+func (p *Prescription) Amend(db *gorm.DB, fields PrescriptionFields) error {
+	if !p.Active {
+		return ErrPrescriptionInactive
+	}
+
+	regenerate, err := fields.apply(p)
+	if err != nil {
+		return err
+	}
+	if regenerate {
+		p.Revision++
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Schedules").Save(p).Error; err != nil {
+			return err
+		}
+		if !regenerate {
+			return nil
+		}
+
+		now := time.Now().UTC()
+		if err := p.stopSchedules(tx, now); err != nil {
+			return err
+		}
+		return p.generateSchedule(tx, now, fields.Override)
+	})
+	if errors.Is(err, ErrDoseLimitExceeded) {
+		// O horário recusado dentro da transação deixou o alerta para depois de desfeita
+		raiseLimitAlert(db, p.TenantID, p.DropperID, &p.PatientID, nil, err)
+		return err
+	} else if errors.Is(err, ErrScheduleExists) || errors.Is(err, ErrSevereInteraction) || errors.Is(err, ErrIntervalTooShort) {
+		return err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao alterar receita: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	if regenerate {
+		log.Printf("Receita <%d> alterada, horários regenerados na revisão %d", p.ID, p.Revision)
+	}
+	return nil
+}
+
+// Cancel cancela a receita e termina os seus horários. A receita e as tomas já registadas são mantidas.
+func (p *Prescription) Cancel(db *gorm.DB) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(p).Update("active", false).Error; err != nil {
+			return err
+		}
+		return p.stopSchedules(tx, time.Now().UTC())
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao cancelar receita: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// ListSchedules devolve os horários gerados pela receita, do mais recente para o mais antigo
+func (p *Prescription) ListSchedules(db *gorm.DB) ([]DispenseSchedule, error) {
+	schedules := make([]DispenseSchedule, 0)
+
+	if err := db.Where("prescription_id = ?", p.ID).Order("id desc").Find(&schedules).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return schedules, nil
+}
+
+// ListDoses devolve uma página das tomas registadas a partir da receita
+func (p *Prescription) ListDoses(db *gorm.DB, options ListOptions) ([]DispenseRecord, int64, error) {
+	return listDoses(db.Where("prescription_id = ?", p.ID), options)
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleOccurrences(t *testing.T) {
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	schedule := DispenseSchedule{StartDate: start, EndDate: start.Add(24 * time.Hour), Interval: 8 * time.Hour}
+
+	occurrences := schedule.Occurrences(start.Add(-time.Hour), start.Add(48*time.Hour))
+	if len(occurrences) != 4 || !occurrences[0].Equal(start) || !occurrences[3].Equal(start.Add(24*time.Hour)) {
+		t.Fatalf("Expected 4 doses from the start until the end date, got %v", occurrences)
+	}
+
+	occurrences = schedule.Occurrences(start.Add(time.Hour), start.Add(9*time.Hour))
+	if len(occurrences) != 1 || !occurrences[0].Equal(start.Add(8*time.Hour)) {
+		t.Fatalf("Expected only the 16h dose, got %v", occurrences)
+	}
+
+	schedule.Interval = 6
+	if occurrences := schedule.Occurrences(start, start.Add(time.Hour)); len(occurrences) != 0 {
+		t.Fatalf("An interval below the minimum should not produce doses, got %d", len(occurrences))
+	}
+}
+
+func TestPrescriptionSchedule(t *testing.T) {
+	medication, dose, frequency, duration := "Ibuprofeno", uint(2), 8*time.Hour, 7*24*time.Hour
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+
+	prescription := Prescription{ID: 3, PatientID: 5, Revision: 1}
+	regenerate, err := PrescriptionFields{
+		Medication: &medication, Dose: &dose, Frequency: &frequency, StartDate: &start, Duration: &duration,
+	}.apply(&prescription)
+	if err != nil || !regenerate {
+		t.Fatalf("Fields were not applied: %v", err)
+	}
+
+	spec, ok := prescription.scheduleSpec(start.Add(-time.Hour))
+	if !ok || !spec.Start.Equal(start) || !spec.End.Equal(start.Add(duration)) || spec.Interval != frequency {
+		t.Fatalf("Unexpected schedule: %+v", spec)
+	}
+	if spec.Pills[medication] != 2 || *spec.PrescriptionID != 3 || *spec.PatientID != 5 {
+		t.Fatalf("The schedule should dispense the prescribed dose and link back to it: %+v", spec)
+	}
+
+	// Ao regenerar a meio do tratamento as tomas continuam alinhadas com o início
+	spec, _ = prescription.scheduleSpec(start.Add(9 * time.Hour))
+	if !spec.Start.Equal(start.Add(16 * time.Hour)) {
+		t.Fatalf("Expected the next dose at 00h, got %s", spec.Start)
+	}
+	if _, ok := prescription.scheduleSpec(start.Add(duration + time.Minute)); ok {
+		t.Fatal("A finished prescription should not generate a schedule")
+	}
+
+	prescriber := "Dr. Silva"
+	if regenerate, _ := (PrescriptionFields{Prescriber: &prescriber}).apply(&prescription); regenerate {
+		t.Fatal("Changing the prescriber should not regenerate the schedules")
+	}
+	frequency = time.Second
+	if _, err := (PrescriptionFields{Frequency: &frequency}).apply(&prescription); !errors.Is(err, ErrInvalidPrescription) {
+		t.Fatalf("Expected an invalid prescription, got %v", err)
+	}
+}
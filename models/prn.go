@@ -0,0 +1,286 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotPrnSchedule      = errors.New("o horário não é de toma em SOS")
+	ErrInvalidScheduleKind = errors.New("tipo de horário inválido")
+	ErrInvalidDailyCap     = errors.New("o limite diário de tomas só se aplica a horários em SOS")
+)
+
+// Tipos de horário
+const (
+	// As tomas são dispensadas a cada Interval pelo PillDispenseBGJob
+	ScheduleKindScheduled = "scheduled"
+	// As tomas são pedidas pelo paciente (SOS, PRN). Interval é o tempo mínimo entre tomas e
+	// MaxDailyDoses o máximo de tomas em 24 horas.
+	ScheduleKindPRN = "prn"
+)
+
+// Origem de um pedido de toma em SOS
+const (
+	PrnSourceDevice = "device"
+	PrnSourceApp    = "app"
+)
+
+// Motivos de recusa de um pedido de toma em SOS
+const (
+	PrnDeniedInactive  = "inactive"
+	PrnDeniedPaused    = "paused"
+	PrnDeniedLockout   = "lockout"
+	PrnDeniedDailyCap  = "daily_cap"
+	PrnDeniedDoseLimit = "dose_limit"
+	PrnDeniedNoPills   = "not_enough_pills"
+)
+
+// PrnRequest regista cada pedido de toma em SOS, aceite ou recusado, para consulta pelo cuidador
+type PrnRequest struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	DropperID  uint  `gorm:"index;not null" json:"-"`
+	ScheduleID uint  `gorm:"index;not null" json:"schedule_id"`
+	PatientID  *uint `gorm:"index" json:"patient_id"`
+	// Utilizador que fez o pedido na app, nil se veio do botão do dropper
+	UserID *uint  `json:"user_id"`
+	Source string `gorm:"not null" json:"source"`
+
+	Granted bool   `json:"granted"`
+	Reason  string `json:"reason,omitempty"`
+	// Hora a partir da qual um novo pedido pode ser aceite, nas recusas por intervalo ou limite diário
+	NextAllowedAt *time.Time `json:"next_allowed_at"`
+	// Toma registada, se o pedido foi aceite
+	DoseID *uint `json:"dose_id"`
+}
+
+// validKind confirma o tipo do horário e que o limite diário só é usado em horários em SOS
+func (s *DispenseSchedule) validKind() error {
+	if s.Kind != ScheduleKindScheduled && s.Kind != ScheduleKindPRN {
+		return ErrInvalidScheduleKind
+	}
+	if s.MaxDailyDoses > 0 && s.Kind != ScheduleKindPRN {
+		return ErrInvalidDailyCap
+	}
+	return nil
+}
+
+// prnDecision decide se uma toma em SOS pode ser dispensada em now, dadas as horas das tomas
+// já dispensadas, das mais recentes para as mais antigas. Devolve o motivo da recusa, vazio se
+// for aceite, e a hora a partir da qual seria aceite.
+func (s *DispenseSchedule) prnDecision(dispensed []time.Time, now time.Time) (string, *time.Time) {
+	if !s.Active || now.Before(s.StartDate) || now.After(s.EndDate) {
+		return PrnDeniedInactive, nil
+	}
+	if s.pausedAt(now) {
+		return PrnDeniedPaused, s.ResumeAt
+	}
+
+	if len(dispensed) > 0 {
+		if next := dispensed[0].Add(s.Interval); next.After(now) {
+			return PrnDeniedLockout, &next
+		}
+	}
+
+	if s.MaxDailyDoses > 0 {
+		window := now.Add(-24 * time.Hour)
+		count := 0
+		for _, at := range dispensed {
+			if at.After(window) {
+				count++
+			}
+		}
+		if count >= int(s.MaxDailyDoses) {
+			// A toma mais antiga das que contam para o limite sai da janela de 24 horas
+			next := dispensed[s.MaxDailyDoses-1].Add(24 * time.Hour)
+			return PrnDeniedDailyCap, &next
+		}
+	}
+	return "", nil
+}
+
+// RequestPRN processa um pedido de toma em SOS. Verifica o intervalo mínimo, o limite diário
+// e os limites de dose antes de reservar os comprimidos. Todos os pedidos ficam registados;
+// uma recusa não é um erro e o motivo está no PrnRequest devolvido.
+func (s *DispenseSchedule) RequestPRN(db *gorm.DB, source string, userID *uint) (*PrnRequest, []MqttActionRequest, error) {
+	if s.Kind != ScheduleKindPRN {
+		return nil, nil, ErrNotPrnSchedule
+	}
+
+	request := PrnRequest{
+		DropperID:  s.DropperID,
+		ScheduleID: s.ID,
+		PatientID:  s.PatientID,
+		UserID:     userID,
+		Source:     source,
+	}
+	var commands []MqttActionRequest
+	var alert *Alert
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Bloqueia o horário para que dois pedidos simultâneos não passem ambos o intervalo mínimo
+		var schedule DispenseSchedule
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&schedule, s.ID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		dispensed := make([]time.Time, 0)
+		err := tx.
+			Model(&DispenseRecord{}).
+			Where("schedule_id = ? and status = ? and dispensed_at > ?", schedule.ID, DoseDispensed, now.Add(-max(24*time.Hour, schedule.Interval))).
+			Order("dispensed_at desc").
+			Pluck("dispensed_at", &dispensed).
+			Error
+		if err != nil {
+			return err
+		}
+
+		request.Reason, request.NextAllowedAt = schedule.prnDecision(dispensed, now)
+		if request.Reason == "" {
+			request.DoseID, commands, alert, err = dispensePRN(tx, &schedule, now)
+			if errors.Is(err, ErrDoseLimitExceeded) {
+				request.Reason = PrnDeniedDoseLimit
+			} else if errors.Is(err, ErrNotEnoughPills) {
+				request.Reason = PrnDeniedNoPills
+			} else if err != nil {
+				return err
+			}
+		}
+
+		request.Granted = request.Reason == ""
+		return tx.Create(&request).Error
+	})
+	if err != nil {
+		log.Printf("Erro inesperado no pedido em SOS do horário <%d>: %s", s.ID, err.Error())
+		return nil, nil, ErrUnexpectedError
+	}
+	if alert != nil {
+		publishAlert(db, alert)
+	}
+
+	if request.Granted {
+		log.Printf("Pedido em SOS <%d> do horário <%d> aceite", request.ID, s.ID)
+		var record DispenseRecord
+		if err := db.First(&record, *request.DoseID).Error; err == nil {
+			publishDispense(db, record, commands)
+		}
+	} else {
+		log.Printf("Pedido em SOS <%d> do horário <%d> recusado: %s", request.ID, s.ID, request.Reason)
+	}
+	return &request, commands, nil
+}
+
+// dispensePRN regista e reserva a toma em SOS. Uma recusa por limites ou falta de comprimidos
+// não deixa alterações, para que o pedido possa ser registado na mesma transação. Na recusa por
+// limites é registado o alerta devolvido, a publicar depois do commit.
+func dispensePRN(tx *gorm.DB, schedule *DispenseSchedule, now time.Time) (doseID *uint, commands []MqttActionRequest, alert *Alert, err error) {
+	pills, err := schedule.Pills(tx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tenantID, err := scheduleTenant(tx, schedule)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := checkDispenseLimits(tx, tenantID, schedule.DropperID, schedule.PatientID, pills, now); errors.Is(err, ErrDoseLimitExceeded) {
+		if alert = limitAlert(tenantID, schedule.DropperID, schedule.PatientID, &schedule.ID, err); !createAlert(tx, alert) {
+			alert = nil
+		}
+		return nil, nil, alert, err
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Savepoint, a reserva é desfeita se faltar algum dos comprimidos
+	confirmBy := now.Add(ConfirmationWindow)
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		dropper := Dropper{Model: gorm.Model{ID: schedule.DropperID}}
+		if commands, err = dropper.reservePills(tx, pills); err != nil {
+			return err
+		}
+
+		record := DispenseRecord{
+			DropperID:      schedule.DropperID,
+			ScheduleID:     &schedule.ID,
+			PrescriptionID: schedule.PrescriptionID,
+			PatientID:      schedule.PatientID,
+			DueAt:          now,
+			DispensedAt:    &now,
+			ConfirmBy:      &confirmBy,
+			Source:         DoseSourcePRN,
+			Status:         DoseDispensed,
+			Pills:          pills,
+		}
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+		doseID = &record.ID
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return doseID, commands, nil, nil
+}
+
+// RequestPRNFromDevice processa o pedido feito no botão do dropper. Sem horário indicado é
+// usado o único horário em SOS ativo do dropper.
+func RequestPRNFromDevice(db *gorm.DB, serial uuid.UUID, scheduleID uint) (*PrnRequest, []MqttActionRequest, error) {
+	var dropper Dropper
+	err := db.First(&dropper, "serial_id = ?", serial).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, nil, ErrUnexpectedError
+	}
+
+	var schedule *DispenseSchedule
+	if scheduleID != 0 {
+		if schedule, err = dropper.FindSchedule(db, scheduleID); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		schedules := make([]DispenseSchedule, 0)
+		err := db.
+			Where("dropper_id = ? and kind = ? and active = true", dropper.ID, ScheduleKindPRN).
+			Limit(2).
+			Find(&schedules).
+			Error
+		if err != nil {
+			log.Printf("Erro inesperado: %s", err.Error())
+			return nil, nil, ErrUnexpectedError
+		}
+		if len(schedules) != 1 {
+			return nil, nil, ErrNotPrnSchedule
+		}
+		schedule = &schedules[0]
+	}
+
+	return schedule.RequestPRN(db, PrnSourceDevice, nil)
+}
+
+// ListPrnRequests devolve uma página dos pedidos em SOS feitos no dropper, dos mais recentes
+// para os mais antigos
+func (d *Dropper) ListPrnRequests(db *gorm.DB, options ListOptions) ([]PrnRequest, int64, error) {
+	requests := make([]PrnRequest, 0)
+
+	// Os pedidos não têm nome nem estado ativo
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	query := db.Model(&PrnRequest{}).Where("dropper_id = ?", d.ID)
+	total, err := options.find(query, &requests, "created_at", "granted")
+
+	return requests, total, err
+}
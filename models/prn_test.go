@@ -0,0 +1,74 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrnDecision(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	// Em SOS, no máximo 4 por dia e com pelo menos 6 horas entre tomas
+	schedule := DispenseSchedule{
+		Active:        true,
+		Kind:          ScheduleKindPRN,
+		StartDate:     start,
+		EndDate:       start.Add(30 * 24 * time.Hour),
+		Interval:      6 * time.Hour,
+		MaxDailyDoses: 4,
+	}
+	now := start.Add(10 * 24 * time.Hour)
+
+	if reason, _ := schedule.prnDecision(nil, now); reason != "" {
+		t.Fatalf("The first request should be granted, got %s", reason)
+	}
+
+	reason, next := schedule.prnDecision([]time.Time{now.Add(-2 * time.Hour)}, now)
+	if reason != PrnDeniedLockout || !next.Equal(now.Add(4*time.Hour)) {
+		t.Fatalf("Expected a lockout until %s, got %s %v", now.Add(4*time.Hour), reason, next)
+	}
+
+	// Um intervalo mais curto deixa passar o intervalo mínimo, mas não o limite diário
+	schedule.Interval = time.Hour
+	dispensed := []time.Time{now.Add(-2 * time.Hour), now.Add(-8 * time.Hour), now.Add(-14 * time.Hour), now.Add(-20 * time.Hour), now.Add(-26 * time.Hour)}
+	reason, next = schedule.prnDecision(dispensed, now)
+	if reason != PrnDeniedDailyCap || !next.Equal(now.Add(4*time.Hour)) {
+		t.Fatalf("Expected the daily cap until %s, got %s %v", now.Add(4*time.Hour), reason, next)
+	}
+	if reason, _ := schedule.prnDecision(dispensed[1:], now); reason != "" {
+		t.Fatalf("Doses older than 24 hours should not count, got %s", reason)
+	}
+
+	if reason, _ := schedule.prnDecision(nil, start.Add(-time.Hour)); reason != PrnDeniedInactive {
+		t.Fatalf("Requests before the start should be denied, got %s", reason)
+	}
+	schedule.Active = false
+	if reason, _ := schedule.prnDecision(nil, now); reason != PrnDeniedInactive {
+		t.Fatalf("Requests on an inactive schedule should be denied, got %s", reason)
+	}
+}
+
+func TestPrnScheduleOccurrences(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	schedule := DispenseSchedule{
+		Kind:          ScheduleKindPRN,
+		StartDate:     start,
+		EndDate:       start.Add(30 * 24 * time.Hour),
+		Interval:      time.Hour,
+		MaxDailyDoses: 4,
+	}
+
+	if occurrences := schedule.Occurrences(start, start.Add(24*time.Hour)); len(occurrences) != 0 {
+		t.Fatalf("PRN schedules should not have planned doses, got %d", len(occurrences))
+	}
+	// Os limites de dose contam com o máximo que pode ser pedido
+	if daily := schedule.maxOccurrences(24 * time.Hour); daily != 4 {
+		t.Fatalf("Expected 4 doses a day, got %d", daily)
+	}
+	if weekly := schedule.maxOccurrences(7 * 24 * time.Hour); weekly != 28 {
+		t.Fatalf("Expected 28 doses a week, got %d", weekly)
+	}
+
+	if err := (&DispenseSchedule{Kind: ScheduleKindScheduled, MaxDailyDoses: 2}).validKind(); err != ErrInvalidDailyCap {
+		t.Fatalf("A daily cap on a regular schedule should be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,416 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Limites de paginação das listagens
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// ListOptions descreve a paginação, filtragem e ordenação de uma listagem
+type ListOptions struct {
+	Page    int
+	PerPage int
+	// Filtra por estado ativo quando definido
+	Active *bool
+	// Filtra por nome, parcial e sem distinção de maiúsculas
+	Name string
+	// Coluna de ordenação, prefixada com '-' para ordem descendente
+	Sort string
+}
+
+// normalize aplica os valores por omissão da paginação
+func (o *ListOptions) normalize() {
+	if o.Page < 1 {
+		o.Page = 1
+	}
+	if o.PerPage < 1 {
+		o.PerPage = DefaultPageSize
+	} else if o.PerPage > MaxPageSize {
+		o.PerPage = MaxPageSize
+	}
+}
+
+// filter aplica os filtros de estado e nome à query
+func (o *ListOptions) filter(query *gorm.DB) *gorm.DB {
+	if o.Active != nil {
+		query = query.Where("active = ?", *o.Active)
+	}
+	if o.Name != "" {
+		query = query.Where("name ILIKE ?", "%"+o.Name+"%")
+	}
+	return query
+}
+
+// page aplica a ordenação e paginação à query. As colunas de ordenação aceites
+// são as de allowed, para nunca passar input do utilizador diretamente para o SQL
+func (o *ListOptions) page(query *gorm.DB, allowed ...string) (*gorm.DB, error) {
+	o.normalize()
+
+	order := "id"
+	if o.Sort != "" {
+		column, descending := strings.CutPrefix(o.Sort, "-")
+		if !slices.Contains(allowed, column) {
+			return nil, ErrInvalidSort
+		}
+		order = column
+		if descending {
+			order += " desc"
+		}
+	}
+
+	return query.Order(order).Offset((o.Page - 1) * o.PerPage).Limit(o.PerPage), nil
+}
+
+// find conta os registos que respeitam os filtros e devolve a página pedida em dest
+func (o *ListOptions) find(query *gorm.DB, dest any, allowed ...string) (total int64, err error) {
+	query = o.filter(query)
+	if err = query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return
+	}
+
+	paged, err := o.page(query, allowed...)
+	if err != nil {
+		return
+	}
+	err = paged.Find(dest).Error
+	return
+}
+
+// FindDropperBySerial procura um dropper acessível ao ator pelo seu serial. Droppers de outros
+// tenants são tratados como inexistentes, para não revelar que o serial existe.
+func FindDropperBySerial(db *gorm.DB, actor Actor, serial uuid.UUID) (*Dropper, error) {
+	var dropper Dropper
+
+	err := db.Scopes(AccessibleBy(actor)).First(&dropper, "serial_id = ?", serial).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return &dropper, nil
+}
+
+// FindDropper procura um dropper acessível ao ator pelo seu id interno
+func FindDropper(db *gorm.DB, actor Actor, id uint) (*Dropper, error) {
+	var dropper Dropper
+
+	err := db.Scopes(AccessibleBy(actor)).First(&dropper, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return &dropper, nil
+}
+
+// ListDroppers devolve uma página dos droppers acessíveis ao ator e o total de droppers que respeitam os filtros
+func ListDroppers(db *gorm.DB, actor Actor, options ListOptions) ([]Dropper, int64, error) {
+	droppers := make([]Dropper, 0)
+
+	total, err := options.find(db.Model(&Dropper{}).Scopes(AccessibleBy(actor)), &droppers, "name", "active", "created_at", "updated_at")
+
+	return droppers, total, err
+}
+
+// DropperChanges contêm os campos alteráveis de um dropper, campos nil não são alterados
+type DropperChanges struct {
+	Name       *string
+	Active     *bool
+	MachineURL *string
+}
+
+// Update aplica as alterações ao dropper
+func (d *Dropper) Update(db *gorm.DB, changes DropperChanges) error {
+	if changes.Name != nil {
+		d.Name = *changes.Name
+	}
+	if changes.Active != nil {
+		d.Active = *changes.Active
+	}
+	if changes.MachineURL != nil {
+		d.MachineURL = *changes.MachineURL
+	}
+
+	err := db.Save(d).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDropperExists
+	}
+	return err
+}
+
+// Delete remove o dropper, os seus horários e secções deixam de estar acessíveis. Os horários são
+// desativados para que o dropper removido não volte a dispensar.
+func (d *Dropper) Delete(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&DispenseSchedule{}).
+			Where("dropper_id = ? and active = true", d.ID).
+			Update("active", false).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(d).Error
+	})
+}
+
+// ListSections devolve as secções do dropper pela ordem física, com as respetivas posições
+func (d *Dropper) ListSections(db *gorm.DB) ([]DropperSection, error) {
+	sections := make([]DropperSection, 0)
+
+	err := db.
+		Preload("Positions", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Where("dropper_id = ?", d.ID).
+		Order("id").
+		Find(&sections).
+		Error
+
+	return sections, err
+}
+
+// FindSection procura uma secção do dropper pelo seu id e devolve também o seu índice (1 - 9)
+func (d *Dropper) FindSection(db *gorm.DB, id uint) (*DropperSection, uint, error) {
+	sections, err := d.ListSections(db)
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, 0, ErrUnexpectedError
+	}
+
+	for i, section := range sections {
+		if section.ID == id {
+			return &section, uint(i + 1), nil
+		}
+	}
+	return nil, 0, ErrSectionNotFound
+}
+
+// DeleteSection remove uma secção e as suas posições
+func (d *Dropper) DeleteSection(db *gorm.DB, id uint) error {
+	section, _, err := d.FindSection(db, id)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("dropper_section_id = ?", section.ID).Delete(&Position{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(section).Error
+	})
+}
+
+// ListSchedules devolve uma página dos horários do dropper e o total que respeita os filtros
+func (d *Dropper) ListSchedules(db *gorm.DB, options ListOptions) ([]DispenseSchedule, int64, error) {
+	schedules := make([]DispenseSchedule, 0)
+
+	total, err := options.find(
+		db.Model(&DispenseSchedule{}).Where("dropper_id = ?", d.ID),
+		&schedules,
+		"name", "active", "start_date", "end_date", "created_at",
+	)
+
+	return schedules, total, err
+}
+
+// FindSchedule procura um horário do dropper pelo seu id
+func (d *Dropper) FindSchedule(db *gorm.DB, id uint) (*DispenseSchedule, error) {
+	var schedule DispenseSchedule
+
+	err := db.First(&schedule, "id = ? and dropper_id = ?", id, d.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrScheduleNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return &schedule, nil
+}
+
+// Pills devolve os comprimidos dispensados em cada toma do horário
+func (s *DispenseSchedule) Pills(db *gorm.DB) (PillList, error) {
+	pills := make([]Pill, 0)
+
+	err := db.
+		Model(&Pill{}).
+		Joins("join scheduled_pills on scheduled_pills.id = pills.scheduled_pills_id and scheduled_pills.deleted_at is null").
+		Where("scheduled_pills.dispense_schedule_id = ?", s.ID).
+		Find(&pills).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(PillList, len(pills))
+	for _, pill := range pills {
+		list[pill.Name] += int(pill.Count)
+	}
+	return list, nil
+}
+
+// ScheduleChanges contêm os campos alteráveis de um horário, campos nil não são alterados
+type ScheduleChanges struct {
+	Name        *string
+	Active      *bool
+	Description *string
+	StartDate   *time.Time
+	EndDate     *time.Time
+	Interval    *time.Duration
+	// Só nos horários em SOS, o tipo do horário não pode ser alterado
+	MaxDailyDoses *uint
+	Pills         PillList
+	// Substitui as fases do horário, uma lista vazia remove-as
+	Phases []SchedulePhase
+	// Lembretes antes de cada toma e adiamentos permitidos
+	ReminderLead   *time.Duration
+	MaxSnoozes     *uint
+	SnoozeDuration *time.Duration
+	// Necessário para alterar o horário se passar a ter interações graves
+	Override *Override
+}
+
+// UpdateDispenseSchedule aplica as alterações a um horário do dropper
+func (d *Dropper) UpdateDispenseSchedule(db *gorm.DB, id uint, changes ScheduleChanges) (*DispenseSchedule, error) {
+	schedule, err := d.FindSchedule(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if changes.Name != nil {
+		schedule.Name = *changes.Name
+	}
+	if changes.Active != nil {
+		schedule.Active = *changes.Active
+	}
+	if changes.Description != nil {
+		schedule.Description = *changes.Description
+	}
+	if changes.StartDate != nil {
+		schedule.StartDate = changes.StartDate.UTC()
+	}
+	if changes.EndDate != nil {
+		schedule.EndDate = changes.EndDate.UTC()
+	}
+	if changes.Interval != nil {
+		schedule.Interval = *changes.Interval
+	}
+	if changes.MaxDailyDoses != nil {
+		schedule.MaxDailyDoses = *changes.MaxDailyDoses
+	}
+	if changes.ReminderLead != nil {
+		schedule.ReminderLead = *changes.ReminderLead
+	}
+	if changes.MaxSnoozes != nil {
+		schedule.MaxSnoozes = *changes.MaxSnoozes
+	}
+	if changes.SnoozeDuration != nil {
+		schedule.SnoozeDuration = *changes.SnoozeDuration
+	}
+
+	if err := schedule.validKind(); err != nil {
+		return nil, err
+	}
+	// As fases têm de continuar a cobrir o horário se as datas mudarem
+	phases := schedule.Phases
+	if changes.Phases != nil {
+		phases = changes.Phases
+		// Sem fases o horário volta a dispensar os seus comprimidos, que têm de vir no pedido
+		if len(phases) == 0 && len(changes.Pills) == 0 {
+			return nil, ErrPhasesWithoutPills
+		}
+	}
+	if err := schedule.setPhases(phases, changes.Pills); err != nil {
+		return nil, err
+	}
+	if err := schedule.validReminders(); err != nil {
+		return nil, err
+	}
+	if schedule.Interval < MinScheduleInterval {
+		return nil, ErrIntervalTooShort
+	}
+
+	pills := changes.Pills
+	if pills == nil {
+		if pills, err = schedule.Pills(db); err != nil {
+			log.Printf("Erro inesperado: %s", err.Error())
+			return nil, ErrUnexpectedError
+		}
+	}
+
+	pills = schedule.dosePills(pills)
+
+	// Só é preciso verificar interações se mudarem os comprimidos ou as datas, que mudam os
+	// horários sobrepostos, ou se o horário for reativado
+	if changes.Pills != nil || changes.Phases != nil || changes.StartDate != nil || changes.EndDate != nil ||
+		(changes.Active != nil && *changes.Active) {
+		if schedule.Warnings, err = checkInteractions(db, schedule, pills, changes.Override); err != nil {
+			return nil, err
+		}
+	}
+	// Qualquer alteração pode aumentar a dose, ex: um intervalo mais curto
+	if err := checkScheduleLimits(db, schedule, pills); errors.Is(err, ErrDoseLimitExceeded) {
+		raiseScheduleLimitAlert(db, schedule, err)
+		return nil, err
+	} else if err != nil {
+		log.Printf("Erro inesperado ao verificar limites de dose: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(schedule).Error; err != nil {
+			return err
+		}
+		// Um horário que passa a ter fases deixa de ter comprimidos próprios
+		if changes.Pills != nil || changes.Phases != nil {
+			if err := replaceSchedulePills(tx, schedule.ID, changes.Pills); err != nil {
+				return err
+			}
+		}
+		return recordOverride(tx, schedule, schedule.Warnings, changes.Override)
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrScheduleExists
+	} else if err != nil {
+		log.Printf("Erro inesperado ao alterar horário: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return schedule, nil
+}
+
+// DeleteDispenseSchedule remove um horário do dropper
+func (d *Dropper) DeleteDispenseSchedule(db *gorm.DB, id uint) error {
+	schedule, err := d.FindSchedule(db, id)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := replaceSchedulePills(tx, schedule.ID, nil); err != nil {
+			return err
+		}
+		return tx.Delete(schedule).Error
+	})
+}
+
+// NewDispenseCommand cria o comando mqtt que roda o dropper até à posição pedida
+func NewDispenseCommand(dropperID uint, position uint) MqttActionRequest {
+	return MqttActionRequest{
+		Topic: fmt.Sprintf("angle%d", dropperID),
+		Value: []byte(fmt.Sprintf("0,%d", position)),
+	}
+}
@@ -0,0 +1,291 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Tipos de discrepância entre o estado reportado pelo dispositivo e a base de dados
+const (
+	// DiscrepancyPhantomPill o dispositivo deteta um comprimido numa posição que a base de dados tem como vazia
+	DiscrepancyPhantomPill = "phantom_pill"
+	// DiscrepancyUnexpectedEmpty o dispositivo deteta uma posição vazia que a base de dados tem como ocupada
+	DiscrepancyUnexpectedEmpty = "unexpected_empty"
+)
+
+// Formas de resolver uma discrepância
+const (
+	ResolutionDevice   = "device"
+	ResolutionDatabase = "database"
+	// ResolutionConsistent é atribuida automaticamente quando um relatório posterior já concorda com a base de dados
+	ResolutionConsistent = "consistent"
+)
+
+var (
+	ErrDiscrepancyNotFound  = errors.New("discrepância não encontrada")
+	ErrDiscrepancyResolved  = errors.New("discrepância já resolvida")
+	ErrInvalidResolution    = errors.New("resolução inválida, esperado 'device' ou 'database'")
+	ErrInvalidOccupancyData = errors.New("relatório de ocupação inválido")
+)
+
+// OccupancyReport é o payload enviado pelos droppers com sensores de posição.
+// Cada secção é identificada pela sua ordem na máquina (1 - 9) e lista as posições ocupadas.
+type OccupancyReport struct {
+	Sections []SectionOccupancy `json:"sections"`
+}
+
+type SectionOccupancy struct {
+	Section  uint   `json:"section"`
+	Occupied []uint `json:"occupied"`
+}
+
+// SlotDiscrepancy regista uma diferença entre o estado de uma posição no dispositivo e na base de dados
+type SlotDiscrepancy struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	DropperID        uint  `gorm:"index" json:"-"`
+	DropperSectionID uint  `json:"-"`
+	PositionID       *uint `json:"-"`
+
+	Section          uint   `json:"section"`
+	Position         uint   `json:"position"`
+	Kind             string `json:"kind"`
+	DeviceOccupied   bool   `json:"device_occupied"`
+	DatabaseOccupied bool   `json:"database_occupied"`
+
+	Resolved   bool       `gorm:"default:false;index" json:"resolved"`
+	Resolution string     `json:"resolution,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// diffOccupancy compara as secções de um dropper (ordenadas) com o relatório do dispositivo
+// e devolve as discrepâncias encontradas, sem as persistir
+func diffOccupancy(dropperID uint, sections []DropperSection, report OccupancyReport) ([]SlotDiscrepancy, error) {
+	found := make([]SlotDiscrepancy, 0)
+
+	for _, reported := range report.Sections {
+		if reported.Section < 1 || int(reported.Section) > len(sections) {
+			return nil, ErrInvalidOccupancyData
+		}
+		section := sections[reported.Section-1]
+		known := make(map[uint]bool, len(section.Positions))
+
+		for _, position := range section.Positions {
+			known[position.Position] = true
+
+			device_occupied := slices.Contains(reported.Occupied, position.Position)
+			database_occupied := !position.Empty
+			if device_occupied == database_occupied {
+				continue
+			}
+
+			kind := DiscrepancyUnexpectedEmpty
+			if device_occupied {
+				kind = DiscrepancyPhantomPill
+			}
+			found = append(found, SlotDiscrepancy{
+				DropperID:        dropperID,
+				DropperSectionID: section.ID,
+				PositionID:       &position.ID,
+				Section:          reported.Section,
+				Position:         position.Position,
+				Kind:             kind,
+				DeviceOccupied:   device_occupied,
+				DatabaseOccupied: database_occupied,
+			})
+		}
+
+		// Posições ocupadas no dispositivo que nem existem na base de dados
+		for _, occupied := range reported.Occupied {
+			if occupied < 1 || occupied > 9 {
+				return nil, ErrInvalidOccupancyData
+			}
+			if known[occupied] {
+				continue
+			}
+			known[occupied] = true
+			found = append(found, SlotDiscrepancy{
+				DropperID:        dropperID,
+				DropperSectionID: section.ID,
+				Section:          reported.Section,
+				Position:         occupied,
+				Kind:             DiscrepancyPhantomPill,
+				DeviceOccupied:   true,
+				DatabaseOccupied: false,
+			})
+		}
+	}
+
+	return found, nil
+}
+
+// ReconcileOccupancy recebe o relatório de ocupação de um dropper, compara-o com o estado das posições
+// e regista as discrepâncias novas. Discrepâncias pendentes que deixaram de existir são fechadas.
+func ReconcileOccupancy(db *gorm.DB, serial uuid.UUID, report OccupancyReport) ([]SlotDiscrepancy, error) {
+	var dropper Dropper
+	err := db.
+		Preload("Sections", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Sections.Positions").
+		First(&dropper, "serial_id = ?", serial).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	found, err := diffOccupancy(dropper.ID, dropper.Sections, report)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []SlotDiscrepancy
+	err = db.Where("dropper_id = ? and resolved = false", dropper.ID).Find(&pending).Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	created := make([]SlotDiscrepancy, 0, len(found))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		for _, old := range pending {
+			still_present := slices.ContainsFunc(found, func(d SlotDiscrepancy) bool {
+				return d.Section == old.Section && d.Position == old.Position && d.Kind == old.Kind
+			})
+			// Só fechamos secções que vieram no relatório
+			reported := slices.ContainsFunc(report.Sections, func(s SectionOccupancy) bool {
+				return s.Section == old.Section
+			})
+			if still_present || !reported {
+				continue
+			}
+			old.Resolved = true
+			old.Resolution = ResolutionConsistent
+			old.ResolvedAt = &now
+			if err := tx.Save(&old).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, discrepancy := range found {
+			already_known := slices.ContainsFunc(pending, func(d SlotDiscrepancy) bool {
+				return d.Section == discrepancy.Section && d.Position == discrepancy.Position && d.Kind == discrepancy.Kind
+			})
+			if already_known {
+				continue
+			}
+			if err := tx.Create(&discrepancy).Error; err != nil {
+				return err
+			}
+			created = append(created, discrepancy)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Erro ao registar discrepâncias: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	if len(created) > 0 {
+		dropper.PublishEvent(EventInventory, InventoryEvent{Reason: InventoryOccupancy, Discrepancies: len(created)})
+	}
+	return created, nil
+}
+
+// ListDiscrepancies devolve as discrepâncias de um dropper, por omissão apenas as pendentes
+func (d *Dropper) ListDiscrepancies(db *gorm.DB, include_resolved bool) ([]SlotDiscrepancy, error) {
+	discrepancies := make([]SlotDiscrepancy, 0)
+
+	query := db.Where("dropper_id = ?", d.ID)
+	if !include_resolved {
+		query = query.Where("resolved = false")
+	}
+
+	err := query.Order("created_at").Find(&discrepancies).Error
+	return discrepancies, err
+}
+
+// ResolveDiscrepancy aceita a visão do dispositivo ou da base de dados para uma discrepância pendente.
+// Aceitar o dispositivo altera o estado da posição, aceitar a base de dados apenas fecha o registo.
+// pillName só é usado quando o dispositivo deteta um comprimido numa posição que não existe na base de dados.
+func (d *Dropper) ResolveDiscrepancy(db *gorm.DB, id uint, resolution string, pillName string) (*SlotDiscrepancy, error) {
+	if resolution != ResolutionDevice && resolution != ResolutionDatabase {
+		return nil, ErrInvalidResolution
+	}
+
+	var discrepancy SlotDiscrepancy
+	err := db.First(&discrepancy, "id = ? and dropper_id = ?", id, d.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDiscrepancyNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	if discrepancy.Resolved {
+		return nil, ErrDiscrepancyResolved
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if resolution == ResolutionDevice {
+			if err := applyDeviceView(tx, &discrepancy, pillName); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now().UTC()
+		discrepancy.Resolved = true
+		discrepancy.Resolution = resolution
+		discrepancy.ResolvedAt = &now
+		return tx.Save(&discrepancy).Error
+	})
+	if err != nil {
+		log.Printf("Erro ao resolver discrepância: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return &discrepancy, nil
+}
+
+// applyDeviceView atualiza a posição para refletir o que o sensor do dispositivo reportou
+func applyDeviceView(tx *gorm.DB, discrepancy *SlotDiscrepancy, pillName string) error {
+	if discrepancy.PositionID == nil {
+		position := NewSectionPosition(pillName, discrepancy.Position, false)
+		position.DropperSectionID = discrepancy.DropperSectionID
+		if err := tx.Create(&position).Error; err != nil {
+			return err
+		}
+		discrepancy.PositionID = &position.ID
+	} else {
+		err := tx.Model(&Position{}).
+			Where("id = ?", *discrepancy.PositionID).
+			Update("empty", !discrepancy.DeviceOccupied).
+			Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// A secção fica vazia quando nenhuma das suas posições tem comprimidos
+	var occupied int64
+	err := tx.Model(&Position{}).
+		Where("dropper_section_id = ? and empty = false", discrepancy.DropperSectionID).
+		Count(&occupied).
+		Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&DropperSection{}).
+		Where("id = ?", discrepancy.DropperSectionID).
+		Update("empty", occupied == 0).
+		Error
+}
@@ -0,0 +1,316 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidReminder      = errors.New("configuração de lembretes inválida")
+	ErrReminderNotFound     = errors.New("lembrete não encontrado")
+	ErrSnoozeLimit          = errors.New("a toma já foi adiada o número máximo de vezes")
+	ErrDoseAlreadyDispensed = errors.New("a toma já foi dispensada")
+)
+
+const (
+	// ConfirmationWindow é o tempo, após a dispensa, para confirmar que a toma foi feita
+	ConfirmationWindow = 30 * time.Minute
+	// reminderTopic é o tópico mqtt dos lembretes, igual a mqtt_api.BuildDeviceRemindRoute
+	reminderTopic = "devices/disp/remind/"
+)
+
+// DoseReminder é o lembrete enviado ao dropper antes de uma toma de um horário com lembretes.
+// O paciente pode adiar a toma até MaxSnoozes vezes, SnoozeDuration de cada vez; a toma é
+// dispensada em DispenseAt.
+type DoseReminder struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ScheduleID uint `gorm:"uniqueIndex:idx_reminder_dose;not null" json:"schedule_id"`
+	DropperID  uint `gorm:"index;not null" json:"-"`
+
+	// Hora prevista da toma no horário
+	DueAt time.Time `gorm:"uniqueIndex:idx_reminder_dose;not null" json:"due_at"`
+	// Hora a que a toma vai ser dispensada, depois dos adiamentos
+	DispenseAt time.Time `gorm:"index;not null" json:"dispense_at"`
+	// Hora do próximo envio do lembrete
+	RemindAt time.Time `gorm:"not null" json:"remind_at"`
+	Reminded bool      `json:"reminded"`
+	Snoozes  uint      `json:"snoozes"`
+}
+
+// reminderCommand é o conteúdo do lembrete enviado ao dropper
+type reminderCommand struct {
+	ReminderID  uint      `json:"reminder_id"`
+	ScheduleID  uint      `json:"schedule_id"`
+	DispenseAt  time.Time `json:"dispense_at"`
+	SnoozesLeft uint      `json:"snoozes_left"`
+}
+
+// validReminders confirma que os adiamentos cabem no intervalo entre tomas
+func (s *DispenseSchedule) validReminders() error {
+	if s.ReminderLead == 0 {
+		if s.MaxSnoozes > 0 {
+			return ErrInvalidReminder
+		}
+		return nil
+	}
+	if s.ReminderLead < 0 || s.Kind == ScheduleKindPRN {
+		return ErrInvalidReminder
+	}
+	if s.MaxSnoozes > 0 {
+		if s.SnoozeDuration < MinScheduleInterval || time.Duration(s.MaxSnoozes)*s.SnoozeDuration >= s.Interval {
+			return ErrInvalidReminder
+		}
+	}
+	return nil
+}
+
+// snooze adia a toma SnoozeDuration a partir de agora, ou da hora de dispensa se for posterior.
+// O lembrete volta a ser enviado antes da nova hora.
+func (r *DoseReminder) snooze(s *DispenseSchedule, now time.Time) error {
+	if r.Snoozes >= s.MaxSnoozes {
+		return ErrSnoozeLimit
+	}
+
+	r.Snoozes++
+	r.DispenseAt = maxTime(r.DispenseAt, now).Add(s.SnoozeDuration)
+	r.RemindAt = r.DispenseAt.Add(-min(s.ReminderLead, s.SnoozeDuration/2))
+	r.Reminded = false
+	return nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// SendDueReminders cria os lembretes das tomas previstas nos próximos ReminderLead de cada
+// horário e envia para ch os lembretes cuja hora chegou
+func SendDueReminders(db *gorm.DB, ch chan MqttActionRequest, now time.Time) error {
+	schedules := make([]DispenseSchedule, 0)
+	err := db.
+		Where("active = true and kind = ? and reminder_lead > 0 and end_date >= ?", ScheduleKindScheduled, now).
+		Where("dropper_id in (?)", activeDroppers(db)).
+		Find(&schedules).
+		Error
+	if err != nil {
+		log.Printf("Erro ao buscar horários com lembretes: %s", err.Error())
+		return err
+	}
+
+	for i := range schedules {
+		schedule := &schedules[i]
+		for _, due := range schedule.Occurrences(now, now.Add(schedule.ReminderLead)) {
+			if schedule.pausedAt(due) {
+				continue
+			}
+			reminder := DoseReminder{
+				ScheduleID: schedule.ID,
+				DropperID:  schedule.DropperID,
+				DueAt:      due,
+				DispenseAt: due,
+				RemindAt:   due.Add(-schedule.ReminderLead),
+			}
+			if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reminder).Error; err != nil {
+				log.Printf("Erro ao criar lembrete do horário <%d>: %s", schedule.ID, err.Error())
+			}
+		}
+	}
+
+	pending := make([]DoseReminder, 0)
+	err = db.
+		Where("reminded = false and remind_at <= ? and dispense_at >= ?", now, now.Add(-DispenseLookback)).
+		Where("dropper_id in (?)", activeDroppers(db)).
+		Find(&pending).
+		Error
+	if err != nil {
+		log.Printf("Erro ao buscar lembretes: %s", err.Error())
+		return err
+	}
+	for i := range pending {
+		reminder := &pending[i]
+
+		command, err := reminder.command(db)
+		if err != nil {
+			log.Printf("Erro ao preparar lembrete <%d>: %s", reminder.ID, err.Error())
+			continue
+		}
+		if err := db.Model(reminder).Update("reminded", true).Error; err != nil {
+			log.Printf("Erro ao marcar lembrete <%d>: %s", reminder.ID, err.Error())
+			continue
+		}
+		ch <- command
+	}
+	return nil
+}
+
+// command cria o comando mqtt do lembrete, para o tópico do serial do dropper
+func (r *DoseReminder) command(db *gorm.DB) (MqttActionRequest, error) {
+	var schedule DispenseSchedule
+	if err := db.First(&schedule, r.ScheduleID).Error; err != nil {
+		return MqttActionRequest{}, err
+	}
+	var serial uuid.UUID
+	if err := db.Model(&Dropper{}).Where("id = ?", r.DropperID).Pluck("serial_id", &serial).Error; err != nil {
+		return MqttActionRequest{}, err
+	}
+
+	payload, err := json.Marshal(reminderCommand{
+		ReminderID:  r.ID,
+		ScheduleID:  r.ScheduleID,
+		DispenseAt:  r.DispenseAt,
+		SnoozesLeft: schedule.MaxSnoozes - min(r.Snoozes, schedule.MaxSnoozes),
+	})
+	if err != nil {
+		return MqttActionRequest{}, err
+	}
+	return MqttActionRequest{Topic: reminderTopic + serial.String(), Value: payload}, nil
+}
+
+// snoozedDoses devolve, pela hora prevista, a hora de dispensa das tomas adiadas do horário
+func (s *DispenseSchedule) snoozedDoses(db *gorm.DB, from, to time.Time) (map[time.Time]time.Time, error) {
+	reminders := make([]DoseReminder, 0)
+	err := db.Where("schedule_id = ? and snoozes > 0 and due_at >= ? and due_at < ?", s.ID, from, to).Find(&reminders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	snoozed := make(map[time.Time]time.Time, len(reminders))
+	for _, reminder := range reminders {
+		snoozed[reminder.DueAt.UTC()] = reminder.DispenseAt
+	}
+	return snoozed, nil
+}
+
+// dispenseSnoozedDoses dispensa as tomas adiadas cuja nova hora calha em [from, to)
+func dispenseSnoozedDoses(db *gorm.DB, ch chan MqttActionRequest, from, to time.Time) error {
+	reminders := make([]DoseReminder, 0)
+	err := db.
+		Where("snoozes > 0 and dispense_at >= ? and dispense_at < ?", from, to).
+		Where("dropper_id in (?)", activeDroppers(db)).
+		Find(&reminders).
+		Error
+	if err != nil {
+		log.Printf("Erro ao buscar tomas adiadas: %s", err.Error())
+		return err
+	}
+
+	for _, reminder := range reminders {
+		var schedule DispenseSchedule
+		if err := db.First(&schedule, reminder.ScheduleID).Error; err != nil {
+			log.Printf("Erro ao buscar o horário <%d> da toma adiada: %s", reminder.ScheduleID, err.Error())
+			continue
+		}
+		if !schedule.Active {
+			continue
+		}
+
+		commands, _, err := dispenseScheduled(db, &schedule, reminder.DueAt.UTC())
+		if err != nil {
+			log.Printf("Erro ao dispensar a toma adiada das %s do horário <%d>: %s", reminder.DueAt, schedule.ID, err.Error())
+			continue
+		}
+		for _, command := range commands {
+			ch <- command
+		}
+	}
+	return nil
+}
+
+// Snooze adia a toma do lembrete, se ainda não tiver sido dispensada
+func (r *DoseReminder) Snooze(db *gorm.DB) error {
+	var schedule DispenseSchedule
+	if err := db.First(&schedule, r.ScheduleID).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	var dispensed int64
+	if err := db.Model(&DispenseRecord{}).Where("schedule_id = ? and due_at = ?", r.ScheduleID, r.DueAt).Count(&dispensed).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	if dispensed > 0 {
+		return ErrDoseAlreadyDispensed
+	}
+
+	if err := r.snooze(&schedule, time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := db.Model(r).Select("snoozes", "dispense_at", "remind_at", "reminded").Updates(r).Error; err != nil {
+		log.Printf("Erro inesperado ao adiar toma: %s", err.Error())
+		return ErrUnexpectedError
+	}
+
+	log.Printf("Toma das %s do horário <%d> adiada para %s", r.DueAt, r.ScheduleID, r.DispenseAt)
+	return nil
+}
+
+// FindReminder procura um lembrete do dropper
+func (d *Dropper) FindReminder(db *gorm.DB, id uint) (*DoseReminder, error) {
+	var reminder DoseReminder
+
+	err := db.First(&reminder, "id = ? and dropper_id = ?", id, d.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrReminderNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &reminder, nil
+}
+
+// ListReminders devolve uma página dos lembretes das tomas do dropper que ainda não foram
+// dispensadas, das mais próximas para as mais distantes
+func (d *Dropper) ListReminders(db *gorm.DB, options ListOptions) ([]DoseReminder, int64, error) {
+	reminders := make([]DoseReminder, 0)
+
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "dispense_at"
+	}
+	query := db.
+		Model(&DoseReminder{}).
+		Where("dropper_id = ? and dispense_at >= ?", d.ID, time.Now().UTC().Add(-DispenseLookback))
+	total, err := options.find(query, &reminders, "dispense_at", "due_at")
+
+	return reminders, total, err
+}
+
+// SnoozeFromDevice adia a próxima toma do dropper com lembrete já enviado, quando o paciente
+// carrega no botão do dropper
+func SnoozeFromDevice(db *gorm.DB, serial uuid.UUID) (*DoseReminder, error) {
+	var dropper Dropper
+	err := db.First(&dropper, "serial_id = ?", serial).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDropperNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	var reminder DoseReminder
+	err = db.
+		Where("dropper_id = ? and reminded = true and dispense_at >= ?", dropper.ID, time.Now().UTC()).
+		Order("dispense_at").
+		First(&reminder).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrReminderNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return &reminder, reminder.Snooze(db)
+}
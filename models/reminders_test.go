@@ -0,0 +1,55 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleValidReminders(t *testing.T) {
+	schedule := DispenseSchedule{Interval: 8 * time.Hour, ReminderLead: 15 * time.Minute, MaxSnoozes: 3, SnoozeDuration: 10 * time.Minute}
+	if err := schedule.validReminders(); err != nil {
+		t.Fatalf("Expected valid reminders, got %s", err)
+	}
+
+	// Os adiamentos não podem chegar à toma seguinte
+	schedule.SnoozeDuration = 3 * time.Hour
+	if err := schedule.validReminders(); err != ErrInvalidReminder {
+		t.Fatalf("Expected %s, got %v", ErrInvalidReminder, err)
+	}
+
+	// Adiamentos sem lembrete
+	schedule = DispenseSchedule{Interval: 8 * time.Hour, MaxSnoozes: 1, SnoozeDuration: 10 * time.Minute}
+	if err := schedule.validReminders(); err != ErrInvalidReminder {
+		t.Fatalf("Expected %s, got %v", ErrInvalidReminder, err)
+	}
+
+	schedule = DispenseSchedule{Kind: ScheduleKindPRN, Interval: 8 * time.Hour, ReminderLead: 15 * time.Minute}
+	if err := schedule.validReminders(); err != ErrInvalidReminder {
+		t.Fatal("PRN schedules should not have reminders")
+	}
+}
+
+func TestReminderSnooze(t *testing.T) {
+	due := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	schedule := DispenseSchedule{Interval: 8 * time.Hour, ReminderLead: 15 * time.Minute, MaxSnoozes: 2, SnoozeDuration: 10 * time.Minute}
+	reminder := DoseReminder{DueAt: due, DispenseAt: due, RemindAt: due.Add(-15 * time.Minute), Reminded: true}
+
+	if err := reminder.snooze(&schedule, due.Add(-5*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !reminder.DispenseAt.Equal(due.Add(10*time.Minute)) || !reminder.RemindAt.Equal(due.Add(5*time.Minute)) || reminder.Reminded {
+		t.Fatalf("Unexpected snoozed reminder: %+v", reminder)
+	}
+
+	// Adiar depois da hora de dispensa conta a partir de agora
+	if err := reminder.snooze(&schedule, due.Add(20*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !reminder.DispenseAt.Equal(due.Add(30*time.Minute)) || reminder.Snoozes != 2 {
+		t.Fatalf("Unexpected snoozed reminder: %+v", reminder)
+	}
+
+	if err := reminder.snooze(&schedule, due.Add(25*time.Minute)); err != ErrSnoozeLimit {
+		t.Fatalf("Expected %s, got %v", ErrSnoozeLimit, err)
+	}
+}
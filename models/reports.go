@@ -0,0 +1,415 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/TomascpMarques/dropmedical/reports"
+)
+
+var (
+	ErrReportNotFound = errors.New("relatório não encontrado")
+	ErrReportNotReady = errors.New("o relatório ainda não está pronto")
+	ErrInvalidReport  = errors.New("pedido de relatório inválido")
+)
+
+// Tipos de relatório
+const (
+	// Todas as tomas registadas no período, com o horário e a confirmação
+	ReportDispensing = "dispensing"
+	// Adesão por medicamento e período
+	ReportAdherence = "adherence"
+)
+
+// Estados de um relatório
+const (
+	ReportPending = "pending"
+	ReportReady   = "ready"
+	ReportFailed  = "failed"
+)
+
+// ReportTick é o intervalo entre execuções do ReportBGJob
+const ReportTick = 5 * time.Second
+
+// Report é um relatório pedido por um utilizador, gerado em segundo plano pelo ReportBGJob.
+// O ficheiro gerado fica guardado em Content até ser descarregado.
+type Report struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	TenantID uint `gorm:"index;not null" json:"-"`
+	UserID   uint `gorm:"not null" json:"user_id"`
+
+	Kind   string `gorm:"not null" json:"kind"`
+	Format string `gorm:"not null" json:"format"`
+	// O relatório é de um paciente ou de um dropper
+	PatientID *uint     `gorm:"index" json:"patient_id"`
+	DropperID *uint     `gorm:"index" json:"-"`
+	From      time.Time `gorm:"not null" json:"from"`
+	To        time.Time `gorm:"not null" json:"to"`
+	// Período da adesão, PeriodDay, PeriodWeek ou PeriodMonth
+	Period string `json:"period"`
+
+	Status      string     `gorm:"index;not null" json:"status"`
+	Error       string     `json:"error,omitempty"`
+	FileName    string     `json:"file_name"`
+	Content     []byte     `json:"-"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// ReportFields são os dados de um pedido de relatório
+type ReportFields struct {
+	Kind      string
+	Format    string
+	PatientID *uint
+	DropperID *uint
+	From      time.Time
+	To        time.Time
+	Period    string
+}
+
+// RequestReport valida e regista o pedido de relatório, que fica à espera do ReportBGJob
+func RequestReport(db *gorm.DB, tenantID uint, userID uint, fields ReportFields) (*Report, error) {
+	if fields.Kind != ReportDispensing && fields.Kind != ReportAdherence {
+		return nil, ErrInvalidReport
+	}
+	if !reports.ValidFormat(fields.Format) || (fields.PatientID == nil) == (fields.DropperID == nil) {
+		return nil, ErrInvalidReport
+	}
+	query := AdherenceQuery{From: fields.From, To: fields.To, Period: fields.Period}
+	if fields.From.IsZero() || fields.To.IsZero() {
+		return nil, ErrInvalidPeriod
+	}
+	if err := query.normalize(time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if fields.PatientID != nil {
+		if _, err := FindPatient(db, tenantID, *fields.PatientID); err != nil {
+			return nil, err
+		}
+	}
+
+	report := Report{
+		TenantID:  tenantID,
+		UserID:    userID,
+		Kind:      fields.Kind,
+		Format:    fields.Format,
+		PatientID: fields.PatientID,
+		DropperID: fields.DropperID,
+		From:      query.From,
+		To:        query.To,
+		Period:    query.Period,
+		Status:    ReportPending,
+	}
+	if err := db.Create(&report).Error; err != nil {
+		log.Printf("Erro inesperado ao pedir relatório: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &report, nil
+}
+
+// FindReport procura um relatório do tenant, sem o conteúdo
+func FindReport(db *gorm.DB, tenantID uint, id uint) (*Report, error) {
+	var report Report
+
+	err := db.Omit("content").First(&report, "id = ? and tenant_id = ?", id, tenantID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrReportNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &report, nil
+}
+
+// ListReports devolve uma página dos relatórios do tenant, dos mais recentes para os mais antigos
+func ListReports(db *gorm.DB, tenantID uint, options ListOptions) ([]Report, int64, error) {
+	list := make([]Report, 0)
+
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	query := db.Model(&Report{}).Omit("content").Where("tenant_id = ?", tenantID)
+	total, err := options.find(query, &list, "created_at", "status")
+
+	return list, total, err
+}
+
+// Download devolve o ficheiro do relatório e o seu content-type
+func (r *Report) Download(db *gorm.DB) ([]byte, string, error) {
+	if r.Status != ReportReady {
+		return nil, "", ErrReportNotReady
+	}
+
+	var content []byte
+	if err := db.Model(&Report{}).Where("id = ?", r.ID).Pluck("content", &content).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, "", ErrUnexpectedError
+	}
+	return content, reports.ContentType(r.Format), nil
+}
+
+// GenerateReports gera os relatórios pendentes, um de cada vez. O relatório é bloqueado
+// enquanto é gerado, para que vários servidores não gerem o mesmo.
+func GenerateReports(db *gorm.DB) error {
+	for {
+		generated := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var report Report
+			err := tx.
+				Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ?", ReportPending).
+				Order("id").
+				First(&report).
+				Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			generated = true
+
+			now := time.Now().UTC()
+			report.CompletedAt = &now
+			if err := report.generate(tx, now); err != nil {
+				log.Printf("Erro ao gerar o relatório <%d>: %s", report.ID, err.Error())
+				report.Status, report.Error = ReportFailed, err.Error()
+			} else {
+				report.Status = ReportReady
+			}
+			return tx.Model(&report).Select("status", "error", "file_name", "content", "completed_at").Updates(&report).Error
+		})
+		if err != nil {
+			log.Printf("Erro ao gerar relatórios: %s", err.Error())
+			return err
+		}
+		if !generated {
+			return nil
+		}
+	}
+}
+
+// ReportBGJob corre a cada ReportTick e gera os relatórios pedidos
+func ReportBGJob(db *gorm.DB) error {
+	time.Sleep(ReportTick)
+	return GenerateReports(db)
+}
+
+// generate preenche o documento do relatório e guarda o ficheiro em Content
+func (r *Report) generate(db *gorm.DB, now time.Time) error {
+	doc, err := r.document(db, now)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := reports.Render(&out, r.Format, doc); err != nil {
+		return err
+	}
+	r.Content = out.Bytes()
+	r.FileName = fmt.Sprintf("%s-%d-%s.%s", r.Kind, r.ID, r.From.Format("20060102"), r.Format)
+	return nil
+}
+
+// document reúne as tomas e os horários do paciente ou do dropper no período do relatório
+func (r *Report) document(db *gorm.DB, now time.Time) (*reports.Document, error) {
+	location := time.UTC
+	var scope *gorm.DB
+	var subject string
+	if r.PatientID != nil {
+		patient, err := FindPatient(db, r.TenantID, *r.PatientID)
+		if err != nil {
+			return nil, err
+		}
+		location = patient.Location()
+		scope = db.Where("patient_id = ?", patient.ID)
+		subject = "Paciente: " + patient.Name
+	} else {
+		var dropper Dropper
+		if err := db.Unscoped().First(&dropper, *r.DropperID).Error; err != nil {
+			return nil, err
+		}
+		scope = db.Where("dropper_id = ?", dropper.ID)
+		subject = fmt.Sprintf("Dropper: %s (%s)", dropper.Name, dropper.SerialID)
+	}
+
+	records := make([]DispenseRecord, 0)
+	err := db.
+		Preload("Confirmation").
+		Where(scope).
+		Where("due_at >= ? and due_at < ?", r.From, r.To).
+		Order("due_at").
+		Find(&records).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]DispenseSchedule, 0)
+	err = db.
+		Unscoped().
+		Where(scope).
+		Where("start_date < ? and end_date >= ?", r.To, r.From).
+		Order("start_date").
+		Find(&schedules).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &reports.Document{
+		Subject:     subject,
+		From:        r.From.In(location),
+		To:          r.To.In(location),
+		GeneratedAt: now.In(location),
+	}
+	if r.Kind == ReportAdherence {
+		query := AdherenceQuery{From: r.From, To: r.To, Period: r.Period}
+		adherenceDocument(doc, adherenceReport(0, records, query, location, now), location)
+	} else {
+		dispensingDocument(doc, records, schedules, location, now)
+	}
+	return doc, nil
+}
+
+const reportTimeLayout = "2006-01-02 15:04"
+
+func formatReportTime(t *time.Time, location *time.Location) string {
+	if t == nil {
+		return ""
+	}
+	return t.In(location).Format(reportTimeLayout)
+}
+
+// formatPills escreve os comprimidos por ordem alfabética, ex: "Aspirina x1, Brufen x2"
+func formatPills(pills PillList) string {
+	names := make([]string, 0, len(pills))
+	for name := range pills {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s x%d", name, pills[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// dispensingDocument lista todas as tomas do período, com o resumo por estado e os horários
+func dispensingDocument(doc *reports.Document, records []DispenseRecord, schedules []DispenseSchedule, location *time.Location, now time.Time) {
+	doc.Title = "Relatório de dispensa"
+	doc.Columns = []reports.Column{
+		{Key: "due_at", Label: "Prevista"},
+		{Key: "dispensed_at", Label: "Dispensada"},
+		{Key: "schedule", Label: "Horário"},
+		{Key: "source", Label: "Origem"},
+		{Key: "status", Label: "Estado"},
+		{Key: "pills", Label: "Comprimidos"},
+		{Key: "taken_at", Label: "Tomada"},
+		{Key: "outcome", Label: "Resultado"},
+		{Key: "reason", Label: "Motivo"},
+	}
+
+	names := make(map[uint]string, len(schedules))
+	for _, schedule := range schedules {
+		names[schedule.ID] = schedule.Name
+	}
+
+	statuses := make(map[string]int)
+	doc.Rows = make([][]string, len(records))
+	for i := range records {
+		record := &records[i]
+		statuses[record.Status]++
+
+		schedule := ""
+		if record.ScheduleID != nil {
+			schedule = names[*record.ScheduleID]
+		}
+		var takenAt *time.Time
+		if record.Confirmation != nil {
+			takenAt = &record.Confirmation.TakenAt
+		}
+		doc.Rows[i] = []string{
+			formatReportTime(&record.DueAt, location),
+			formatReportTime(record.DispensedAt, location),
+			schedule,
+			record.Source,
+			record.Status,
+			formatPills(record.Pills),
+			formatReportTime(takenAt, location),
+			record.Outcome(now),
+			record.Reason,
+		}
+	}
+
+	doc.Summary = []reports.Field{
+		{Label: "Tomas registadas", Value: fmt.Sprint(len(records))},
+		{Label: "Dispensadas", Value: fmt.Sprint(statuses[DoseDispensed])},
+		{Label: "Falhadas", Value: fmt.Sprint(statuses[DoseFailed])},
+		{Label: "Saltadas", Value: fmt.Sprint(statuses[DoseSkipped])},
+	}
+	for _, schedule := range schedules {
+		doc.Summary = append(doc.Summary, reports.Field{
+			Label: "Horário " + schedule.Name,
+			Value: fmt.Sprintf(
+				"%s, a cada %s, de %s a %s",
+				schedule.Kind, schedule.Interval, formatReportTime(&schedule.StartDate, location), formatReportTime(&schedule.EndDate, location),
+			),
+		})
+	}
+}
+
+func formatRate(counts AdherenceCounts, outcome string) string {
+	return fmt.Sprintf("%.1f%%", counts.Rate(outcome))
+}
+
+// adherenceDocument lista a adesão de cada medicamento em cada período, com os totais no resumo
+func adherenceDocument(doc *reports.Document, report AdherenceReport, location *time.Location) {
+	doc.Title = "Relatório de adesão"
+	doc.Columns = []reports.Column{
+		{Key: "medication", Label: "Medicamento"},
+		{Key: "period_start", Label: "Início"},
+		{Key: "doses", Label: "Tomas"},
+		{Key: "on_time", Label: "A horas"},
+		{Key: "late", Label: "Tardias"},
+		{Key: "missed", Label: "Falhadas"},
+		{Key: "pending", Label: "Pendentes"},
+		{Key: "on_time_rate", Label: "% a horas"},
+	}
+
+	doc.Summary = []reports.Field{
+		{Label: "Tomas dispensadas", Value: fmt.Sprint(report.Doses)},
+		{Label: "Tomadas a horas", Value: formatRate(report.AdherenceCounts, AdherenceOnTime)},
+		{Label: "Tomadas tarde", Value: formatRate(report.AdherenceCounts, AdherenceLate)},
+		{Label: "Falhadas", Value: formatRate(report.AdherenceCounts, AdherenceMissed)},
+	}
+
+	doc.Rows = make([][]string, 0)
+	for _, medication := range report.Medications {
+		for _, period := range medication.Periods {
+			if period.Doses == 0 {
+				continue
+			}
+			doc.Rows = append(doc.Rows, []string{
+				medication.Medication,
+				period.Start.In(location).Format("2006-01-02"),
+				fmt.Sprint(period.Doses),
+				fmt.Sprint(period.OnTime),
+				fmt.Sprint(period.Late),
+				fmt.Sprint(period.Missed),
+				fmt.Sprint(period.Pending),
+				formatRate(period.AdherenceCounts, AdherenceOnTime),
+			})
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/dropmedical/reports"
+)
+
+func TestDispensingDocument(t *testing.T) {
+	due := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	deadline := due.Add(ConfirmationWindow)
+	scheduleID := uint(7)
+
+	schedules := []DispenseSchedule{{Name: "MANHÃ", Kind: ScheduleKindScheduled, Interval: 24 * time.Hour, StartDate: due, EndDate: due.AddDate(0, 1, 0)}}
+	schedules[0].ID = scheduleID
+	records := []DispenseRecord{
+		{ScheduleID: &scheduleID, DueAt: due, DispensedAt: &due, ConfirmBy: &deadline, Status: DoseDispensed, Source: DoseSourceSchedule, Pills: PillList{"Brufen": 2, "Aspirina": 1}},
+		{ScheduleID: &scheduleID, DueAt: due.Add(24 * time.Hour), Status: DoseSkipped, Source: DoseSourceSchedule, Reason: ReasonPaused},
+	}
+
+	lisbon, _ := time.LoadLocation("Europe/Lisbon")
+	doc := &reports.Document{}
+	dispensingDocument(doc, records, schedules, lisbon, due.Add(time.Hour))
+
+	if len(doc.Rows) != 2 || len(doc.Rows[0]) != len(doc.Columns) {
+		t.Fatalf("Expected a row per dose: %+v", doc.Rows)
+	}
+	// As horas são escritas no fuso horário do paciente
+	if doc.Rows[0][0] != "2024-05-01 09:00" || doc.Rows[0][2] != "MANHÃ" || doc.Rows[0][5] != "Aspirina x1, Brufen x2" || doc.Rows[0][7] != AdherenceMissed {
+		t.Fatalf("Unexpected row: %v", doc.Rows[0])
+	}
+	if doc.Summary[1].Value != "1" || doc.Summary[3].Value != "1" || doc.Summary[4].Label != "Horário MANHÃ" {
+		t.Fatalf("Unexpected summary: %+v", doc.Summary)
+	}
+}
+
+func TestAdherenceDocument(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	report := AdherenceReport{
+		AdherenceCounts: AdherenceCounts{Doses: 4, OnTime: 3, Missed: 1},
+		Medications: []MedicationAdherence{{
+			Medication:      "Aspirina",
+			AdherenceCounts: AdherenceCounts{Doses: 4, OnTime: 3, Missed: 1},
+			Periods: []AdherencePeriod{
+				{Start: from, End: from.AddDate(0, 0, 7), AdherenceCounts: AdherenceCounts{Doses: 4, OnTime: 3, Missed: 1}},
+				{Start: from.AddDate(0, 0, 7), End: from.AddDate(0, 0, 14)},
+			},
+		}},
+	}
+
+	doc := &reports.Document{}
+	adherenceDocument(doc, report, time.UTC)
+
+	// Os períodos sem tomas não aparecem na tabela
+	if len(doc.Rows) != 1 || doc.Rows[0][7] != "75.0%" {
+		t.Fatalf("Unexpected rows: %+v", doc.Rows)
+	}
+	if doc.Summary[1].Value != "75.0%" || doc.Summary[3].Value != "25.0%" {
+		t.Fatalf("Unexpected summary: %+v", doc.Summary)
+	}
+}
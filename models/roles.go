@@ -0,0 +1,239 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Role é o papel de um utilizador, no seu tenant ou num dropper específico
+type Role string
+
+const (
+	// Vê os seus horários e o estado do dropper
+	RolePatient Role = "patient"
+	// Recarrega secções e faz dispensas manuais
+	RoleCaregiver Role = "caregiver"
+	// Cria e altera horários a partir de receitas
+	RolePharmacist Role = "pharmacist"
+	// Gere os dispositivos e os acessos
+	RoleAdmin Role = "admin"
+)
+
+// Permission é uma ação protegida da API
+type Permission string
+
+const (
+	PermViewAccount     Permission = "account:view"
+	PermViewDropper     Permission = "dropper:view"
+	PermManageDevices   Permission = "dropper:manage"
+	PermDispense        Permission = "dropper:dispense"
+	PermReloadSection   Permission = "section:reload"
+	PermViewSchedules   Permission = "schedule:view"
+	PermManageSchedules Permission = "schedule:manage"
+	PermManageAccess    Permission = "access:manage"
+	PermViewPatients    Permission = "patient:view"
+	PermManagePatients  Permission = "patient:manage"
+	PermAckAlerts       Permission = "alert:acknowledge"
+	PermRequestPRN      Permission = "prn:request"
+	PermControlSchedule Permission = "schedule:control"
+	PermSnoozeDose      Permission = "dose:snooze"
+	PermConfirmDose     Permission = "dose:confirm"
+	PermExportReports   Permission = "report:export"
+	PermShareCalendar   Permission = "calendar:share"
+	PermImportData      Permission = "data:import"
+	PermManageWebhooks  Permission = "webhook:manage"
+	PermViewAudit       Permission = "audit:view"
+)
+
+// rolePermissions define as permissões de cada papel
+var rolePermissions = map[Role][]Permission{
+	RolePatient: {
+		PermViewAccount, PermViewDropper, PermViewSchedules, PermViewPatients,
+		PermRequestPRN, PermSnoozeDose, PermConfirmDose, PermShareCalendar,
+	},
+	RoleCaregiver: {
+		PermViewAccount, PermViewDropper, PermViewSchedules, PermViewPatients,
+		PermReloadSection, PermDispense, PermManagePatients, PermAckAlerts,
+		PermRequestPRN, PermControlSchedule, PermSnoozeDose, PermConfirmDose,
+		PermExportReports, PermShareCalendar,
+	},
+	RolePharmacist: {
+		PermViewAccount, PermViewDropper, PermViewSchedules, PermViewPatients,
+		PermManageSchedules, PermAckAlerts, PermControlSchedule, PermExportReports,
+	},
+	RoleAdmin: {
+		PermViewAccount, PermViewDropper, PermViewSchedules, PermViewPatients,
+		PermReloadSection, PermDispense, PermManageSchedules, PermManagePatients,
+		PermManageDevices, PermManageAccess, PermAckAlerts, PermRequestPRN,
+		PermControlSchedule, PermSnoozeDose, PermConfirmDose, PermExportReports,
+		PermShareCalendar, PermImportData, PermManageWebhooks, PermViewAudit,
+	},
+}
+
+var (
+	ErrInvalidRole   = errors.New("papel inválido")
+	ErrGrantExists   = errors.New("o utilizador já tem acesso a este dropper")
+	ErrGrantNotFound = errors.New("o utilizador não tem acesso a este dropper")
+)
+
+// Valid confirma que o papel é um dos papéis conhecidos
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Can indica se o papel tem a permissão
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
+
+// DropperGrant dá a um utilizador um papel num dropper, mesmo que o dropper seja de outro tenant
+type DropperGrant struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+
+	DropperID uint `gorm:"uniqueIndex:idx_dropper_grant;not null" json:"-"`
+	UserID    uint `gorm:"uniqueIndex:idx_dropper_grant;index;not null" json:"user_id"`
+	Role      Role `gorm:"not null" json:"role"`
+	// Utilizador que concedeu o acesso
+	GrantedBy uint `json:"granted_by"`
+
+	User User `gorm:"constraint:OnDelete:CASCADE;" json:"user"`
+}
+
+// Actor identifica quem faz um pedido: o utilizador, o seu tenant e o seu papel nesse tenant
+type Actor struct {
+	UserID   uint
+	TenantID uint
+	Role     Role
+}
+
+// AccessibleBy limita uma query sobre droppers aos do tenant do ator e aos que lhe foram concedidos.
+// Um ator sem tenant nem acessos nunca corresponde a nenhum dropper.
+func AccessibleBy(actor Actor) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		granted := db.Session(&gorm.Session{NewDB: true}).
+			Model(&DropperGrant{}).
+			Select("dropper_id").
+			Where("user_id = ?", actor.UserID)
+
+		return db.Where("(droppers.tenant_id = ? OR droppers.id IN (?))", actor.TenantID, granted)
+	}
+}
+
+// DropperRoles devolve os papéis do ator no dropper: o seu papel no tenant, se o dropper for do
+// seu tenant, e o papel que lhe tenha sido concedido no dropper
+func (a Actor) DropperRoles(db *gorm.DB, d *Dropper) ([]Role, error) {
+	roles := make([]Role, 0, 2)
+	if d.TenantID != 0 && d.TenantID == a.TenantID {
+		roles = append(roles, a.Role)
+	}
+
+	var grant DropperGrant
+	err := db.Limit(1).Find(&grant, "dropper_id = ? and user_id = ?", d.ID, a.UserID).Error
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	if grant.ID != 0 {
+		roles = append(roles, grant.Role)
+	}
+
+	return roles, nil
+}
+
+// Can indica se algum dos papéis do ator no dropper tem a permissão
+func (a Actor) Can(db *gorm.DB, d *Dropper, p Permission) (bool, error) {
+	roles, err := a.DropperRoles(db, d)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(roles, func(r Role) bool { return r.Can(p) }), nil
+}
+
+// ListGrants devolve os acessos concedidos no dropper, com o papel indicado ou todos se role for vazio
+func (d *Dropper) ListGrants(db *gorm.DB, role Role) ([]DropperGrant, error) {
+	grants := make([]DropperGrant, 0)
+
+	query := db.Preload("User").Where("dropper_id = ?", d.ID)
+	if role != "" {
+		query = query.Where("role = ?", role)
+	}
+	if err := query.Order("created_at").Find(&grants).Error; err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return grants, nil
+}
+
+// Grant concede ao utilizador com o email indicado um papel no dropper
+func (d *Dropper) Grant(db *gorm.DB, email string, role Role, grantedBy uint) (*DropperGrant, error) {
+	if !role.Valid() {
+		return nil, ErrInvalidRole
+	}
+
+	var user User
+	err := db.First(&user, "email = ?", normalizeEmail(email)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	grant := DropperGrant{
+		DropperID: d.ID,
+		UserID:    user.ID,
+		Role:      role,
+		GrantedBy: grantedBy,
+		User:      user,
+	}
+	err = db.Omit("User").Create(&grant).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrGrantExists
+	} else if err != nil {
+		log.Printf("Erro inesperado ao conceder acesso: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	log.Printf("Utilizador <%d> tem agora o papel %s no dropper <%d>", user.ID, role, d.ID)
+	return &grant, nil
+}
+
+// Revoke retira ao utilizador o papel indicado no dropper. Os calendários do dropper criados
+// pelo utilizador são revogados se ele deixar de poder partilhar as tomas do dropper.
+func (d *Dropper) Revoke(db *gorm.DB, userID uint, role Role) error {
+	var revoked int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("dropper_id = ? and user_id = ? and role = ?", d.ID, userID, role).Delete(&DropperGrant{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		revoked = result.RowsAffected
+
+		var user User
+		if err := tx.Limit(1).Find(&user, userID).Error; err != nil {
+			return err
+		}
+		actor := Actor{UserID: userID, TenantID: user.TenantID, Role: user.Role}
+		if can, err := actor.Can(tx, d, PermShareCalendar); err != nil || can {
+			return err
+		}
+		return revokeCalendarFeeds(tx, tx.Where("user_id = ? and dropper_id = ?", userID, d.ID))
+	})
+	if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	if revoked == 0 {
+		return ErrGrantNotFound
+	}
+
+	log.Printf("Utilizador <%d> perdeu o papel %s no dropper <%d>", userID, role, d.ID)
+	return nil
+}
@@ -0,0 +1,34 @@
+package models
+
+import "testing"
+
+func TestRolePermissions(t *testing.T) {
+	cases := []struct {
+		role    Role
+		allowed []Permission
+		denied  []Permission
+	}{
+		{RolePatient, []Permission{PermViewDropper, PermViewSchedules, PermRequestPRN, PermSnoozeDose, PermConfirmDose, PermShareCalendar}, []Permission{PermControlSchedule, PermExportReports, PermDispense, PermReloadSection, PermManageSchedules, PermManageDevices, PermAckAlerts, PermImportData, PermManageWebhooks, PermViewAudit}},
+		{RoleCaregiver, []Permission{PermReloadSection, PermDispense, PermAckAlerts, PermControlSchedule}, []Permission{PermManageSchedules, PermManageDevices, PermManageAccess, PermImportData, PermManageWebhooks, PermViewAudit}},
+		{RolePharmacist, []Permission{PermManageSchedules, PermExportReports}, []Permission{PermDispense, PermReloadSection, PermManageDevices, PermRequestPRN, PermConfirmDose, PermShareCalendar}},
+		{RoleAdmin, []Permission{PermManageDevices, PermManageAccess, PermDispense, PermManageSchedules, PermImportData, PermManageWebhooks, PermViewAudit}, nil},
+		{Role("intruder"), nil, []Permission{PermViewAccount, PermViewDropper}},
+	}
+
+	for _, c := range cases {
+		for _, p := range c.allowed {
+			if !c.role.Can(p) {
+				t.Errorf("%s should have %s", c.role, p)
+			}
+		}
+		for _, p := range c.denied {
+			if c.role.Can(p) {
+				t.Errorf("%s should not have %s", c.role, p)
+			}
+		}
+	}
+
+	if Role("intruder").Valid() || !RoleCaregiver.Valid() {
+		t.Fatal("Only the known roles are valid")
+	}
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm/schema"
+
+	"github.com/TomascpMarques/dropmedical/migrations"
+)
+
+var (
+	createTable = regexp.MustCompile(`(?s)CREATE TABLE "(\w+)" \((.*?)\n\);`)
+	tableColumn = regexp.MustCompile(`(?m)^\s+"(\w+)" `)
+	addColumn   = regexp.MustCompile(`ALTER TABLE "(\w+)" ADD COLUMN "(\w+)"`)
+	dropColumn  = regexp.MustCompile(`ALTER TABLE "(\w+)" DROP COLUMN "(\w+)"`)
+	dropTable   = regexp.MustCompile(`DROP TABLE "(\w+)"`)
+)
+
+// migratedColumns devolve as colunas de cada tabela depois de todas as migrações
+func migratedColumns() map[string]map[string]bool {
+	tables := make(map[string]map[string]bool)
+	for _, migration := range migrations.All() {
+		for _, match := range createTable.FindAllStringSubmatch(migration.Up, -1) {
+			tables[match[1]] = make(map[string]bool)
+			for _, column := range tableColumn.FindAllStringSubmatch(match[2], -1) {
+				tables[match[1]][column[1]] = true
+			}
+		}
+		for _, match := range addColumn.FindAllStringSubmatch(migration.Up, -1) {
+			tables[match[1]][match[2]] = true
+		}
+		for _, match := range dropColumn.FindAllStringSubmatch(migration.Up, -1) {
+			delete(tables[match[1]], match[2])
+		}
+		for _, match := range dropTable.FindAllStringSubmatch(migration.Up, -1) {
+			delete(tables, match[1])
+		}
+	}
+	return tables
+}
+
+// As alterações aos modelos precisam de uma migração com as mesmas colunas
+func TestMigrationsCoverModels(t *testing.T) {
+	tables := migratedColumns()
+	cache := &sync.Map{}
+
+	check := func(s *schema.Schema) {
+		columns, ok := tables[s.Table]
+		if !ok {
+			t.Errorf("No migration creates the table %s", s.Table)
+			return
+		}
+		for _, column := range s.DBNames {
+			if !columns[column] {
+				t.Errorf("No migration adds the column %s.%s", s.Table, column)
+			}
+		}
+	}
+	for _, model := range schemaModels {
+		s, err := schema.Parse(model, cache, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(s)
+		for _, relationship := range s.Relationships.Relations {
+			if relationship.JoinTable != nil {
+				check(relationship.JoinTable)
+			}
+		}
+	}
+}
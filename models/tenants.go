@@ -0,0 +1,32 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Tenant é uma conta/agregado familiar. Os droppers pertencem a um tenant e todas as
+// consultas feitas em nome de um utilizador são limitadas ao tenant desse utilizador.
+type Tenant struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	Name string `json:"name"`
+
+	Users    []User    `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	Droppers []Dropper `gorm:"constraint:OnDelete:SET NULL;" json:"-"`
+}
+
+// CreateTenant cria uma nova conta vazia
+func CreateTenant(db *gorm.DB, name string) (*Tenant, error) {
+	tenant := Tenant{Name: name}
+
+	if err := db.Create(&tenant).Error; err != nil {
+		log.Printf("Erro inesperado ao criar tenant: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &tenant, nil
+}
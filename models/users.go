@@ -0,0 +1,276 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// MinPasswordLength é o tamanho mínimo aceite para uma password
+const MinPasswordLength = 8
+
+var (
+	ErrUserExists          = errors.New("já existe um utilizador com este email")
+	ErrUserNotFound        = errors.New("utilizador não encontrado")
+	ErrInvalidEmail        = errors.New("email inválido")
+	ErrWeakPassword        = errors.New("a password é demasiado curta")
+	ErrInvalidCredentials  = errors.New("email ou password incorretos")
+	ErrInvalidRefreshToken = errors.New("refresh token inválido ou expirado")
+)
+
+// User é uma conta com acesso à API
+type User struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	// Tenant a que o utilizador pertence, criado no registo
+	TenantID uint `gorm:"index" json:"tenant_id"`
+	// Papel do utilizador no seu tenant
+	Role Role `gorm:"not null;default:admin" json:"role"`
+
+	Email        string `gorm:"uniqueIndex;not null" json:"email"`
+	Name         string `json:"name"`
+	PasswordHash string `gorm:"not null" json:"-"`
+}
+
+// RefreshToken guarda o hash de um refresh token emitido, o token em si nunca é guardado
+type RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UserID    uint   `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// newUser valida o email e a password de uma nova conta, guardando apenas o hash bcrypt da password
+func newUser(name, email, password string, role Role) (*User, error) {
+	email = normalizeEmail(email)
+	if _, err := mail.ParseAddress(email); err != nil {
+		return nil, ErrInvalidEmail
+	}
+	if len(password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		// bcrypt recusa passwords com mais de 72 bytes
+		return nil, ErrWeakPassword
+	}
+
+	return &User{Email: email, Name: name, PasswordHash: string(hash), Role: role}, nil
+}
+
+// RegisterUser cria uma nova conta. Cada utilizador registado fica com um tenant próprio, de que
+// é administrador; para entrar noutro tenant é preciso um convite (ver AcceptInvite).
+func RegisterUser(db *gorm.DB, name, email, password string) (*User, error) {
+	user, err := newUser(name, email, password, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		tenant := Tenant{Name: name}
+		if err := tx.Create(&tenant).Error; err != nil {
+			return err
+		}
+		user.TenantID = tenant.ID
+		return tx.Create(user).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrUserExists
+	} else if err != nil {
+		log.Printf("Erro inesperado ao criar utilizador: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	return user, nil
+}
+
+// dummyHash é comparado quando o email não existe, para que o tempo de resposta não revele contas
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dropmedical-dummy-password"), bcrypt.DefaultCost)
+
+// AuthenticateUser valida as credenciais e devolve o utilizador correspondente
+func AuthenticateUser(db *gorm.DB, email, password string) (*User, error) {
+	var user User
+
+	err := db.First(&user, "email = ?", normalizeEmail(email)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if err := user.ensureTenant(db); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ensureTenant dá um tenant próprio às contas criadas antes de existirem tenants
+func (u *User) ensureTenant(db *gorm.DB) error {
+	if u.TenantID != 0 {
+		return nil
+	}
+
+	tenant, err := CreateTenant(db, u.Name)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(u).Update("tenant_id", tenant.ID).Error; err != nil {
+		log.Printf("Erro inesperado ao associar tenant ao utilizador <%d>: %s", u.ID, err.Error())
+		return ErrUnexpectedError
+	}
+	u.TenantID = tenant.ID
+	return nil
+}
+
+// FindUser procura um utilizador pelo seu id
+func FindUser(db *gorm.DB, id uint) (*User, error) {
+	var user User
+
+	err := db.First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &user, nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshToken gera um novo refresh token opaco para o utilizador, válido durante ttl
+func IssueRefreshToken(db *gorm.DB, userID uint, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := db.Create(&RefreshToken{
+		UserID:    userID,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}).Error
+	if err != nil {
+		log.Printf("Erro inesperado ao guardar refresh token: %s", err.Error())
+		return "", ErrUnexpectedError
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken troca um refresh token válido por um novo, revogando o anterior. O utilizador
+// é lido da base de dados, por isso os novos tokens têm o tenant e o papel atuais.
+// Se um token já revogado for reutilizado, todos os tokens do utilizador são revogados,
+// porque isso indica que o token foi roubado.
+func RotateRefreshToken(db *gorm.DB, token string, ttl time.Duration) (*User, string, error) {
+	var stored RefreshToken
+
+	err := db.First(&stored, "token_hash = ?", hashRefreshToken(token)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", ErrInvalidRefreshToken
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, "", ErrUnexpectedError
+	}
+
+	now := time.Now().UTC()
+	if stored.RevokedAt != nil {
+		return nil, "", revokeReusedToken(db, stored.UserID)
+	}
+	if now.After(stored.ExpiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	user, err := FindUser(db, stored.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := user.ensureTenant(db); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	err = db.Transaction(func(tx *gorm.DB) (err error) {
+		// Só um dos pedidos simultâneos com o mesmo token o revoga, os outros são uma reutilização
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? and revoked_at is null", stored.ID).
+			Update("revoked_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errRefreshTokenReused
+		}
+
+		next, err = IssueRefreshToken(tx, user.ID, ttl)
+		return err
+	})
+	if errors.Is(err, errRefreshTokenReused) {
+		return nil, "", revokeReusedToken(db, stored.UserID)
+	} else if errors.Is(err, ErrUnexpectedError) {
+		return nil, "", err
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, "", ErrUnexpectedError
+	}
+
+	return user, next, nil
+}
+
+// errRefreshTokenReused indica que o refresh token foi revogado por outro pedido
+var errRefreshTokenReused = errors.New("refresh token reutilizado")
+
+// revokeReusedToken revoga todas as sessões do utilizador cujo refresh token revogado foi
+// reutilizado e devolve o erro a responder
+func revokeReusedToken(db *gorm.DB, userID uint) error {
+	log.Printf("Refresh token revogado reutilizado, a revogar todas as sessões do utilizador <%d>", userID)
+	if err := revokeSessions(db, userID); err != nil {
+		log.Printf("Erro inesperado ao revogar as sessões do utilizador <%d>: %s", userID, err.Error())
+		return ErrUnexpectedError
+	}
+	return ErrInvalidRefreshToken
+}
+
+// revokeSessions revoga todos os refresh tokens ativos do utilizador
+func revokeSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&RefreshToken{}).
+		Where("user_id = ? and revoked_at is null", userID).
+		Update("revoked_at", time.Now().UTC()).
+		Error
+}
+
+// RevokeRefreshToken revoga um refresh token, terminando essa sessão
+func RevokeRefreshToken(db *gorm.DB, token string) error {
+	return db.Model(&RefreshToken{}).
+		Where("token_hash = ? and revoked_at is null", hashRefreshToken(token)).
+		Update("revoked_at", time.Now().UTC()).
+		Error
+}
@@ -0,0 +1,458 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/TomascpMarques/dropmedical/events"
+	"github.com/TomascpMarques/dropmedical/webhooks"
+)
+
+var (
+	ErrWebhookNotFound   = errors.New("webhook não encontrado")
+	ErrInvalidWebhook    = errors.New("webhook inválido, o endereço tem de ser http(s) e público e os eventos conhecidos")
+	ErrDeliveryNotFound  = errors.New("entrega não encontrada")
+	ErrDeliveryNotFailed = errors.New("só as entregas falhadas podem ser repetidas")
+)
+
+// Estados de uma entrega
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// EventWebhookPing é o evento de teste enviado a pedido, para confirmar o endereço e a assinatura
+const EventWebhookPing = "ping"
+
+const (
+	// WebhookMaxAttempts é o número de tentativas até a entrega ficar falhada, cerca de um dia
+	WebhookMaxAttempts = 10
+	// WebhookTick é o intervalo entre execuções do WebhookBGJob
+	WebhookTick = 5 * time.Second
+	// WebhookLease é o tempo em que uma entrega reclamada não é tentada por outro processo, mais
+	// do que uma tentativa demora. Se o processo parar a meio, a entrega é tentada depois dele.
+	WebhookLease = 6 * webhooks.Timeout
+)
+
+// WebhookEventTypes são os eventos que podem ser subscritos
+var WebhookEventTypes = []string{
+	EventDispense, EventAlert, EventDeviceAck, EventInventory, EventDeviceOnline, EventDeviceOffline,
+}
+
+// WebhookClient é o cliente HTTP das entregas, que só liga a endereços públicos
+var WebhookClient = webhooks.NewClient()
+
+// Webhook é a subscrição dos eventos do tenant por um parceiro. Os eventos são entregues pelo
+// WebhookBGJob, assinados com o segredo, que só é devolvido na criação.
+type Webhook struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	TenantID uint `gorm:"index;not null" json:"-"`
+	// Utilizador que criou o webhook
+	CreatedBy uint `json:"created_by"`
+
+	URL        string   `gorm:"not null" json:"url"`
+	EventTypes []string `gorm:"serializer:json" json:"events"`
+	Secret     string   `gorm:"not null" json:"-"`
+	Active     bool     `gorm:"not null" json:"active"`
+}
+
+// WebhookDelivery é a entrega de um evento a um webhook e o registo da última tentativa
+type WebhookDelivery struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	WebhookID uint `gorm:"index;not null" json:"webhook_id"`
+	// Id do evento em tempo real, recomeça quando o servidor reinicia
+	EventID   uint64 `json:"event_id"`
+	EventType string `gorm:"not null" json:"event_type"`
+	// Corpo JSON enviado, igual em todas as tentativas
+	Payload []byte `gorm:"not null" json:"-"`
+
+	Status        string     `gorm:"index;not null" json:"status"`
+	Attempts      int        `gorm:"not null" json:"attempts"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at"`
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+	// Estado HTTP da última resposta, 0 se o parceiro não respondeu
+	ResponseStatus int        `json:"response_status"`
+	Error          string     `json:"error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// WebhookFields são os dados de criação ou alteração de um webhook, os campos nil não mudam
+type WebhookFields struct {
+	URL        *string
+	EventTypes []string
+	Active     *bool
+}
+
+// apply valida e copia os campos definidos para o webhook. O host do endereço tem de resolver só
+// para endereços públicos, o que volta a ser confirmado em cada entrega pelo WebhookClient.
+func (f WebhookFields) apply(w *Webhook) error {
+	if f.URL != nil {
+		target, err := url.Parse(*f.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+			return ErrInvalidWebhook
+		}
+		if err := webhooks.CheckHost(context.Background(), target.Hostname()); err != nil {
+			log.Printf("Endereço de webhook recusado: %s", err.Error())
+			return ErrInvalidWebhook
+		}
+		w.URL = target.String()
+	}
+	if f.EventTypes != nil {
+		if len(f.EventTypes) == 0 {
+			return ErrInvalidWebhook
+		}
+		types := make([]string, 0, len(f.EventTypes))
+		for _, kind := range f.EventTypes {
+			if !slices.Contains(WebhookEventTypes, kind) {
+				return ErrInvalidWebhook
+			}
+			if !slices.Contains(types, kind) {
+				types = append(types, kind)
+			}
+		}
+		w.EventTypes = types
+	}
+	if f.Active != nil {
+		w.Active = *f.Active
+	}
+	return nil
+}
+
+// CreateWebhook cria o webhook do tenant com um segredo novo. O endereço e os eventos são obrigatórios.
+func CreateWebhook(db *gorm.DB, tenantID uint, userID uint, fields WebhookFields) (*Webhook, error) {
+	if fields.URL == nil || fields.EventTypes == nil {
+		return nil, ErrInvalidWebhook
+	}
+
+	webhook := Webhook{TenantID: tenantID, CreatedBy: userID, Active: true}
+	if err := fields.apply(&webhook); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Erro inesperado ao gerar o segredo do webhook: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	webhook.Secret = "whsec_" + base64.RawURLEncoding.EncodeToString(raw)
+
+	if err := db.Create(&webhook).Error; err != nil {
+		log.Printf("Erro inesperado ao criar webhook: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &webhook, nil
+}
+
+// ListWebhooks devolve uma página dos webhooks do tenant, filtrados por estado ativo
+func ListWebhooks(db *gorm.DB, tenantID uint, options ListOptions) ([]Webhook, int64, error) {
+	list := make([]Webhook, 0)
+
+	options.Name = ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	query := db.Model(&Webhook{}).Where("tenant_id = ?", tenantID)
+	total, err := options.find(query, &list, "created_at", "url")
+
+	return list, total, err
+}
+
+// FindWebhook procura o webhook do tenant
+func FindWebhook(db *gorm.DB, tenantID uint, id uint) (*Webhook, error) {
+	var webhook Webhook
+
+	err := db.First(&webhook, "id = ? and tenant_id = ?", id, tenantID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWebhookNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &webhook, nil
+}
+
+// Update altera o endereço, os eventos ou o estado do webhook. As entregas por fazer de um
+// webhook inativo esperam até este voltar a ser ativado.
+func (w *Webhook) Update(db *gorm.DB, fields WebhookFields) error {
+	if err := fields.apply(w); err != nil {
+		return err
+	}
+
+	if err := db.Save(w).Error; err != nil {
+		log.Printf("Erro inesperado ao alterar webhook: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// Delete remove o webhook e o registo das suas entregas
+func (w *Webhook) Delete(db *gorm.DB) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", w.ID).Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(w).Error
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao remover webhook: %s", err.Error())
+		return ErrUnexpectedError
+	}
+	return nil
+}
+
+// subscribes indica se o webhook recebe os eventos do tipo indicado
+func (w *Webhook) subscribes(kind string) bool {
+	return w.Active && slices.Contains(w.EventTypes, kind)
+}
+
+// enqueue cria a entrega do evento ao webhook, feita pelo WebhookBGJob
+func (w *Webhook) enqueue(db *gorm.DB, event events.Event) (*WebhookDelivery, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	delivery := WebhookDelivery{
+		WebhookID:     w.ID,
+		EventID:       event.ID,
+		EventType:     event.Type,
+		Payload:       payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// Ping põe na fila um evento de teste, entregue mesmo que o webhook não o subscreva
+func (w *Webhook) Ping(db *gorm.DB) (*WebhookDelivery, error) {
+	delivery, err := w.enqueue(db, events.Event{
+		Type: EventWebhookPing,
+		Time: time.Now().UTC(),
+		Data: map[string]any{"webhook_id": w.ID},
+	})
+	if err != nil {
+		log.Printf("Erro inesperado ao testar webhook: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return delivery, nil
+}
+
+// ListDeliveries devolve uma página do registo de entregas do webhook, filtradas pelo estado
+func (w *Webhook) ListDeliveries(db *gorm.DB, status string, options ListOptions) ([]WebhookDelivery, int64, error) {
+	list := make([]WebhookDelivery, 0)
+
+	query := db.Model(&WebhookDelivery{}).Where("webhook_id = ?", w.ID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	options.Active, options.Name = nil, ""
+	if options.Sort == "" {
+		options.Sort = "-created_at"
+	}
+	total, err := options.find(query, &list, "created_at", "next_attempt_at", "attempts")
+
+	return list, total, err
+}
+
+// ReplayDelivery volta a pôr na fila uma entrega falhada, com as tentativas a zero
+func (w *Webhook) ReplayDelivery(db *gorm.DB, id uint) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+
+	err := db.First(&delivery, "id = ? and webhook_id = ?", id, w.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDeliveryNotFound
+	} else if err != nil {
+		log.Printf("Erro inesperado: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	if delivery.Status != DeliveryFailed {
+		return nil, ErrDeliveryNotFailed
+	}
+
+	now := time.Now().UTC()
+	delivery.Status, delivery.Attempts, delivery.NextAttemptAt = DeliveryPending, 0, &now
+	if err := db.Model(&delivery).Select("status", "attempts", "next_attempt_at").Updates(&delivery).Error; err != nil {
+		log.Printf("Erro inesperado ao repetir entrega: %s", err.Error())
+		return nil, ErrUnexpectedError
+	}
+	return &delivery, nil
+}
+
+// ReplayFailed volta a pôr na fila todas as entregas falhadas do webhook e devolve quantas foram
+func (w *Webhook) ReplayFailed(db *gorm.DB) (int64, error) {
+	result := db.Model(&WebhookDelivery{}).
+		Where("webhook_id = ? and status = ?", w.ID, DeliveryFailed).
+		Updates(map[string]any{"status": DeliveryPending, "attempts": 0, "next_attempt_at": time.Now().UTC()})
+	if result.Error != nil {
+		log.Printf("Erro inesperado ao repetir entregas: %s", result.Error.Error())
+		return 0, ErrUnexpectedError
+	}
+	return result.RowsAffected, nil
+}
+
+// EnqueueWebhookEvent põe na fila a entrega do evento a cada webhook ativo do tenant que o subscreve
+func EnqueueWebhookEvent(db *gorm.DB, event events.Event) error {
+	if event.TenantID == 0 {
+		return nil
+	}
+
+	var list []Webhook
+	if err := db.Where("tenant_id = ? and active", event.TenantID).Find(&list).Error; err != nil {
+		return err
+	}
+	for i := range list {
+		if !list[i].subscribes(event.Type) {
+			continue
+		}
+		if _, err := list[i].enqueue(db, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt tenta entregar o evento ao webhook, no instante now do relógio do job. Se falhar, a
+// próxima tentativa é marcada com espera exponencial e, depois de WebhookMaxAttempts, a entrega
+// fica falhada.
+func (d *WebhookDelivery) attempt(client *http.Client, webhook *Webhook, now time.Time) {
+	d.Attempts++
+	d.LastAttemptAt = &now
+
+	status, err := webhooks.Send(context.Background(), client, webhooks.Request{
+		URL:      webhook.URL,
+		Secret:   webhook.Secret,
+		Event:    d.EventType,
+		Delivery: strconv.FormatUint(uint64(d.ID), 10),
+		Body:     d.Payload,
+	})
+	d.ResponseStatus = status
+	if err != nil {
+		// O registo das entregas é lido pelo tenant, só fica o motivo sem os detalhes
+		log.Printf("Erro na entrega <%d> ao webhook <%d> (tentativa %d): %s", d.ID, webhook.ID, d.Attempts, err.Error())
+		d.Error = webhooks.Reason(err)
+	}
+
+	switch {
+	case err == nil:
+		d.Status, d.Error, d.NextAttemptAt, d.DeliveredAt = DeliveryDelivered, "", nil, &now
+	case d.Attempts >= WebhookMaxAttempts:
+		d.Status, d.NextAttemptAt = DeliveryFailed, nil
+	default:
+		next := now.Add(webhooks.Backoff(d.Attempts))
+		d.NextAttemptAt = &next
+	}
+}
+
+// claimWebhookDelivery reclama a próxima entrega pendente até now de um webhook ativo, adiando a
+// sua próxima tentativa pelo WebhookLease, e devolve-a com o webhook ou nil se não houver
+func claimWebhookDelivery(db *gorm.DB, now time.Time) (*WebhookDelivery, *Webhook, error) {
+	var delivery WebhookDelivery
+	var webhook Webhook
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? and next_attempt_at <= ?", DeliveryPending, now).
+			Where("webhook_id in (?)", tx.Model(&Webhook{}).Select("id").Where("active")).
+			Order("next_attempt_at").
+			First(&delivery).
+			Error
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&webhook, delivery.WebhookID).Error; err != nil {
+			return err
+		}
+
+		lease := time.Now().UTC().Add(WebhookLease)
+		return tx.Model(&delivery).Update("next_attempt_at", lease).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return &delivery, &webhook, nil
+}
+
+// DeliverWebhooks faz as tentativas de entrega pendentes até now, dos webhooks ativos. Cada
+// entrega é reclamada numa transação curta, enviada fora dela e o resultado gravado depois, para
+// que nenhuma transação fique aberta durante o pedido HTTP.
+func DeliverWebhooks(db *gorm.DB, client *http.Client, now time.Time) error {
+	for {
+		delivery, webhook, err := claimWebhookDelivery(db, now)
+		if err != nil {
+			log.Printf("Erro ao entregar webhooks: %s", err.Error())
+			return err
+		}
+		if delivery == nil {
+			return nil
+		}
+
+		delivery.attempt(client, webhook, now)
+		err = db.Model(delivery).
+			Select("status", "attempts", "next_attempt_at", "last_attempt_at", "response_status", "error", "delivered_at").
+			Updates(delivery).
+			Error
+		if err != nil {
+			log.Printf("Erro ao gravar a entrega <%d> do webhook <%d>: %s", delivery.ID, webhook.ID, err.Error())
+			return err
+		}
+	}
+}
+
+// WebhookBGJob corre a cada WebhookTick e faz as entregas pendentes
+func WebhookBGJob(db *gorm.DB) error {
+	time.Sleep(WebhookTick)
+	return DeliverWebhooks(db, WebhookClient, time.Now().UTC())
+}
+
+// lastWebhookEvent é o último evento posto na fila, para retomar a subscrição se esta for fechada
+var lastWebhookEvent uint64
+
+// WebhookEventsBGJob subscreve os eventos em tempo real e põe na fila as entregas aos webhooks.
+// Termina se a subscrição for fechada por não acompanhar os eventos, para ser retomada.
+func WebhookEventsBGJob(db *gorm.DB) error {
+	sub, missed, complete := Events.Subscribe(lastWebhookEvent)
+	defer sub.Close()
+	if !complete {
+		log.Printf("Eventos perdidos pelos webhooks depois do evento <%d>", lastWebhookEvent)
+	}
+
+	enqueue := func(event events.Event) {
+		if err := EnqueueWebhookEvent(db, event); err != nil {
+			log.Printf("Erro ao pôr na fila o evento <%d> dos webhooks: %s", event.ID, err.Error())
+		}
+		lastWebhookEvent = event.ID
+	}
+	for _, event := range missed {
+		enqueue(event)
+	}
+	for event := range sub.Events() {
+		enqueue(event)
+	}
+	return nil
+}
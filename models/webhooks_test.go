@@ -0,0 +1,90 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/dropmedical/webhooks"
+)
+
+func TestWebhookFields(t *testing.T) {
+	invalid := []WebhookFields{
+		{URL: strPtr("ftp://partner.example/hook")},
+		{URL: strPtr("/hook")},
+		{URL: strPtr("http://127.0.0.1:8080/hook")},
+		{URL: strPtr("http://localhost/hook")},
+		{URL: strPtr("http://10.0.0.5/hook")},
+		{URL: strPtr("http://169.254.169.254/latest/meta-data")},
+		{URL: strPtr("http://[::1]/hook")},
+		{EventTypes: []string{}},
+		{EventTypes: []string{EventDispense, "unknown"}},
+	}
+	for _, fields := range invalid {
+		if err := fields.apply(&Webhook{}); !errors.Is(err, ErrInvalidWebhook) {
+			t.Errorf("Expected %+v to be invalid, got %v", fields, err)
+		}
+	}
+
+	webhook := Webhook{Active: true}
+	fields := WebhookFields{URL: strPtr("https://203.0.113.10/hook"), EventTypes: []string{EventAlert, EventDispense, EventAlert}}
+	if err := fields.apply(&webhook); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.EventTypes) != 2 || !webhook.subscribes(EventDispense) || webhook.subscribes(EventInventory) {
+		t.Fatalf("Unexpected subscription %+v", webhook)
+	}
+	webhook.Active = false
+	if webhook.subscribes(EventDispense) {
+		t.Fatal("Inactive webhooks receive no events")
+	}
+}
+
+func strPtr(value string) *string {
+	return &value
+}
+
+func TestWebhookDeliveryAttempts(t *testing.T) {
+	failures := WebhookMaxAttempts
+	var signature error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature = webhooks.Verify("whsec_test", r.Header.Get(webhooks.SignatureHeader), body, time.Now())
+		if failures > 0 {
+			failures--
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	webhook := Webhook{ID: 1, URL: server.URL, Secret: "whsec_test", Active: true}
+	delivery := WebhookDelivery{ID: 1, EventType: EventDispense, Payload: []byte(`{}`), Status: DeliveryPending}
+	now := time.Now().UTC()
+
+	delivery.attempt(server.Client(), &webhook, now)
+	if signature != nil {
+		t.Fatalf("The stand-in should verify the signature: %s", signature.Error())
+	}
+	if delivery.Status != DeliveryPending || delivery.ResponseStatus != 500 || delivery.Error != webhooks.ErrRejected.Error() || !delivery.NextAttemptAt.Equal(now.Add(webhooks.BaseBackoff)) {
+		t.Fatalf("Expected a retry after the backoff, got %+v", delivery)
+	}
+
+	for delivery.Status == DeliveryPending {
+		delivery.attempt(server.Client(), &webhook, now)
+	}
+	if delivery.Status != DeliveryFailed || delivery.Attempts != WebhookMaxAttempts || delivery.NextAttemptAt != nil {
+		t.Fatalf("Expected the delivery to fail after %d attempts, got %+v", WebhookMaxAttempts, delivery)
+	}
+
+	// Depois de repetida a entrega é feita
+	delivery.Status, delivery.Attempts = DeliveryPending, 0
+	delivery.attempt(server.Client(), &webhook, now)
+	if delivery.Status != DeliveryDelivered || delivery.DeliveredAt == nil || delivery.Error != "" {
+		t.Fatalf("Expected the delivery to succeed, got %+v", delivery)
+	}
+}
@@ -1,13 +1,18 @@
 package mqtt_api
 
 import (
+	"encoding/json"
 	"log"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
 )
 
 // MQTT Topics
@@ -20,6 +25,20 @@ const (
 	DevicesROOT   = "devices/disp"
 	DevicesDrop   = "/drop"
 	DevicesReload = "/reload"
+	// Relatórios dos sensores de posição, enviados pelo dispositivo
+	DevicesOccupancy = "/occupancy"
+	// Pedidos de toma em SOS feitos no botão do dropper
+	DevicesRequest = "/request"
+	// Respostas aos pedidos de toma em SOS, com o motivo da recusa
+	DevicesPrnReply = "/prn"
+	// Lembretes antes de cada toma (LED/buzzer), enviados pelo PillDispenseBGJob
+	DevicesRemind = "/remind"
+	// Adiamentos da toma, quando o paciente carrega no botão depois do lembrete
+	DevicesSnooze = "/snooze"
+	// Eventos de toma feita (copo retirado ou comprimidos tomados), enviados pelo dispositivo
+	DevicesTaken = "/taken"
+	// Respostas do dispositivo aos comandos, ex: depois de rodar até à posição pedida
+	DevicesAck = "/ack"
 	// -----------------------
 )
 
@@ -31,17 +50,59 @@ func BuildDeviceReloadPillRoute(device_id string) string {
 	return DevicesROOT + DevicesReload + "/" + device_id
 }
 
+func BuildDeviceOccupancyRoute(device_id string) string {
+	return DevicesROOT + DevicesOccupancy + "/" + device_id
+}
+
+func BuildDeviceRequestRoute(device_id string) string {
+	return DevicesROOT + DevicesRequest + "/" + device_id
+}
+
+func BuildDevicePrnReplyRoute(device_id string) string {
+	return DevicesROOT + DevicesPrnReply + "/" + device_id
+}
+
+func BuildDeviceRemindRoute(device_id string) string {
+	return DevicesROOT + DevicesRemind + "/" + device_id
+}
+
+func BuildDeviceSnoozeRoute(device_id string) string {
+	return DevicesROOT + DevicesSnooze + "/" + device_id
+}
+
+func BuildDeviceTakenRoute(device_id string) string {
+	return DevicesROOT + DevicesTaken + "/" + device_id
+}
+
+func BuildDeviceAckRoute(device_id string) string {
+	return DevicesROOT + DevicesAck + "/" + device_id
+}
+
+// deviceIDFromTopic devolve o último segmento do tópico, onde os dispositivos colocam o seu serial
+func deviceIDFromTopic(topic string) string {
+	parts := strings.Split(topic, "/")
+	return parts[len(parts)-1]
+}
+
+// deviceDB devolve a ligação usada nas mensagens do dropper, cujas alterações ficam no histórico
+// de auditoria em nome do dispositivo
+func deviceDB(db *gorm.DB, serial uuid.UUID) *gorm.DB {
+	return models.AuditAs(db, models.AuditActor{Source: models.AuditSourceDevice, Device: serial.String()})
+}
+
 // NewMqttServer cria um novo servidor mqtt que permite comunicação full duplex
-func NewMqttServer() *mqtt.Server {
+func NewMqttServer(db *gorm.DB) *mqtt.Server {
 	server := mqtt.New(&mqtt.Options{
 		InlineClient: true, // you must enable inline client to use direct publishing and subscribing.
 	})
 
 	server.AddHook(new(auth.AllowHook), nil)
+	if err := server.AddHook(&presenceHook{db: db}, nil); err != nil {
+		log.Fatalln("Falha ao adicionar o hook MqTT de ligação dos dispositivos")
+	}
 
 	err := server.Subscribe(DevicesROOT+DevicesDrop+Wildcard, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
-		topic := strings.Split(pk.TopicName, "/")
-		device_id := topic[len(topic)-1]
+		device_id := deviceIDFromTopic(pk.TopicName)
 
 		if device_id == "" {
 			server.Log.Info(DevicesROOT+DevicesDrop+Wildcard, "status", "responded")
@@ -63,6 +124,41 @@ func NewMqttServer() *mqtt.Server {
 		log.Fatalln("Falha ao atribuir subscriber MqTT para o registo de dispensers")
 	}
 
+	err = server.Subscribe(DevicesROOT+DevicesOccupancy+Wildcard, 2, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handleOccupancyReport(db, pk)
+	})
+	if err != nil {
+		log.Fatalln("Falha ao atribuir subscriber MqTT para os relatórios de ocupação")
+	}
+
+	err = server.Subscribe(DevicesROOT+DevicesRequest+Wildcard, 3, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handlePrnRequest(db, server, pk)
+	})
+	if err != nil {
+		log.Fatalln("Falha ao atribuir subscriber MqTT para os pedidos de toma em SOS")
+	}
+
+	err = server.Subscribe(DevicesROOT+DevicesSnooze+Wildcard, 4, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handleSnooze(db, pk)
+	})
+	if err != nil {
+		log.Fatalln("Falha ao atribuir subscriber MqTT para os adiamentos de tomas")
+	}
+
+	err = server.Subscribe(DevicesROOT+DevicesTaken+Wildcard, 5, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handleDoseTaken(db, pk)
+	})
+	if err != nil {
+		log.Fatalln("Falha ao atribuir subscriber MqTT para as confirmações de tomas")
+	}
+
+	err = server.Subscribe(DevicesROOT+DevicesAck+Wildcard, 6, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handleDeviceAck(db, pk)
+	})
+	if err != nil {
+		log.Fatalln("Falha ao atribuir subscriber MqTT para as respostas dos dispositivos")
+	}
+
 	// Server health check
 	go func() {
 		for {
@@ -80,3 +176,165 @@ func NewMqttServer() *mqtt.Server {
 
 	return server
 }
+
+// handleOccupancyReport reconcilia o relatório de ocupação enviado por um dropper com a base de dados
+func handleOccupancyReport(db *gorm.DB, pk packets.Packet) {
+	serial, err := uuid.Parse(deviceIDFromTopic(pk.TopicName))
+	if err != nil {
+		log.Printf("Relatório de ocupação com serial inválido <%s>\n", pk.TopicName)
+		return
+	}
+
+	var report models.OccupancyReport
+	if err := json.Unmarshal(pk.Payload, &report); err != nil {
+		log.Printf("Relatório de ocupação mal-formado de <%s>: %s\n", serial, err.Error())
+		return
+	}
+
+	discrepancies, err := models.ReconcileOccupancy(deviceDB(db, serial), serial, report)
+	if err != nil {
+		log.Printf("Falha ao reconciliar ocupação de <%s>: %s\n", serial, err.Error())
+		return
+	}
+
+	for _, discrepancy := range discrepancies {
+		log.Printf(
+			"Discrepância <%s> no dropper <%s>: secção %d posição %d\n",
+			discrepancy.Kind, serial, discrepancy.Section, discrepancy.Position,
+		)
+	}
+}
+
+// prnRequestPayload é enviado pelo dropper quando o paciente carrega no botão. Sem horário é
+// usado o único horário em SOS ativo do dropper.
+type prnRequestPayload struct {
+	ScheduleID uint `json:"schedule_id"`
+}
+
+// prnReply é a resposta a um pedido de toma em SOS, publicada em BuildDevicePrnReplyRoute
+type prnReply struct {
+	Granted       bool       `json:"granted"`
+	Reason        string     `json:"reason,omitempty"`
+	NextAllowedAt *time.Time `json:"next_allowed_at,omitempty"`
+}
+
+// Motivo da resposta a pedidos que não chegam a ser avaliados, ex: horário inexistente
+const prnInvalidRequest = "invalid_request"
+
+// handlePrnRequest avalia o pedido de toma em SOS do dropper, envia os comandos de dispensa se
+// for aceite e responde sempre ao dropper com o resultado
+func handlePrnRequest(db *gorm.DB, server *mqtt.Server, pk packets.Packet) {
+	device_id := deviceIDFromTopic(pk.TopicName)
+	serial, err := uuid.Parse(device_id)
+	if err != nil {
+		log.Printf("Pedido em SOS com serial inválido <%s>\n", pk.TopicName)
+		return
+	}
+
+	var payload prnRequestPayload
+	if len(pk.Payload) > 0 {
+		if err := json.Unmarshal(pk.Payload, &payload); err != nil {
+			log.Printf("Pedido em SOS mal-formado de <%s>: %s\n", serial, err.Error())
+			publishPrnReply(server, device_id, prnReply{Reason: prnInvalidRequest})
+			return
+		}
+	}
+
+	request, commands, err := models.RequestPRNFromDevice(deviceDB(db, serial), serial, payload.ScheduleID)
+	if err != nil {
+		log.Printf("Falha no pedido em SOS de <%s>: %s\n", serial, err.Error())
+		publishPrnReply(server, device_id, prnReply{Reason: prnInvalidRequest})
+		return
+	}
+
+	for _, command := range commands {
+		if err := server.Publish(command.Topic, command.Value, false, 0); err != nil {
+			log.Printf("Falha ao enviar comando para <%s>: %s\n", serial, err.Error())
+		}
+	}
+	publishPrnReply(server, device_id, prnReply{
+		Granted:       request.Granted,
+		Reason:        request.Reason,
+		NextAllowedAt: request.NextAllowedAt,
+	})
+}
+
+func publishPrnReply(server *mqtt.Server, device_id string, reply prnReply) {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if err := server.Publish(BuildDevicePrnReplyRoute(device_id), payload, false, 1); err != nil {
+		log.Printf("Falha ao responder ao pedido em SOS de <%s>: %s\n", device_id, err.Error())
+	}
+}
+
+// handleSnooze adia a próxima toma do dropper com lembrete enviado. O dropper recebe um novo
+// lembrete antes da nova hora da toma.
+func handleSnooze(db *gorm.DB, pk packets.Packet) {
+	serial, err := uuid.Parse(deviceIDFromTopic(pk.TopicName))
+	if err != nil {
+		log.Printf("Adiamento com serial inválido <%s>\n", pk.TopicName)
+		return
+	}
+
+	reminder, err := models.SnoozeFromDevice(deviceDB(db, serial), serial)
+	if err != nil {
+		log.Printf("Falha ao adiar a toma de <%s>: %s\n", serial, err.Error())
+		return
+	}
+	log.Printf("Toma do lembrete <%d> de <%s> adiada para %s\n", reminder.ID, serial, reminder.DispenseAt)
+}
+
+// doseTakenPayload é enviado pelo dropper quando deteta que a toma foi feita. Sem taken_at a
+// toma foi feita na hora de receção.
+type doseTakenPayload struct {
+	Event   string     `json:"event"`
+	TakenAt *time.Time `json:"taken_at"`
+}
+
+// handleDoseTaken confirma as tomas dispensadas no dropper que ainda não foram confirmadas
+func handleDoseTaken(db *gorm.DB, pk packets.Packet) {
+	serial, err := uuid.Parse(deviceIDFromTopic(pk.TopicName))
+	if err != nil {
+		log.Printf("Confirmação de toma com serial inválido <%s>\n", pk.TopicName)
+		return
+	}
+
+	var payload doseTakenPayload
+	if err := json.Unmarshal(pk.Payload, &payload); err != nil {
+		log.Printf("Confirmação de toma mal-formada de <%s>: %s\n", serial, err.Error())
+		return
+	}
+	takenAt := time.Now().UTC()
+	if payload.TakenAt != nil {
+		takenAt = *payload.TakenAt
+	}
+
+	confirmed, err := models.ConfirmFromDevice(deviceDB(db, serial), serial, payload.Event, takenAt)
+	if err != nil {
+		log.Printf("Falha ao confirmar tomas de <%s>: %s\n", serial, err.Error())
+		return
+	}
+	log.Printf("%d tomas de <%s> confirmadas (%s)\n", len(confirmed), serial, payload.Event)
+}
+
+// handleDeviceAck publica a resposta do dropper a um comando nos eventos em tempo real
+func handleDeviceAck(db *gorm.DB, pk packets.Packet) {
+	serial, err := uuid.Parse(deviceIDFromTopic(pk.TopicName))
+	if err != nil {
+		log.Printf("Resposta a comando com serial inválido <%s>\n", pk.TopicName)
+		return
+	}
+
+	var ack models.DeviceAck
+	if err := json.Unmarshal(pk.Payload, &ack); err != nil {
+		log.Printf("Resposta a comando mal-formada de <%s>: %s\n", serial, err.Error())
+		return
+	}
+
+	if err := models.PublishDeviceEvent(deviceDB(db, serial), serial, models.EventDeviceAck, ack); err != nil {
+		log.Printf("Falha ao publicar a resposta de <%s>: %s\n", serial, err.Error())
+	}
+}
@@ -0,0 +1,52 @@
+package mqtt_api
+
+import (
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"gorm.io/gorm"
+
+	"github.com/TomascpMarques/dropmedical/models"
+)
+
+// presenceHook publica os eventos de ligação e desligação dos droppers. Os dispositivos ligam-se
+// com o seu serial como client id; as restantes ligações são ignoradas.
+type presenceHook struct {
+	mqtt.HookBase
+	db *gorm.DB
+}
+
+func (h *presenceHook) ID() string {
+	return "dropper-presence"
+}
+
+func (h *presenceHook) Provides(b byte) bool {
+	return b == mqtt.OnSessionEstablished || b == mqtt.OnDisconnect
+}
+
+func (h *presenceHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.publish(cl, models.EventDeviceOnline)
+}
+
+func (h *presenceHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	// Numa nova ligação do mesmo dispositivo a sessão anterior é fechada, mas ele continua ligado
+	if errors.Is(err, packets.ErrSessionTakenOver) {
+		return
+	}
+	h.publish(cl, models.EventDeviceOffline)
+}
+
+func (h *presenceHook) publish(cl *mqtt.Client, kind string) {
+	serial, err := uuid.Parse(cl.ID)
+	if err != nil {
+		return
+	}
+
+	err = models.PublishDeviceEvent(deviceDB(h.db, serial), serial, kind, nil)
+	if err != nil && !errors.Is(err, models.ErrDropperNotFound) {
+		log.Printf("Falha ao publicar <%s> de <%s>: %s\n", kind, serial, err.Error())
+	}
+}
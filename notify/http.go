@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPProvider envia as notificações por SMS ou push através da API HTTP de um fornecedor.
+// Cada notificação é um POST JSON com o token no cabeçalho Authorization.
+type HTTPProvider struct {
+	URL    string
+	Token  string
+	Client *http.Client
+
+	payload func(Message) any
+}
+
+// smsPayload é o corpo enviado ao fornecedor de SMS
+type smsPayload struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// pushPayload é o corpo enviado ao fornecedor de push
+type pushPayload struct {
+	Token string            `json:"token"`
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data"`
+}
+
+// NewSMSProvider cria o canal de SMS, envia `{"to": "<telefone>", "text": "<assunto>: <corpo>"}`
+func NewSMSProvider(url string, token string) *HTTPProvider {
+	return &HTTPProvider{URL: url, Token: token, Client: &http.Client{Timeout: Timeout}, payload: func(m Message) any {
+		return smsPayload{To: m.To, Text: m.Subject + ": " + m.Body}
+	}}
+}
+
+// NewPushProvider cria o canal de push, envia `{"token", "title", "body", "data": {"kind"}}`
+func NewPushProvider(url string, token string) *HTTPProvider {
+	return &HTTPProvider{URL: url, Token: token, Client: &http.Client{Timeout: Timeout}, payload: func(m Message) any {
+		return pushPayload{Token: m.To, Title: m.Subject, Body: m.Body, Data: map[string]string{"kind": m.Kind}}
+	}}
+}
+
+func (p *HTTPProvider) Send(ctx context.Context, message Message) error {
+	if message.To == "" {
+		return ErrNoRecipient
+	}
+
+	body, err := json.Marshal(p.payload(message))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("resposta %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
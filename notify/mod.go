@@ -0,0 +1,229 @@
+// Package notify envia as notificações dos alertas aos cuidadores por email (SMTP), SMS e push,
+// estes dois através de fornecedores HTTP genéricos. Os textos vêm de modelos em português e
+// inglês. As preferências de cada utilizador, as horas de silêncio e a deduplicação das
+// notificações estão no pacote models.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Canais de notificação
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// Idiomas dos modelos, o primeiro é o idioma por omissão
+const (
+	LangPT = "pt"
+	LangEN = "en"
+)
+
+// Timeout é o tempo máximo do envio de uma notificação
+const Timeout = 15 * time.Second
+
+var (
+	ErrInvalidClock = errors.New("hora inválida, o formato é HH:MM")
+	ErrNoRecipient  = errors.New("notificação sem destinatário")
+	ErrNoChannel    = errors.New("canal de notificações não configurado")
+)
+
+// Message é uma notificação pronta a enviar. To é o endereço no canal: o email, o número de
+// telefone ou o token do dispositivo.
+type Message struct {
+	Kind    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Channel envia as notificações de um canal
+type Channel interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// Data são os dados usados pelos modelos
+type Data struct {
+	// Mensagem do alerta, em português
+	Message string
+	Dropper string
+	Patient string
+	// Hora do alerta no fuso horário do destinatário
+	Time    string
+	Details map[string]any
+}
+
+// Template é o assunto e o corpo de uma notificação
+type Template struct {
+	Subject string
+	Body    string
+}
+
+// fallbackKind é o modelo usado nos tipos de alerta sem modelo próprio
+const fallbackKind = ""
+
+// templates contêm os modelos de cada tipo de alerta em cada idioma
+var templates = map[string]map[string]Template{
+	"missed_dose": {
+		LangPT: {
+			Subject: "Toma não confirmada{{with .Patient}}: {{.}}{{end}}",
+			Body:    "A toma das {{.Details.due}}{{with .Patient}} de {{.}}{{end}} no dropper {{.Dropper}} não foi confirmada.",
+		},
+		LangEN: {
+			Subject: "Dose not confirmed{{with .Patient}}: {{.}}{{end}}",
+			Body:    "The {{.Details.due}} dose{{with .Patient}} for {{.}}{{end}} on dropper {{.Dropper}} was not confirmed.",
+		},
+	},
+	"low_stock": {
+		LangPT: {
+			Subject: "Poucos comprimidos no dropper {{.Dropper}}",
+			Body:    "Restam {{.Details.remaining}} comprimidos de {{.Details.pill}} no dropper {{.Dropper}}. Recarregue o dropper.",
+		},
+		LangEN: {
+			Subject: "Low stock on dropper {{.Dropper}}",
+			Body:    "Only {{.Details.remaining}} {{.Details.pill}} pills are left on dropper {{.Dropper}}. Please reload the dropper.",
+		},
+	},
+	"device_offline": {
+		LangPT: {
+			Subject: "Dropper {{.Dropper}} desligado",
+			Body:    "O dropper {{.Dropper}} desligou-se às {{.Time}}. As tomas não são dispensadas enquanto estiver desligado.",
+		},
+		LangEN: {
+			Subject: "Dropper {{.Dropper}} offline",
+			Body:    "Dropper {{.Dropper}} went offline at {{.Time}}. Doses are not dispensed while it is offline.",
+		},
+	},
+	"dose_limit": {
+		LangPT: {
+			Subject: "Toma recusada no dropper {{.Dropper}}",
+			Body:    "{{.Message}}",
+		},
+		LangEN: {
+			Subject: "Dose blocked on dropper {{.Dropper}}",
+			Body:    "A dose{{with .Patient}} for {{.}}{{end}} was blocked because it exceeds a dose limit.",
+		},
+	},
+	fallbackKind: {
+		LangPT: {Subject: "Alerta dropmedical", Body: "{{.Message}}"},
+		LangEN: {Subject: "dropmedical alert", Body: "{{.Message}}"},
+	},
+}
+
+// Render gera o assunto e o corpo da notificação do tipo de alerta no idioma indicado. Os
+// idiomas e os tipos desconhecidos usam o português e o modelo genérico.
+func Render(kind string, lang string, data Data) (subject string, body string, err error) {
+	byLang, ok := templates[kind]
+	if !ok {
+		byLang = templates[fallbackKind]
+	}
+	tmpl, ok := byLang[lang]
+	if !ok {
+		tmpl = byLang[LangPT]
+	}
+
+	if subject, err = execute(tmpl.Subject, data); err != nil {
+		return
+	}
+	body, err = execute(tmpl.Body, data)
+	return
+}
+
+func execute(text string, data Data) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// QuietHours são as horas em que as notificações esperam, em minutos desde a meia-noite na hora
+// local do utilizador. Se Start for depois de End o período passa a meia-noite, ex: 22:00 a 07:00.
+type QuietHours struct {
+	Start int
+	End   int
+}
+
+// ParseClock converte uma hora HH:MM em minutos desde a meia-noite
+func ParseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, ErrInvalidClock
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// Until devolve quando uma notificação criada em t pode ser enviada: t fora das horas de
+// silêncio, ou o fim das horas de silêncio. t tem de estar no fuso horário do utilizador.
+func (q QuietHours) Until(t time.Time) time.Time {
+	if q.Start == q.End {
+		return t
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	end := midnight.Add(time.Duration(q.End) * time.Minute)
+
+	if q.Start < q.End {
+		if minute >= q.Start && minute < q.End {
+			return end
+		}
+		return t
+	}
+	switch {
+	case minute >= q.Start:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, q.End, 0, 0, t.Location())
+	case minute < q.End:
+		return end
+	}
+	return t
+}
+
+// LoadFromEnv cria os canais configurados no ambiente. Os canais sem configuração não são
+// criados e as notificações desses canais não são enviadas.
+//   - email: SMTP_ADDR (host:porta), SMTP_FROM, SMTP_USERNAME e SMTP_PASSWORD
+//   - sms: SMS_PROVIDER_URL e SMS_PROVIDER_TOKEN
+//   - push: PUSH_PROVIDER_URL e PUSH_PROVIDER_TOKEN
+func LoadFromEnv() map[string]Channel {
+	channels := make(map[string]Channel)
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		channels[ChannelEmail] = &SMTP{
+			Addr:     addr,
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	}
+	if url := os.Getenv("SMS_PROVIDER_URL"); url != "" {
+		channels[ChannelSMS] = NewSMSProvider(url, os.Getenv("SMS_PROVIDER_TOKEN"))
+	}
+	if url := os.Getenv("PUSH_PROVIDER_URL"); url != "" {
+		channels[ChannelPush] = NewPushProvider(url, os.Getenv("PUSH_PROVIDER_TOKEN"))
+	}
+
+	for _, channel := range []string{ChannelEmail, ChannelSMS, ChannelPush} {
+		if _, ok := channels[channel]; !ok {
+			log.Printf("Canal de notificações <%s> não configurado", channel)
+		}
+	}
+	return channels
+}
+
+// singleLine remove as quebras de linha de um cabeçalho
+func singleLine(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	data := Data{Dropper: "Cozinha", Patient: "João", Details: map[string]any{"due": "08:00"}}
+
+	subject, body, err := Render("missed_dose", LangEN, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Dose not confirmed: João" || body != "The 08:00 dose for João on dropper Cozinha was not confirmed." {
+		t.Fatalf("Unexpected notification %q %q", subject, body)
+	}
+
+	// Idiomas desconhecidos usam o português
+	if subject, _, _ := Render("low_stock", "fr", data); subject != "Poucos comprimidos no dropper Cozinha" {
+		t.Fatalf("Unexpected subject %q", subject)
+	}
+	if subject, body, _ := Render("unknown", LangPT, Data{Message: "Algo aconteceu"}); subject != "Alerta dropmedical" || body != "Algo aconteceu" {
+		t.Fatalf("Unknown kinds should use the generic template, got %q %q", subject, body)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	lisbon, _ := time.LoadLocation("Europe/Lisbon")
+	start, _ := ParseClock("22:00")
+	end, _ := ParseClock("07:30")
+	quiet := QuietHours{Start: start, End: end}
+
+	cases := []struct {
+		at       time.Time
+		expected time.Time
+	}{
+		{time.Date(2024, 5, 1, 12, 0, 0, 0, lisbon), time.Date(2024, 5, 1, 12, 0, 0, 0, lisbon)},
+		{time.Date(2024, 5, 1, 23, 15, 0, 0, lisbon), time.Date(2024, 5, 2, 7, 30, 0, 0, lisbon)},
+		{time.Date(2024, 5, 2, 3, 0, 0, 0, lisbon), time.Date(2024, 5, 2, 7, 30, 0, 0, lisbon)},
+		{time.Date(2024, 5, 2, 7, 30, 0, 0, lisbon), time.Date(2024, 5, 2, 7, 30, 0, 0, lisbon)},
+	}
+	for _, c := range cases {
+		if until := quiet.Until(c.at); !until.Equal(c.expected) {
+			t.Errorf("%s: expected %s, got %s", c.at, c.expected, until)
+		}
+	}
+
+	// Horas de silêncio durante o dia
+	daytime := QuietHours{Start: 13 * 60, End: 15 * 60}
+	if until := daytime.Until(time.Date(2024, 5, 1, 14, 0, 0, 0, lisbon)); until.Hour() != 15 {
+		t.Fatalf("Expected to wait until 15:00, got %s", until)
+	}
+	if _, err := ParseClock("25:00"); err != ErrInvalidClock {
+		t.Fatal("Invalid clocks should be rejected")
+	}
+}
+
+// smtpStandIn é um servidor SMTP local que guarda os emails recebidos
+func smtpStandIn(t *testing.T) (addr string, received chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received = make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reply("354 end with .")
+				var data strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := smtpStandIn(t)
+	channel := &SMTP{Addr: addr, From: "alertas@dropmedical.pt"}
+
+	err := channel.Send(context.Background(), Message{
+		Kind:    "device_offline",
+		To:      "cuidador@example.com",
+		Subject: "Dropper Cozinha desligado",
+		Body:    "O dropper desligou-se.\nVerifique a ligação.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := <-received
+	for _, expected := range []string{
+		"To: cuidador@example.com\r\n",
+		"Subject: Dropper Cozinha desligado\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"O dropper desligou-se.\r\nVerifique a ligação.\r\n",
+	} {
+		if !strings.Contains(email, expected) {
+			t.Errorf("Expected the email to contain %q:\n%s", expected, email)
+		}
+	}
+
+	if err := channel.Send(context.Background(), Message{Subject: "Sem destinatário"}); err != ErrNoRecipient {
+		t.Fatalf("Expected ErrNoRecipient, got %v", err)
+	}
+}
+
+func TestHTTPProviders(t *testing.T) {
+	var body map[string]any
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Missing the provider token")
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	message := Message{Kind: "low_stock", To: "+351910000000", Subject: "Poucos comprimidos", Body: "Restam 2."}
+	if err := NewSMSProvider(server.URL, "secret").Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	if body["to"] != "+351910000000" || body["text"] != "Poucos comprimidos: Restam 2." {
+		t.Fatalf("Unexpected SMS %v", body)
+	}
+
+	message.To = "device-token"
+	if err := NewPushProvider(server.URL, "secret").Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	if body["token"] != "device-token" || body["title"] != "Poucos comprimidos" || body["data"].(map[string]any)["kind"] != "low_stock" {
+		t.Fatalf("Unexpected push %v", body)
+	}
+
+	status = 429
+	if err := NewSMSProvider(server.URL, "secret").Send(context.Background(), message); err == nil {
+		t.Fatal("Provider errors should fail the notification")
+	}
+}
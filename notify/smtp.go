@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP envia as notificações por email. Usa STARTTLS quando o servidor o suporta e só se
+// autentica se Username estiver definido.
+type SMTP struct {
+	// Endereço do servidor, host:porta
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(ctx context.Context, message Message) error {
+	if message.To == "" {
+		return ErrNoRecipient
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(message.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.email(message)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// email gera o email em texto simples UTF-8
+func (s *SMTP) email(message Message) []byte {
+	var out strings.Builder
+	fmt.Fprintf(&out, "From: %s\r\n", singleLine(s.From))
+	fmt.Fprintf(&out, "To: %s\r\n", singleLine(message.To))
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", singleLine(message.Subject)))
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	out.WriteString("MIME-Version: 1.0\r\n")
+	out.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	out.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	out.WriteString("\r\n")
+	out.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+	out.WriteString("\r\n")
+	return []byte(out.String())
+}
@@ -0,0 +1,131 @@
+// Package reports desenha os relatórios de dispensa e adesão em CSV, JSON e PDF. Os dados chegam
+// já preenchidos num Document, o pacote não acede à base de dados.
+package reports
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrUnknownFormat = errors.New("formato de relatório desconhecido")
+
+// Formatos suportados
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+	FormatPDF  = "pdf"
+)
+
+var contentTypes = map[string]string{
+	FormatCSV:  "text/csv; charset=utf-8",
+	FormatJSON: "application/json; charset=utf-8",
+	FormatPDF:  "application/pdf",
+}
+
+// Column é uma coluna da tabela do relatório. Key identifica a coluna no JSON, Label é o
+// cabeçalho no CSV e no PDF.
+type Column struct {
+	Key   string
+	Label string
+}
+
+// Field é uma linha do resumo do relatório, ex: "Tomas dispensadas: 42"
+type Field struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// Document é o conteúdo de um relatório: um cabeçalho, um resumo e uma tabela
+type Document struct {
+	Title       string
+	Subject     string
+	From        time.Time
+	To          time.Time
+	GeneratedAt time.Time
+	Summary     []Field
+	Columns     []Column
+	Rows        [][]string
+}
+
+// ValidFormat indica se o formato é suportado
+func ValidFormat(format string) bool {
+	_, ok := contentTypes[format]
+	return ok
+}
+
+// ContentType devolve o content-type do formato
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Render escreve o documento em w no formato pedido
+func Render(w io.Writer, format string, doc *Document) error {
+	switch format {
+	case FormatCSV:
+		return renderCSV(w, doc)
+	case FormatJSON:
+		return renderJSON(w, doc)
+	case FormatPDF:
+		return renderPDF(w, doc)
+	}
+	return ErrUnknownFormat
+}
+
+// renderCSV escreve apenas a tabela, para ser aberta numa folha de cálculo
+func renderCSV(w io.Writer, doc *Document) error {
+	writer := csv.NewWriter(w)
+
+	header := make([]string, len(doc.Columns))
+	for i, column := range doc.Columns {
+		header[i] = column.Label
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(doc.Rows); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// jsonDocument é a forma do relatório em JSON, cada linha é um objeto com as chaves das colunas
+type jsonDocument struct {
+	Title       string              `json:"title"`
+	Subject     string              `json:"subject"`
+	From        time.Time           `json:"from"`
+	To          time.Time           `json:"to"`
+	GeneratedAt time.Time           `json:"generated_at"`
+	Summary     []Field             `json:"summary"`
+	Rows        []map[string]string `json:"rows"`
+}
+
+func renderJSON(w io.Writer, doc *Document) error {
+	out := jsonDocument{
+		Title:       doc.Title,
+		Subject:     doc.Subject,
+		From:        doc.From,
+		To:          doc.To,
+		GeneratedAt: doc.GeneratedAt,
+		Summary:     doc.Summary,
+		Rows:        make([]map[string]string, len(doc.Rows)),
+	}
+	if out.Summary == nil {
+		out.Summary = []Field{}
+	}
+	for i, row := range doc.Rows {
+		out.Rows[i] = make(map[string]string, len(doc.Columns))
+		for j, column := range doc.Columns {
+			if j < len(row) {
+				out.Rows[i][column.Key] = row[j]
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
@@ -0,0 +1,109 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDocument(rows int) *Document {
+	doc := &Document{
+		Title:       "Relatório de dispensa",
+		Subject:     "Paciente: João",
+		From:        time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		To:          time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		GeneratedAt: time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC),
+		Summary:     []Field{{Label: "Tomas", Value: fmt.Sprint(rows)}},
+		Columns:     []Column{{Key: "due_at", Label: "Prevista"}, {Key: "pills", Label: "Comprimidos"}},
+	}
+	for i := 0; i < rows; i++ {
+		doc.Rows = append(doc.Rows, []string{fmt.Sprintf("2024-05-%02d 08:00", i%30+1), "Aspirina (1), \"Brufen\" (2)"})
+	}
+	return doc
+}
+
+func TestRenderCSV(t *testing.T) {
+	var out bytes.Buffer
+	if err := Render(&out, FormatCSV, testDocument(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "Prevista,Comprimidos" || !strings.HasSuffix(lines[1], `"Aspirina (1), ""Brufen"" (2)"`) {
+		t.Fatalf("Unexpected CSV:\n%s", out.String())
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := Render(&out, FormatJSON, testDocument(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc jsonDocument
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Rows) != 2 || doc.Rows[0]["due_at"] != "2024-05-01 08:00" || doc.Summary[0].Value != "2" {
+		t.Fatalf("Unexpected JSON: %+v", doc)
+	}
+}
+
+func TestRenderPDF(t *testing.T) {
+	var out bytes.Buffer
+	// Linhas suficientes para várias páginas
+	if err := Render(&out, FormatPDF, testDocument(120)); err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := out.String()
+	if !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatal("Expected a complete PDF file")
+	}
+	if !strings.Contains(pdf, "/Count 3") {
+		t.Fatalf("Expected the table to span 3 pages")
+	}
+	// Os acentos são codificados em WinAnsi e os parênteses escapados
+	if !strings.Contains(pdf, "(Relat\xf3rio de dispensa)") || !strings.Contains(pdf, `Aspirina \(1\)`) {
+		t.Fatal("Expected the text to be encoded for the base fonts")
+	}
+
+	// A tabela de referências aponta para o início de cada objeto
+	xref := strings.Index(pdf, "\nxref\n") + 1
+	entries := strings.Split(pdf[xref:], "\n")[3:]
+	for i, entry := range entries[:4] {
+		var offset int
+		fmt.Sscanf(entry, "%d", &offset)
+		if !strings.HasPrefix(pdf[offset:], fmt.Sprintf("%d 0 obj", i+1)) {
+			t.Fatalf("Wrong offset for object %d", i+1)
+		}
+	}
+}
+
+func TestRenderPDFWithoutEmptyPages(t *testing.T) {
+	// Inclui o número de linhas que enche exatamente cada página
+	for rows := 1; rows <= 150; rows++ {
+		var out bytes.Buffer
+		if err := Render(&out, FormatPDF, testDocument(rows)); err != nil {
+			t.Fatal(err)
+		}
+
+		pages := strings.Split(out.String(), "\nstream\n")[1:]
+		for i, page := range pages {
+			page, _, _ = strings.Cut(page, "endstream")
+			if !strings.Contains(page, `Aspirina \(1\)`) {
+				t.Fatalf("Page %d of %d has no table rows with %d rows", i+1, len(pages), rows)
+			}
+		}
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	if err := Render(&bytes.Buffer{}, "docx", testDocument(1)); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("Expected %s, got %v", ErrUnknownFormat, err)
+	}
+}
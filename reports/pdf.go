@@ -0,0 +1,194 @@
+package reports
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Página A4 na horizontal, em pontos
+const (
+	pageWidth  = 842.0
+	pageHeight = 595.0
+	margin     = 36.0
+
+	titleSize  = 14.0
+	textSize   = 8.0
+	lineHeight = 11.0
+	// Largura média de um carácter da Helvetica, em proporção do tamanho da letra
+	charWidth = 0.5
+)
+
+// pdfWriter escreve um PDF mínimo só com texto, nas fontes base Helvetica, que qualquer leitor
+// de PDF suporta sem as incluir no ficheiro
+type pdfWriter struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+	y     float64
+}
+
+// winAnsi converte o texto para a codificação das fontes base, para suportar os acentos
+var winAnsi = encoding.ReplaceUnsupported(charmap.Windows1252.NewEncoder())
+
+// pdfString devolve o texto como string literal PDF
+func pdfString(text string) string {
+	encoded, err := winAnsi.String(text)
+	if err != nil {
+		encoded = text
+	}
+	return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", " ", "\n", " ").Replace(encoded) + ")"
+}
+
+func (p *pdfWriter) newPage() {
+	p.page = new(bytes.Buffer)
+	p.pages = append(p.pages, p.page)
+	p.y = pageHeight - margin
+}
+
+// text escreve uma linha na posição x da linha atual
+func (p *pdfWriter) text(x float64, font string, size float64, text string) {
+	fmt.Fprintf(p.page, "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, p.y, pdfString(text))
+}
+
+// line avança para a linha seguinte, mudando de página se necessário. Devolve true se mudou.
+func (p *pdfWriter) line(height float64) bool {
+	p.y -= height
+	if p.y < margin+lineHeight {
+		p.newPage()
+		return true
+	}
+	return false
+}
+
+// fit corta o texto para caber na largura indicada
+func fit(text string, width float64) string {
+	limit := int(width / (textSize * charWidth))
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	if limit < 2 {
+		return ""
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// columnWidths distribui a largura da página pelas colunas, proporcionalmente ao maior texto de cada
+func columnWidths(doc *Document) []float64 {
+	weights := make([]float64, len(doc.Columns))
+	total := 0.0
+	for i, column := range doc.Columns {
+		longest := len([]rune(column.Label))
+		for _, row := range doc.Rows {
+			if i < len(row) {
+				longest = max(longest, len([]rune(row[i])))
+			}
+		}
+		weights[i] = float64(min(max(longest, 4), 40))
+		total += weights[i]
+	}
+
+	widths := make([]float64, len(weights))
+	for i, weight := range weights {
+		widths[i] = (pageWidth - 2*margin) * weight / total
+	}
+	return widths
+}
+
+func (p *pdfWriter) tableRow(widths []float64, font string, cells []string) {
+	x := margin
+	for i, width := range widths {
+		if i < len(cells) {
+			p.text(x, font, textSize, fit(cells[i], width-4))
+		}
+		x += width
+	}
+}
+
+func renderPDF(w io.Writer, doc *Document) error {
+	p := &pdfWriter{}
+	p.newPage()
+
+	p.text(margin, "F2", titleSize, doc.Title)
+	p.line(titleSize + 4)
+	if doc.Subject != "" {
+		p.text(margin, "F1", textSize+2, doc.Subject)
+		p.line(lineHeight + 2)
+	}
+	p.text(margin, "F1", textSize, fmt.Sprintf("Período: %s a %s", doc.From.Format("2006-01-02 15:04"), doc.To.Format("2006-01-02 15:04")))
+	p.line(lineHeight)
+	p.text(margin, "F1", textSize, "Gerado em "+doc.GeneratedAt.Format("2006-01-02 15:04 MST"))
+	p.line(lineHeight * 1.5)
+
+	for _, field := range doc.Summary {
+		p.text(margin, "F2", textSize, field.Label+":")
+		p.text(margin+160, "F1", textSize, field.Value)
+		p.line(lineHeight)
+	}
+	p.line(lineHeight / 2)
+
+	widths := columnWidths(doc)
+	header := make([]string, len(doc.Columns))
+	for i, column := range doc.Columns {
+		header[i] = column.Label
+	}
+	p.tableRow(widths, "F2", header)
+	for _, row := range doc.Rows {
+		// Só muda de página antes de uma linha, para não acabar numa página só com o cabeçalho
+		if p.line(lineHeight) {
+			// O cabeçalho da tabela repete-se em cada página
+			p.tableRow(widths, "F2", header)
+			p.line(lineHeight)
+		}
+		p.tableRow(widths, "F1", row)
+	}
+
+	for i, page := range p.pages {
+		p.page, p.y = page, margin/2
+		p.text(pageWidth-margin-60, "F1", textSize, fmt.Sprintf("Página %d de %d", i+1, len(p.pages)))
+	}
+	return p.write(w)
+}
+
+// write escreve o documento: catálogo, árvore de páginas, fontes e cada página com o seu conteúdo
+func (p *pdfWriter) write(w io.Writer) error {
+	out := new(bytes.Buffer)
+	offsets := make([]int, 0)
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objetos 1 a 4, as páginas começam no 5 e cada uma ocupa dois objetos
+	kids := make([]string, len(p.pages))
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range p.pages {
+		object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i,
+		))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -2,4 +2,4 @@
 
 source .env/local.env
 export ENVIRONMENT="local"
-go run main.go
\ No newline at end of file
+go run . migrate up && go run .
\ No newline at end of file
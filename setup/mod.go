@@ -3,9 +3,17 @@ package setup
 import (
 	"log"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
+	cors "github.com/gin-contrib/cors"
+
+	auth "github.com/TomascpMarques/dropmedical/auth"
 	http_api "github.com/TomascpMarques/dropmedical/http_api"
+	interactions "github.com/TomascpMarques/dropmedical/interactions"
 	models "github.com/TomascpMarques/dropmedical/models"
+	notify "github.com/TomascpMarques/dropmedical/notify"
 	gin "github.com/gin-gonic/gin"
 	godotenv "github.com/joho/godotenv"
 	"gorm.io/gorm"
@@ -39,10 +47,46 @@ func LoadEnvironment() {
 }
 
 func SetupGinApp(db *gorm.DB, ch *chan models.MqttActionRequest) (engine *gin.Engine, err error) {
-	models.MigrateAll(db)
+	if err = auth.CheckConfig(); err != nil {
+		return
+	}
+
+	checker, err := interactions.LoadFromEnv()
+	if err != nil {
+		return
+	}
+	models.SetInteractionChecker(checker)
+	models.SetNotificationChannels(notify.LoadFromEnv())
 
 	engine = gin.Default()
+	// CORS has to be registered before the routes, gin only applies middlewares to routes added after them
+	engine.Use(cors.New(corsConfig()))
 	http_api.SetupRoutesGroup(engine, db, ch)
 
 	return
 }
+
+// corsConfig only allows the origins listed in CORS_ALLOWED_ORIGINS (comma separated).
+// Auth uses bearer tokens and not cookies, so credentials are never allowed cross-origin.
+func corsConfig() cors.Config {
+	origins := make([]string, 0)
+	if value, ok := os.LookupEnv("CORS_ALLOWED_ORIGINS"); ok {
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+	}
+	if len(origins) == 0 {
+		log.Println("CORS_ALLOWED_ORIGINS vazio, pedidos cross-origin não serão aceites")
+	}
+
+	return cors.Config{
+		AllowOriginFunc:  func(origin string) bool { return slices.Contains(origins, origin) },
+		AllowMethods:     []string{"GET", "POST", "PATCH", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", "Accept-Language"},
+		ExposeHeaders:    []string{"Content-Length"},
+		AllowCredentials: false,
+		MaxAge:           12 * time.Hour,
+	}
+}
@@ -0,0 +1,225 @@
+// Package webhooks assina e envia os eventos da API aos endereços dos parceiros. Cada entrega é
+// um POST JSON assinado com HMAC-SHA256 do segredo do webhook, para que o parceiro confirme que
+// foi enviada por nós. As entregas só são feitas a endereços públicos, para que um webhook não
+// sirva para chegar aos serviços da rede interna. As subscrições, a fila de entregas e o registo
+// das tentativas estão no pacote models.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Cabeçalhos das entregas
+const (
+	// Assinatura no formato `t=<unix>,v1=<hex>`, de `<unix>.<corpo>`
+	SignatureHeader = "X-Dropmedical-Signature"
+	// Tipo do evento, ex: dispense
+	EventHeader = "X-Dropmedical-Event"
+	// Id da entrega, igual em todas as tentativas, para o parceiro ignorar repetições
+	DeliveryHeader = "X-Dropmedical-Delivery"
+)
+
+const (
+	// Timeout é o tempo máximo de cada tentativa de entrega
+	Timeout = 10 * time.Second
+	// BaseBackoff é a espera depois da primeira tentativa falhada, duplicada a cada tentativa
+	BaseBackoff = 30 * time.Second
+	// MaxBackoff é a espera máxima entre tentativas
+	MaxBackoff = 6 * time.Hour
+	// SignatureTolerance é a idade máxima aceite por Verify, contra a repetição de entregas antigas
+	SignatureTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("assinatura inválida")
+	ErrExpiredSignature = errors.New("assinatura expirada")
+	ErrForbiddenAddress = errors.New("o endereço não é público")
+	ErrUnreachable      = errors.New("o parceiro não respondeu")
+	ErrRejected         = errors.New("o parceiro recusou a entrega")
+)
+
+// AllowPrivate deixa entregar a endereços da rede interna, só para os testes com servidores locais
+var AllowPrivate = false
+
+// reserved são os blocos que não são privados para o netip mas também não chegam à internet
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// Public indica se as entregas podem ser feitas ao endereço, que não pode ser de loopback,
+// privado, link-local, ex: 169.254.169.254, multicast nem o endereço não especificado
+func Public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reserved {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost confirma que o host, um nome ou um ip, só resolve para endereços públicos
+func CheckHost(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: %s não resolve", ErrForbiddenAddress, host)
+	}
+	for _, addr := range addrs {
+		if !AllowPrivate && !Public(addr) {
+			return fmt.Errorf("%w: %s resolve para %s", ErrForbiddenAddress, host, addr)
+		}
+	}
+	return nil
+}
+
+// control recusa a ligação a um endereço que não é público. Corre com o endereço já resolvido,
+// para que um nome que mude depois do registo do webhook não leve a entrega à rede interna.
+func control(network string, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	if !AllowPrivate && !Public(addr.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr.Addr())
+	}
+	return nil
+}
+
+// NewClient devolve o cliente HTTP das entregas, que só liga a endereços públicos, incluindo nos
+// redirecionamentos, e não usa o proxy do ambiente
+func NewClient() *http.Client {
+	dialer := &net.Dialer{Timeout: Timeout, Control: control}
+	return &http.Client{
+		Timeout: Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: Timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// Reason devolve o motivo de uma falha de Send que pode ser mostrado ao tenant, sem o corpo da
+// resposta nem os detalhes da ligação, que dariam a ler os serviços a que o servidor chega
+func Reason(err error) string {
+	for _, known := range []error{ErrForbiddenAddress, ErrRejected, ErrUnreachable} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return ErrUnreachable.Error()
+}
+
+// Sign devolve o valor do SignatureHeader do corpo enviado no instante indicado
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + unix + ",v1=" + digest(secret, unix, body)
+}
+
+func digest(secret string, unix string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify confirma a assinatura de uma entrega, como deve ser feito pelo parceiro
+func Verify(secret string, header string, body []byte, now time.Time) error {
+	var unix, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			unix = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || signature == "" {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(digest(secret, unix, body))) {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return ErrExpiredSignature
+	}
+	return nil
+}
+
+// Backoff devolve a espera até à próxima tentativa depois de attempts tentativas falhadas
+func Backoff(attempts int) time.Duration {
+	wait := BaseBackoff
+	for i := 1; i < attempts && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, MaxBackoff)
+}
+
+// Request é uma tentativa de entrega de um evento
+type Request struct {
+	URL      string
+	Secret   string
+	Event    string
+	Delivery string
+	Body     []byte
+}
+
+// Send envia a entrega assinada no momento do envio, para que a assinatura não expire enquanto a
+// entrega espera pelas anteriores. Só as respostas 2xx contam como entregues, nas restantes é
+// devolvido o estado da resposta e um ErrRejected com o início do seu corpo, para o registo do
+// servidor. Os erros da ligação são ErrUnreachable ou ErrForbiddenAddress.
+func Send(ctx context.Context, client *http.Client, r Request) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dropmedical-webhooks")
+	req.Header.Set(SignatureHeader, Sign(r.Secret, time.Now(), r.Body))
+	req.Header.Set(EventHeader, r.Event)
+	req.Header.Set(DeliveryHeader, r.Delivery)
+
+	resp, err := client.Do(req)
+	if errors.Is(err, ErrForbiddenAddress) {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return resp.StatusCode, fmt.Errorf("%w: resposta %d: %s", ErrRejected, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
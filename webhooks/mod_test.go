@@ -0,0 +1,117 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	body := []byte(`{"type":"dispense"}`)
+	header := Sign("whsec_test", now, body)
+
+	if err := Verify("whsec_test", header, body, now.Add(time.Minute)); err != nil {
+		t.Fatalf("Expected a valid signature: %s", err.Error())
+	}
+	if err := Verify("whsec_other", header, body, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Another secret should not verify, got %v", err)
+	}
+	if err := Verify("whsec_test", header, []byte(`{"type":"alert"}`), now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("A changed body should not verify, got %v", err)
+	}
+	if err := Verify("whsec_test", header, body, now.Add(time.Hour)); !errors.Is(err, ErrExpiredSignature) {
+		t.Fatalf("Old deliveries should expire, got %v", err)
+	}
+	if err := Verify("whsec_test", "v1=abc", body, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("A header without timestamp is invalid, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		4:  4 * time.Minute,
+		20: MaxBackoff,
+	}
+	for attempts, expected := range cases {
+		if wait := Backoff(attempts); wait != expected {
+			t.Errorf("%d attempts: expected %s, got %s", attempts, expected, wait)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	status := 200
+	var received error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = Verify("whsec_test", r.Header.Get(SignatureHeader), body, time.Now())
+		if r.Header.Get(EventHeader) != "alert" || r.Header.Get(DeliveryHeader) != "7" {
+			t.Errorf("Unexpected headers %v", r.Header)
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, "down for maintenance")
+	}))
+	defer server.Close()
+
+	request := Request{URL: server.URL, Secret: "whsec_test", Event: "alert", Delivery: "7", Body: []byte(`{}`)}
+	if code, err := Send(context.Background(), server.Client(), request); code != 200 || err != nil {
+		t.Fatalf("Expected the delivery to succeed, got %d %v", code, err)
+	}
+	if received != nil {
+		t.Fatalf("The stand-in should verify the signature: %s", received.Error())
+	}
+
+	status = 503
+	code, err := Send(context.Background(), server.Client(), request)
+	if code != 503 || !errors.Is(err, ErrRejected) || err.Error() != "o parceiro recusou a entrega: resposta 503: down for maintenance" {
+		t.Fatalf("Expected the delivery to fail, got %d %v", code, err)
+	}
+	if reason := Reason(err); reason != ErrRejected.Error() {
+		t.Fatalf("The response body should not be shown to the tenant, got %q", reason)
+	}
+
+	// O cliente das entregas não liga ao servidor local
+	code, err = Send(context.Background(), NewClient(), request)
+	if code != 0 || !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("Expected the local address to be refused, got %d %v", code, err)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	cases := map[string]bool{
+		"203.0.113.10":    true,
+		"2001:db8::1":     true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"::ffff:10.0.0.1": false,
+		"224.0.0.1":       false,
+	}
+	for addr, expected := range cases {
+		if public := Public(netip.MustParseAddr(addr)); public != expected {
+			t.Errorf("%s: expected public %v, got %v", addr, expected, public)
+		}
+	}
+
+	if err := CheckHost(context.Background(), "169.254.169.254"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("Expected the metadata address to be refused, got %v", err)
+	}
+	if err := CheckHost(context.Background(), "203.0.113.10"); err != nil {
+		t.Fatalf("Expected a public address to be accepted, got %v", err)
+	}
+}